@@ -0,0 +1,77 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Car lifecycle events. Their payload is a JSON array of CarEvent, one per car, as a
+// transaction such as initLedger can create several cars but only emit one event.
+const (
+	EventCarCreated     = "CarCreated"
+	EventCarTransferred = "CarTransferred"
+	EventCarScrapped    = "CarScrapped"
+	EventCarDeleted     = "CarDeleted"
+)
+
+// CarEvent describes a change of a car, along with the car once changed
+type CarEvent struct {
+	VIN              string `json:"vin"`
+	Car              Car    `json:"car"`
+	PreviousOwner    string `json:"previousOwner,omitempty"`    // only set in CarTransferred
+	PreviousOwnerMSP string `json:"previousOwnerMSP,omitempty"` // only set in CarTransferred
+	TxID             string `json:"txID"`
+	Timestamp        int64  `json:"timestamp"`
+}
+
+/*
+ * setCarLifecycleEvent emits a car lifecycle event about cars
+ */
+func setCarLifecycleEvent(APIstub shim.ChaincodeStubInterface, name string, cars []Car) error {
+	txTimestamp, err := getTxTimestamp(APIstub)
+	if err != nil {
+		return err
+	}
+	events := make([]CarEvent, len(cars))
+	for i := range cars {
+		events[i] = CarEvent{VIN: cars[i].VIN, Car: cars[i], TxID: APIstub.GetTxID(), Timestamp: txTimestamp.Seconds}
+	}
+	return setCarEvent(APIstub, name, events)
+}
+
+/*
+ * setCarEvent emits an event with a JSON payload. Only one event is delivered per
+ * transaction, so each function sets at most one.
+ */
+func setCarEvent(APIstub shim.ChaincodeStubInterface, name string, payload interface{}) error {
+	payloadAsBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	err = APIstub.SetEvent(name, payloadAsBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to set event %s: %s", name, err.Error())
+	}
+	return nil
+}
@@ -31,8 +31,13 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
@@ -42,19 +47,51 @@ import (
 type SmartContract struct {
 }
 
-// Define the car structure, with 4 properties.  Structure tags are used by encoding/json library
+// Define the car structure.  Structure tags are used by encoding/json library
+// Cars created before version 2 only have make, model, colour and owner, and are stored
+// under arbitrary keys such as CAR0.  Version 2 cars are stored under a composite key
+// in the "car" namespace, made of their VIN.
 type Car struct {
-	Make   string `json:"make"`
-	Model  string `json:"model"`
-	Colour string `json:"colour"`
-	Owner  string `json:"owner"`
+	Version   int    `json:"version,omitempty"`
+	VIN       string `json:"vin,omitempty"`
+	Make      string `json:"make"`
+	Model     string `json:"model"`
+	Colour    string `json:"colour"`
+	Owner     string `json:"owner"`
+	OwnerMSP  string `json:"ownerMSP,omitempty"` // empty for cars registered before owner MSPs were recorded
+	Year      int    `json:"year,omitempty"`
+	Mileage   int    `json:"mileage,omitempty"`
+	Plate     string `json:"plate,omitempty"`
+	Status    string `json:"status,omitempty"`
+	LegacyKey string `json:"legacyKey,omitempty"` // key the car was migrated from, if any
 }
 
+// Current version of the car structure
+const carVersion = 2
+
+// Object type of the composite keys cars are stored under, e.g. car~VIN
+const carObjectType = "car"
+
+// Status values of a car. Cars without a status, created before version 2, are active.
+const (
+	StatusActive   = "active"
+	StatusScrapped = "scrapped"
+	StatusStolen   = "stolen"
+)
+
 /*
  * The Init method is called when the Smart Contract "fabcar" is instantiated by the blockchain network
  * Best practice is to have any Ledger initialization in separate function -- see initLedger()
+ * The optional arguments are the MSP IDs of the organizations allowed to run admin operations.
  */
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
+	_, args := APIstub.GetFunctionAndParameters()
+	if len(args) > 0 {
+		err := setAdminMSPs(APIstub, args)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 	return shim.Success(nil)
 }
 
@@ -70,13 +107,57 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 	if function == "queryCar" {
 		return s.queryCar(APIstub, args)
 	} else if function == "initLedger" {
-		return s.initLedger(APIstub)
+		return s.initLedger(APIstub, args)
 	} else if function == "createCar" {
 		return s.createCar(APIstub, args)
 	} else if function == "queryAllCars" {
-		return s.queryAllCars(APIstub)
-	} else if function == "changeCarOwner" {
-		return s.changeCarOwner(APIstub, args)
+		return s.queryAllCars(APIstub, args)
+	} else if function == "initiateTransfer" {
+		return s.initiateTransfer(APIstub, args)
+	} else if function == "acceptTransfer" {
+		return s.acceptTransfer(APIstub, args)
+	} else if function == "cancelTransfer" {
+		return s.cancelTransfer(APIstub, args)
+	} else if function == "queryTransfer" {
+		return s.queryTransfer(APIstub, args)
+	} else if function == "queryOwnershipHistory" {
+		return s.queryOwnershipHistory(APIstub, args)
+	} else if function == "deleteCar" {
+		return s.deleteCar(APIstub, args)
+	} else if function == "queryCarsByOwner" {
+		return s.queryCarsByOwner(APIstub, args)
+	} else if function == "queryCarsByMake" {
+		return s.queryCarsByMake(APIstub, args)
+	} else if function == "queryCarsByMakeModel" {
+		return s.queryCarsByMakeModel(APIstub, args)
+	} else if function == "authorizeGarage" {
+		return s.authorizeGarage(APIstub, args)
+	} else if function == "revokeGarage" {
+		return s.revokeGarage(APIstub, args)
+	} else if function == "addServiceRecord" {
+		return s.addServiceRecord(APIstub, args)
+	} else if function == "queryServiceHistory" {
+		return s.queryServiceHistory(APIstub, args)
+	} else if function == "authorizeInsurer" {
+		return s.authorizeInsurer(APIstub, args)
+	} else if function == "revokeInsurer" {
+		return s.revokeInsurer(APIstub, args)
+	} else if function == "issuePolicy" {
+		return s.issuePolicy(APIstub, args)
+	} else if function == "queryPolicies" {
+		return s.queryPolicies(APIstub, args)
+	} else if function == "fileClaim" {
+		return s.fileClaim(APIstub, args)
+	} else if function == "updateClaimStatus" {
+		return s.updateClaimStatus(APIstub, args)
+	} else if function == "queryClaims" {
+		return s.queryClaims(APIstub, args)
+	} else if function == "setCarStatus" {
+		return s.setCarStatus(APIstub, args)
+	} else if function == "migrateCar" {
+		return s.migrateCar(APIstub, args)
+	} else if function == "assignOwnerMSP" {
+		return s.assignOwnerMSP(APIstub, args)
 	}
 
 	return shim.Error("Invalid Smart Contract function name.")
@@ -88,68 +169,333 @@ func (s *SmartContract) queryCar(APIstub shim.ChaincodeStubInterface, args []str
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
-	carAsBytes, _ := APIstub.GetState(args[0])
+	key, err := carKey(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	carAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return shim.Error("Failed to get car " + args[0] + ": " + err.Error())
+	} else if carAsBytes == nil {
+		return shim.Error("Car does not exist: " + args[0])
+	}
+
 	return shim.Success(carAsBytes)
 }
 
-func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface) sc.Response {
-	cars := []Car{
-		Car{Make: "Toyota", Model: "Prius", Colour: "blue", Owner: "Tomoko"},
-		Car{Make: "Ford", Model: "Mustang", Colour: "red", Owner: "Brad"},
-		Car{Make: "Hyundai", Model: "Tucson", Colour: "green", Owner: "Jin Soo"},
-		Car{Make: "Volkswagen", Model: "Passat", Colour: "yellow", Owner: "Max"},
-		Car{Make: "Tesla", Model: "S", Colour: "black", Owner: "Adriana"},
-		Car{Make: "Peugeot", Model: "205", Colour: "purple", Owner: "Michel"},
-		Car{Make: "Chery", Model: "S22L", Colour: "white", Owner: "Aarav"},
-		Car{Make: "Fiat", Model: "Punto", Colour: "violet", Owner: "Pari"},
-		Car{Make: "Tata", Model: "Nano", Colour: "indigo", Owner: "Valeria"},
-		Car{Make: "Holden", Model: "Barina", Colour: "brown", Owner: "Shotaro"},
-	}
-
-	i := 0
-	for i < len(cars) {
-		fmt.Println("i is ", i)
-		carAsBytes, _ := json.Marshal(cars[i])
-		APIstub.PutState("CAR"+strconv.Itoa(i), carAsBytes)
+// seedTransientKey is the transient map entry initLedger reads the seed document from
+const seedTransientKey = "seed"
+
+// defaultSeed is the seed document used when initLedger is given none
+var defaultSeed = []Car{
+	Car{VIN: "JTDKB20U493000001", Make: "Toyota", Model: "Prius", Colour: "blue", Owner: "Tomoko", Year: 2009, Mileage: 120500, Plate: "TKY-1001"},
+	Car{VIN: "1FA6P8CF1H5000002", Make: "Ford", Model: "Mustang", Colour: "red", Owner: "Brad", Year: 2017, Mileage: 30200, Plate: "BRD-2002"},
+	Car{VIN: "KM8J33A48GU000003", Make: "Hyundai", Model: "Tucson", Colour: "green", Owner: "Jin Soo", Year: 2016, Mileage: 45800, Plate: "JSO-3003"},
+	Car{VIN: "WVWZZZ3C98E000004", Make: "Volkswagen", Model: "Passat", Colour: "yellow", Owner: "Max", Year: 2008, Mileage: 160000, Plate: "MAX-4004"},
+	Car{VIN: "5YJSA1E24HF000005", Make: "Tesla", Model: "S", Colour: "black", Owner: "Adriana", Year: 2017, Mileage: 22000, Plate: "ADR-5005"},
+	Car{VIN: "VF3CCHMZ7GT000006", Make: "Peugeot", Model: "205", Colour: "purple", Owner: "Michel", Year: 2016, Mileage: 51000, Plate: "MIC-6006"},
+	Car{VIN: "LVVDB11B06D000007", Make: "Chery", Model: "S22L", Colour: "white", Owner: "Aarav", Year: 2006, Mileage: 98000, Plate: "AAR-7007"},
+	Car{VIN: "ZFA18800X00000008", Make: "Fiat", Model: "Punto", Colour: "violet", Owner: "Pari", Year: 2000, Mileage: 187000, Plate: "PAR-8008"},
+	Car{VIN: "MAT60756899000009", Make: "Tata", Model: "Nano", Colour: "indigo", Owner: "Valeria", Year: 2009, Mileage: 64000, Plate: "VAL-9009"},
+	Car{VIN: "6G1TB2ABXCL000010", Make: "Holden", Model: "Barina", Colour: "brown", Owner: "Shotaro", Year: 2012, Mileage: 73000, Plate: "SHO-1010"},
+}
+
+/*
+ * initLedger creates the cars of a seed document, a JSON array of cars. The optional
+ * arguments are
+ *	seed document and force flag
+ * When no seed document is given as argument, it is read from the "seed" transient map
+ * entry, which keeps it out of the ledger, and the default seed is used when there is none.
+ * initLedger refuses to run once the ledger holds cars, unless the force flag is "force"
+ * and the client is an admin. Seed cars then replace the cars with the same VIN, whose
+ * policies lapse.
+ * Seed cars without an owner MSP are owned in the organization of the client.
+ */
+func (s *SmartContract) initLedger(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting at most 2")
+	}
+
+	force := false
+	if len(args) == 2 {
+		if args[1] != "force" && args[1] != "" {
+			return shim.Error("Invalid flag " + args[1] + ", expecting force")
+		}
+		force = args[1] == "force"
+	}
+
+	seed := []byte(nil)
+	if len(args) > 0 && args[0] != "" {
+		seed = []byte(args[0])
+	}
+	transient, err := APIstub.GetTransient()
+	if err != nil {
+		return shim.Error("Failed to get transient map: " + err.Error())
+	}
+	if transientSeed, ok := transient[seedTransientKey]; ok {
+		if seed != nil {
+			return shim.Error("Seed document must be given either as argument or in the transient map")
+		}
+		seed = transientSeed
+	}
+
+	cars := make([]Car, len(defaultSeed))
+	copy(cars, defaultSeed)
+	if seed != nil {
+		cars, err = parseSeed(seed)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	exist, err := carsExist(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if exist {
+		if !force {
+			return shim.Error("Ledger already holds cars, pass the force flag to seed it anyway")
+		}
+		err = checkAdmin(APIstub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	mspID, _, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for i := range cars {
+		cars[i].Version = carVersion
+		cars[i].Status = StatusActive
+		if cars[i].OwnerMSP == "" {
+			cars[i].OwnerMSP = mspID
+		}
+		if exist {
+			err = removeCar(APIstub, cars[i].VIN)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		err = addCar(APIstub, &cars[i])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
 		fmt.Println("Added", cars[i])
-		i = i + 1
+	}
+	err = setCarLifecycleEvent(APIstub, EventCarCreated, cars)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
 	return shim.Success(nil)
 }
 
+/*
+ * parseSeed decodes and validates a seed document
+ */
+func parseSeed(seed []byte) ([]Car, error) {
+	var cars []Car
+	err := json.Unmarshal(seed, &cars)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode seed document: %s", err.Error())
+	} else if len(cars) == 0 {
+		return nil, errors.New("Seed document holds no car")
+	}
+
+	seen := make(map[string]bool)
+	for i := range cars {
+		car := &cars[i]
+		vin, err := normalizeVIN(car.VIN)
+		if err != nil {
+			return nil, fmt.Errorf("Seed car %d: %s", i, err.Error())
+		}
+		if seen[vin] {
+			return nil, fmt.Errorf("Seed car %d: duplicate VIN %s", i, vin)
+		}
+		seen[vin] = true
+		if car.Make == "" || car.Model == "" || car.Colour == "" || car.Owner == "" {
+			return nil, fmt.Errorf("Seed car %d: make, model, colour and owner must be non-empty strings", i)
+		}
+		if car.Year != 0 && car.Year < 1886 {
+			return nil, fmt.Errorf("Seed car %d: invalid year %d", i, car.Year)
+		}
+		if car.Mileage < 0 {
+			return nil, fmt.Errorf("Seed car %d: invalid mileage %d", i, car.Mileage)
+		}
+		// only the car description is seeded, the ledger sets the rest
+		*car = Car{VIN: vin, Make: car.Make, Model: car.Model, Colour: car.Colour, Owner: car.Owner, OwnerMSP: car.OwnerMSP,
+			Year: car.Year, Mileage: car.Mileage, Plate: strings.ToUpper(strings.TrimSpace(car.Plate))}
+	}
+	return cars, nil
+}
+
+/*
+ * carsExist tells whether the ledger holds any car, in the car namespace or under a legacy
+ * simple key. Earlier versions only stored cars under simple keys, so any simple key is
+ * taken for a car not migrated yet.
+ */
+func carsExist(APIstub shim.ChaincodeStubInterface) (bool, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(carObjectType, []string{})
+	if err != nil {
+		return false, err
+	}
+	defer resultsIterator.Close()
+	if resultsIterator.HasNext() {
+		return true, nil
+	}
+
+	// composite keys start with 0x00, every simple key sorts after it
+	legacyIterator, err := APIstub.GetStateByRange("\x01", string(utf8.MaxRune))
+	if err != nil {
+		return false, err
+	}
+	defer legacyIterator.Close()
+	return legacyIterator.HasNext(), nil
+}
+
+/*
+ * createCar registers a new car under its VIN. The arguments are
+ *	VIN, make, model, colour, owner and, optionally, year, mileage and registration plate,
+ *	followed by the owner MSP ID
+ * The owner is identified by the common name and the MSP ID of their client certificate.
+ * When no owner MSP ID is given, the owner is a member of the organization of the client.
+ */
 func (s *SmartContract) createCar(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) != 5 {
-		return shim.Error("Incorrect number of arguments. Expecting 5")
+	if len(args) != 5 && len(args) != 6 && len(args) != 8 && len(args) != 9 {
+		return shim.Error("Incorrect number of arguments. Expecting 5, 6, 8 or 9")
+	}
+	ownerMSP, _, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) == 6 || len(args) == 9 {
+		ownerMSP = args[len(args)-1]
+		if ownerMSP == "" {
+			return shim.Error("Owner MSP ID must be a non-empty string")
+		}
+	}
+
+	vin, err := normalizeVIN(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key, err := carKey(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	existingCarAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return shim.Error("Failed to get car " + vin + ": " + err.Error())
+	} else if existingCarAsBytes != nil {
+		return shim.Error("Car already exists: " + vin)
 	}
 
-	var car = Car{Make: args[1], Model: args[2], Colour: args[3], Owner: args[4]}
+	var car = Car{Version: carVersion, VIN: vin, Make: args[1], Model: args[2], Colour: args[3], Owner: args[4], OwnerMSP: ownerMSP,
+		Status: StatusActive}
+	if len(args) >= 8 {
+		err = setCarDetails(&car, args[5], args[6], args[7])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 
-	carAsBytes, _ := json.Marshal(car)
-	APIstub.PutState(args[0], carAsBytes)
+	err = addCar(APIstub, &car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = setCarLifecycleEvent(APIstub, EventCarCreated, []Car{car})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
-func (s *SmartContract) queryAllCars(APIstub shim.ChaincodeStubInterface) sc.Response {
+/*
+ * queryAllCars lists the cars of the car namespace. The optional arguments are
+ *	page size, bookmark, sort field and sort order
+ * Without a page size every car is returned, sorted by VIN, as a JSON array of Key/Record
+ * pairs. With a page size, the response is an object holding the records of the page and
+ * the bookmark to pass to get the next page, empty on the last page.
+ * Cars can be sorted by vin, make, model, owner, year or mileage, in asc or desc order.
+ * Listing by ascending VIN streams the namespace and stops once the page is full, the
+ * other orders need every car to be read and sorted first.
+ */
+func (s *SmartContract) queryAllCars(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	startKey := "CAR0"
-	endKey := "CAR999"
+	if len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting at most 4")
+	}
 
-	resultsIterator, err := APIstub.GetStateByRange(startKey, endKey)
+	// query.js sends a single empty argument, treat empty arguments as not given
+	pageSize, bookmark, err := parsePageArgs(args)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer resultsIterator.Close()
+	sortBy := "vin"
+	order := "asc"
+	if len(args) > 2 && args[2] != "" {
+		sortBy = strings.ToLower(args[2])
+		if _, ok := carSortFields[sortBy]; !ok {
+			return shim.Error("Invalid sort field " + args[2] + ", expecting one of vin, make, model, owner, year, mileage")
+		}
+	}
+	if len(args) > 3 && args[3] != "" {
+		order = strings.ToLower(args[3])
+		if order != "asc" && order != "desc" {
+			return shim.Error("Invalid sort order " + args[3] + ", expecting asc or desc")
+		}
+	}
+
+	var page []Car
+	if sortBy == "vin" && order == "asc" {
+		page, bookmark, err = streamCars(APIstub, carObjectType, []string{}, pageSize, bookmark)
+	} else {
+		page, bookmark, err = sortedCars(APIstub, pageSize, bookmark, sortBy, order == "desc")
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return carsResponse("queryAllCars", page, pageSize, bookmark)
+}
+
+/*
+ * parsePageArgs reads the optional page size and bookmark arguments, the first two of args
+ */
+func parsePageArgs(args []string) (int, string, error) {
+	pageSize := 0
+	bookmark := ""
+	if len(args) > 0 && args[0] != "" {
+		var err error
+		pageSize, err = strconv.Atoi(args[0])
+		if err != nil || pageSize <= 0 {
+			return 0, "", errors.New("Page size must be a positive number")
+		}
+	}
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	return pageSize, bookmark, nil
+}
 
+/*
+ * carsResponse returns a page of cars as a JSON array of Key/Record pairs or, when a page
+ * size was given, as an object holding the records and the bookmark of the next page
+ */
+func carsResponse(function string, page []Car, pageSize int, bookmark string) sc.Response {
 	// buffer is a JSON array containing QueryResults
 	var buffer bytes.Buffer
 	buffer.WriteString("[")
 
 	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
+	for i := range page {
+		carAsBytes, err := json.Marshal(page[i])
 		if err != nil {
 			return shim.Error(err.Error())
 		}
@@ -159,40 +505,511 @@ func (s *SmartContract) queryAllCars(APIstub shim.ChaincodeStubInterface) sc.Res
 		}
 		buffer.WriteString("{\"Key\":")
 		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
+		buffer.WriteString(page[i].VIN)
 		buffer.WriteString("\"")
 
 		buffer.WriteString(", \"Record\":")
 		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
+		buffer.Write(carAsBytes)
 		buffer.WriteString("}")
 		bArrayMemberAlreadyWritten = true
 	}
 	buffer.WriteString("]")
 
-	fmt.Printf("- queryAllCars:\n%s\n", buffer.String())
+	if pageSize > 0 {
+		records := buffer.String()
+		buffer.Reset()
+		buffer.WriteString("{\"records\":")
+		buffer.WriteString(records)
+		buffer.WriteString(fmt.Sprintf(", \"fetched\":%d, \"bookmark\":\"%s\"}", len(page), bookmark))
+	}
+
+	fmt.Printf("- %s:\n%s\n", function, buffer.String())
 
 	return shim.Success(buffer.Bytes())
 }
 
-func (s *SmartContract) changeCarOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+// carSortFields compares two cars on the field used as key, ties are broken by VIN
+var carSortFields = map[string]func(a, b *Car) bool{
+	"vin":     func(a, b *Car) bool { return a.VIN < b.VIN },
+	"make":    func(a, b *Car) bool { return a.Make < b.Make },
+	"model":   func(a, b *Car) bool { return a.Model < b.Model },
+	"owner":   func(a, b *Car) bool { return a.Owner < b.Owner },
+	"year":    func(a, b *Car) bool { return a.Year < b.Year },
+	"mileage": func(a, b *Car) bool { return a.Mileage < b.Mileage },
+}
+
+// carSorter sorts cars with one of the carSortFields
+type carSorter struct {
+	cars []Car
+	less func(a, b *Car) bool
+	desc bool
+}
+
+func (cs carSorter) Len() int      { return len(cs.cars) }
+func (cs carSorter) Swap(i, j int) { cs.cars[i], cs.cars[j] = cs.cars[j], cs.cars[i] }
+func (cs carSorter) Less(i, j int) bool {
+	a, b := &cs.cars[i], &cs.cars[j]
+	if cs.less(a, b) {
+		return !cs.desc
+	} else if cs.less(b, a) {
+		return cs.desc
+	}
+	return a.VIN < b.VIN
+}
+
+/*
+ * streamCars returns up to pageSize cars, 0 meaning all of them, in key order starting
+ * after the bookmark, and the bookmark of the next page. The cars are listed from the car
+ * namespace or from an index, whose keys end with the VIN, matching attributes.
+ * The bookmark is made of the key attributes following the matched ones, which is the VIN
+ * when listing the namespace.
+ */
+func streamCars(APIstub shim.ChaincodeStubInterface, objectType string, attributes []string, pageSize int, bookmark string) ([]Car, string, error) {
+	after, err := decodeBookmark(bookmark)
+	if err != nil {
+		return nil, "", err
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resultsIterator.Close()
+
+	cars := []Car{}
+	var last []string
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, "", err
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, "", err
+		}
+		vin := keyParts[len(keyParts)-1]
+		position := keyParts[len(attributes):]
+		if !isAfter(position, after) {
+			continue
+		}
+		if pageSize > 0 && len(cars) == pageSize {
+			// there is at least one more car, the page ends with the last car returned
+			return cars, encodeBookmark(last), nil
+		}
+		last = position
+
+		if objectType != carObjectType {
+			// index entries only hold the key, read the car itself
+			car, err := getCar(APIstub, vin)
+			if err != nil {
+				return nil, "", err
+			}
+			cars = append(cars, *car)
+			continue
+		}
+		car := Car{}
+		err = json.Unmarshal(queryResponse.Value, &car)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to decode car %s: %s", vin, err.Error())
+		}
+		cars = append(cars, car)
+	}
+	return cars, "", nil
+}
+
+/*
+ * encodeBookmark joins the key attributes of a bookmark, escaped so that they can hold
+ * any character
+ */
+func encodeBookmark(position []string) string {
+	escaped := make([]string, len(position))
+	for i := range position {
+		escaped[i] = url.QueryEscape(position[i])
+	}
+	return strings.Join(escaped, "/")
+}
+
+/*
+ * decodeBookmark splits a bookmark built by encodeBookmark, an empty bookmark is nil
+ */
+func decodeBookmark(bookmark string) ([]string, error) {
+	if bookmark == "" {
+		return nil, nil
+	}
+	position := strings.Split(bookmark, "/")
+	for i := range position {
+		var err error
+		position[i], err = url.QueryUnescape(position[i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bookmark %s", bookmark)
+		}
+	}
+	return position, nil
+}
+
+/*
+ * isAfter tells whether the key attributes of position sort after those of the bookmark,
+ * as composite keys do
+ */
+func isAfter(position []string, bookmark []string) bool {
+	for i := range position {
+		if i >= len(bookmark) || position[i] > bookmark[i] {
+			return true
+		} else if position[i] < bookmark[i] {
+			return false
+		}
+	}
+	return false
+}
+
+/*
+ * sortedCars reads every car, sorts them and returns the page starting at the bookmark
+ * offset, along with the bookmark of the next page
+ */
+func sortedCars(APIstub shim.ChaincodeStubInterface, pageSize int, bookmark string, sortBy string, desc bool) ([]Car, string, error) {
+	offset := 0
+	if bookmark != "" {
+		var err error
+		offset, err = strconv.Atoi(bookmark)
+		if err != nil || offset < 0 {
+			return nil, "", fmt.Errorf("Invalid bookmark %s", bookmark)
+		}
+	}
+
+	cars, _, err := streamCars(APIstub, carObjectType, []string{}, 0, "")
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Sort(carSorter{cars: cars, less: carSortFields[sortBy], desc: desc})
+
+	if offset >= len(cars) {
+		return []Car{}, "", nil
+	}
+	end := len(cars)
+	if pageSize > 0 && offset+pageSize < end {
+		end = offset + pageSize
+	}
+	next := ""
+	if end < len(cars) {
+		next = strconv.Itoa(end)
+	}
+	return cars[offset:end], next, nil
+}
+
+/*
+ * deleteCar removes a car, its index entries and its pending transfer, the only argument
+ * is the VIN. Only the owner can delete a car, its ownership log is kept and its policies
+ * lapse.
+ */
+func (s *SmartContract) deleteCar(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	vin, err := normalizeVIN(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	car, err := getCar(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspID, name, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !isOwner(car, mspID, name) {
+		return shim.Error("Only the owner of car " + args[0] + " can delete it")
+	}
+
+	err = removeCar(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = setCarLifecycleEvent(APIstub, EventCarDeleted, []Car{*car})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * removeCar deletes a car, if it exists, with its index entries and pending transfer, and
+ * lapses its policies
+ */
+func removeCar(APIstub shim.ChaincodeStubInterface, vin string) error {
+	key, err := carKey(APIstub, vin)
+	if err != nil {
+		return err
+	}
+	carAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to get car %s: %s", vin, err.Error())
+	} else if carAsBytes == nil {
+		return nil
+	}
+	car := Car{}
+	err = json.Unmarshal(carAsBytes, &car)
+	if err != nil {
+		return fmt.Errorf("Failed to decode car %s: %s", vin, err.Error())
+	}
+
+	err = APIstub.DelState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to delete car %s: %s", vin, err.Error())
+	}
+	err = delCarIndexes(APIstub, &car)
+	if err != nil {
+		return err
+	}
+	if car.VIN != "" {
+		err = lapsePolicies(APIstub, car.VIN)
+		if err != nil {
+			return err
+		}
+	}
+	return delTransferOffer(APIstub, vin)
+}
+
+/*
+ * setCarStatus sets the status of a car, active, scrapped or stolen. The arguments are
+ *	VIN or legacy key, and status
+ * Only the owner or an admin can set the status. A stolen car cannot be transferred or
+ * insured until it is active again, and scrapping a car is final: its policies lapse and
+ * its pending transfer is cancelled.
+ */
+func (s *SmartContract) setCarStatus(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
 	if len(args) != 2 {
 		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
-	carAsBytes, _ := APIstub.GetState(args[0])
-	car := Car{}
+	status := strings.ToLower(args[1])
+	if status != StatusActive && status != StatusScrapped && status != StatusStolen {
+		return shim.Error("Invalid status " + args[1] + ", expecting one of active, scrapped, stolen")
+	}
+
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.Status == StatusScrapped {
+		return shim.Error("Car is scrapped: " + args[0])
+	}
+	mspID, name, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !isOwner(car, mspID, name) {
+		err = checkAdmin(APIstub)
+		if err != nil {
+			return shim.Error("Only the owner of car " + args[0] + " or an admin can set its status: " + err.Error())
+		}
+	}
+	car.Status = status
+
+	err = putCar(APIstub, args[0], car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// a scrapped car is neither insured nor sold any more
+	if status == StatusScrapped && car.VIN != "" {
+		err = lapsePolicies(APIstub, car.VIN)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = delTransferOffer(APIstub, car.VIN)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	// cars still under a legacy key are not known to event consumers until migrated
+	if status == StatusScrapped && car.VIN != "" {
+		err = setCarLifecycleEvent(APIstub, EventCarScrapped, []Car{*car})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	return shim.Success(nil)
+}
 
-	json.Unmarshal(carAsBytes, &car)
-	car.Owner = args[1]
+/*
+ * migrateCar moves a car stored under a legacy simple key, such as CAR0 or its bare VIN,
+ * into the car namespace, upgrading it to the current version. The arguments are
+ *	legacy key, VIN and, optionally, year, mileage and registration plate
+ * The legacy key is deleted, and kept in the migrated car for reference.
+ * Cars are only listed and indexed once migrated, which starts their ownership log.
+ * Only the owner or an admin can migrate a car. Cars written before owners had an MSP ID
+ * cannot be told apart from a namesake in another organization, so only an admin can
+ * migrate them.
+ */
+func (s *SmartContract) migrateCar(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	carAsBytes, _ = json.Marshal(car)
-	APIstub.PutState(args[0], carAsBytes)
+	if len(args) != 2 && len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 5")
+	}
+
+	legacyKey := args[0]
+	if strings.HasPrefix(legacyKey, "\x00") {
+		return shim.Error("Legacy key must be a simple key")
+	}
+	vin, err := normalizeVIN(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	key, err := carKey(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	car, err := readCar(APIstub, legacyKey, legacyKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	mspID, name, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !isOwner(car, mspID, name) {
+		err = checkAdmin(APIstub)
+		if err != nil {
+			return shim.Error("Only the owner of car " + legacyKey + " or an admin can migrate it: " + err.Error())
+		}
+	}
+	existingCarAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return shim.Error("Failed to get car " + vin + ": " + err.Error())
+	} else if existingCarAsBytes != nil {
+		return shim.Error("Car already exists: " + vin)
+	}
+
+	car.Version = carVersion
+	car.VIN = vin
+	car.LegacyKey = legacyKey
+	if car.Status == "" {
+		car.Status = StatusActive
+	}
+	if len(args) == 5 {
+		err = setCarDetails(car, args[2], args[3], args[4])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = addCar(APIstub, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = APIstub.DelState(legacyKey)
+	if err != nil {
+		return shim.Error("Failed to delete legacy car " + legacyKey + ": " + err.Error())
+	}
+	err = setCarLifecycleEvent(APIstub, EventCarCreated, []Car{*car})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
 
+/*
+ * carKey returns the state key of the car identified by id: the car namespace composite
+ * key for a VIN, or id itself for a car that still uses a legacy key
+ */
+func carKey(APIstub shim.ChaincodeStubInterface, id string) (string, error) {
+	if vin, err := normalizeVIN(id); err == nil {
+		return APIstub.CreateCompositeKey(carObjectType, []string{vin})
+	}
+	return id, nil
+}
+
+/*
+ * getCar reads and decodes the car identified by id, a VIN or a legacy key
+ */
+func getCar(APIstub shim.ChaincodeStubInterface, id string) (*Car, error) {
+	key, err := carKey(APIstub, id)
+	if err != nil {
+		return nil, err
+	}
+	return readCar(APIstub, key, id)
+}
+
+/*
+ * readCar reads and decodes the car stored under key, id is used in error messages
+ */
+func readCar(APIstub shim.ChaincodeStubInterface, key string, id string) (*Car, error) {
+	carAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get car %s: %s", id, err.Error())
+	} else if carAsBytes == nil {
+		return nil, fmt.Errorf("Car does not exist: %s", id)
+	}
+
+	car := Car{}
+	err = json.Unmarshal(carAsBytes, &car)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode car %s: %s", id, err.Error())
+	}
+	return &car, nil
+}
+
+/*
+ * addCar saves a new car, indexes it and starts its ownership log
+ */
+func addCar(APIstub shim.ChaincodeStubInterface, car *Car) error {
+	err := putCar(APIstub, car.VIN, car)
+	if err != nil {
+		return err
+	}
+	err = putCarIndexes(APIstub, car)
+	if err != nil {
+		return err
+	}
+	return logOwnership(APIstub, car, OwnershipRegistered, "", "")
+}
+
+/*
+ * putCar encodes and saves the car identified by id, a VIN or a legacy key
+ */
+func putCar(APIstub shim.ChaincodeStubInterface, id string, car *Car) error {
+	key, err := carKey(APIstub, id)
+	if err != nil {
+		return err
+	}
+	carAsBytes, err := json.Marshal(car)
+	if err != nil {
+		return err
+	}
+	err = APIstub.PutState(key, carAsBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to save car: %s", err.Error())
+	}
+	return nil
+}
+
+/*
+ * setCarDetails validates and sets the year, mileage and registration plate of a car
+ */
+func setCarDetails(car *Car, year string, mileage string, plate string) error {
+	var err error
+	car.Year, err = strconv.Atoi(year)
+	if err != nil || car.Year < 1886 {
+		return fmt.Errorf("Invalid year %s", year)
+	}
+	car.Mileage, err = strconv.Atoi(mileage)
+	if err != nil || car.Mileage < 0 {
+		return fmt.Errorf("Invalid mileage %s", mileage)
+	}
+	car.Plate = strings.ToUpper(strings.TrimSpace(plate))
+	if car.Plate == "" {
+		return fmt.Errorf("Registration plate must be a non-empty string")
+	}
+	return nil
+}
+
 // The main function is only relevant in unit test mode. Only included here for completeness.
 func main() {
 
@@ -0,0 +1,1030 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// testStub wraps the MockStub so that a test can choose the function arguments, the
+// client identity, the transient map and make ledger calls fail. Each invoke runs in a new transaction,
+// one second after the previous one, and the last event set is recorded.
+type testStub struct {
+	*shim.MockStub
+	args         []string
+	getErr       error
+	putErr       error
+	creator      []byte
+	transient    map[string][]byte
+	txCount      int64
+	eventName    string
+	eventPayload []byte
+}
+
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	return stub.args[0], stub.args[1:]
+}
+
+func (stub *testStub) GetState(key string) ([]byte, error) {
+	if stub.getErr != nil {
+		return nil, stub.getErr
+	}
+	return stub.MockStub.GetState(key)
+}
+
+func (stub *testStub) PutState(key string, value []byte) error {
+	if stub.putErr != nil {
+		return stub.putErr
+	}
+	return stub.MockStub.PutState(key, value)
+}
+
+func (stub *testStub) GetCreator() ([]byte, error) {
+	return stub.creator, nil
+}
+
+func (stub *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: 1500000000 + stub.txCount}, nil
+}
+
+func (stub *testStub) GetTransient() (map[string][]byte, error) {
+	return stub.transient, nil
+}
+
+func (stub *testStub) SetEvent(name string, payload []byte) error {
+	stub.eventName = name
+	stub.eventPayload = payload
+	return nil
+}
+
+// newTestStub returns a stub whose invokes run as a registrar of Org1MSP
+func newTestStub() *testStub {
+	stub := &testStub{MockStub: shim.NewMockStub("fabcar", new(SmartContract))}
+	return stub.as("Org1MSP", "Registrar")
+}
+
+// invoke runs a transaction against the wrapped stub
+func (stub *testStub) invoke(args ...string) sc.Response {
+	stub.args = args
+	stub.txCount++
+	stub.eventName = ""
+	stub.eventPayload = nil
+	txID := strconv.FormatInt(stub.txCount, 10)
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+	return new(SmartContract).Invoke(stub)
+}
+
+// as makes the following invokes run as the client name of the organization mspID,
+// using a self-signed certificate
+func (stub *testStub) as(mspID string, name string) *testStub {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	certAsBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	stub.creator, err = proto.Marshal(&msp.SerializedIdentity{Mspid: mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certAsBytes})})
+	if err != nil {
+		panic(err)
+	}
+	return stub
+}
+
+// countKeys returns the number of keys of an object type
+func countKeys(stub *testStub, objectType string) int {
+	count := 0
+	for key := range stub.State {
+		if gotType, _, err := stub.SplitCompositeKey(key); err == nil && gotType == objectType {
+			count++
+		}
+	}
+	return count
+}
+
+// testVIN is a valid VIN used by the tests creating a car
+const testVIN = "1HGCM82633A004352"
+
+// testCar is the car created by the tests with testVIN, owned by owner
+func testCar(owner string) Car {
+	return Car{Version: carVersion, VIN: testVIN, Make: "Honda", Model: "Accord", Colour: "black", Owner: owner, OwnerMSP: "Org1MSP", Status: StatusActive}
+}
+
+func checkInvoke(t *testing.T, stub *testStub, args ...string) sc.Response {
+	res := stub.invoke(args...)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", res.Message)
+		t.FailNow()
+	}
+	return res
+}
+
+func checkInvokeFailed(t *testing.T, stub *testStub, args ...string) sc.Response {
+	res := stub.invoke(args...)
+	if res.Status == shim.OK {
+		fmt.Println("Invoke", args, "succeeded but failure was expected")
+		t.FailNow()
+	}
+	return res
+}
+
+func checkCar(t *testing.T, stub *testStub, key string, expected Car) {
+	res := checkInvoke(t, stub, "queryCar", key)
+	var car Car
+	err := json.Unmarshal(res.Payload, &car)
+	if err != nil {
+		fmt.Println("Could not decode car", key, err)
+		t.FailNow()
+	}
+	if car != expected {
+		fmt.Println("Car", key, "was", car, "and not", expected, "as expected")
+		t.FailNow()
+	}
+}
+
+// stateKey returns the state key of the car identified by id, a VIN or a legacy key
+func stateKey(stub *testStub, id string) string {
+	key, err := carKey(stub, id)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func checkStateNotExist(t *testing.T, stub *testStub, id string) {
+	if stub.State[stateKey(stub, id)] != nil {
+		fmt.Println("State", id, "exists but was not expected to")
+		t.FailNow()
+	}
+}
+
+func Test_initLedger_creates_ten_cars(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "initLedger")
+
+	if countKeys(stub, carObjectType) != 10 {
+		fmt.Println(countKeys(stub, carObjectType), "cars were created instead of 10")
+		t.FailNow()
+	}
+	checkCar(t, stub, "JTDKB20U493000001", Car{Version: carVersion, VIN: "JTDKB20U493000001", Make: "Toyota", Model: "Prius", Colour: "blue", Owner: "Tomoko", OwnerMSP: "Org1MSP",
+		Year: 2009, Mileage: 120500, Plate: "TKY-1001", Status: StatusActive})
+}
+
+func Test_initLedger_refuses_when_cars_exist(t *testing.T) {
+	stub := newTestStub()
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("Org1MSP")})
+	checkInvoke(t, stub, "initLedger")
+	stub.as("Org1MSP", "Tomoko")
+	checkInvoke(t, stub, "initiateTransfer", "JTDKB20U493000001", "Barry")
+
+	checkInvokeFailed(t, stub, "initLedger")
+	checkInvokeFailed(t, stub, "initLedger", "", "now")
+	stub.as("Org2MSP", "Tomoko")
+	checkInvokeFailed(t, stub, "initLedger", "", "force")
+
+	stub.as("Org1MSP", "Tomoko")
+	checkInvoke(t, stub, "initLedger", `[{"vin":"JTDKB20U493000001","make":"Toyota","model":"Yaris","colour":"red","owner":"Kenji"}]`, "force")
+	checkCar(t, stub, "JTDKB20U493000001", Car{Version: carVersion, VIN: "JTDKB20U493000001", Make: "Toyota", Model: "Yaris", Colour: "red", Owner: "Kenji", OwnerMSP: "Org1MSP",
+		Status: StatusActive})
+	checkInvokeFailed(t, stub, "queryTransfer", "JTDKB20U493000001")
+	if countKeys(stub, carObjectType) != 10 || countKeys(stub, ownerIndex) != 10 {
+		fmt.Println("Forced seed did not replace the car")
+		t.FailNow()
+	}
+}
+
+func Test_initLedger_refuses_when_legacy_cars_exist(t *testing.T) {
+	for _, key := range []string{"CAR0", testVIN} {
+		stub := newTestStub()
+		stub.MockInit("1", [][]byte{[]byte("init"), []byte("Org1MSP")})
+		putRawState(stub, key, `{"make":"Toyota","model":"Prius","colour":"blue","owner":"Tomoko"}`)
+
+		checkInvokeFailed(t, stub, "initLedger")
+		checkInvokeFailed(t, stub, "queryCar", "JTDKB20U493000001")
+		checkInvoke(t, stub, "initLedger", "", "force")
+		checkInvoke(t, stub, "queryCar", "JTDKB20U493000001")
+		if stub.State[key] == nil {
+			fmt.Println("Forced seed removed legacy car", key)
+			t.FailNow()
+		}
+	}
+}
+
+func Test_initLedger_force_requires_admin_configuration(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "initLedger")
+	stub.as("Org1MSP", "Tomoko")
+	checkInvokeFailed(t, stub, "initLedger", "", "force")
+}
+
+func Test_initLedger_with_seed_document(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "initLedger", `[{"vin":"1hgcm82633a004352","make":"Honda","model":"Accord","colour":"black","owner":"Tom","status":"scrapped"},
+		{"vin":"1G1RA6E44BU000011","make":"Chevy","model":"Volt","colour":"red","owner":"Nick","year":2011,"mileage":5000,"plate":"ab-1"}]`)
+
+	checkCar(t, stub, testVIN, testCar("Tom"))
+	checkCar(t, stub, "1G1RA6E44BU000011", Car{Version: carVersion, VIN: "1G1RA6E44BU000011", Make: "Chevy", Model: "Volt", Colour: "red", Owner: "Nick", OwnerMSP: "Org1MSP",
+		Year: 2011, Mileage: 5000, Plate: "AB-1", Status: StatusActive})
+	if countKeys(stub, carObjectType) != 2 {
+		fmt.Println(countKeys(stub, carObjectType), "cars were created instead of 2")
+		t.FailNow()
+	}
+}
+
+func Test_initLedger_with_transient_seed(t *testing.T) {
+	stub := newTestStub()
+	stub.transient = map[string][]byte{seedTransientKey: []byte(`[{"vin":"1HGCM82633A004352","make":"Honda","model":"Accord","colour":"black","owner":"Tom"}]`)}
+	checkInvokeFailed(t, stub, "initLedger", `[{"vin":"1G1RA6E44BU000011","make":"Chevy","model":"Volt","colour":"red","owner":"Nick"}]`)
+
+	checkInvoke(t, stub, "initLedger")
+	checkCar(t, stub, testVIN, testCar("Tom"))
+	checkStateNotExist(t, stub, "1G1RA6E44BU000011")
+}
+
+func Test_initLedger_rejects_invalid_seed(t *testing.T) {
+	stub := newTestStub()
+	for _, seed := range []string{
+		`not json`,
+		`[]`,
+		`{"vin":"1HGCM82633A004352"}`,
+		`[{"vin":"1HGCM82643A004352","make":"Honda","model":"Accord","colour":"black","owner":"Tom"}]`,
+		`[{"vin":"1HGCM82633A004352","make":"Honda","model":"Accord","colour":"black"}]`,
+		`[{"vin":"1HGCM82633A004352","make":"Honda","model":"Accord","colour":"black","owner":"Tom","year":1800}]`,
+		`[{"vin":"1HGCM82633A004352","make":"Honda","model":"Accord","colour":"black","owner":"Tom"},
+		  {"vin":"1hgcm82633a004352","make":"Honda","model":"Civic","colour":"white","owner":"Nick"}]`,
+	} {
+		checkInvokeFailed(t, stub, "initLedger", seed)
+	}
+	if countKeys(stub, carObjectType) != 0 {
+		fmt.Println("Invalid seed created cars")
+		t.FailNow()
+	}
+}
+
+func Test_initLedger_fails_when_PutState_fails(t *testing.T) {
+	stub := newTestStub()
+	stub.putErr = errors.New("put failed")
+	checkInvokeFailed(t, stub, "initLedger")
+}
+
+func Test_queryCar_missing_car_fails(t *testing.T) {
+	stub := newTestStub()
+	res := checkInvokeFailed(t, stub, "queryCar", "CAR42")
+	if res.Payload != nil {
+		fmt.Println("queryCar returned a payload for a missing car")
+		t.FailNow()
+	}
+}
+
+func Test_queryCar_fails_when_GetState_fails(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	stub.getErr = errors.New("get failed")
+	checkInvokeFailed(t, stub, "queryCar", testVIN)
+}
+
+func Test_queryCar_wrong_number_of_arguments(t *testing.T) {
+	stub := newTestStub()
+	checkInvokeFailed(t, stub, "queryCar")
+	checkInvokeFailed(t, stub, "queryCar", "CAR1", "CAR2")
+}
+
+func Test_createCar_then_queryCar(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	checkCar(t, stub, testVIN, testCar("Tom"))
+}
+
+func Test_createCar_does_not_overwrite_existing_car(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	checkInvokeFailed(t, stub, "createCar", testVIN, "Chevy", "Volt", "red", "Nick")
+	checkCar(t, stub, testVIN, testCar("Tom"))
+}
+
+func Test_createCar_fails_when_ledger_fails(t *testing.T) {
+	stub := newTestStub()
+	stub.getErr = errors.New("get failed")
+	checkInvokeFailed(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	checkStateNotExist(t, stub, testVIN)
+
+	stub.getErr = nil
+	stub.putErr = errors.New("put failed")
+	checkInvokeFailed(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	checkStateNotExist(t, stub, testVIN)
+}
+
+func Test_createCar_wrong_number_of_arguments(t *testing.T) {
+	stub := newTestStub()
+	checkInvokeFailed(t, stub, "createCar", "CAR1", "Honda", "Accord", "black")
+	checkStateNotExist(t, stub, testVIN)
+}
+
+// transferCar runs a transfer of the testVIN car from Tom to Barry, both of Org1MSP
+func transferCar(t *testing.T, stub *testStub) {
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "initiateTransfer", testVIN, "Barry", "Org1MSP")
+	stub.as("Org1MSP", "Barry")
+	checkInvoke(t, stub, "acceptTransfer", testVIN)
+}
+
+func Test_transfer(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "initiateTransfer", testVIN, "Barry")
+	if stub.eventName != EventTransferInitiated {
+		fmt.Println("Event was", stub.eventName, "and not", EventTransferInitiated)
+		t.FailNow()
+	}
+	checkCar(t, stub, testVIN, testCar("Tom"))
+
+	res := checkInvoke(t, stub, "queryTransfer", testVIN)
+	var offer TransferOffer
+	err := json.Unmarshal(res.Payload, &offer)
+	if err != nil || offer.Seller != "Tom" || offer.SellerMSP != "Org1MSP" || offer.Buyer != "Barry" {
+		fmt.Println("Pending transfer was", string(res.Payload))
+		t.FailNow()
+	}
+
+	stub.as("Org2MSP", "Barry")
+	checkInvoke(t, stub, "acceptTransfer", testVIN)
+	if stub.eventName != EventCarTransferred {
+		fmt.Println("Event was", stub.eventName, "and not", EventCarTransferred)
+		t.FailNow()
+	}
+	expected := testCar("Barry")
+	expected.OwnerMSP = "Org2MSP"
+	checkCar(t, stub, testVIN, expected)
+	checkInvokeFailed(t, stub, "queryTransfer", testVIN)
+
+	// the new owner is identified by name and MSP
+	stub.as("Org1MSP", "Barry")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Tom")
+	stub.as("Org2MSP", "Barry")
+	checkInvoke(t, stub, "initiateTransfer", testVIN, "Tom")
+}
+
+func Test_transfer_requires_owner_and_buyer(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+
+	stub.as("Org1MSP", "Barry")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Barry")
+	stub.as("Org1MSP", "Tom")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Tom")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "")
+	checkInvokeFailed(t, stub, "acceptTransfer", testVIN)
+
+	checkInvoke(t, stub, "initiateTransfer", testVIN, "Barry", "Org2MSP")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Nick")
+	checkInvokeFailed(t, stub, "acceptTransfer", testVIN)
+	stub.as("Org1MSP", "Barry")
+	checkInvokeFailed(t, stub, "acceptTransfer", testVIN)
+	stub.as("Org2MSP", "Nick")
+	checkInvokeFailed(t, stub, "acceptTransfer", testVIN)
+	checkCar(t, stub, testVIN, testCar("Tom"))
+}
+
+func Test_transfer_requires_owner_MSP(t *testing.T) {
+	stub := newTestStub()
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("AdminMSP")})
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	checkInvokeFailed(t, stub, "createCar", "1G1RA6E44BU000011", "Chevy", "Volt", "red", "Nick", "")
+	checkInvoke(t, stub, "createCar", "1G1RA6E44BU000011", "Chevy", "Volt", "red", "Nick", "Org2MSP")
+	checkInvoke(t, stub, "createCar", "JTDKB20U493000001", "Toyota", "Prius", "blue", "Nick", "2009", "120500", "TKY-1001", "Org2MSP")
+
+	// the same common name in another organization is another client
+	stub.as("Org2MSP", "Tom")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Barry")
+	checkInvokeFailed(t, stub, "deleteCar", testVIN)
+	stub.as("Org1MSP", "Nick")
+	checkInvokeFailed(t, stub, "initiateTransfer", "1G1RA6E44BU000011", "Barry")
+	stub.as("Org2MSP", "Nick")
+	checkInvoke(t, stub, "initiateTransfer", "1G1RA6E44BU000011", "Barry")
+	checkInvoke(t, stub, "deleteCar", "JTDKB20U493000001")
+
+	// a car registered without owner MSP is owned by nobody until an admin assigns one
+	putRawState(stub, stateKey(stub, testVIN), `{"version":2,"vin":"`+testVIN+`","make":"Honda","model":"Accord","colour":"black","owner":"Tom","status":"active"}`)
+	stub.as("Org1MSP", "Tom")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Barry")
+	checkInvokeFailed(t, stub, "assignOwnerMSP", testVIN, "Org1MSP")
+	stub.as("AdminMSP", "Admin")
+	checkInvokeFailed(t, stub, "assignOwnerMSP", testVIN, "")
+	checkInvoke(t, stub, "assignOwnerMSP", testVIN, "Org1MSP")
+	checkInvokeFailed(t, stub, "assignOwnerMSP", testVIN, "Org2MSP")
+	checkCar(t, stub, testVIN, testCar("Tom"))
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "initiateTransfer", testVIN, "Barry")
+}
+
+func Test_transfer_refuses_legacy_car(t *testing.T) {
+	stub := newTestStub()
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("AdminMSP")})
+	putRawState(stub, "CAR0", `{"make":"Toyota","model":"Prius","colour":"blue","owner":"Tomoko","ownerMSP":"Org1MSP"}`)
+
+	stub.as("Org1MSP", "Tomoko")
+	checkInvokeFailed(t, stub, "initiateTransfer", "CAR0", "Barry")
+	stub.as("AdminMSP", "Admin")
+	checkInvokeFailed(t, stub, "assignOwnerMSP", "CAR0", "Org1MSP")
+	if offerKey, _ := stub.CreateCompositeKey(transferObjectType, []string{""}); stub.State[offerKey] != nil {
+		fmt.Println("A transfer was initiated for a legacy car")
+		t.FailNow()
+	}
+}
+
+func Test_transfer_cancel(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+
+	// the seller withdraws
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "initiateTransfer", testVIN, "Barry")
+	stub.as("Org1MSP", "Nick")
+	checkInvokeFailed(t, stub, "cancelTransfer", testVIN)
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "cancelTransfer", testVIN)
+	if stub.eventName != EventTransferCancelled {
+		fmt.Println("Event was", stub.eventName, "and not", EventTransferCancelled)
+		t.FailNow()
+	}
+	stub.as("Org1MSP", "Barry")
+	checkInvokeFailed(t, stub, "acceptTransfer", testVIN)
+
+	// the buyer declines
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "initiateTransfer", testVIN, "Barry")
+	stub.as("Org1MSP", "Barry")
+	checkInvoke(t, stub, "cancelTransfer", testVIN)
+	checkInvokeFailed(t, stub, "cancelTransfer", testVIN)
+	checkInvokeFailed(t, stub, "acceptTransfer", testVIN)
+	checkCar(t, stub, testVIN, testCar("Tom"))
+}
+
+func Test_transfer_refuses_stolen_car(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "initiateTransfer", testVIN, "Barry")
+	checkInvoke(t, stub, "setCarStatus", testVIN, "stolen")
+
+	stub.as("Org1MSP", "Barry")
+	checkInvokeFailed(t, stub, "acceptTransfer", testVIN)
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "cancelTransfer", testVIN)
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Barry")
+}
+
+func Test_transfer_missing_car_fails(t *testing.T) {
+	stub := newTestStub()
+	stub.as("Org1MSP", "Tom")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Barry")
+	checkInvokeFailed(t, stub, "acceptTransfer", testVIN)
+	checkInvokeFailed(t, stub, "cancelTransfer", testVIN)
+	checkStateNotExist(t, stub, testVIN)
+}
+
+// putRawState writes a value directly, e.g. a car created by an older version of the chaincode
+func putRawState(stub *testStub, key string, value string) {
+	stub.MockTransactionStart("0")
+	stub.MockStub.PutState(key, []byte(value))
+	stub.MockTransactionEnd("0")
+}
+
+func Test_transfer_fails_on_corrupted_car(t *testing.T) {
+	stub := newTestStub()
+	putRawState(stub, stateKey(stub, testVIN), "not a car")
+
+	stub.as("Org1MSP", "Tom")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Barry")
+	if string(stub.State[stateKey(stub, testVIN)]) != "not a car" {
+		fmt.Println("Corrupted car was overwritten")
+		t.FailNow()
+	}
+}
+
+func Test_transfer_fails_when_ledger_fails(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+
+	stub.as("Org1MSP", "Tom")
+	stub.getErr = errors.New("get failed")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Barry")
+
+	stub.getErr = nil
+	stub.putErr = errors.New("put failed")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Barry")
+	stub.putErr = nil
+
+	checkInvoke(t, stub, "initiateTransfer", testVIN, "Barry")
+	stub.as("Org1MSP", "Barry")
+	stub.putErr = errors.New("put failed")
+	checkInvokeFailed(t, stub, "acceptTransfer", testVIN)
+	stub.putErr = nil
+
+	checkCar(t, stub, testVIN, testCar("Tom"))
+}
+
+func Test_queryOwnershipHistory(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	transferCar(t, stub)
+	stub.as("Org1MSP", "Barry")
+	checkInvoke(t, stub, "initiateTransfer", testVIN, "Nick", "Org2MSP")
+	stub.as("Org2MSP", "Nick")
+	checkInvoke(t, stub, "acceptTransfer", testVIN)
+
+	res := checkInvoke(t, stub, "queryOwnershipHistory", testVIN)
+	var records []OwnershipRecord
+	err := json.Unmarshal(res.Payload, &records)
+	if err != nil {
+		fmt.Println("Could not decode ownership history", err)
+		t.FailNow()
+	}
+	expected := []OwnershipRecord{
+		{VIN: testVIN, Event: OwnershipRegistered, Owner: "Tom", OwnerMSP: "Org1MSP", Timestamp: 1500000001, TxID: "1"},
+		{VIN: testVIN, Event: OwnershipTransferred, PreviousOwner: "Tom", PreviousOwnerMSP: "Org1MSP", Owner: "Barry", OwnerMSP: "Org1MSP", Timestamp: 1500000003, TxID: "3"},
+		{VIN: testVIN, Event: OwnershipTransferred, PreviousOwner: "Barry", PreviousOwnerMSP: "Org1MSP", Owner: "Nick", OwnerMSP: "Org2MSP",
+			Timestamp: 1500000005, TxID: "5"},
+	}
+	if fmt.Sprint(records) != fmt.Sprint(expected) {
+		fmt.Println("Ownership history was", records, "and not", expected, "as expected")
+		t.FailNow()
+	}
+
+	res = checkInvoke(t, stub, "queryOwnershipHistory", "1FA6P8CF1H5000002")
+	if string(res.Payload) != "[]" {
+		fmt.Println("Ownership history of a missing car was", string(res.Payload))
+		t.FailNow()
+	}
+}
+
+// carRecord is an entry of the queryAllCars response
+type carRecord struct {
+	Key    string
+	Record Car
+}
+
+// carPage is the queryAllCars response when a page size is given
+type carPage struct {
+	Records  []carRecord `json:"records"`
+	Fetched  int         `json:"fetched"`
+	Bookmark string      `json:"bookmark"`
+}
+
+func checkQueryAllCarsPage(t *testing.T, stub *testStub, args ...string) carPage {
+	return checkQueryPage(t, stub, append([]string{"queryAllCars"}, args...)...)
+}
+
+// checkQueryPage runs a query with a page size and decodes the page it returns
+func checkQueryPage(t *testing.T, stub *testStub, args ...string) carPage {
+	res := checkInvoke(t, stub, args...)
+	var page carPage
+	err := json.Unmarshal(res.Payload, &page)
+	if err != nil {
+		fmt.Println("Could not decode page", err)
+		t.FailNow()
+	}
+	if page.Fetched != len(page.Records) {
+		fmt.Println("Page fetched", page.Fetched, "but holds", len(page.Records), "records")
+		t.FailNow()
+	}
+	return page
+}
+
+func checkKeys(t *testing.T, records []carRecord, expected ...string) {
+	keys := []string{}
+	for _, record := range records {
+		keys = append(keys, record.Key)
+	}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		fmt.Println("Keys were", keys, "and not", expected, "as expected")
+		t.FailNow()
+	}
+}
+
+func Test_queryAllCars(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "initLedger")
+	res := checkInvoke(t, stub, "queryAllCars")
+
+	var cars []carRecord
+	err := json.Unmarshal(res.Payload, &cars)
+	if err != nil {
+		fmt.Println("Could not decode cars", err)
+		t.FailNow()
+	}
+	if len(cars) != 10 {
+		fmt.Println("queryAllCars returned", len(cars), "cars instead of 10")
+		t.FailNow()
+	}
+	checkKeys(t, cars[:3], "1FA6P8CF1H5000002", "5YJSA1E24HF000005", "6G1TB2ABXCL000010")
+
+	// query.js sends a single empty argument
+	res = checkInvoke(t, stub, "queryAllCars", "")
+	if string(res.Payload[:1]) != "[" {
+		fmt.Println("queryAllCars with an empty argument did not return an array")
+		t.FailNow()
+	}
+}
+
+func Test_queryAllCars_is_not_limited_to_CAR_keys(t *testing.T) {
+	stub := newTestStub()
+	for i := 0; i < 1100; i++ {
+		vin := fmt.Sprintf("1HGCM826X3A%06d", i)
+		vin = vin[:8] + string(vinCheckDigit(vin)) + vin[9:]
+		checkInvoke(t, stub, "createCar", vin, "Honda", "Accord", "black", "Tom")
+	}
+	putRawState(stub, "CAR0", `{"make":"Toyota","model":"Prius","colour":"blue","owner":"Tomoko"}`)
+
+	res := checkInvoke(t, stub, "queryAllCars")
+	var cars []carRecord
+	err := json.Unmarshal(res.Payload, &cars)
+	if err != nil {
+		fmt.Println("Could not decode cars", err)
+		t.FailNow()
+	}
+	if len(cars) != 1100 {
+		fmt.Println("queryAllCars returned", len(cars), "cars instead of 1100")
+		t.FailNow()
+	}
+}
+
+func Test_queryAllCars_pages_by_VIN(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "initLedger")
+
+	page := checkQueryAllCarsPage(t, stub, "4")
+	checkKeys(t, page.Records, "1FA6P8CF1H5000002", "5YJSA1E24HF000005", "6G1TB2ABXCL000010", "JTDKB20U493000001")
+	page = checkQueryAllCarsPage(t, stub, "4", page.Bookmark)
+	checkKeys(t, page.Records, "KM8J33A48GU000003", "LVVDB11B06D000007", "MAT60756899000009", "VF3CCHMZ7GT000006")
+	page = checkQueryAllCarsPage(t, stub, "4", page.Bookmark)
+	checkKeys(t, page.Records, "WVWZZZ3C98E000004", "ZFA18800X00000008")
+	if page.Bookmark != "" {
+		fmt.Println("Last page has bookmark", page.Bookmark)
+		t.FailNow()
+	}
+
+	page = checkQueryAllCarsPage(t, stub, "5", "MAT60756899000009")
+	if page.Fetched != 3 || page.Bookmark != "" {
+		fmt.Println("Page after the last bookmark was", page)
+		t.FailNow()
+	}
+}
+
+func Test_queryAllCars_sorts(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "initLedger")
+
+	page := checkQueryAllCarsPage(t, stub, "3", "", "year", "desc")
+	checkKeys(t, page.Records, "1FA6P8CF1H5000002", "5YJSA1E24HF000005", "KM8J33A48GU000003")
+	if page.Bookmark != "3" {
+		fmt.Println("Bookmark was", page.Bookmark, "and not 3")
+		t.FailNow()
+	}
+	page = checkQueryAllCarsPage(t, stub, "3", page.Bookmark, "year", "desc")
+	if page.Fetched != 3 {
+		fmt.Println("Second page fetched", page.Fetched, "cars instead of 3")
+		t.FailNow()
+	}
+	for i := 1; i < len(page.Records); i++ {
+		if page.Records[i-1].Record.Year < page.Records[i].Record.Year {
+			fmt.Println("Cars are not sorted by descending year", page.Records)
+			t.FailNow()
+		}
+	}
+
+	page = checkQueryAllCarsPage(t, stub, "10", "", "make")
+	for i := 1; i < len(page.Records); i++ {
+		if page.Records[i-1].Record.Make > page.Records[i].Record.Make {
+			fmt.Println("Cars are not sorted by make", page.Records)
+			t.FailNow()
+		}
+	}
+
+	checkInvokeFailed(t, stub, "queryAllCars", "0")
+	checkInvokeFailed(t, stub, "queryAllCars", "3", "", "colour")
+	checkInvokeFailed(t, stub, "queryAllCars", "3", "", "year", "up")
+	checkInvokeFailed(t, stub, "queryAllCars", "3", "x", "year")
+}
+
+func Test_unknown_function_fails(t *testing.T) {
+	stub := newTestStub()
+	checkInvokeFailed(t, stub, "removeCar", "CAR1")
+}
+
+func Test_createCar_rejects_invalid_VIN(t *testing.T) {
+	stub := newTestStub()
+	checkInvokeFailed(t, stub, "createCar", "CAR1", "Honda", "Accord", "black", "Tom")
+	checkInvokeFailed(t, stub, "createCar", "1HGCM82643A004352", "Honda", "Accord", "black", "Tom")
+	checkStateNotExist(t, stub, "CAR1")
+	checkStateNotExist(t, stub, "1HGCM82643A004352")
+}
+
+func Test_createCar_with_details_and_lower_case_VIN(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createCar", "1hgcm82633a004352", "Honda", "Accord", "black", "Tom", "2003", "154000", "ab-123-cd")
+
+	expected := testCar("Tom")
+	expected.Year = 2003
+	expected.Mileage = 154000
+	expected.Plate = "AB-123-CD"
+	checkCar(t, stub, testVIN, expected)
+}
+
+func Test_createCar_rejects_invalid_details(t *testing.T) {
+	stub := newTestStub()
+	checkInvokeFailed(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom", "year", "154000", "AB-123-CD")
+	checkInvokeFailed(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom", "2003", "-1", "AB-123-CD")
+	checkInvokeFailed(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom", "2003", "154000", " ")
+	checkStateNotExist(t, stub, testVIN)
+}
+
+func Test_setCarStatus(t *testing.T) {
+	stub := newTestStub()
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("AdminMSP")})
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	checkInvokeFailed(t, stub, "setCarStatus", testVIN, "borrowed")
+
+	// only the owner or an admin can set the status
+	stub.as("Org1MSP", "Barry")
+	checkInvokeFailed(t, stub, "setCarStatus", testVIN, "stolen")
+	checkInvokeFailed(t, stub, "setCarStatus", testVIN, "scrapped")
+	stub.as("AdminMSP", "Admin")
+	checkInvoke(t, stub, "setCarStatus", testVIN, "stolen")
+	checkInvoke(t, stub, "setCarStatus", testVIN, "active")
+
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "setCarStatus", testVIN, "stolen")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Barry")
+	checkInvoke(t, stub, "setCarStatus", testVIN, "active")
+	checkInvoke(t, stub, "initiateTransfer", testVIN, "Barry")
+	checkInvoke(t, stub, "setCarStatus", testVIN, "scrapped")
+	checkInvokeFailed(t, stub, "queryTransfer", testVIN)
+	checkInvokeFailed(t, stub, "setCarStatus", testVIN, "active")
+	checkInvokeFailed(t, stub, "initiateTransfer", testVIN, "Barry")
+
+	expected := testCar("Tom")
+	expected.Status = StatusScrapped
+	checkCar(t, stub, testVIN, expected)
+}
+
+func Test_migrateCar_moves_legacy_car_to_its_VIN(t *testing.T) {
+	stub := newTestStub()
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("Org1MSP")})
+	putRawState(stub, "CAR0", `{"make":"Toyota","model":"Prius","colour":"blue","owner":"Tomoko"}`)
+
+	checkInvoke(t, stub, "migrateCar", "CAR0", "JTDKB20U493000001", "2009", "120500", "TKY-1001")
+	checkStateNotExist(t, stub, "CAR0")
+	checkCar(t, stub, "JTDKB20U493000001", Car{Version: carVersion, VIN: "JTDKB20U493000001", Make: "Toyota", Model: "Prius", Colour: "blue", Owner: "Tomoko",
+		Year: 2009, Mileage: 120500, Plate: "TKY-1001", Status: StatusActive, LegacyKey: "CAR0"})
+}
+
+func Test_migrateCar_refuses_to_overwrite_or_use_invalid_VIN(t *testing.T) {
+	stub := newTestStub()
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("Org1MSP")})
+	putRawState(stub, "CAR0", `{"make":"Toyota","model":"Prius","colour":"blue","owner":"Tomoko"}`)
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+
+	checkInvokeFailed(t, stub, "migrateCar", "CAR0", testVIN)
+	checkInvokeFailed(t, stub, "migrateCar", "CAR0", "JTDKB20U493000002")
+	checkInvokeFailed(t, stub, "migrateCar", "CAR9", "JTDKB20U493000001")
+	checkInvokeFailed(t, stub, "migrateCar", testVIN, "JTDKB20U493000001")
+	checkCar(t, stub, "CAR0", Car{Make: "Toyota", Model: "Prius", Colour: "blue", Owner: "Tomoko"})
+	checkCar(t, stub, testVIN, testCar("Tom"))
+}
+
+func Test_migrateCar_is_refused_to_other_clients(t *testing.T) {
+	stub := newTestStub()
+	putRawState(stub, "CAR0", `{"make":"Toyota","model":"Prius","colour":"blue","owner":"Tomoko"}`)
+	carAsBytes, _ := json.Marshal(testCar("Tom"))
+	putRawState(stub, testVIN, string(carAsBytes))
+
+	// without admins, a car without owner MSP cannot be migrated, even by a namesake of its owner
+	stub.as("Org1MSP", "Tomoko")
+	checkInvokeFailed(t, stub, "migrateCar", "CAR0", "JTDKB20U493000001")
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("AdminMSP")})
+	checkInvokeFailed(t, stub, "migrateCar", "CAR0", "JTDKB20U493000001")
+	stub.as("Org2MSP", "Tom")
+	checkInvokeFailed(t, stub, "migrateCar", testVIN, testVIN)
+	checkCar(t, stub, "CAR0", Car{Make: "Toyota", Model: "Prius", Colour: "blue", Owner: "Tomoko"})
+	if string(stub.State[testVIN]) != string(carAsBytes) {
+		fmt.Println("Car under bare VIN was changed to", string(stub.State[testVIN]))
+		t.FailNow()
+	}
+
+	stub.as("AdminMSP", "Admin")
+	checkInvoke(t, stub, "migrateCar", "CAR0", "JTDKB20U493000001")
+	checkStateNotExist(t, stub, "CAR0")
+}
+
+func Test_migrateCar_moves_car_stored_under_bare_VIN(t *testing.T) {
+	stub := newTestStub()
+	carAsBytes, _ := json.Marshal(testCar("Tom"))
+	putRawState(stub, testVIN, string(carAsBytes))
+
+	// the owner needs no admin
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "migrateCar", testVIN, testVIN)
+	if stub.State[testVIN] != nil {
+		fmt.Println("Bare VIN key was not deleted")
+		t.FailNow()
+	}
+	expected := testCar("Tom")
+	expected.LegacyKey = testVIN
+	checkCar(t, stub, testVIN, expected)
+}
+
+func Test_queryCarsByOwner_follows_transfers(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "initLedger")
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	checkInvoke(t, stub, "createCar", "1G1RA6E44BU000011", "Chevy", "Volt", "red", "Tom")
+
+	res := checkInvoke(t, stub, "queryCarsByOwner", "Tom")
+	var cars []carRecord
+	err := json.Unmarshal(res.Payload, &cars)
+	if err != nil {
+		fmt.Println("Could not decode cars", err)
+		t.FailNow()
+	}
+	checkKeys(t, cars, "1G1RA6E44BU000011", testVIN)
+
+	transferCar(t, stub)
+	page := checkQueryPage(t, stub, "queryCarsByOwner", "Tom", "5")
+	checkKeys(t, page.Records, "1G1RA6E44BU000011")
+	page = checkQueryPage(t, stub, "queryCarsByOwner", "Barry", "5")
+	checkKeys(t, page.Records, testVIN)
+	if page.Records[0].Record.Owner != "Barry" {
+		fmt.Println("Car owner was", page.Records[0].Record.Owner, "and not Barry")
+		t.FailNow()
+	}
+}
+
+func Test_queryCarsByMake_pages(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "initLedger")
+	checkInvoke(t, stub, "createCar", "JTDKB20U993000012", "Toyota", "Corolla", "white", "Tom")
+	checkInvoke(t, stub, "createCar", "JTDKB20U093000013", "Toyota", "Prius", "grey", "Nick")
+
+	page := checkQueryPage(t, stub, "queryCarsByMake", "Toyota", "2")
+	checkKeys(t, page.Records, "JTDKB20U993000012", "JTDKB20U093000013")
+	page = checkQueryPage(t, stub, "queryCarsByMake", "Toyota", "2", page.Bookmark)
+	checkKeys(t, page.Records, "JTDKB20U493000001")
+	if page.Bookmark != "" {
+		fmt.Println("Last page has bookmark", page.Bookmark)
+		t.FailNow()
+	}
+
+	page = checkQueryPage(t, stub, "queryCarsByMakeModel", "Toyota", "Prius", "1")
+	checkKeys(t, page.Records, "JTDKB20U093000013")
+	page = checkQueryPage(t, stub, "queryCarsByMakeModel", "Toyota", "Prius", "1", page.Bookmark)
+	checkKeys(t, page.Records, "JTDKB20U493000001")
+
+	page = checkQueryPage(t, stub, "queryCarsByMake", "Trabant", "2")
+	checkKeys(t, page.Records)
+	checkInvokeFailed(t, stub, "queryCarsByMake")
+	checkInvokeFailed(t, stub, "queryCarsByMakeModel", "Toyota", "Prius", "0")
+	checkInvokeFailed(t, stub, "queryCarsByMake", "Toyota", "2", "%zz")
+}
+
+func Test_deleteCar_removes_index_entries(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "initiateTransfer", testVIN, "Barry")
+
+	stub.as("Org1MSP", "Barry")
+	checkInvokeFailed(t, stub, "deleteCar", testVIN)
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "deleteCar", testVIN)
+	checkStateNotExist(t, stub, testVIN)
+	checkInvokeFailed(t, stub, "queryTransfer", testVIN)
+	for _, index := range []string{ownerIndex, makeModelIndex} {
+		if countKeys(stub, index) != 0 {
+			fmt.Println("Index", index, "still has entries")
+			t.FailNow()
+		}
+	}
+	checkInvoke(t, stub, "queryOwnershipHistory", testVIN)
+}
+
+func Test_migrateCar_indexes_car(t *testing.T) {
+	stub := newTestStub()
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("Org1MSP")})
+	putRawState(stub, "CAR0", `{"make":"Toyota","model":"Prius","colour":"blue","owner":"Tomoko"}`)
+	checkInvoke(t, stub, "migrateCar", "CAR0", "JTDKB20U493000001")
+
+	page := checkQueryPage(t, stub, "queryCarsByOwner", "Tomoko", "5")
+	checkKeys(t, page.Records, "JTDKB20U493000001")
+}
+
+// checkCarEvent checks the last event was name, about the cars with the given VINs
+func checkCarEvent(t *testing.T, stub *testStub, name string, vins ...string) []CarEvent {
+	if stub.eventName != name {
+		fmt.Println("Event was", stub.eventName, "and not", name)
+		t.FailNow()
+	}
+	var events []CarEvent
+	err := json.Unmarshal(stub.eventPayload, &events)
+	if err != nil {
+		fmt.Println("Could not decode event payload", err)
+		t.FailNow()
+	}
+	got := []string{}
+	for _, event := range events {
+		if event.VIN != event.Car.VIN || event.TxID != strconv.FormatInt(stub.txCount, 10) {
+			fmt.Println("Event", event, "does not match its car or transaction")
+			t.FailNow()
+		}
+		got = append(got, event.VIN)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(vins) {
+		fmt.Println("Event was about", got, "and not", vins)
+		t.FailNow()
+	}
+	return events
+}
+
+func Test_lifecycle_events(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "initLedger", `[{"vin":"1G1RA6E44BU000011","make":"Chevy","model":"Volt","colour":"red","owner":"Nick"},
+		{"vin":"JTDKB20U493000001","make":"Toyota","model":"Prius","colour":"blue","owner":"Tomoko"}]`)
+	checkCarEvent(t, stub, EventCarCreated, "1G1RA6E44BU000011", "JTDKB20U493000001")
+
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	events := checkCarEvent(t, stub, EventCarCreated, testVIN)
+	if events[0].Car != testCar("Tom") || events[0].Timestamp != 1500000002 {
+		fmt.Println("CarCreated event was", events[0])
+		t.FailNow()
+	}
+
+	transferCar(t, stub)
+	events = checkCarEvent(t, stub, EventCarTransferred, testVIN)
+	if events[0].Car.Owner != "Barry" || events[0].PreviousOwner != "Tom" {
+		fmt.Println("CarTransferred event was", events[0])
+		t.FailNow()
+	}
+
+	checkInvoke(t, stub, "setCarStatus", testVIN, "stolen")
+	if stub.eventName != "" {
+		fmt.Println("Stolen car emitted", stub.eventName)
+		t.FailNow()
+	}
+	checkInvoke(t, stub, "setCarStatus", testVIN, "scrapped")
+	events = checkCarEvent(t, stub, EventCarScrapped, testVIN)
+	if events[0].Car.Status != StatusScrapped {
+		fmt.Println("CarScrapped event was", events[0])
+		t.FailNow()
+	}
+
+	stub.as("Org1MSP", "Nick")
+	checkInvoke(t, stub, "deleteCar", "1G1RA6E44BU000011")
+	checkCarEvent(t, stub, EventCarDeleted, "1G1RA6E44BU000011")
+
+	putRawState(stub, "CAR0", `{"make":"Toyota","model":"Prius","colour":"blue","owner":"Tomoko"}`)
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("Org1MSP")})
+	checkInvoke(t, stub, "migrateCar", "CAR0", "JTDKB20U093000013")
+	checkCarEvent(t, stub, EventCarCreated, "JTDKB20U093000013")
+}
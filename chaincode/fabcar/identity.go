@@ -0,0 +1,149 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+/*
+ * getCreatorIdentity returns the MSP ID and the certificate common name of the client
+ * that submitted the transaction
+ */
+func getCreatorIdentity(APIstub shim.ChaincodeStubInterface) (string, string, error) {
+	creator, err := APIstub.GetCreator()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get creator: %s", err.Error())
+	}
+
+	serializedID := &msp.SerializedIdentity{}
+	err = proto.Unmarshal(creator, serializedID)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to decode creator: %s", err.Error())
+	}
+
+	block, _ := pem.Decode(serializedID.IdBytes)
+	if block == nil {
+		return "", "", errors.New("Failed to decode creator certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to parse creator certificate: %s", err.Error())
+	}
+
+	return serializedID.Mspid, cert.Subject.CommonName, nil
+}
+
+/*
+ * getTxTimestamp returns the transaction timestamp, set by the client and the same on
+ * every endorser, unlike the wall clock time
+ */
+func getTxTimestamp(APIstub shim.ChaincodeStubInterface) (*timestamp.Timestamp, error) {
+	txTimestamp, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get transaction timestamp: %s", err.Error())
+	} else if txTimestamp == nil {
+		return nil, errors.New("Transaction timestamp is not available")
+	}
+	return txTimestamp, nil
+}
+
+// configObjectType holds chaincode configuration entries, such as the admin MSP IDs set at Init
+const configObjectType = "config~name"
+
+/*
+ * setAdminMSPs stores the MSP IDs whose members may run admin operations
+ */
+func setAdminMSPs(APIstub shim.ChaincodeStubInterface, mspIDs []string) error {
+	return putConfig(APIstub, "adminMSPs", mspIDs)
+}
+
+/*
+ * checkAdmin returns an error unless the client belongs to one of the admin MSPs
+ */
+func checkAdmin(APIstub shim.ChaincodeStubInterface) error {
+	var adminMSPs []string
+	found, err := getConfig(APIstub, "adminMSPs", &adminMSPs)
+	if err != nil {
+		return err
+	} else if !found {
+		return errors.New("No admin MSP configured, instantiate the chaincode with the admin MSP IDs")
+	}
+
+	mspID, _, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return err
+	}
+	for _, adminMSP := range adminMSPs {
+		if mspID == adminMSP {
+			return nil
+		}
+	}
+	return fmt.Errorf("Client from %s is not allowed to run admin operations", mspID)
+}
+
+/*
+ * putConfig encodes and saves a configuration entry
+ */
+func putConfig(APIstub shim.ChaincodeStubInterface, name string, value interface{}) error {
+	configKey, err := APIstub.CreateCompositeKey(configObjectType, []string{name})
+	if err != nil {
+		return err
+	}
+	valueAsBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	err = APIstub.PutState(configKey, valueAsBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to save %s configuration: %s", name, err.Error())
+	}
+	return nil
+}
+
+/*
+ * getConfig reads and decodes a configuration entry into value, and tells whether it exists
+ */
+func getConfig(APIstub shim.ChaincodeStubInterface, name string, value interface{}) (bool, error) {
+	configKey, err := APIstub.CreateCompositeKey(configObjectType, []string{name})
+	if err != nil {
+		return false, err
+	}
+	valueAsBytes, err := APIstub.GetState(configKey)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get %s configuration: %s", name, err.Error())
+	} else if valueAsBytes == nil {
+		return false, nil
+	}
+	err = json.Unmarshal(valueAsBytes, value)
+	if err != nil {
+		return false, fmt.Errorf("Failed to decode %s configuration: %s", name, err.Error())
+	}
+	return true, nil
+}
@@ -0,0 +1,137 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Secondary indexes of the cars, their entries only hold the key and a 0x00 value
+const (
+	ownerIndex     = "owner~vin"
+	makeModelIndex = "make~model~vin"
+)
+
+/*
+ * queryCarsByOwner lists the cars of an owner, by VIN. The arguments are
+ *	owner and, optionally, page size and bookmark
+ * The response is the same as the one of queryAllCars.
+ */
+func (s *SmartContract) queryCarsByOwner(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	return queryCarsByIndex(APIstub, "queryCarsByOwner", ownerIndex, args[:1], args[1:])
+}
+
+/*
+ * queryCarsByMake lists the cars of a make, by model and VIN. The arguments are
+ *	make and, optionally, page size and bookmark
+ * The bookmark of a page is made of the model and VIN of its last car.
+ */
+func (s *SmartContract) queryCarsByMake(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	return queryCarsByIndex(APIstub, "queryCarsByMake", makeModelIndex, args[:1], args[1:])
+}
+
+/*
+ * queryCarsByMakeModel lists the cars of a make and model, by VIN. The arguments are
+ *	make, model and, optionally, page size and bookmark
+ */
+func (s *SmartContract) queryCarsByMakeModel(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) < 2 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 to 4")
+	}
+
+	return queryCarsByIndex(APIstub, "queryCarsByMakeModel", makeModelIndex, args[:2], args[2:])
+}
+
+/*
+ * queryCarsByIndex lists a page of the cars whose index entries match attributes
+ */
+func queryCarsByIndex(APIstub shim.ChaincodeStubInterface, function string, index string, attributes []string, pageArgs []string) sc.Response {
+	pageSize, bookmark, err := parsePageArgs(pageArgs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	page, bookmark, err := streamCars(APIstub, index, attributes, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return carsResponse(function, page, pageSize, bookmark)
+}
+
+/*
+ * putCarIndexes adds the index entries of a car
+ */
+func putCarIndexes(APIstub shim.ChaincodeStubInterface, car *Car) error {
+	for _, key := range []struct {
+		index      string
+		attributes []string
+	}{
+		{ownerIndex, []string{car.Owner, car.VIN}},
+		{makeModelIndex, []string{car.Make, car.Model, car.VIN}},
+	} {
+		indexKey, err := APIstub.CreateCompositeKey(key.index, key.attributes)
+		if err != nil {
+			return err
+		}
+		err = APIstub.PutState(indexKey, []byte{0x00})
+		if err != nil {
+			return fmt.Errorf("Failed to index car %s: %s", car.VIN, err.Error())
+		}
+	}
+	return nil
+}
+
+/*
+ * delCarIndexes removes the index entries of a car
+ */
+func delCarIndexes(APIstub shim.ChaincodeStubInterface, car *Car) error {
+	for _, key := range []struct {
+		index      string
+		attributes []string
+	}{
+		{ownerIndex, []string{car.Owner, car.VIN}},
+		{makeModelIndex, []string{car.Make, car.Model, car.VIN}},
+	} {
+		indexKey, err := APIstub.CreateCompositeKey(key.index, key.attributes)
+		if err != nil {
+			return err
+		}
+		err = APIstub.DelState(indexKey)
+		if err != nil {
+			return fmt.Errorf("Failed to remove index of car %s: %s", car.VIN, err.Error())
+		}
+	}
+	return nil
+}
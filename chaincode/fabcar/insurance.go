@@ -0,0 +1,537 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Object types of the insurance keys, policy~VIN~policyID and claim~VIN~policyID~claimID
+const (
+	policyObjectType = "policy"
+	claimObjectType  = "claim"
+)
+
+// Statuses of a policy. Policies lapse when the car is transferred to a new owner.
+const (
+	PolicyActive = "active"
+	PolicyLapsed = "lapsed"
+)
+
+// Statuses of a claim
+const (
+	ClaimFiled     = "filed"
+	ClaimReviewing = "reviewing"
+	ClaimApproved  = "approved"
+	ClaimRejected  = "rejected"
+	ClaimPaid      = "paid"
+	ClaimWithdrawn = "withdrawn"
+)
+
+// insurerTransitions lists the statuses the insurer can move a claim to, by status
+var insurerTransitions = map[string][]string{
+	ClaimFiled:     {ClaimReviewing, ClaimRejected},
+	ClaimReviewing: {ClaimApproved, ClaimRejected},
+	ClaimApproved:  {ClaimPaid},
+}
+
+// claimantTransitions lists the statuses the claimant can move a claim to, by status
+var claimantTransitions = map[string][]string{
+	ClaimFiled:     {ClaimWithdrawn},
+	ClaimReviewing: {ClaimWithdrawn},
+}
+
+// Policy is an insurance policy of a car, issued by an insurer organization to the owner
+type Policy struct {
+	ID         string `json:"id"` // ID of the transaction that issued the policy
+	VIN        string `json:"vin"`
+	Insurer    string `json:"insurer"` // MSP ID of the insurer
+	Holder     string `json:"holder"`
+	HolderMSP  string `json:"holderMSP,omitempty"`
+	Start      string `json:"start"` // first day of coverage, YYYY-MM-DD
+	End        string `json:"end"`   // last day of coverage, YYYY-MM-DD
+	Premium    int64  `json:"premium"`
+	Status     string `json:"status"`
+	LapsedTxID string `json:"lapsedTxID,omitempty"`
+}
+
+// Claim is a damage claim filed by the holder of a policy
+type Claim struct {
+	ID             string              `json:"id"` // ID of the transaction that filed the claim
+	PolicyID       string              `json:"policyID"`
+	VIN            string              `json:"vin"`
+	IncidentDate   string              `json:"incidentDate"`
+	Description    string              `json:"description"`
+	EvidenceHashes []string            `json:"evidenceHashes"` // SHA-256 of the photos and reports, hex encoded
+	Claimant       string              `json:"claimant"`
+	ClaimantMSP    string              `json:"claimantMSP"`
+	Status         string              `json:"status"`
+	History        []ClaimStatusChange `json:"history"`
+}
+
+// ClaimStatusChange is a step of the workflow of a claim
+type ClaimStatusChange struct {
+	Status    string `json:"status"`
+	By        string `json:"by"`
+	ByMSP     string `json:"byMSP"`
+	Note      string `json:"note,omitempty"`
+	TxID      string `json:"txID"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+/*
+ * authorizeInsurer allows the members of an organization to issue policies, the only
+ * argument is its MSP ID. Only admins can authorize insurers.
+ */
+func (s *SmartContract) authorizeInsurer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	return setAuthorizedMSP(APIstub, args, "insurerMSPs", true)
+}
+
+/*
+ * revokeInsurer stops the members of an organization from issuing policies, the only
+ * argument is its MSP ID. Only admins can revoke insurers, their policies and claims are
+ * kept and can still be processed.
+ */
+func (s *SmartContract) revokeInsurer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	return setAuthorizedMSP(APIstub, args, "insurerMSPs", false)
+}
+
+/*
+ * issuePolicy insures a car for its current owner. The arguments are
+ *	VIN, coverage start and end dates (YYYY-MM-DD) and premium, in cents
+ * Only members of an authorized insurer can issue policies, the insurer being their
+ * organization. The coverage period must not overlap one of an active policy of the car.
+ */
+func (s *SmartContract) issuePolicy(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.VIN == "" {
+		return shim.Error("Car must be migrated before it can be insured: " + args[0])
+	} else if car.OwnerMSP == "" {
+		return shim.Error("Car must have an owner MSP before it can be insured: " + args[0])
+	} else if car.Status == StatusScrapped || car.Status == StatusStolen {
+		return shim.Error("Cannot insure a " + car.Status + " car: " + args[0])
+	}
+
+	start, err := time.Parse(dateLayout, args[1])
+	if err != nil {
+		return shim.Error("Invalid start date " + args[1] + ", expecting YYYY-MM-DD")
+	}
+	end, err := time.Parse(dateLayout, args[2])
+	if err != nil {
+		return shim.Error("Invalid end date " + args[2] + ", expecting YYYY-MM-DD")
+	}
+	if end.Before(start) {
+		return shim.Error("Coverage cannot end before it starts")
+	}
+	premium, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || premium <= 0 {
+		return shim.Error("Invalid premium " + args[3] + ", expecting a positive amount in cents")
+	}
+
+	mspID, _, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	insurers, err := getAuthorizedMSPs(APIstub, "insurerMSPs")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !contains(insurers, mspID) {
+		return shim.Error("Client from " + mspID + " is not an authorized insurer")
+	}
+
+	policy := Policy{ID: APIstub.GetTxID(), VIN: car.VIN, Insurer: mspID, Holder: car.Owner, HolderMSP: car.OwnerMSP,
+		Start: args[1], End: args[2], Premium: premium, Status: PolicyActive}
+	policies, err := getPolicies(APIstub, car.VIN)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, other := range policies {
+		// dates are YYYY-MM-DD, so they compare as strings
+		if other.Status == PolicyActive && other.Start <= policy.End && policy.Start <= other.End {
+			return shim.Error("Car " + args[0] + " is already covered by policy " + other.ID + " of " + other.Insurer)
+		}
+	}
+
+	err = putPolicy(APIstub, &policy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	policyAsBytes, err := json.Marshal(policy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(policyAsBytes)
+}
+
+/*
+ * queryPolicies returns the policies of a car, lapsed ones included, as a JSON array.
+ * The only argument is the VIN.
+ */
+func (s *SmartContract) queryPolicies(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	vin, err := normalizeVIN(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	policies, err := getPolicies(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	policiesAsBytes, err := json.Marshal(policies)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- queryPolicies:\n%s\n", policiesAsBytes)
+
+	return shim.Success(policiesAsBytes)
+}
+
+/*
+ * fileClaim files a damage claim against an active policy. The arguments are
+ *	VIN, policy ID, incident date (YYYY-MM-DD), damage description and evidence hashes
+ * The evidence hashes are hex encoded SHA-256, separated by commas. Only the policy
+ * holder can file claims, for incidents within the coverage period.
+ */
+func (s *SmartContract) fileClaim(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+
+	policy, err := getPolicy(APIstub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if policy.Status != PolicyActive {
+		return shim.Error("Policy " + args[1] + " is " + policy.Status)
+	}
+	if _, err := time.Parse(dateLayout, args[2]); err != nil {
+		return shim.Error("Invalid incident date " + args[2] + ", expecting YYYY-MM-DD")
+	}
+	if args[2] < policy.Start || args[2] > policy.End {
+		return shim.Error("Incident date " + args[2] + " is outside the coverage of policy " + args[1])
+	}
+	if args[3] == "" {
+		return shim.Error("Damage description must be a non-empty string")
+	}
+	evidenceHashes, err := parseEvidenceHashes(args[4])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	mspID, name, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if name != policy.Holder || mspID != policy.HolderMSP {
+		return shim.Error("Only the holder " + policy.Holder + " can file claims against policy " + args[1])
+	}
+
+	txTimestamp, err := getTxTimestamp(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	claim := Claim{ID: APIstub.GetTxID(), PolicyID: policy.ID, VIN: policy.VIN, IncidentDate: args[2], Description: args[3],
+		EvidenceHashes: evidenceHashes, Claimant: name, ClaimantMSP: mspID, Status: ClaimFiled,
+		History: []ClaimStatusChange{{Status: ClaimFiled, By: name, ByMSP: mspID, TxID: APIstub.GetTxID(), Timestamp: txTimestamp.Seconds}}}
+	err = putClaim(APIstub, &claim)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	claimAsBytes, err := json.Marshal(claim)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(claimAsBytes)
+}
+
+/*
+ * updateClaimStatus moves a claim along its workflow. The arguments are
+ *	VIN, policy ID, claim ID, new status and an optional note
+ * The insurer of the policy reviews the claim, then approves or rejects it, and marks
+ * approved claims paid. The claimant can withdraw the claim until it is decided.
+ */
+func (s *SmartContract) updateClaimStatus(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 4 && len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 or 5")
+	}
+
+	policy, err := getPolicy(APIstub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	claim, err := getClaim(APIstub, policy, args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	mspID, name, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var transitions map[string][]string
+	if mspID == policy.Insurer {
+		transitions = insurerTransitions
+	} else if name == claim.Claimant && mspID == claim.ClaimantMSP {
+		transitions = claimantTransitions
+	} else {
+		return shim.Error("Only the insurer " + policy.Insurer + " or the claimant can update claim " + args[2])
+	}
+	if !contains(transitions[claim.Status], args[3]) {
+		return shim.Error("Cannot move claim " + args[2] + " from " + claim.Status + " to " + args[3])
+	}
+
+	txTimestamp, err := getTxTimestamp(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	change := ClaimStatusChange{Status: args[3], By: name, ByMSP: mspID, TxID: APIstub.GetTxID(), Timestamp: txTimestamp.Seconds}
+	if len(args) == 5 {
+		change.Note = args[4]
+	}
+	claim.Status = change.Status
+	claim.History = append(claim.History, change)
+	err = putClaim(APIstub, claim)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * queryClaims returns the claims filed against the policies of a car, as a JSON array.
+ * The only argument is the VIN.
+ */
+func (s *SmartContract) queryClaims(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	vin, err := normalizeVIN(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(claimObjectType, []string{vin})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	claims := []Claim{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		claim := Claim{}
+		err = json.Unmarshal(queryResponse.Value, &claim)
+		if err != nil {
+			return shim.Error("Failed to decode claim " + queryResponse.Key + ": " + err.Error())
+		}
+		claims = append(claims, claim)
+	}
+	claimsAsBytes, err := json.Marshal(claims)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- queryClaims:\n%s\n", claimsAsBytes)
+
+	return shim.Success(claimsAsBytes)
+}
+
+/*
+ * lapsePolicies lapses the active policies of a car, called when it changes owner, is
+ * scrapped or is removed. Claims already filed against them can still be processed.
+ */
+func lapsePolicies(APIstub shim.ChaincodeStubInterface, vin string) error {
+	policies, err := getPolicies(APIstub, vin)
+	if err != nil {
+		return err
+	}
+	for i := range policies {
+		if policies[i].Status != PolicyActive {
+			continue
+		}
+		policies[i].Status = PolicyLapsed
+		policies[i].LapsedTxID = APIstub.GetTxID()
+		err = putPolicy(APIstub, &policies[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * parseEvidenceHashes reads a comma separated list of hex encoded SHA-256
+ */
+func parseEvidenceHashes(arg string) ([]string, error) {
+	if arg == "" {
+		return nil, errors.New("At least one evidence hash is required")
+	}
+	hashes := strings.Split(arg, ",")
+	for _, hash := range hashes {
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 32 {
+			return nil, errors.New("Invalid evidence hash " + hash + ", expecting a hex encoded SHA-256")
+		}
+	}
+	return hashes, nil
+}
+
+/*
+ * getPolicies returns the policies of a car
+ */
+func getPolicies(APIstub shim.ChaincodeStubInterface, vin string) ([]Policy, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(policyObjectType, []string{vin})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	policies := []Policy{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		policy := Policy{}
+		err = json.Unmarshal(queryResponse.Value, &policy)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode policy %s: %s", queryResponse.Key, err.Error())
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+/*
+ * getPolicy returns a policy of a car, or an error if it does not exist
+ */
+func getPolicy(APIstub shim.ChaincodeStubInterface, vin string, policyID string) (*Policy, error) {
+	vin, err := normalizeVIN(vin)
+	if err != nil {
+		return nil, err
+	}
+	key, err := APIstub.CreateCompositeKey(policyObjectType, []string{vin, policyID})
+	if err != nil {
+		return nil, err
+	}
+	policyAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get policy %s: %s", policyID, err.Error())
+	} else if policyAsBytes == nil {
+		return nil, fmt.Errorf("Policy %s of car %s does not exist", policyID, vin)
+	}
+	policy := &Policy{}
+	err = json.Unmarshal(policyAsBytes, policy)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode policy %s: %s", policyID, err.Error())
+	}
+	return policy, nil
+}
+
+/*
+ * putPolicy saves a policy under its car and ID
+ */
+func putPolicy(APIstub shim.ChaincodeStubInterface, policy *Policy) error {
+	key, err := APIstub.CreateCompositeKey(policyObjectType, []string{policy.VIN, policy.ID})
+	if err != nil {
+		return err
+	}
+	policyAsBytes, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	err = APIstub.PutState(key, policyAsBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to save policy %s: %s", policy.ID, err.Error())
+	}
+	return nil
+}
+
+/*
+ * getClaim returns a claim filed against a policy, or an error if it does not exist
+ */
+func getClaim(APIstub shim.ChaincodeStubInterface, policy *Policy, claimID string) (*Claim, error) {
+	key, err := APIstub.CreateCompositeKey(claimObjectType, []string{policy.VIN, policy.ID, claimID})
+	if err != nil {
+		return nil, err
+	}
+	claimAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get claim %s: %s", claimID, err.Error())
+	} else if claimAsBytes == nil {
+		return nil, fmt.Errorf("Claim %s of policy %s does not exist", claimID, policy.ID)
+	}
+	claim := &Claim{}
+	err = json.Unmarshal(claimAsBytes, claim)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode claim %s: %s", claimID, err.Error())
+	}
+	return claim, nil
+}
+
+/*
+ * putClaim saves a claim under its car, policy and ID
+ */
+func putClaim(APIstub shim.ChaincodeStubInterface, claim *Claim) error {
+	key, err := APIstub.CreateCompositeKey(claimObjectType, []string{claim.VIN, claim.PolicyID, claim.ID})
+	if err != nil {
+		return err
+	}
+	claimAsBytes, err := json.Marshal(claim)
+	if err != nil {
+		return err
+	}
+	err = APIstub.PutState(key, claimAsBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to save claim %s: %s", claim.ID, err.Error())
+	}
+	return nil
+}
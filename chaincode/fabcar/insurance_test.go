@@ -0,0 +1,261 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// newInsuranceStub returns a stub holding the testVIN car of Tom, insured by InsurerMSP
+// with the policy returned, where Org1MSP is the admin
+func newInsuranceStub(t *testing.T) (*testStub, Policy) {
+	stub := newTestStub()
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("Org1MSP")})
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	stub.as("Org1MSP", "Admin")
+	checkInvoke(t, stub, "authorizeInsurer", "InsurerMSP")
+	stub.as("InsurerMSP", "Underwriter")
+	res := checkInvoke(t, stub, "issuePolicy", testVIN, "2017-01-01", "2017-12-31", "45000")
+	var policy Policy
+	err := json.Unmarshal(res.Payload, &policy)
+	if err != nil {
+		fmt.Println("Could not decode policy", err)
+		t.FailNow()
+	}
+	return stub, policy
+}
+
+func checkPolicies(t *testing.T, stub *testStub, vin string) []Policy {
+	res := checkInvoke(t, stub, "queryPolicies", vin)
+	var policies []Policy
+	err := json.Unmarshal(res.Payload, &policies)
+	if err != nil {
+		fmt.Println("Could not decode policies", err)
+		t.FailNow()
+	}
+	return policies
+}
+
+func checkClaims(t *testing.T, stub *testStub, vin string) []Claim {
+	res := checkInvoke(t, stub, "queryClaims", vin)
+	var claims []Claim
+	err := json.Unmarshal(res.Payload, &claims)
+	if err != nil {
+		fmt.Println("Could not decode claims", err)
+		t.FailNow()
+	}
+	return claims
+}
+
+// findPolicy returns the policy of the given ID, policies not being listed in issue order
+func findPolicy(t *testing.T, policies []Policy, id string) Policy {
+	for _, policy := range policies {
+		if policy.ID == id {
+			return policy
+		}
+	}
+	fmt.Println("Policy", id, "was not found in", policies)
+	t.FailNow()
+	return Policy{}
+}
+
+func Test_issuePolicy(t *testing.T) {
+	stub, policy := newInsuranceStub(t)
+	expected := Policy{ID: "3", VIN: testVIN, Insurer: "InsurerMSP", Holder: "Tom", HolderMSP: "Org1MSP", Start: "2017-01-01", End: "2017-12-31",
+		Premium: 45000, Status: PolicyActive}
+	if policy != expected {
+		fmt.Println("Policy was", policy, "and not", expected, "as expected")
+		t.FailNow()
+	}
+
+	// the coverage of another insurer cannot overlap, but can follow
+	stub.as("Org1MSP", "Admin")
+	checkInvoke(t, stub, "authorizeInsurer", "Org2MSP")
+	stub.as("Org2MSP", "Underwriter")
+	checkInvokeFailed(t, stub, "issuePolicy", testVIN, "2017-12-31", "2018-12-30", "40000")
+	checkInvoke(t, stub, "issuePolicy", testVIN, "2018-01-01", "2018-12-31", "40000")
+
+	policies := checkPolicies(t, stub, testVIN)
+	if len(policies) != 2 || findPolicy(t, policies, policy.ID) != policy || findPolicy(t, policies, "6").Insurer != "Org2MSP" {
+		fmt.Println("Policies were", policies)
+		t.FailNow()
+	}
+}
+
+func Test_issuePolicy_rejects_invalid_policies(t *testing.T) {
+	stub, _ := newInsuranceStub(t)
+	checkInvokeFailed(t, stub, "issuePolicy", "1G1RA6E44BU000011", "2018-01-01", "2018-12-31", "45000")
+	checkInvokeFailed(t, stub, "issuePolicy", testVIN, "01/01/2018", "2018-12-31", "45000")
+	checkInvokeFailed(t, stub, "issuePolicy", testVIN, "2018-12-31", "2018-01-01", "45000")
+	checkInvokeFailed(t, stub, "issuePolicy", testVIN, "2018-01-01", "2018-12-31", "450.00")
+	checkInvokeFailed(t, stub, "issuePolicy", testVIN, "2018-01-01", "2018-12-31", "0")
+	checkInvokeFailed(t, stub, "issuePolicy", testVIN, "2018-01-01", "2018-12-31")
+
+	stub.as("Org2MSP", "Underwriter")
+	checkInvokeFailed(t, stub, "issuePolicy", testVIN, "2018-01-01", "2018-12-31", "45000")
+	checkInvokeFailed(t, stub, "authorizeInsurer", "Org2MSP")
+
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "setCarStatus", testVIN, "stolen")
+	stub.as("InsurerMSP", "Underwriter")
+	checkInvokeFailed(t, stub, "issuePolicy", testVIN, "2018-01-01", "2018-12-31", "45000")
+
+	if len(checkPolicies(t, stub, testVIN)) != 1 {
+		fmt.Println("Invalid policy was issued")
+		t.FailNow()
+	}
+}
+
+func Test_claim_workflow(t *testing.T) {
+	stub, policy := newInsuranceStub(t)
+	stub.as("Org1MSP", "Tom")
+	res := checkInvoke(t, stub, "fileClaim", testVIN, policy.ID, "2017-06-01", "Rear bumper dented", testHash+","+testHash)
+	var claim Claim
+	err := json.Unmarshal(res.Payload, &claim)
+	if err != nil || claim.ID != "4" || claim.Status != ClaimFiled || len(claim.EvidenceHashes) != 2 {
+		fmt.Println("Filed claim was", claim, err)
+		t.FailNow()
+	}
+
+	// only the insurer decides, in workflow order
+	checkInvokeFailed(t, stub, "updateClaimStatus", testVIN, policy.ID, claim.ID, ClaimApproved)
+	stub.as("InsurerMSP", "Adjuster")
+	checkInvokeFailed(t, stub, "updateClaimStatus", testVIN, policy.ID, claim.ID, ClaimPaid)
+	checkInvoke(t, stub, "updateClaimStatus", testVIN, policy.ID, claim.ID, ClaimReviewing)
+	checkInvoke(t, stub, "updateClaimStatus", testVIN, policy.ID, claim.ID, ClaimApproved, "Repair quote accepted")
+	stub.as("Org1MSP", "Tom")
+	checkInvokeFailed(t, stub, "updateClaimStatus", testVIN, policy.ID, claim.ID, ClaimWithdrawn)
+	stub.as("InsurerMSP", "Payments")
+	checkInvoke(t, stub, "updateClaimStatus", testVIN, policy.ID, claim.ID, ClaimPaid)
+	checkInvokeFailed(t, stub, "updateClaimStatus", testVIN, policy.ID, claim.ID, ClaimRejected)
+
+	claims := checkClaims(t, stub, testVIN)
+	expected := []ClaimStatusChange{
+		{Status: ClaimFiled, By: "Tom", ByMSP: "Org1MSP", TxID: "4", Timestamp: 1500000004},
+		{Status: ClaimReviewing, By: "Adjuster", ByMSP: "InsurerMSP", TxID: "7", Timestamp: 1500000007},
+		{Status: ClaimApproved, By: "Adjuster", ByMSP: "InsurerMSP", Note: "Repair quote accepted", TxID: "8", Timestamp: 1500000008},
+		{Status: ClaimPaid, By: "Payments", ByMSP: "InsurerMSP", TxID: "10", Timestamp: 1500000010},
+	}
+	if len(claims) != 1 || claims[0].Status != ClaimPaid || fmt.Sprint(claims[0].History) != fmt.Sprint(expected) {
+		fmt.Println("Claims were", claims, "and not with history", expected, "as expected")
+		t.FailNow()
+	}
+}
+
+func Test_claim_can_be_withdrawn_by_claimant(t *testing.T) {
+	stub, policy := newInsuranceStub(t)
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "fileClaim", testVIN, policy.ID, "2017-06-01", "Windscreen cracked", testHash)
+	stub.as("Org2MSP", "Tom")
+	checkInvokeFailed(t, stub, "updateClaimStatus", testVIN, policy.ID, "4", ClaimWithdrawn)
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "updateClaimStatus", testVIN, policy.ID, "4", ClaimWithdrawn)
+
+	if claims := checkClaims(t, stub, testVIN); len(claims) != 1 || claims[0].Status != ClaimWithdrawn {
+		fmt.Println("Claims were", claims)
+		t.FailNow()
+	}
+}
+
+func Test_fileClaim_rejects_invalid_claims(t *testing.T) {
+	stub, policy := newInsuranceStub(t)
+	stub.as("Org1MSP", "Tom")
+	checkInvokeFailed(t, stub, "fileClaim", testVIN, "2", "2017-06-01", "Rear bumper dented", testHash)
+	checkInvokeFailed(t, stub, "fileClaim", testVIN, policy.ID, "2018-01-01", "Rear bumper dented", testHash)
+	checkInvokeFailed(t, stub, "fileClaim", testVIN, policy.ID, "June 1st", "Rear bumper dented", testHash)
+	checkInvokeFailed(t, stub, "fileClaim", testVIN, policy.ID, "2017-06-01", "", testHash)
+	checkInvokeFailed(t, stub, "fileClaim", testVIN, policy.ID, "2017-06-01", "Rear bumper dented", "")
+	checkInvokeFailed(t, stub, "fileClaim", testVIN, policy.ID, "2017-06-01", "Rear bumper dented", testHash+",photo.jpg")
+	stub.as("Org1MSP", "Barry")
+	checkInvokeFailed(t, stub, "fileClaim", testVIN, policy.ID, "2017-06-01", "Rear bumper dented", testHash)
+
+	if len(checkClaims(t, stub, testVIN)) != 0 {
+		fmt.Println("Invalid claim was filed")
+		t.FailNow()
+	}
+}
+
+func Test_transfer_lapses_policies(t *testing.T) {
+	stub, policy := newInsuranceStub(t)
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "fileClaim", testVIN, policy.ID, "2017-06-01", "Rear bumper dented", testHash)
+	transferCar(t, stub)
+
+	policies := checkPolicies(t, stub, testVIN)
+	if len(policies) != 1 || policies[0].Status != PolicyLapsed || policies[0].LapsedTxID != "6" {
+		fmt.Println("Policies were", policies)
+		t.FailNow()
+	}
+	// neither the previous nor the new owner can claim on a lapsed policy
+	checkInvokeFailed(t, stub, "fileClaim", testVIN, policy.ID, "2017-07-01", "Scratched door", testHash)
+	stub.as("Org1MSP", "Tom")
+	checkInvokeFailed(t, stub, "fileClaim", testVIN, policy.ID, "2017-07-01", "Scratched door", testHash)
+
+	// claims filed before the transfer are still processed, and the new owner can be insured
+	stub.as("InsurerMSP", "Adjuster")
+	checkInvoke(t, stub, "updateClaimStatus", testVIN, policy.ID, "4", ClaimReviewing)
+	checkInvoke(t, stub, "issuePolicy", testVIN, "2017-07-01", "2018-06-30", "52000")
+	policies = checkPolicies(t, stub, testVIN)
+	if renewed := findPolicy(t, policies, "11"); len(policies) != 2 || renewed.Holder != "Barry" || renewed.HolderMSP != "Org1MSP" {
+		fmt.Println("Policies were", policies)
+		t.FailNow()
+	}
+}
+
+func Test_scrapping_lapses_policies(t *testing.T) {
+	stub, policy := newInsuranceStub(t)
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "fileClaim", testVIN, policy.ID, "2017-06-01", "Rear bumper dented", testHash)
+	checkInvoke(t, stub, "setCarStatus", testVIN, "scrapped")
+
+	policies := checkPolicies(t, stub, testVIN)
+	if len(policies) != 1 || policies[0].Status != PolicyLapsed {
+		fmt.Println("Policies were", policies)
+		t.FailNow()
+	}
+	checkInvokeFailed(t, stub, "fileClaim", testVIN, policy.ID, "2017-07-01", "Scratched door", testHash)
+	stub.as("InsurerMSP", "Adjuster")
+	checkInvoke(t, stub, "updateClaimStatus", testVIN, policy.ID, "4", ClaimReviewing)
+}
+
+func Test_removing_a_car_lapses_policies(t *testing.T) {
+	stub, _ := newInsuranceStub(t)
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "deleteCar", testVIN)
+
+	policies := checkPolicies(t, stub, testVIN)
+	if len(policies) != 1 || policies[0].Status != PolicyLapsed {
+		fmt.Println("Policies of the deleted car were", policies)
+		t.FailNow()
+	}
+
+	// a seed car replacing an insured car does not inherit its policies
+	stub, _ = newInsuranceStub(t)
+	stub.as("Org1MSP", "Admin")
+	checkInvoke(t, stub, "initLedger", `[{"vin":"`+testVIN+`","make":"Honda","model":"Civic","colour":"red","owner":"Kenji"}]`, "force")
+
+	policies = checkPolicies(t, stub, testVIN)
+	if len(policies) != 1 || policies[0].Status != PolicyLapsed {
+		fmt.Println("Policies of the replaced car were", policies)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,302 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Object type of the maintenance log keys, service~VIN~date~txID
+const serviceObjectType = "service"
+
+// Layout of the service record and insurance policy dates
+const dateLayout = "2006-01-02"
+
+// ServiceRecord is an entry of the maintenance log of a car, appended by a garage
+type ServiceRecord struct {
+	VIN             string `json:"vin"`
+	Date            string `json:"date"`
+	Mileage         int    `json:"mileage"`
+	Work            string `json:"work"`
+	DocumentHash    string `json:"documentHash"`            // SHA-256 of the invoice or report, hex encoded
+	Garage          string `json:"garage"`                  // MSP ID of the garage
+	Mechanic        string `json:"mechanic"`                // common name of the client certificate
+	OdometerAlert   bool   `json:"odometerAlert,omitempty"` // mileage is lower than an earlier record's or the car's
+	PreviousMileage int    `json:"previousMileage,omitempty"`
+	TxID            string `json:"txID"`
+}
+
+/*
+ * authorizeGarage allows the members of an organization to append service records, the
+ * only argument is its MSP ID. Only admins can authorize garages.
+ */
+func (s *SmartContract) authorizeGarage(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	return setAuthorizedMSP(APIstub, args, "garageMSPs", true)
+}
+
+/*
+ * revokeGarage stops the members of an organization from appending service records, the
+ * only argument is its MSP ID. Only admins can revoke garages, their records are kept.
+ */
+func (s *SmartContract) revokeGarage(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	return setAuthorizedMSP(APIstub, args, "garageMSPs", false)
+}
+
+/*
+ * setAuthorizedMSP adds the MSP ID of args to, or removes it from, the authorized MSPs
+ * held by the config entry name. Only admins can change them.
+ */
+func setAuthorizedMSP(APIstub shim.ChaincodeStubInterface, args []string, name string, authorized bool) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+	if args[0] == "" {
+		return shim.Error("MSP ID must be a non-empty string")
+	}
+
+	err := checkAdmin(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	mspIDs, err := getAuthorizedMSPs(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	updated := []string{}
+	for _, mspID := range mspIDs {
+		if mspID != args[0] {
+			updated = append(updated, mspID)
+		}
+	}
+	if authorized {
+		updated = append(updated, args[0])
+	}
+
+	err = putConfig(APIstub, name, updated)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * addServiceRecord appends a record to the maintenance log of a car. The arguments are
+ *	VIN, date (YYYY-MM-DD), mileage, work description and document hash
+ * Only members of an authorized garage can add records. A record whose mileage is lower
+ * than the one of the previous record, by date, or than the mileage the car was registered
+ * with, is flagged as a possible odometer fraud. A backdated record whose mileage is higher
+ * than the one of the following record flags that record instead.
+ */
+func (s *SmartContract) addServiceRecord(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.VIN == "" {
+		return shim.Error("Car must be migrated before it can be serviced: " + args[0])
+	} else if car.Status == StatusScrapped {
+		return shim.Error("Cannot service a scrapped car: " + args[0])
+	}
+
+	if _, err := time.Parse(dateLayout, args[1]); err != nil {
+		return shim.Error("Invalid date " + args[1] + ", expecting YYYY-MM-DD")
+	}
+	mileage, err := strconv.Atoi(args[2])
+	if err != nil || mileage < 0 {
+		return shim.Error("Invalid mileage " + args[2])
+	}
+	if args[3] == "" {
+		return shim.Error("Work description must be a non-empty string")
+	}
+	if hash, err := hex.DecodeString(args[4]); err != nil || len(hash) != 32 {
+		return shim.Error("Invalid document hash " + args[4] + ", expecting a hex encoded SHA-256")
+	}
+
+	mspID, name, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	garages, err := getAuthorizedMSPs(APIstub, "garageMSPs")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !contains(garages, mspID) {
+		return shim.Error("Client from " + mspID + " is not an authorized garage")
+	}
+
+	record := ServiceRecord{VIN: car.VIN, Date: args[1], Mileage: mileage, Work: args[3], DocumentHash: args[4],
+		Garage: mspID, Mechanic: name, TxID: APIstub.GetTxID()}
+	previous, next, nextKey, err := getAdjacentServiceRecords(APIstub, car.VIN, record.Date)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if record.Mileage < car.Mileage {
+		record.OdometerAlert = true
+		record.PreviousMileage = car.Mileage
+	}
+	if previous != nil && record.Mileage < previous.Mileage && previous.Mileage > record.PreviousMileage {
+		record.OdometerAlert = true
+		record.PreviousMileage = previous.Mileage
+	}
+	if next != nil && next.Mileage < record.Mileage && record.Mileage > next.PreviousMileage {
+		next.OdometerAlert = true
+		next.PreviousMileage = record.Mileage
+		nextAsBytes, err := json.Marshal(next)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = APIstub.PutState(nextKey, nextAsBytes)
+		if err != nil {
+			return shim.Error("Failed to flag service record: " + err.Error())
+		}
+	}
+
+	key, err := APIstub.CreateCompositeKey(serviceObjectType, []string{car.VIN, record.Date, record.TxID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	recordAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = APIstub.PutState(key, recordAsBytes)
+	if err != nil {
+		return shim.Error("Failed to save service record: " + err.Error())
+	}
+
+	return shim.Success(recordAsBytes)
+}
+
+/*
+ * queryServiceHistory returns the maintenance log of a car, by date, as a JSON array.
+ * The only argument is the VIN.
+ */
+func (s *SmartContract) queryServiceHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	vin, err := normalizeVIN(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(serviceObjectType, []string{vin})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	// buffer is a JSON array containing the service records
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		// Add a comma before array members, suppress it for the first array member
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(queryResponse.Value)
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	fmt.Printf("- queryServiceHistory:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}
+
+/*
+ * getAdjacentServiceRecords returns the last record of a car dated on or before date and
+ * the first one dated after it, with its key, or nil if there is none
+ */
+func getAdjacentServiceRecords(APIstub shim.ChaincodeStubInterface, vin string, date string) (*ServiceRecord, *ServiceRecord, string, error) {
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(serviceObjectType, []string{vin})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer resultsIterator.Close()
+
+	var previous *ServiceRecord
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, "", err
+		}
+		record := ServiceRecord{}
+		err = json.Unmarshal(queryResponse.Value, &record)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("Failed to decode service record %s: %s", queryResponse.Key, err.Error())
+		}
+		if record.Date > date {
+			return previous, &record, queryResponse.Key, nil
+		}
+		previous = &record
+	}
+	return previous, nil, "", nil
+}
+
+/*
+ * getAuthorizedMSPs returns the MSP IDs held by the config entry name, such as the
+ * authorized garages
+ */
+func getAuthorizedMSPs(APIstub shim.ChaincodeStubInterface, name string) ([]string, error) {
+	mspIDs := []string{}
+	found, err := getConfig(APIstub, name, &mspIDs)
+	if err != nil {
+		return nil, err
+	} else if !found {
+		return []string{}, nil
+	}
+	return mspIDs, nil
+}
+
+/*
+ * contains tells whether value is one of values
+ */
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
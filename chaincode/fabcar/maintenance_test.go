@@ -0,0 +1,172 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// testHash is a valid document hash, the SHA-256 of an empty document
+const testHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// newGarageStub returns a stub holding the testVIN car, where GarageMSP is an authorized
+// garage and Org1MSP the admin
+func newGarageStub(t *testing.T) *testStub {
+	stub := newTestStub()
+	stub.MockInit("1", [][]byte{[]byte("init"), []byte("Org1MSP")})
+	checkInvoke(t, stub, "createCar", testVIN, "Honda", "Accord", "black", "Tom")
+	stub.as("Org1MSP", "Admin")
+	checkInvoke(t, stub, "authorizeGarage", "GarageMSP")
+	stub.as("GarageMSP", "Mechanic")
+	return stub
+}
+
+func checkServiceHistory(t *testing.T, stub *testStub, vin string) []ServiceRecord {
+	res := checkInvoke(t, stub, "queryServiceHistory", vin)
+	var records []ServiceRecord
+	err := json.Unmarshal(res.Payload, &records)
+	if err != nil {
+		fmt.Println("Could not decode service history", err)
+		t.FailNow()
+	}
+	return records
+}
+
+func Test_addServiceRecord(t *testing.T) {
+	stub := newGarageStub(t)
+	checkInvoke(t, stub, "addServiceRecord", testVIN, "2017-06-01", "150000", "Oil change", testHash)
+	checkInvoke(t, stub, "addServiceRecord", testVIN, "2016-03-15", "120000", "Brake pads", testHash)
+
+	records := checkServiceHistory(t, stub, testVIN)
+	expected := []ServiceRecord{
+		{VIN: testVIN, Date: "2016-03-15", Mileage: 120000, Work: "Brake pads", DocumentHash: testHash, Garage: "GarageMSP", Mechanic: "Mechanic", TxID: "4"},
+		{VIN: testVIN, Date: "2017-06-01", Mileage: 150000, Work: "Oil change", DocumentHash: testHash, Garage: "GarageMSP", Mechanic: "Mechanic", TxID: "3"},
+	}
+	if fmt.Sprint(records) != fmt.Sprint(expected) {
+		fmt.Println("Service history was", records, "and not", expected, "as expected")
+		t.FailNow()
+	}
+}
+
+func Test_addServiceRecord_flags_odometer_rollback(t *testing.T) {
+	stub := newGarageStub(t)
+	checkInvoke(t, stub, "addServiceRecord", testVIN, "2017-06-01", "150000", "Oil change", testHash)
+	checkInvoke(t, stub, "addServiceRecord", testVIN, "2018-06-01", "90000", "Oil change", testHash)
+	// records are compared by date, not by the order they were added in
+	checkInvoke(t, stub, "addServiceRecord", testVIN, "2017-01-01", "140000", "Tyres", testHash)
+
+	records := checkServiceHistory(t, stub, testVIN)
+	if len(records) != 3 || records[0].OdometerAlert || records[1].OdometerAlert {
+		fmt.Println("Records were flagged", records)
+		t.FailNow()
+	}
+	if !records[2].OdometerAlert || records[2].PreviousMileage != 150000 {
+		fmt.Println("Rolled back odometer was not flagged", records[2])
+		t.FailNow()
+	}
+}
+
+func Test_addServiceRecord_flags_the_following_record(t *testing.T) {
+	stub := newGarageStub(t)
+	checkInvoke(t, stub, "addServiceRecord", testVIN, "2017-06-01", "150000", "Oil change", testHash)
+	checkInvoke(t, stub, "addServiceRecord", testVIN, "2018-06-01", "160000", "Oil change", testHash)
+	// a backdated record can reveal that a later one was rolled back
+	checkInvoke(t, stub, "addServiceRecord", testVIN, "2018-01-01", "170000", "Tyres", testHash)
+
+	records := checkServiceHistory(t, stub, testVIN)
+	if len(records) != 3 || records[0].OdometerAlert || records[1].OdometerAlert {
+		fmt.Println("Records were flagged", records)
+		t.FailNow()
+	}
+	if !records[2].OdometerAlert || records[2].PreviousMileage != 170000 {
+		fmt.Println("Following record was not flagged", records[2])
+		t.FailNow()
+	}
+
+	// an earlier record with a lower mileage leaves the flag alone
+	checkInvoke(t, stub, "addServiceRecord", testVIN, "2018-03-01", "165000", "Brake pads", testHash)
+	records = checkServiceHistory(t, stub, testVIN)
+	if len(records) != 4 || !records[2].OdometerAlert || records[2].PreviousMileage != 170000 {
+		fmt.Println("Records were flagged", records)
+		t.FailNow()
+	}
+	if !records[3].OdometerAlert || records[3].PreviousMileage != 170000 {
+		fmt.Println("Following record was not flagged", records[3])
+		t.FailNow()
+	}
+}
+
+func Test_addServiceRecord_flags_mileage_below_the_car(t *testing.T) {
+	stub := newGarageStub(t)
+	stub.as("Org1MSP", "Registrar")
+	checkInvoke(t, stub, "createCar", "1G1RA6E44BU000011", "Chevrolet", "Volt", "white", "Tom", "2011", "80000", "VLT-1111")
+	stub.as("GarageMSP", "Mechanic")
+	checkInvoke(t, stub, "addServiceRecord", "1G1RA6E44BU000011", "2017-06-01", "60000", "Oil change", testHash)
+	checkInvoke(t, stub, "addServiceRecord", "1G1RA6E44BU000011", "2018-06-01", "90000", "Oil change", testHash)
+
+	records := checkServiceHistory(t, stub, "1G1RA6E44BU000011")
+	if len(records) != 2 || !records[0].OdometerAlert || records[0].PreviousMileage != 80000 {
+		fmt.Println("Mileage below the car's was not flagged", records)
+		t.FailNow()
+	}
+	if records[1].OdometerAlert {
+		fmt.Println("Record was flagged", records[1])
+		t.FailNow()
+	}
+}
+
+func Test_addServiceRecord_requires_authorized_garage(t *testing.T) {
+	stub := newGarageStub(t)
+	stub.as("Org2MSP", "Mechanic")
+	checkInvokeFailed(t, stub, "addServiceRecord", testVIN, "2017-06-01", "150000", "Oil change", testHash)
+	checkInvokeFailed(t, stub, "authorizeGarage", "Org2MSP")
+
+	stub.as("Org1MSP", "Admin")
+	checkInvoke(t, stub, "revokeGarage", "GarageMSP")
+	stub.as("GarageMSP", "Mechanic")
+	checkInvokeFailed(t, stub, "addServiceRecord", testVIN, "2017-06-01", "150000", "Oil change", testHash)
+
+	if len(checkServiceHistory(t, stub, testVIN)) != 0 {
+		fmt.Println("Unauthorized garage added a service record")
+		t.FailNow()
+	}
+}
+
+func Test_addServiceRecord_rejects_invalid_records(t *testing.T) {
+	stub := newGarageStub(t)
+	checkInvokeFailed(t, stub, "addServiceRecord", "1G1RA6E44BU000011", "2017-06-01", "150000", "Oil change", testHash)
+	checkInvokeFailed(t, stub, "addServiceRecord", testVIN, "01/06/2017", "150000", "Oil change", testHash)
+	checkInvokeFailed(t, stub, "addServiceRecord", testVIN, "2017-06-01", "-1", "Oil change", testHash)
+	checkInvokeFailed(t, stub, "addServiceRecord", testVIN, "2017-06-01", "150000", "", testHash)
+	checkInvokeFailed(t, stub, "addServiceRecord", testVIN, "2017-06-01", "150000", "Oil change", "invoice.pdf")
+	checkInvokeFailed(t, stub, "addServiceRecord", testVIN, "2017-06-01", "150000", "Oil change")
+
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "setCarStatus", testVIN, "scrapped")
+	stub.as("GarageMSP", "Mechanic")
+	checkInvokeFailed(t, stub, "addServiceRecord", testVIN, "2017-06-01", "150000", "Oil change", testHash)
+
+	if len(checkServiceHistory(t, stub, testVIN)) != 0 {
+		fmt.Println("Invalid service record was added")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,462 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Object type of the pending transfer keys, transfer~VIN
+const transferObjectType = "transfer"
+
+// Object type of the ownership log keys, ownership~VIN~timestamp~txID
+const ownershipObjectType = "ownership"
+
+// Events emitted when a transfer is initiated or cancelled, with the transfer offer as
+// payload. An accepted transfer emits the CarTransferred lifecycle event.
+const (
+	EventTransferInitiated = "TransferInitiated"
+	EventTransferCancelled = "TransferCancelled"
+)
+
+// Ownership log events
+const (
+	OwnershipRegistered  = "registered"
+	OwnershipTransferred = "transferred"
+)
+
+// TransferOffer is a transfer initiated by the owner of a car and waiting for the buyer
+type TransferOffer struct {
+	VIN         string `json:"vin"`
+	Seller      string `json:"seller"`
+	SellerMSP   string `json:"sellerMSP"`
+	Buyer       string `json:"buyer"`
+	BuyerMSP    string `json:"buyerMSP,omitempty"` // any MSP when empty
+	InitiatedAt int64  `json:"initiatedAt"`
+	TxID        string `json:"txID"`
+	CancelledBy string `json:"cancelledBy,omitempty"` // only set in the cancel event
+}
+
+// OwnershipRecord is an entry of the ownership log of a car
+type OwnershipRecord struct {
+	VIN              string `json:"vin"`
+	Event            string `json:"event"`
+	PreviousOwner    string `json:"previousOwner,omitempty"`
+	PreviousOwnerMSP string `json:"previousOwnerMSP,omitempty"`
+	Owner            string `json:"owner"`
+	OwnerMSP         string `json:"ownerMSP,omitempty"`
+	Timestamp        int64  `json:"timestamp"`
+	TxID             string `json:"txID"`
+}
+
+/*
+ * initiateTransfer offers a car to a buyer. The arguments are
+ *	VIN, buyer and, optionally, the buyer MSP ID
+ * Only the current owner, identified by the common name and the MSP ID of the client
+ * certificate, can initiate a transfer of a migrated car. The car is not transferred
+ * until the buyer accepts it, and only one transfer can be pending for a car.
+ */
+func (s *SmartContract) initiateTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
+	}
+	if args[1] == "" {
+		return shim.Error("Buyer must be a non-empty string")
+	}
+
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.VIN == "" {
+		return shim.Error("Car must be migrated before it can be transferred: " + args[0])
+	} else if car.Status == StatusScrapped || car.Status == StatusStolen {
+		return shim.Error("Cannot transfer a " + car.Status + " car: " + args[0])
+	}
+
+	mspID, name, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !isOwner(car, mspID, name) {
+		return shim.Error("Only the owner of car " + args[0] + " can transfer it")
+	}
+
+	offer := TransferOffer{VIN: car.VIN, Seller: name, SellerMSP: mspID, Buyer: args[1], TxID: APIstub.GetTxID()}
+	if len(args) == 3 {
+		offer.BuyerMSP = args[2]
+	}
+	if offer.Buyer == offer.Seller && (offer.BuyerMSP == "" || offer.BuyerMSP == offer.SellerMSP) {
+		return shim.Error("Cannot transfer a car to its owner")
+	}
+
+	pending, err := getTransferOffer(APIstub, car.VIN)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if pending != nil {
+		return shim.Error("A transfer to " + pending.Buyer + " is already pending for car " + args[0])
+	}
+
+	txTimestamp, err := getTxTimestamp(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offer.InitiatedAt = txTimestamp.Seconds
+
+	err = putTransferOffer(APIstub, &offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = setCarEvent(APIstub, EventTransferInitiated, &offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * acceptTransfer completes the pending transfer of a car, the only argument is the VIN.
+ * Only the buyer named when the transfer was initiated can accept it.
+ */
+func (s *SmartContract) acceptTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offer, err := getTransferOffer(APIstub, car.VIN)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if offer == nil {
+		return shim.Error("No transfer is pending for car " + args[0])
+	}
+	if car.Status == StatusScrapped || car.Status == StatusStolen {
+		return shim.Error("Cannot transfer a " + car.Status + " car: " + args[0])
+	}
+	if !isOwner(car, offer.SellerMSP, offer.Seller) {
+		return shim.Error("Seller " + offer.Seller + " no longer owns car " + args[0])
+	}
+
+	mspID, name, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if name != offer.Buyer || (offer.BuyerMSP != "" && mspID != offer.BuyerMSP) {
+		return shim.Error("Only the buyer " + offer.Buyer + " can accept the transfer of car " + args[0])
+	}
+
+	err = delCarIndexes(APIstub, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	previousOwner, previousOwnerMSP := car.Owner, car.OwnerMSP
+	car.Owner = name
+	car.OwnerMSP = mspID
+	err = putCar(APIstub, car.VIN, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putCarIndexes(APIstub, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = delTransferOffer(APIstub, car.VIN)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// policies insure an owner, the buyer must take out their own
+	err = lapsePolicies(APIstub, car.VIN)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = logOwnership(APIstub, car, OwnershipTransferred, previousOwner, previousOwnerMSP)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTimestamp, err := getTxTimestamp(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	event := CarEvent{VIN: car.VIN, Car: *car, PreviousOwner: previousOwner, PreviousOwnerMSP: previousOwnerMSP,
+		TxID: APIstub.GetTxID(), Timestamp: txTimestamp.Seconds}
+	err = setCarEvent(APIstub, EventCarTransferred, []CarEvent{event})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * cancelTransfer cancels the pending transfer of a car, the only argument is the VIN.
+ * The seller can withdraw the transfer, and the buyer can decline it.
+ */
+func (s *SmartContract) cancelTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	vin, err := normalizeVIN(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offer, err := getTransferOffer(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if offer == nil {
+		return shim.Error("No transfer is pending for car " + args[0])
+	}
+
+	mspID, name, err := getCreatorIdentity(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	isSeller := name == offer.Seller && mspID == offer.SellerMSP
+	isBuyer := name == offer.Buyer && (offer.BuyerMSP == "" || mspID == offer.BuyerMSP)
+	if !isSeller && !isBuyer {
+		return shim.Error("Only the seller or the buyer can cancel the transfer of car " + args[0])
+	}
+
+	err = delTransferOffer(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offer.CancelledBy = name
+	err = setCarEvent(APIstub, EventTransferCancelled, offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * queryTransfer returns the pending transfer of a car, the only argument is the VIN
+ */
+func (s *SmartContract) queryTransfer(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	vin, err := normalizeVIN(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	offer, err := getTransferOffer(APIstub, vin)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if offer == nil {
+		return shim.Error("No transfer is pending for car " + args[0])
+	}
+
+	offerAsBytes, err := json.Marshal(offer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(offerAsBytes)
+}
+
+/*
+ * queryOwnershipHistory returns the ownership log of a car, oldest first, as a JSON array.
+ * The only argument is the VIN.
+ */
+func (s *SmartContract) queryOwnershipHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	vin, err := normalizeVIN(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(ownershipObjectType, []string{vin})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	// buffer is a JSON array containing the ownership records
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		// Add a comma before array members, suppress it for the first array member
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(queryResponse.Value)
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	fmt.Printf("- queryOwnershipHistory:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
+}
+
+/*
+ * assignOwnerMSP records the owner MSP ID of a car registered before owner MSPs were
+ * recorded, which no client owns until then. The arguments are
+ *	VIN and owner MSP ID
+ * Only admins can assign an owner MSP, and only to a car that has none.
+ */
+func (s *SmartContract) assignOwnerMSP(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+	if args[1] == "" {
+		return shim.Error("Owner MSP ID must be a non-empty string")
+	}
+
+	err := checkAdmin(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	car, err := getCar(APIstub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if car.VIN == "" {
+		return shim.Error("Car must be migrated before its owner MSP can be assigned: " + args[0])
+	} else if car.OwnerMSP != "" {
+		return shim.Error("Car " + args[0] + " is already owned in " + car.OwnerMSP)
+	}
+
+	car.OwnerMSP = args[1]
+	err = putCar(APIstub, car.VIN, car)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+/*
+ * isOwner tells whether the client identified by mspID and name owns the car. Cars
+ * without an owner MSP are owned by nobody until an admin assigns one.
+ */
+func isOwner(car *Car, mspID string, name string) bool {
+	return car.OwnerMSP != "" && car.Owner == name && car.OwnerMSP == mspID
+}
+
+/*
+ * getTransferOffer returns the transfer pending for a car, or nil if there is none
+ */
+func getTransferOffer(APIstub shim.ChaincodeStubInterface, vin string) (*TransferOffer, error) {
+	key, err := APIstub.CreateCompositeKey(transferObjectType, []string{vin})
+	if err != nil {
+		return nil, err
+	}
+	offerAsBytes, err := APIstub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get transfer of car %s: %s", vin, err.Error())
+	} else if offerAsBytes == nil {
+		return nil, nil
+	}
+
+	offer := TransferOffer{}
+	err = json.Unmarshal(offerAsBytes, &offer)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode transfer of car %s: %s", vin, err.Error())
+	}
+	return &offer, nil
+}
+
+/*
+ * putTransferOffer saves the transfer pending for a car
+ */
+func putTransferOffer(APIstub shim.ChaincodeStubInterface, offer *TransferOffer) error {
+	key, err := APIstub.CreateCompositeKey(transferObjectType, []string{offer.VIN})
+	if err != nil {
+		return err
+	}
+	offerAsBytes, err := json.Marshal(offer)
+	if err != nil {
+		return err
+	}
+	err = APIstub.PutState(key, offerAsBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to save transfer: %s", err.Error())
+	}
+	return nil
+}
+
+/*
+ * delTransferOffer removes the transfer pending for a car
+ */
+func delTransferOffer(APIstub shim.ChaincodeStubInterface, vin string) error {
+	key, err := APIstub.CreateCompositeKey(transferObjectType, []string{vin})
+	if err != nil {
+		return err
+	}
+	err = APIstub.DelState(key)
+	if err != nil {
+		return fmt.Errorf("Failed to delete transfer of car %s: %s", vin, err.Error())
+	}
+	return nil
+}
+
+/*
+ * logOwnership appends an entry for the current owner of the car to its ownership log.
+ * Entries are keyed by transaction timestamp, so that the log lists them in order.
+ */
+func logOwnership(APIstub shim.ChaincodeStubInterface, car *Car, event string, previousOwner string, previousOwnerMSP string) error {
+	txTimestamp, err := getTxTimestamp(APIstub)
+	if err != nil {
+		return err
+	}
+	record := OwnershipRecord{VIN: car.VIN, Event: event, PreviousOwner: previousOwner, PreviousOwnerMSP: previousOwnerMSP,
+		Owner: car.Owner, OwnerMSP: car.OwnerMSP, Timestamp: txTimestamp.Seconds, TxID: APIstub.GetTxID()}
+
+	key, err := APIstub.CreateCompositeKey(ownershipObjectType,
+		[]string{car.VIN, fmt.Sprintf("%010d.%09d", txTimestamp.Seconds, txTimestamp.Nanos), record.TxID})
+	if err != nil {
+		return err
+	}
+	recordAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	err = APIstub.PutState(key, recordAsBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to save ownership of car %s: %s", car.VIN, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+/*
+ * Vehicle identification number (VIN) validation.
+ * A VIN is 17 characters long as defined by ISO 3779, digits and capital letters except
+ * I, O and Q which could be mistaken for 1 and 0. The 9th character is a check digit,
+ * computed as in the North American standard (49 CFR 565): each character is transliterated
+ * to a number, weighted by its position, and the sum modulo 11 gives the digit, 10 being X.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const vinLength = 17
+
+// vinWeights are the position weights used to compute the check digit
+var vinWeights = [vinLength]int{8, 7, 6, 5, 4, 3, 2, 10, 0, 9, 8, 7, 6, 5, 4, 3, 2}
+
+// vinValue transliterates a VIN character to the number used in the check digit computation.
+// The second value is false for characters that are not allowed in a VIN.
+func vinValue(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'A' && c <= 'H':
+		return int(c-'A') + 1, true
+	case c >= 'J' && c <= 'N':
+		return int(c-'J') + 1, true
+	case c == 'P':
+		return 7, true
+	case c == 'R':
+		return 9, true
+	case c >= 'S' && c <= 'Z':
+		return int(c-'S') + 2, true
+	}
+	return 0, false
+}
+
+// vinCheckDigit computes the check digit of a VIN that has already been checked for
+// length and allowed characters
+func vinCheckDigit(vin string) byte {
+	sum := 0
+	for i := 0; i < vinLength; i++ {
+		value, _ := vinValue(vin[i])
+		sum += value * vinWeights[i]
+	}
+	if sum%11 == 10 {
+		return 'X'
+	}
+	return byte('0' + sum%11)
+}
+
+// normalizeVIN upper-cases a VIN and checks its format and check digit
+func normalizeVIN(vin string) (string, error) {
+	vin = strings.ToUpper(strings.TrimSpace(vin))
+	if len(vin) != vinLength {
+		return "", fmt.Errorf("Invalid VIN %s: must be %d characters long", vin, vinLength)
+	}
+	for i := 0; i < vinLength; i++ {
+		if _, ok := vinValue(vin[i]); !ok {
+			return "", fmt.Errorf("Invalid VIN %s: character %q at position %d is not allowed", vin, vin[i], i+1)
+		}
+	}
+	if expected := vinCheckDigit(vin); vin[8] != expected {
+		return "", fmt.Errorf("Invalid VIN %s: check digit is %c, expected %c", vin, vin[8], expected)
+	}
+	return vin, nil
+}
@@ -0,0 +1,70 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_normalizeVIN_accepts_valid_VINs(t *testing.T) {
+	for vin, expected := range map[string]string{
+		"1HGCM82633A004352":   "1HGCM82633A004352",
+		"1hgcm82633a004352":   "1HGCM82633A004352",
+		" 6G1TB2ABXCL000010 ": "6G1TB2ABXCL000010",
+		"ZFA18800X00000008":   "ZFA18800X00000008",
+	} {
+		normalized, err := normalizeVIN(vin)
+		if err != nil {
+			fmt.Println("VIN", vin, "was rejected:", err)
+			t.FailNow()
+		}
+		if normalized != expected {
+			fmt.Println("VIN", vin, "was normalized to", normalized, "and not", expected)
+			t.FailNow()
+		}
+	}
+}
+
+func Test_normalizeVIN_rejects_invalid_VINs(t *testing.T) {
+	for _, vin := range []string{
+		"",                   // empty
+		"CAR0",               // legacy key
+		"1HGCM82633A00435",   // too short
+		"1HGCM82633A0043522", // too long
+		"1HGCM82633A00435I",  // I is not allowed
+		"1HGCM82633A00435O",  // O is not allowed
+		"1HGCQ82633A004352",  // Q is not allowed
+		"1HGCM82643A004352",  // wrong check digit
+		"1HGCM826-3A004352",  // punctuation
+	} {
+		if _, err := normalizeVIN(vin); err == nil {
+			fmt.Println("VIN", vin, "was accepted but is invalid")
+			t.FailNow()
+		}
+	}
+}
+
+func Test_vinCheckDigit_can_be_X(t *testing.T) {
+	if vinCheckDigit("6G1TB2ABXCL000010") != 'X' {
+		fmt.Println("Check digit of 6G1TB2ABXCL000010 is not X")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// configIndex holds chaincode configuration entries, such as the admin MSP IDs set at Init
+const configIndex = "config~name"
+
+// =========================================================================================
+// getCreatorIdentity returns the MSP ID and the certificate common name of the client
+// that submitted the transaction
+// =========================================================================================
+func getCreatorIdentity(stub shim.ChaincodeStubInterface) (string, string, error) {
+	creator, err := stub.GetCreator()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to get creator: %s", err.Error())
+	}
+
+	serializedID := &msp.SerializedIdentity{}
+	err = proto.Unmarshal(creator, serializedID)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to decode creator: %s", err.Error())
+	}
+
+	block, _ := pem.Decode(serializedID.IdBytes)
+	if block == nil {
+		return "", "", errors.New("Failed to decode creator certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to parse creator certificate: %s", err.Error())
+	}
+
+	return serializedID.Mspid, cert.Subject.CommonName, nil
+}
+
+// =========================================================================================
+// getTxTimestampSeconds returns the transaction timestamp, in seconds since epoch.
+// The timestamp is set by the client and is the same on every endorser, which makes it
+// safe to use where wall clock time would break endorsement determinism.
+// =========================================================================================
+func getTxTimestampSeconds(stub shim.ChaincodeStubInterface) (int64, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get transaction timestamp: %s", err.Error())
+	} else if txTimestamp == nil {
+		return 0, errors.New("Transaction timestamp is not available")
+	}
+	return txTimestamp.Seconds, nil
+}
+
+// =========================================================================================
+// setAdminMSPs stores the MSP IDs whose members may run admin operations
+// =========================================================================================
+func setAdminMSPs(stub shim.ChaincodeStubInterface, mspIDs []string) error {
+	adminKey, err := stub.CreateCompositeKey(configIndex, []string{"adminMSPs"})
+	if err != nil {
+		return err
+	}
+	mspIDsAsBytes, err := json.Marshal(mspIDs)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(adminKey, mspIDsAsBytes)
+}
+
+// =========================================================================================
+// checkAdmin returns an error unless the client belongs to one of the admin MSPs
+// =========================================================================================
+func checkAdmin(stub shim.ChaincodeStubInterface) error {
+	adminKey, err := stub.CreateCompositeKey(configIndex, []string{"adminMSPs"})
+	if err != nil {
+		return err
+	}
+	mspIDsAsBytes, err := stub.GetState(adminKey)
+	if err != nil {
+		return fmt.Errorf("Failed to get admin configuration: %s", err.Error())
+	} else if mspIDsAsBytes == nil {
+		return errors.New("No admin MSP configured, instantiate the chaincode with the admin MSP IDs")
+	}
+
+	var adminMSPs []string
+	err = json.Unmarshal(mspIDsAsBytes, &adminMSPs)
+	if err != nil {
+		return fmt.Errorf("Failed to decode admin configuration: %s", err.Error())
+	}
+
+	mspID, _, err := getCreatorIdentity(stub)
+	if err != nil {
+		return err
+	}
+	for _, adminMSP := range adminMSPs {
+		if mspID == adminMSP {
+			return nil
+		}
+	}
+	return fmt.Errorf("Client from %s is not allowed to run admin operations", mspID)
+}
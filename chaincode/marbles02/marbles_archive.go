@@ -0,0 +1,243 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// archiveRetention is how long, in seconds, an archived marble can still be restored
+const archiveRetention = 30 * 24 * 60 * 60
+
+// tombstoneIndex lists archived marbles. Each entry stores the archive timestamp as its
+// value so purgeArchived can find expired marbles without reading them.
+const tombstoneIndex = "archived~name"
+
+// archiveRecord is attached to a marble when it is soft deleted
+type archiveRecord struct {
+	Reason       string `json:"reason"`
+	DeletedBy    string `json:"deletedBy"`    //common name of the client certificate
+	DeletedByMSP string `json:"deletedByMSP"` //MSP ID of the client
+	ArchivedAt   int64  `json:"archivedAt"`   //transaction timestamp, in seconds since epoch
+}
+
+// ===========================================================================
+// restoreMarble - bring back an archived marble within the retention window.
+// Only the identity that archived the marble or an admin may restore it.
+// ===========================================================================
+func (t *SimpleChaincode) restoreMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	var req marbleNameRequest
+
+	//   0
+	// "name"
+	// or {"name":"name"}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marbleName := req.Name
+	fmt.Println("- start restoreMarble ", marbleName)
+
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return shim.Error("Failed to get marble:" + err.Error())
+	} else if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist: " + marbleName)
+	}
+
+	marbleToRestore := marble{}
+	err = json.Unmarshal(marbleAsBytes, &marbleToRestore)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marbleToRestore.Archived == nil {
+		return shim.Error("Marble is not archived: " + marbleName)
+	}
+
+	mspID, subject, err := getCreatorIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if mspID != marbleToRestore.Archived.DeletedByMSP || subject != marbleToRestore.Archived.DeletedBy {
+		err = checkAdmin(stub)
+		if err != nil {
+			return shim.Error("Only the client that archived the marble or an admin may restore it: " + err.Error())
+		}
+	}
+
+	now, err := getTxTimestampSeconds(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now-marbleToRestore.Archived.ArchivedAt > archiveRetention {
+		return shim.Error("Retention window has expired for marble: " + marbleName)
+	}
+
+	marbleToRestore.Archived = nil
+	marbleJSONasBytes, err := json.Marshal(marbleToRestore)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(marbleName, marbleJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the marble is visible again, so put it back in the indexes and drop the tombstone
+	err = putMarbleIndexes(stub, &marbleToRestore)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = delTombstone(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end restoreMarble (success)")
+	return shim.Success(nil)
+}
+
+// ===========================================================================================
+// purgeArchived - admin operation that permanently deletes archived marbles.
+// Without arguments, every archived marble whose retention window has expired is purged.
+// When marble names are given, those marbles are purged right away, they must be archived.
+// ===========================================================================================
+func (t *SimpleChaincode) purgeArchived(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	var req purgeArchivedRequest
+
+	//      0..n
+	// ["name", ...]
+	// or {"names":["name", ...]}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var purged int
+	if len(req.Names) > 0 {
+		for _, marbleName := range req.Names {
+			marbleAsBytes, err := stub.GetState(marbleName)
+			if err != nil {
+				return shim.Error("Failed to get marble:" + err.Error())
+			} else if marbleAsBytes == nil {
+				return shim.Error("Marble does not exist: " + marbleName)
+			} else if !isArchived(marbleAsBytes) {
+				return shim.Error("Marble is not archived: " + marbleName)
+			}
+
+			err = purgeMarble(stub, marbleName)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			purged++
+		}
+	} else {
+		now, err := getTxTimestampSeconds(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// Walk the tombstones, the archive timestamp is stored as the entry value
+		tombstoneIterator, err := stub.GetStateByPartialCompositeKey(tombstoneIndex, []string{})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer tombstoneIterator.Close()
+
+		for tombstoneIterator.HasNext() {
+			responseRange, err := tombstoneIterator.Next()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			archivedAt, err := strconv.ParseInt(string(responseRange.Value), 10, 64)
+			if err != nil {
+				return shim.Error("Invalid tombstone for marble " + compositeKeyParts[0] + ": " + err.Error())
+			}
+			if now-archivedAt <= archiveRetention {
+				continue
+			}
+
+			err = purgeMarble(stub, compositeKeyParts[0])
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			purged++
+		}
+	}
+
+	responsePayload := fmt.Sprintf("Purged %d archived marbles", purged)
+	fmt.Println("- end purgeArchived: " + responsePayload)
+	return shim.Success([]byte(responsePayload))
+}
+
+// =========================================================================================
+// purgeMarble removes an archived marble and its tombstone from state.
+// Index entries were already removed when the marble was archived.
+// =========================================================================================
+func purgeMarble(stub shim.ChaincodeStubInterface, marbleName string) error {
+	err := stub.DelState(marbleName)
+	if err != nil {
+		return fmt.Errorf("Failed to delete state: %s", err.Error())
+	}
+	return delTombstone(stub, marbleName)
+}
+
+// =========================================================================================
+// isArchived reports whether the marble JSON has been soft deleted.
+// Only the archived field is decoded.
+// =========================================================================================
+func isArchived(marbleAsBytes []byte) bool {
+	var m struct {
+		Archived *archiveRecord `json:"archived"`
+	}
+	err := json.Unmarshal(marbleAsBytes, &m)
+	return err == nil && m.Archived != nil
+}
+
+func putTombstone(stub shim.ChaincodeStubInterface, marbleName string, archivedAt int64) error {
+	tombstoneKey, err := stub.CreateCompositeKey(tombstoneIndex, []string{marbleName})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(tombstoneKey, []byte(strconv.FormatInt(archivedAt, 10)))
+}
+
+func delTombstone(stub shim.ChaincodeStubInterface, marbleName string) error {
+	tombstoneKey, err := stub.CreateCompositeKey(tombstoneIndex, []string{marbleName})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(tombstoneKey)
+}
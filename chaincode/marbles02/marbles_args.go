@@ -0,0 +1,323 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Every marbles function accepts its arguments in two forms:
+//
+//   positional, as in the CLI samples:  '{"Args":["transferMarble","marble2","jerry"]}'
+//   named, as a single JSON object:      '{"Args":["transferMarble","{\"name\":\"marble2\",\"newOwner\":\"jerry\"}"]}'
+//
+// Both forms are decoded into the request struct of the function and validated from its
+// struct tags, so error messages name the offending field:
+//
+//   json:"name"          the field name, used in the named form and in error messages
+//   arg:"optional"       the field may be left out of the positional form, fields after it must be optional too
+//   validate:"required"  the value must not be empty
+//   validate:"min=N"     a number must be at least N
+//
+// Positional arguments are taken in field order. A trailing []string field collects all
+// remaining positional arguments. Other non-scalar fields are passed as a JSON string.
+
+// namedFormChecker is implemented by requests whose positional form can itself be a single
+// JSON object, to tell the named form apart
+type namedFormChecker interface {
+	isNamedForm(fields map[string]json.RawMessage) bool
+}
+
+type initMarbleRequest struct {
+	Name  string `json:"name" validate:"required"`
+	Color string `json:"color" validate:"required"`
+	Size  int    `json:"size"`
+	Owner string `json:"owner" validate:"required"`
+}
+
+type initMarblesRequest struct {
+	Marbles      []json.RawMessage `json:"marbles" validate:"required"` //entries are decoded and validated one by one, see initMarbles
+	AllOrNothing bool              `json:"allOrNothing" arg:"optional"`
+}
+
+type marbleNameRequest struct {
+	Name string `json:"name" validate:"required"`
+}
+
+type deleteMarbleRequest struct {
+	Name   string `json:"name" validate:"required"`
+	Reason string `json:"reason" arg:"optional"`
+}
+
+type purgeArchivedRequest struct {
+	Names []string `json:"names"`
+}
+
+type lockMarbleRequest struct {
+	Name     string `json:"name" validate:"required"`
+	Holder   string `json:"holder" validate:"required"`
+	Duration int64  `json:"duration" arg:"optional" validate:"min=0"` //seconds, 0 for a lock that never expires
+}
+
+type transferMarbleRequest struct {
+	Name     string `json:"name" validate:"required"`
+	NewOwner string `json:"newOwner" validate:"required"`
+}
+
+type transferMarblesBasedOnColorRequest struct {
+	Color    string `json:"color" validate:"required"`
+	NewOwner string `json:"newOwner" validate:"required"`
+}
+
+type marblesByRangeRequest struct {
+	StartKey string `json:"startKey"`
+	EndKey   string `json:"endKey"`
+}
+
+type ownerStatsRequest struct {
+	Owner string `json:"owner" arg:"optional"`
+}
+
+type colorStatsRequest struct {
+	Color string `json:"color" arg:"optional"`
+}
+
+type colorOwnerStatsRequest struct {
+	Color string `json:"color" arg:"optional"`
+	Owner string `json:"owner" arg:"optional"`
+}
+
+type reindexMarblesRequest struct {
+	StartKey  string `json:"startKey" arg:"optional"`
+	BatchSize int64  `json:"batchSize" arg:"optional" validate:"min=0"` //0 for the default batch size
+}
+
+type ownerRequest struct {
+	Owner string `json:"owner" validate:"required"`
+}
+
+type queryMarblesRequest struct {
+	Query string `json:"query" validate:"required"`
+}
+
+// isNamedForm tells a named request apart from a CouchDB query, which is a JSON object too
+func (r *queryMarblesRequest) isNamedForm(fields map[string]json.RawMessage) bool {
+	_, ok := fields["query"]
+	return ok
+}
+
+// =========================================================================================
+// parseArgs decodes args, in either the positional or the named form, into the request
+// struct pointed to by req and validates it
+// =========================================================================================
+func parseArgs(args []string, req interface{}) error {
+	v := reflect.ValueOf(req).Elem()
+
+	if len(args) == 1 && strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		var fields map[string]json.RawMessage
+		err := json.Unmarshal([]byte(args[0]), &fields)
+		if err == nil {
+			checker, ok := req.(namedFormChecker)
+			if !ok || checker.isNamedForm(fields) {
+				err = decodeNamedArgs(fields, v)
+				if err != nil {
+					return err
+				}
+				return validateArgs(v)
+			}
+		}
+	}
+
+	err := decodePositionalArgs(args, v)
+	if err != nil {
+		return err
+	}
+	return validateArgs(v)
+}
+
+func decodeNamedArgs(fields map[string]json.RawMessage, v reflect.Value) error {
+	t := v.Type()
+	known := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name := argName(t.Field(i))
+		known[name] = true
+
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		err := setFieldFromJSON(v.Field(i), name, raw)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name := range fields {
+		if !known[name] {
+			return fmt.Errorf("Unknown argument %s, expecting %s", name, argsUsage(t))
+		}
+	}
+	return nil
+}
+
+func decodePositionalArgs(args []string, v reflect.Value) error {
+	t := v.Type()
+	n := t.NumField()
+	variadic := n > 0 && t.Field(n-1).Type == reflect.TypeOf([]string{})
+
+	// arguments before the first optional (or variadic) field are mandatory
+	min := n
+	for i := 0; i < n; i++ {
+		if t.Field(i).Tag.Get("arg") == "optional" || (variadic && i == n-1) {
+			min = i
+			break
+		}
+	}
+	if len(args) < min || (!variadic && len(args) > n) {
+		return fmt.Errorf("Incorrect number of arguments. Expecting %s", argsUsage(t))
+	}
+
+	for i, arg := range args {
+		if variadic && i >= n-1 {
+			last := v.Field(n - 1)
+			last.Set(reflect.Append(last, reflect.ValueOf(arg)))
+			continue
+		}
+		err := setFieldFromString(v.Field(i), argName(t.Field(i)), arg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFieldFromJSON decodes a named argument. Scalars may also be given as JSON strings,
+// so "35" and 35 are both accepted for a number.
+func setFieldFromJSON(field reflect.Value, name string, raw json.RawMessage) error {
+	if len(raw) > 0 && raw[0] == '"' {
+		var str string
+		err := json.Unmarshal(raw, &str)
+		if err != nil {
+			return fmt.Errorf("%s must be a string", name)
+		}
+		return setFieldFromString(field, name, str)
+	}
+	if field.Kind() == reflect.String {
+		return fmt.Errorf("%s must be a string", name)
+	}
+
+	err := json.Unmarshal(raw, field.Addr().Interface())
+	if err != nil {
+		return fmt.Errorf("%s must be %s", name, kindDescription(field.Kind()))
+	}
+	return nil
+}
+
+// setFieldFromString converts a positional argument to the type of its field
+func setFieldFromString(field reflect.Value, name string, str string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(str)
+	case reflect.Int, reflect.Int64:
+		number, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s must be a numeric string", name)
+		}
+		field.SetInt(number)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("%s must be a boolean", name)
+		}
+		field.SetBool(b)
+	default:
+		err := json.Unmarshal([]byte(str), field.Addr().Interface())
+		if err != nil {
+			return fmt.Errorf("%s must be %s: %s", name, kindDescription(field.Kind()), err.Error())
+		}
+	}
+	return nil
+}
+
+// validateArgs applies the validate struct tags of the request
+func validateArgs(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := argName(t.Field(i))
+		field := v.Field(i)
+
+		for _, rule := range strings.Split(t.Field(i).Tag.Get("validate"), ",") {
+			switch {
+			case rule == "required":
+				if field.Kind() == reflect.String && field.Len() == 0 {
+					return fmt.Errorf("%s must be a non-empty string", name)
+				}
+				if field.Kind() == reflect.Slice && field.Len() == 0 {
+					return fmt.Errorf("%s must not be empty", name)
+				}
+			case strings.HasPrefix(rule, "min="):
+				min, err := strconv.ParseInt(strings.TrimPrefix(rule, "min="), 10, 64)
+				if err != nil {
+					return fmt.Errorf("Invalid validation rule %s for %s", rule, name)
+				}
+				if field.Int() < min {
+					return fmt.Errorf("%s must be at least %d", name, min)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func argName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// argsUsage lists the positional arguments of a request, e.g. "name, [reason]"
+func argsUsage(t reflect.Type) string {
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := argName(t.Field(i))
+		if t.Field(i).Type == reflect.TypeOf([]string{}) && i == t.NumField()-1 {
+			name = "[" + name + "...]"
+		} else if t.Field(i).Tag.Get("arg") == "optional" {
+			name = "[" + name + "]"
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func kindDescription(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int, reflect.Int64:
+		return "a number"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice:
+		return "a JSON array"
+	default:
+		return "a JSON object"
+	}
+}
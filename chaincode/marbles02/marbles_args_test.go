@@ -0,0 +1,148 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		req      interface{} //a pointer to the zero request the arguments are decoded into
+		expected interface{} //the decoded request, when no error is expected
+		err      string      //the start of the expected error message
+	}{
+		{"positional", []string{"asdf", "blue", "35", "bob"}, &initMarbleRequest{},
+			&initMarbleRequest{Name: "asdf", Color: "blue", Size: 35, Owner: "bob"}, ""},
+		{"named", []string{`{"name":"asdf","color":"blue","size":35,"owner":"bob"}`}, &initMarbleRequest{},
+			&initMarbleRequest{Name: "asdf", Color: "blue", Size: 35, Owner: "bob"}, ""},
+		{"named with a number as string", []string{` {"owner":"bob","size":"35","color":"blue","name":"asdf"}`}, &initMarbleRequest{},
+			&initMarbleRequest{Name: "asdf", Color: "blue", Size: 35, Owner: "bob"}, ""},
+		{"too few positional", []string{"asdf", "blue", "35"}, &initMarbleRequest{},
+			nil, "Incorrect number of arguments. Expecting name, color, size, owner"},
+		{"too many positional", []string{"asdf", "blue", "35", "bob", "extra"}, &initMarbleRequest{},
+			nil, "Incorrect number of arguments. Expecting name, color, size, owner"},
+		{"empty positional", []string{"asdf", "", "35", "bob"}, &initMarbleRequest{},
+			nil, "color must be a non-empty string"},
+		{"missing named", []string{`{"name":"asdf","color":"blue","size":35}`}, &initMarbleRequest{},
+			nil, "owner must be a non-empty string"},
+		{"unknown named", []string{`{"name":"asdf","colour":"blue","size":35,"owner":"bob"}`}, &initMarbleRequest{},
+			nil, "Unknown argument colour, expecting name, color, size, owner"},
+		{"invalid positional number", []string{"asdf", "blue", "big", "bob"}, &initMarbleRequest{},
+			nil, "size must be a numeric string"},
+		{"invalid named number", []string{`{"name":"asdf","color":"blue","size":true,"owner":"bob"}`}, &initMarbleRequest{},
+			nil, "size must be a number"},
+		{"invalid named string", []string{`{"name":35,"color":"blue","size":35,"owner":"bob"}`}, &initMarbleRequest{},
+			nil, "name must be a string"},
+		{"malformed JSON is positional", []string{`{"name":`}, &marbleNameRequest{},
+			&marbleNameRequest{Name: `{"name":`}, ""},
+
+		{"optional left out", []string{"marble1"}, &deleteMarbleRequest{},
+			&deleteMarbleRequest{Name: "marble1"}, ""},
+		{"optional given", []string{"marble1", "created by mistake"}, &deleteMarbleRequest{},
+			&deleteMarbleRequest{Name: "marble1", Reason: "created by mistake"}, ""},
+		{"optional named", []string{`{"name":"marble1"}`}, &deleteMarbleRequest{},
+			&deleteMarbleRequest{Name: "marble1"}, ""},
+		{"too many with optional", []string{"marble1", "reason", "extra"}, &deleteMarbleRequest{},
+			nil, "Incorrect number of arguments. Expecting name, [reason]"},
+		{"no arguments", []string{}, &deleteMarbleRequest{},
+			nil, "Incorrect number of arguments. Expecting name, [reason]"},
+		{"all optional", []string{}, &colorOwnerStatsRequest{},
+			&colorOwnerStatsRequest{}, ""},
+
+		{"minimum", []string{"marble1", "loan-42", "0"}, &lockMarbleRequest{},
+			&lockMarbleRequest{Name: "marble1", Holder: "loan-42"}, ""},
+		{"below minimum", []string{"marble1", "loan-42", "-1"}, &lockMarbleRequest{},
+			nil, "duration must be at least 0"},
+		{"below minimum named", []string{`{"name":"marble1","holder":"loan-42","duration":-60}`}, &lockMarbleRequest{},
+			nil, "duration must be at least 0"},
+
+		{"variadic empty", []string{}, &purgeArchivedRequest{},
+			&purgeArchivedRequest{}, ""},
+		{"variadic", []string{"marble1", "marble2"}, &purgeArchivedRequest{},
+			&purgeArchivedRequest{Names: []string{"marble1", "marble2"}}, ""},
+		{"variadic named", []string{`{"names":["marble1"]}`}, &purgeArchivedRequest{},
+			&purgeArchivedRequest{Names: []string{"marble1"}}, ""},
+		{"variadic named not an array", []string{`{"names":{"name":"marble1"}}`}, &purgeArchivedRequest{},
+			nil, "names must be a JSON array"},
+
+		{"JSON positional", []string{`[{"name":"a","color":"blue","size":1,"owner":"bob"}]`, "true"}, &initMarblesRequest{},
+			&initMarblesRequest{Marbles: []json.RawMessage{json.RawMessage(`{"name":"a","color":"blue","size":1,"owner":"bob"}`)}, AllOrNothing: true}, ""},
+		{"JSON positional named", []string{`{"marbles":[{"name":"a","color":"blue","size":1,"owner":"bob"}]}`}, &initMarblesRequest{},
+			&initMarblesRequest{Marbles: []json.RawMessage{json.RawMessage(`{"name":"a","color":"blue","size":1,"owner":"bob"}`)}}, ""},
+		{"invalid JSON positional", []string{`[{"name":"a"`}, &initMarblesRequest{},
+			nil, "marbles must be a JSON array: "},
+		{"empty JSON positional", []string{`[]`}, &initMarblesRequest{},
+			nil, "marbles must not be empty"},
+		{"invalid boolean", []string{`[{"name":"a"}]`, "yes"}, &initMarblesRequest{},
+			nil, "allOrNothing must be a boolean"},
+
+		{"query positional", []string{`{"selector":{"owner":"tom"}}`}, &queryMarblesRequest{},
+			&queryMarblesRequest{Query: `{"selector":{"owner":"tom"}}`}, ""},
+		{"query named", []string{`{"query":"{\"selector\":{}}"}`}, &queryMarblesRequest{},
+			&queryMarblesRequest{Query: `{"selector":{}}`}, ""},
+	}
+
+	for _, test := range tests {
+		err := parseArgs(test.args, test.req)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				fmt.Println(test.name, ": parseArgs", test.args, "returned", err, "and not", test.err, "as expected")
+				t.FailNow()
+			}
+			continue
+		}
+		if err != nil {
+			fmt.Println(test.name, ": parseArgs", test.args, "failed", err)
+			t.FailNow()
+		}
+		if !reflect.DeepEqual(test.req, test.expected) {
+			fmt.Printf("%s : parseArgs %v decoded %+v and not %+v as expected\n", test.name, test.args, test.req, test.expected)
+			t.FailNow()
+		}
+	}
+}
+
+func TestParseArgs_Usage(t *testing.T) {
+	tests := []struct {
+		req   interface{}
+		usage string
+	}{
+		{initMarbleRequest{}, "name, color, size, owner"},
+		{initMarblesRequest{}, "marbles, [allOrNothing]"},
+		{lockMarbleRequest{}, "name, holder, [duration]"},
+		{purgeArchivedRequest{}, "[names...]"},
+		{reindexMarblesRequest{}, "[startKey], [batchSize]"},
+	}
+
+	for _, test := range tests {
+		usage := argsUsage(reflect.TypeOf(test.req))
+		if usage != test.usage {
+			fmt.Printf("Usage of %T was %s and not %s as expected\n", test.req, usage, test.usage)
+			t.FailNow()
+		}
+	}
+}
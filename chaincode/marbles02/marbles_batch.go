@@ -0,0 +1,151 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// marbleResult is the outcome of one initMarbles entry
+type marbleResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` //"created", "failed", or "rolledBack" when all-or-nothing aborted the batch
+	Error  string `json:"error,omitempty"`
+}
+
+// ===================================================================================
+// initMarbles - create many marbles in one transaction.
+// Each entry is a JSON object decoded and validated with the same rules as the named
+// form of initMarble, and saved with its index entries. An entry which can not be
+// decoded fails on its own, like an invalid one. The response is a JSON array with the status of every entry.
+// By default valid entries are created and invalid ones are reported as failed.
+// With all-or-nothing set, any failure fails the whole transaction and the statuses
+// are returned in the error message instead, so that nothing is written.
+// ===================================================================================
+func (t *SimpleChaincode) initMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	var req initMarblesRequest
+
+	//            0                       1
+	// "[{"name":"asdf",...}]", ["true"|"false"]
+	// or {"marbles":[{"name":"asdf",...}],"allOrNothing":true}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	inputs := req.Marbles
+	allOrNothing := req.AllOrNothing
+	fmt.Printf("- start initMarbles, %d marbles\n", len(inputs))
+
+	// Writes are not visible to reads within the same transaction, so duplicated
+	// names inside the batch are tracked here rather than through GetState. Every
+	// entry is checked before anything is written, so that a batch rejected by
+	// all-or-nothing writes nothing.
+	results := make([]marbleResult, len(inputs))
+	marbles := make([]*marble, len(inputs))
+	seen := make(map[string]bool)
+	var failed int
+	for i, input := range inputs {
+		name, marble, err := newMarbleFromEntry(input)
+		results[i].Name = name
+		if err == nil && seen[marble.Name] {
+			err = fmt.Errorf("Duplicate marble in batch: %s", marble.Name)
+		}
+		if err == nil {
+			seen[marble.Name] = true
+			err = checkMarbleAbsent(stub, marble.Name)
+		}
+		if err != nil {
+			results[i].Status = "failed"
+			results[i].Error = err.Error()
+			failed++
+			continue
+		}
+		marbles[i] = marble
+		results[i].Status = "created"
+	}
+
+	if allOrNothing && failed > 0 {
+		for i := range results {
+			if results[i].Status == "created" {
+				results[i].Status = "rolledBack"
+			}
+		}
+	} else {
+		for _, marble := range marbles {
+			if marble == nil {
+				continue
+			}
+			// a write failure fails the transaction, a marble must not be left half indexed
+			err = createMarble(stub, marble)
+			if err != nil {
+				return shim.Error(fmt.Sprintf("Failed to create marble %s: %s", marble.Name, err.Error()))
+			}
+		}
+	}
+
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if allOrNothing && failed > 0 {
+		return shim.Error(fmt.Sprintf("%d of %d marbles failed, none were created: %s", failed, len(inputs), resultsAsBytes))
+	}
+
+	fmt.Printf("- end initMarbles, %d created, %d failed\n", len(inputs)-failed, failed)
+	return shim.Success(resultsAsBytes)
+}
+
+// =========================================================================================
+// newMarbleFromEntry applies the initMarble input rules to a batch entry. The name of
+// the marble is returned along with the error of an invalid entry, if it could be read.
+// =========================================================================================
+func newMarbleFromEntry(entry json.RawMessage) (string, *marble, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(entry, &fields)
+	if err != nil || fields == nil {
+		return "", nil, errors.New("Marble must be a JSON object")
+	}
+
+	var input initMarbleRequest
+	v := reflect.ValueOf(&input).Elem()
+	err = decodeNamedArgs(fields, v)
+	if err == nil {
+		err = validateArgs(v)
+	}
+	if err != nil {
+		return input.Name, nil, err
+	}
+
+	return input.Name, &marble{
+		ObjectType: "marble",
+		Name:       input.Name,
+		Color:      strings.ToLower(input.Color),
+		Size:       input.Size,
+		Owner:      strings.ToLower(input.Owner),
+	}, nil
+}
@@ -23,14 +23,29 @@ under the License.
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble1","blue","35","tom"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble2","red","50","tom"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble3","blue","70","tom"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarbles","[{\"name\":\"marble4\",\"color\":\"red\",\"size\":20,\"owner\":\"tom\"},{\"name\":\"marble5\",\"color\":\"green\",\"size\":25,\"owner\":\"jerry\"}]","true"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarble","marble2","jerry"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarble","{\"name\":\"marble2\",\"newOwner\":\"jerry\"}"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColor","blue","jerry"]}'
-// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["delete","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["delete","marble1","created by mistake"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["restoreMarble","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["purgeArchived"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["lockMarble","marble2","loan-42","86400"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["unlockMarble","marble2"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["reindexMarbles"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["reindexMarbles","marble2","500"]}'
+
+// ==== Instantiate with the MSP IDs allowed to run admin operations (purgeArchived) ====
+// peer chaincode instantiate -C myc1 -n marbles -v 1.0 -c '{"Args":["init","Org1MSP"]}'
 
 // ==== Query marbles ====
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["readMarble","marble1"]}'
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarblesByRange","marble1","marble3"]}'
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarbleStatsByOwner"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarbleStatsByOwner","tom"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarbleStatsByColor","blue"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarbleStatsByColorAndOwner","blue","tom"]}'
 
 // Rich Query (Only supported if CouchDB is used as state database):
 //   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesByOwner","tom"]}'
@@ -78,9 +93,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -91,13 +108,44 @@ type SimpleChaincode struct {
 }
 
 type marble struct {
-	ObjectType string `json:"docType"` //docType is used to distinguish the various types of objects in state database
-	Name       string `json:"name"`    //the fieldtags are needed to keep case from bouncing around
-	Color      string `json:"color"`
-	Size       int    `json:"size"`
-	Owner      string `json:"owner"`
+	ObjectType string         `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Name       string         `json:"name"`    //the fieldtags are needed to keep case from bouncing around
+	Color      string         `json:"color"`
+	Size       int            `json:"size"`
+	Owner      string         `json:"owner"`
+	Archived   *archiveRecord `json:"archived,omitempty"` //set when the marble has been soft deleted
+	Lock       *marbleLock    `json:"lock,omitempty"`     //set while the marble is held
+}
+
+// marbleStats is one row of an aggregated statistics query. Color and Owner are only
+// set when the statistics are grouped by that field.
+type marbleStats struct {
+	Color     string `json:"color,omitempty"`
+	Owner     string `json:"owner,omitempty"`
+	Count     int    `json:"count"`
+	TotalSize int    `json:"totalSize"`
 }
 
+// marbleStatsList sorts statistics rows by color, then owner
+type marbleStatsList []marbleStats
+
+func (l marbleStatsList) Len() int      { return len(l) }
+func (l marbleStatsList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l marbleStatsList) Less(i, j int) bool {
+	if l[i].Color != l[j].Color {
+		return l[i].Color < l[j].Color
+	}
+	return l[i].Owner < l[j].Owner
+}
+
+// colorOwnerIndex is the composite key index used by the statistics queries.
+// Each entry stores the marble size as its value so aggregates can be computed
+// from the index alone, without reading the marbles themselves.
+const colorOwnerIndex = "color~owner~name"
+
+// defaultReindexBatchSize is the number of marbles reindexMarbles indexes per transaction by default
+const defaultReindexBatchSize = 500
+
 // ===================================================================================
 // Main
 // ===================================================================================
@@ -109,8 +157,37 @@ func main() {
 }
 
 // Init initializes chaincode
+// The optional arguments are the MSP IDs whose members may run admin operations.
+// When none are given the current admin configuration is kept, e.g. on upgrade.
+// On an empty ledger the color~owner~name index is complete from the start. On upgrade of a
+// ledger holding marbles created before the statistics queries existed, the index stays
+// incomplete until reindexMarbles has run through every marble.
 // ===========================
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	if len(args) > 0 {
+		err := setAdminMSPs(stub, args)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	indexed, err := isColorOwnerIndexed(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !indexed {
+		_, nextKey, err := indexMarbles(stub, "", 0)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if nextKey == "" {
+			err = setColorOwnerIndexed(stub)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
 	return shim.Success(nil)
 }
 
@@ -123,12 +200,22 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	// Handle different functions
 	if function == "initMarble" { //create a new marble
 		return t.initMarble(stub, args)
+	} else if function == "initMarbles" { //create a batch of new marbles
+		return t.initMarbles(stub, args)
 	} else if function == "transferMarble" { //change owner of a specific marble
 		return t.transferMarble(stub, args)
 	} else if function == "transferMarblesBasedOnColor" { //transfer all marbles of a certain color
 		return t.transferMarblesBasedOnColor(stub, args)
-	} else if function == "delete" { //delete a marble
+	} else if function == "delete" { //archive a marble (soft delete)
 		return t.delete(stub, args)
+	} else if function == "restoreMarble" { //restore an archived marble
+		return t.restoreMarble(stub, args)
+	} else if function == "purgeArchived" { //permanently remove archived marbles
+		return t.purgeArchived(stub, args)
+	} else if function == "lockMarble" { //hold a marble so it cannot be transferred or deleted
+		return t.lockMarble(stub, args)
+	} else if function == "unlockMarble" { //release a hold on a marble
+		return t.unlockMarble(stub, args)
 	} else if function == "readMarble" { //read a marble
 		return t.readMarble(stub, args)
 	} else if function == "queryMarblesByOwner" { //find marbles for owner X using rich query
@@ -139,6 +226,14 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.getHistoryForMarble(stub, args)
 	} else if function == "getMarblesByRange" { //get marbles based on range query
 		return t.getMarblesByRange(stub, args)
+	} else if function == "getMarbleStatsByOwner" { //count and total size of marbles per owner
+		return t.getMarbleStatsByOwner(stub, args)
+	} else if function == "getMarbleStatsByColor" { //count and total size of marbles per color
+		return t.getMarbleStatsByColor(stub, args)
+	} else if function == "getMarbleStatsByColorAndOwner" { //count and total size of marbles per color/owner pair
+		return t.getMarbleStatsByColorAndOwner(stub, args)
+	} else if function == "reindexMarbles" { //backfill the statistics index after an upgrade
+		return t.reindexMarbles(stub, args)
 	}
 
 	fmt.Println("invoke did not find func: " + function) //error
@@ -149,60 +244,60 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 // initMarble - create a new marble, store into chaincode state
 // ============================================================
 func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var err error
+	var req initMarbleRequest
 
 	//   0       1       2     3
 	// "asdf", "blue", "35", "bob"
-	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
-	}
+	// or {"name":"asdf","color":"blue","size":35,"owner":"bob"}
 
 	// ==== Input sanitation ====
 	fmt.Println("- start init marble")
-	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
-	}
-	if len(args[1]) <= 0 {
-		return shim.Error("2nd argument must be a non-empty string")
-	}
-	if len(args[2]) <= 0 {
-		return shim.Error("3rd argument must be a non-empty string")
-	}
-	if len(args[3]) <= 0 {
-		return shim.Error("4th argument must be a non-empty string")
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	marbleName := args[0]
-	color := strings.ToLower(args[1])
-	owner := strings.ToLower(args[3])
-	size, err := strconv.Atoi(args[2])
+	marbleName := req.Name
+	color := strings.ToLower(req.Color)
+	owner := strings.ToLower(req.Owner)
+	size := req.Size
+
+	// ==== Create marble object, save and index it ====
+	objectType := "marble"
+	marble := &marble{ObjectType: objectType, Name: marbleName, Color: color, Size: size, Owner: owner}
+	err = createMarble(stub, marble)
 	if err != nil {
-		return shim.Error("3rd argument must be a numeric string")
+		return shim.Error(err.Error())
 	}
 
+	// ==== Marble saved and indexed. Return success ====
+	fmt.Println("- end init marble")
+	return shim.Success(nil)
+}
+
+// ===================================================================================
+// createMarble - store a new, already validated, marble and index it.
+// Fails when a marble with the same name already exists.
+// ===================================================================================
+func createMarble(stub shim.ChaincodeStubInterface, marble *marble) error {
 	// ==== Check if marble already exists ====
-	marbleAsBytes, err := stub.GetState(marbleName)
+	err := checkMarbleAbsent(stub, marble.Name)
 	if err != nil {
-		return shim.Error("Failed to get marble: " + err.Error())
-	} else if marbleAsBytes != nil {
-		fmt.Println("This marble already exists: " + marbleName)
-		return shim.Error("This marble already exists: " + marbleName)
+		return err
 	}
 
-	// ==== Create marble object and marshal to JSON ====
-	objectType := "marble"
-	marble := &marble{objectType, marbleName, color, size, owner}
+	// ==== Marshal marble to JSON ====
 	marbleJSONasBytes, err := json.Marshal(marble)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 	//Alternatively, build the marble json string manually if you don't want to use struct marshalling
-	//marbleJSONasString := `{"docType":"Marble",  "name": "` + marbleName + `", "color": "` + color + `", "size": ` + strconv.Itoa(size) + `, "owner": "` + owner + `"}`
+	//marbleJSONasString := `{"docType":"Marble",  "name": "` + marble.Name + `", "color": "` + marble.Color + `", "size": ` + strconv.Itoa(marble.Size) + `, "owner": "` + marble.Owner + `"}`
 	//marbleJSONasBytes := []byte(str)
 
 	// === Save marble to state ===
-	err = stub.PutState(marbleName, marbleJSONasBytes)
+	err = stub.PutState(marble.Name, marbleJSONasBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 
 	//  ==== Index the marble to enable color-based range queries, e.g. return all blue marbles ====
@@ -213,16 +308,33 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 	indexName := "color~name"
 	colorNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{marble.Color, marble.Name})
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the marble.
 	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
 	value := []byte{0x00}
-	stub.PutState(colorNameIndexKey, value)
+	err = stub.PutState(colorNameIndexKey, value)
+	if err != nil {
+		return err
+	}
 
-	// ==== Marble saved and indexed. Return success ====
-	fmt.Println("- end init marble")
-	return shim.Success(nil)
+	//  ==== Index the marble by color and owner to enable aggregated statistics queries ====
+	//  Unlike color~name, this entry carries the marble size as its value.
+	return putColorOwnerIndex(stub, marble)
+}
+
+// ===================================================================================
+// checkMarbleAbsent - fails when a marble with the given name already exists
+// ===================================================================================
+func checkMarbleAbsent(stub shim.ChaincodeStubInterface, name string) error {
+	marbleAsBytes, err := stub.GetState(name)
+	if err != nil {
+		return fmt.Errorf("Failed to get marble: %s", err.Error())
+	} else if marbleAsBytes != nil {
+		fmt.Println("This marble already exists: " + name)
+		return fmt.Errorf("This marble already exists: %s", name)
+	}
+	return nil
 }
 
 // ===============================================
@@ -230,13 +342,14 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 // ===============================================
 func (t *SimpleChaincode) readMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var name, jsonResp string
-	var err error
+	var req marbleNameRequest
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting name of the marble to query")
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	name = args[0]
+	name = req.Name
 	valAsbytes, err := stub.GetState(name) //get the marble from chaincode state
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + name + "\"}"
@@ -244,23 +357,37 @@ func (t *SimpleChaincode) readMarble(stub shim.ChaincodeStubInterface, args []st
 	} else if valAsbytes == nil {
 		jsonResp = "{\"Error\":\"Marble does not exist: " + name + "\"}"
 		return shim.Error(jsonResp)
+	} else if isArchived(valAsbytes) {
+		jsonResp = "{\"Error\":\"Marble is archived: " + name + "\"}"
+		return shim.Error(jsonResp)
 	}
 
 	return shim.Success(valAsbytes)
 }
 
-// ==================================================
-// delete - remove a marble key/value pair from state
-// ==================================================
+// ==================================================================================
+// delete - soft delete a marble. The marble stays in state, marked archived with the
+// reason and the identity of the caller, and is removed from the indexes so that it
+// no longer shows up in queries. It can be brought back with restoreMarble within the
+// retention window, and is only removed for good by purgeArchived.
+// ==================================================================================
 func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var jsonResp string
 	var marbleJSON marble
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+
+	var req deleteMarbleRequest
+
+	//   0          1
+	// "name", ["reason"]
+	// or {"name":"name","reason":"reason"}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	marbleName := args[0]
+	marbleName := req.Name
+	reason := req.Reason
 
-	// to maintain the color~name index, we need to read the marble first and get its color
+	// to maintain the indexes, we need to read the marble first and get its color and owner
 	valAsbytes, err := stub.GetState(marbleName) //get the marble from chaincode state
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + marbleName + "\"}"
@@ -275,24 +402,45 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 		jsonResp = "{\"Error\":\"Failed to decode JSON of: " + marbleName + "\"}"
 		return shim.Error(jsonResp)
 	}
+	if marbleJSON.Archived != nil {
+		return shim.Error("Marble is already archived: " + marbleName)
+	}
+	err = checkNotLocked(stub, &marbleJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	err = stub.DelState(marbleName) //remove the marble from chaincode state
+	// record who archived the marble, when and why
+	archivedAt, err := getTxTimestampSeconds(stub)
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return shim.Error(err.Error())
+	}
+	mspID, subject, err := getCreatorIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
+	marbleJSON.Archived = &archiveRecord{Reason: reason, DeletedBy: subject, DeletedByMSP: mspID, ArchivedAt: archivedAt}
 
-	// maintain the index
-	indexName := "color~name"
-	colorNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{marbleJSON.Color, marbleJSON.Name})
+	marbleJSONasBytes, err := json.Marshal(marbleJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(marbleName, marbleJSONasBytes) //rewrite the marble as archived
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	//  Delete index entry to state.
-	err = stub.DelState(colorNameIndexKey)
+	// maintain the indexes, archived marbles are not part of any of them
+	err = delMarbleIndexes(stub, &marbleJSON)
 	if err != nil {
 		return shim.Error("Failed to delete state:" + err.Error())
 	}
+
+	// leave a tombstone so that purgeArchived can find archived marbles without a full scan
+	err = putTombstone(stub, marbleName, archivedAt)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(nil)
 }
 
@@ -301,14 +449,18 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 // ===========================================================
 func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
+	var req transferMarbleRequest
+
 	//   0       1
 	// "name", "bob"
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	// or {"name":"name","newOwner":"bob"}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	marbleName := args[0]
-	newOwner := strings.ToLower(args[1])
+	marbleName := req.Name
+	newOwner := strings.ToLower(req.NewOwner)
 	fmt.Println("- start transferMarble ", marbleName, newOwner)
 
 	marbleAsBytes, err := stub.GetState(marbleName)
@@ -323,7 +475,25 @@ func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	if marbleToTransfer.Archived != nil {
+		return shim.Error("Marble is archived")
+	}
+	err = checkNotLocked(stub, &marbleToTransfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marbleToTransfer.Lock = nil //any lock left on the marble has expired, the new owner starts clean
+
+	// the owner is part of the color~owner~name index, so move the entry to the new owner
+	err = delColorOwnerIndex(stub, &marbleToTransfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	marbleToTransfer.Owner = newOwner //change the owner
+	err = putColorOwnerIndex(stub, &marbleToTransfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	marbleJSONasBytes, _ := json.Marshal(marbleToTransfer)
 	err = stub.PutState(marbleName, marbleJSONasBytes) //rewrite the marble
@@ -347,13 +517,18 @@ func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args
 // Therefore, range queries are a safe option for performing update transactions based on query results.
 // ===========================================================================================
 func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req marblesByRangeRequest
 
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	//     0          1
+	// "marble1", "marble3"
+	// or {"startKey":"marble1","endKey":"marble3"}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	startKey := args[0]
-	endKey := args[1]
+	startKey := req.StartKey
+	endKey := req.EndKey
 
 	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
 	if err != nil {
@@ -371,6 +546,10 @@ func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, ar
 		if err != nil {
 			return shim.Error(err.Error())
 		}
+		// Archived marbles are hidden from normal queries
+		if isArchived(queryResponse.Value) {
+			continue
+		}
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
 			buffer.WriteString(",")
@@ -403,14 +582,18 @@ func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, ar
 // ===========================================================================================
 func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
+	var req transferMarblesBasedOnColorRequest
+
 	//   0       1
 	// "color", "bob"
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	// or {"color":"color","newOwner":"bob"}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	color := args[0]
-	newOwner := strings.ToLower(args[1])
+	color := req.Color
+	newOwner := strings.ToLower(req.NewOwner)
 	fmt.Println("- start transferMarblesBasedOnColor ", color, newOwner)
 
 	// Query the color~name index by color
@@ -421,7 +604,8 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 	}
 	defer coloredMarbleResultsIterator.Close()
 
-	// Iterate through result set and for each marble found, transfer to newOwner
+	// Iterate through result set and for each marble found, transfer to newOwner.
+	// A locked marble makes the whole transfer fail, nothing is transferred.
 	var i int
 	for i = 0; coloredMarbleResultsIterator.HasNext(); i++ {
 		// Note that we don't get the value (2nd return variable), we'll just get the marble name from the composite key
@@ -453,6 +637,357 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 	return shim.Success([]byte(responsePayload))
 }
 
+// ==== Example: aggregated statistics over a composite key index ===========================
+// The statistics queries below stream over the color~owner~name index and only keep
+// running totals, so the client receives one row per group instead of every marble.
+// Each index entry holds the marble size as its value, so the marbles themselves are never read.
+// ===========================================================================================
+
+// getMarbleStatsByOwner returns count and total size per owner.
+// An optional owner argument restricts the result to that owner.
+func (t *SimpleChaincode) getMarbleStatsByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	var req ownerStatsRequest
+
+	//   0
+	// ["bob"]
+	// or {"owner":"bob"}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	owner := strings.ToLower(req.Owner)
+
+	// owner is the second attribute of the index, so the whole index is streamed
+	stats, err := aggregateMarbleStats(stub, []string{}, func(color, o string) (marbleStats, bool) {
+		return marbleStats{Owner: o}, owner == "" || o == owner
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(stats)
+}
+
+// getMarbleStatsByColor returns count and total size per color.
+// An optional color argument restricts the result to that color.
+func (t *SimpleChaincode) getMarbleStatsByColor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	var req colorStatsRequest
+
+	//   0
+	// ["blue"]
+	// or {"color":"blue"}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	prefix := []string{}
+	if req.Color != "" {
+		prefix = append(prefix, strings.ToLower(req.Color))
+	}
+
+	stats, err := aggregateMarbleStats(stub, prefix, func(color, owner string) (marbleStats, bool) {
+		return marbleStats{Color: color}, true
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(stats)
+}
+
+// getMarbleStatsByColorAndOwner returns count and total size per color/owner pair.
+// Optional color and owner arguments narrow the index range that is streamed.
+func (t *SimpleChaincode) getMarbleStatsByColorAndOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	var req colorOwnerStatsRequest
+
+	//   0         1
+	// ["blue", ["bob"]]
+	// or {"color":"blue","owner":"bob"}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the owner can only narrow the range when a color is given too
+	prefix := []string{}
+	if req.Color != "" {
+		prefix = append(prefix, strings.ToLower(req.Color))
+		if req.Owner != "" {
+			prefix = append(prefix, strings.ToLower(req.Owner))
+		}
+	}
+	owner := strings.ToLower(req.Owner)
+
+	stats, err := aggregateMarbleStats(stub, prefix, func(color, o string) (marbleStats, bool) {
+		return marbleStats{Color: color, Owner: o}, owner == "" || o == owner
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(stats)
+}
+
+// =========================================================================================
+// aggregateMarbleStats streams the color~owner~name index entries matching prefix and
+// accumulates count and total size per group. group maps an entry's color and owner to
+// the row it belongs to, or reports false to skip the entry.
+// The result is a JSON array of marbleStats sorted by color, then owner.
+// =========================================================================================
+func aggregateMarbleStats(stub shim.ChaincodeStubInterface, prefix []string, group func(color, owner string) (marbleStats, bool)) ([]byte, error) {
+
+	// marbles created before an upgrade are missing from the index until it is backfilled,
+	// the totals would silently leave them out
+	indexed, err := isColorOwnerIndexed(stub)
+	if err != nil {
+		return nil, err
+	} else if !indexed {
+		return nil, fmt.Errorf("The %s index is incomplete, run reindexMarbles until it returns an empty nextKey", colorOwnerIndex)
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(colorOwnerIndex, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	totals := make(map[marbleStats]*marbleStats)
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := group(compositeKeyParts[0], compositeKeyParts[1])
+		if !ok {
+			continue
+		}
+
+		size, err := strconv.Atoi(string(responseRange.Value))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid size in index entry for marble %s: %s", compositeKeyParts[2], err.Error())
+		}
+
+		row, found := totals[key]
+		if !found {
+			row = &marbleStats{Color: key.Color, Owner: key.Owner}
+			totals[key] = row
+		}
+		row.Count++
+		row.TotalSize += size
+	}
+
+	stats := make(marbleStatsList, 0, len(totals))
+	for _, row := range totals {
+		stats = append(stats, *row)
+	}
+	sort.Sort(stats)
+
+	statsAsBytes, err := json.Marshal(stats)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("- aggregateMarbleStats result:\n%s\n", statsAsBytes)
+	return statsAsBytes, nil
+}
+
+// ===========================================================================================
+// reindexMarbles - backfill the color~owner~name index after an upgrade. The marbles created
+// before the statistics queries existed have no entry in the index, so the statistics queries
+// are refused until every marble has been indexed. Marbles are indexed in key order, a batch
+// per transaction, and the response gives the key to start the next batch from. Once
+// nextKey is empty the index is complete and the statistics queries are available.
+// Indexing a marble twice writes the same entry, so a batch can safely be run again.
+// ===========================================================================================
+func (t *SimpleChaincode) reindexMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	var req reindexMarblesRequest
+
+	//      0             1
+	// ["startKey", ["batchSize"]]
+	// or {"startKey":"marble2","batchSize":500}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	batchSize := req.BatchSize
+	if batchSize == 0 {
+		batchSize = defaultReindexBatchSize
+	}
+	fmt.Println("- start reindexMarbles ", req.StartKey, batchSize)
+
+	indexed, nextKey, err := indexMarbles(stub, req.StartKey, batchSize)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if nextKey == "" {
+		err = setColorOwnerIndexed(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	responseAsBytes, err := json.Marshal(map[string]interface{}{"indexed": indexed, "nextKey": nextKey})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("- end reindexMarbles: %s\n", responseAsBytes)
+	return shim.Success(responseAsBytes)
+}
+
+// =========================================================================================
+// indexMarbles writes the color~owner~name entries of up to limit marbles, starting from
+// startKey, and returns how many were indexed and the key of the first marble left, empty
+// when every marble has been indexed. A limit of 0 only looks for a marble, without
+// indexing it: nextKey is then empty when the ledger holds no marble.
+// Archived marbles are not part of the index and are skipped.
+// =========================================================================================
+func indexMarbles(stub shim.ChaincodeStubInterface, startKey string, limit int64) (int64, string, error) {
+	// marble names are simple keys, the composite keys of the indexes are not part of the range
+	resultsIterator, err := stub.GetStateByRange(startKey, string(utf8.MaxRune))
+	if err != nil {
+		return 0, "", err
+	}
+	defer resultsIterator.Close()
+
+	var indexed int64
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return 0, "", err
+		}
+		m := marble{}
+		err = json.Unmarshal(responseRange.Value, &m)
+		if err != nil || m.ObjectType != "marble" || m.Archived != nil {
+			continue
+		}
+		if indexed == limit {
+			return indexed, responseRange.Key, nil
+		}
+
+		err = putColorOwnerIndex(stub, &m)
+		if err != nil {
+			return 0, "", err
+		}
+		indexed++
+	}
+	return indexed, "", nil
+}
+
+// =========================================================================================
+// isColorOwnerIndexed reports whether every marble has its color~owner~name index entry
+// =========================================================================================
+func isColorOwnerIndexed(stub shim.ChaincodeStubInterface) (bool, error) {
+	indexedKey, err := stub.CreateCompositeKey(configIndex, []string{"colorOwnerIndexed"})
+	if err != nil {
+		return false, err
+	}
+	indexedAsBytes, err := stub.GetState(indexedKey)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get index configuration: %s", err.Error())
+	}
+	return indexedAsBytes != nil, nil
+}
+
+// =========================================================================================
+// setColorOwnerIndexed records that every marble has its color~owner~name index entry
+// =========================================================================================
+func setColorOwnerIndexed(stub shim.ChaincodeStubInterface) error {
+	indexedKey, err := stub.CreateCompositeKey(configIndex, []string{"colorOwnerIndexed"})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(indexedKey, []byte("true"))
+}
+
+// =========================================================================================
+// putColorOwnerIndex writes the color~owner~name index entry for a marble, with its size as value
+// =========================================================================================
+func putColorOwnerIndex(stub shim.ChaincodeStubInterface, m *marble) error {
+	colorOwnerIndexKey, err := stub.CreateCompositeKey(colorOwnerIndex, []string{m.Color, m.Owner, m.Name})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(colorOwnerIndexKey, []byte(strconv.Itoa(m.Size)))
+}
+
+// =========================================================================================
+// delColorOwnerIndex removes the color~owner~name index entry for a marble
+// =========================================================================================
+func delColorOwnerIndex(stub shim.ChaincodeStubInterface, m *marble) error {
+	colorOwnerIndexKey, err := stub.CreateCompositeKey(colorOwnerIndex, []string{m.Color, m.Owner, m.Name})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(colorOwnerIndexKey)
+}
+
+// =========================================================================================
+// getMarble reads and decodes a marble from state
+// =========================================================================================
+func getMarble(stub shim.ChaincodeStubInterface, marbleName string) (*marble, error) {
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get marble: %s", err.Error())
+	} else if marbleAsBytes == nil {
+		return nil, fmt.Errorf("Marble does not exist: %s", marbleName)
+	}
+
+	m := &marble{}
+	err = json.Unmarshal(marbleAsBytes, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// =========================================================================================
+// putMarble encodes and writes a marble to state. Indexes are not touched.
+// =========================================================================================
+func putMarble(stub shim.ChaincodeStubInterface, m *marble) error {
+	marbleJSONasBytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(m.Name, marbleJSONasBytes)
+}
+
+// =========================================================================================
+// putMarbleIndexes writes every index entry of a marble (color~name and color~owner~name)
+// =========================================================================================
+func putMarbleIndexes(stub shim.ChaincodeStubInterface, m *marble) error {
+	colorNameIndexKey, err := stub.CreateCompositeKey("color~name", []string{m.Color, m.Name})
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(colorNameIndexKey, []byte{0x00})
+	if err != nil {
+		return err
+	}
+	return putColorOwnerIndex(stub, m)
+}
+
+// =========================================================================================
+// delMarbleIndexes removes every index entry of a marble (color~name and color~owner~name)
+// =========================================================================================
+func delMarbleIndexes(stub shim.ChaincodeStubInterface, m *marble) error {
+	colorNameIndexKey, err := stub.CreateCompositeKey("color~name", []string{m.Color, m.Name})
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(colorNameIndexKey)
+	if err != nil {
+		return err
+	}
+	return delColorOwnerIndex(stub, m)
+}
+
 // =======Rich queries =========================================================================
 // Two examples of rich queries are provided below (parameterized query and ad hoc query).
 // Rich queries pass a query string to the state database.
@@ -474,15 +1009,19 @@ func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInt
 // =========================================================================================
 func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
+	var req ownerRequest
+
 	//   0
 	// "bob"
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	// or {"owner":"bob"}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	owner := strings.ToLower(args[0])
+	owner := strings.ToLower(req.Owner)
 
-	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner)
+	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\",\"archived\":{\"$exists\":false}}}", owner)
 
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
@@ -500,13 +1039,17 @@ func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface,
 // =========================================================================================
 func (t *SimpleChaincode) queryMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
+	var req queryMarblesRequest
+
 	//   0
 	// "queryString"
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	// or {"query":"queryString"}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	queryString := args[0]
+	queryString := req.Query
 
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
@@ -562,12 +1105,17 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 }
 
 func (t *SimpleChaincode) getHistoryForMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req marbleNameRequest
 
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	//   0
+	// "name"
+	// or {"name":"name"}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	marbleName := args[0]
+	marbleName := req.Name
 
 	fmt.Printf("- start getHistoryForMarble: %s\n", marbleName)
 
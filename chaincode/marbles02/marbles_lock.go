@@ -0,0 +1,178 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// marbleLock is attached to a marble while it is held, e.g. as collateral or during a
+// pending trade. A locked marble cannot be transferred or deleted.
+type marbleLock struct {
+	Holder    string `json:"holder"`    //party the marble is held for, e.g. a loan or trade reference
+	LockedBy  string `json:"lockedBy"`  //common name of the client certificate that locked the marble
+	LockedMSP string `json:"lockedMSP"` //MSP ID of the client that locked the marble
+	LockedAt  int64  `json:"lockedAt"`  //transaction timestamp, in seconds since epoch
+	ExpiresAt int64  `json:"expiresAt"` //0 when the lock never expires
+}
+
+// =======================================================================================
+// lockMarble - hold a marble for a holder, optionally for a limited time.
+// The expiry is a number of seconds counted from the transaction timestamp.
+// Only the owner of the marble, the client whose certificate common name is the owner
+// name, or an admin may lock it.
+// =======================================================================================
+func (t *SimpleChaincode) lockMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	var req lockMarbleRequest
+
+	//   0          1            2
+	// "name", "loan-42", ["86400"]
+	// or {"name":"name","holder":"loan-42","duration":86400}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marbleName := req.Name
+	holder := req.Holder
+	duration := req.Duration
+	fmt.Println("- start lockMarble ", marbleName, holder)
+
+	marbleToLock, err := getMarble(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marbleToLock.Archived != nil {
+		return shim.Error("Marble is archived")
+	}
+
+	now, err := getTxTimestampSeconds(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if isLocked(marbleToLock, now) {
+		return shim.Error("Marble is already locked by " + marbleToLock.Lock.Holder)
+	}
+
+	mspID, subject, err := getCreatorIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if strings.ToLower(subject) != marbleToLock.Owner {
+		err = checkAdmin(stub)
+		if err != nil {
+			return shim.Error("Only the owner of the marble or an admin may lock it: " + err.Error())
+		}
+	}
+	marbleToLock.Lock = &marbleLock{Holder: holder, LockedBy: subject, LockedMSP: mspID, LockedAt: now}
+	if duration > 0 {
+		marbleToLock.Lock.ExpiresAt = now + duration
+	}
+
+	err = putMarble(stub, marbleToLock)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end lockMarble (success)")
+	return shim.Success(nil)
+}
+
+// =======================================================================================
+// unlockMarble - release the hold on a marble. Only the identity that locked the marble
+// or an admin may release it, anybody may clear a lock that has expired.
+// =======================================================================================
+func (t *SimpleChaincode) unlockMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	var req marbleNameRequest
+
+	//   0
+	// "name"
+	// or {"name":"name"}
+	err := parseArgs(args, &req)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marbleName := req.Name
+	fmt.Println("- start unlockMarble ", marbleName)
+
+	marbleToUnlock, err := getMarble(stub, marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marbleToUnlock.Lock == nil {
+		return shim.Error("Marble is not locked")
+	}
+
+	now, err := getTxTimestampSeconds(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if isLocked(marbleToUnlock, now) {
+		mspID, subject, err := getCreatorIdentity(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if mspID != marbleToUnlock.Lock.LockedMSP || subject != marbleToUnlock.Lock.LockedBy {
+			err = checkAdmin(stub)
+			if err != nil {
+				return shim.Error("Only the client that locked the marble or an admin may unlock it: " + err.Error())
+			}
+		}
+	}
+
+	marbleToUnlock.Lock = nil
+	err = putMarble(stub, marbleToUnlock)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end unlockMarble (success)")
+	return shim.Success(nil)
+}
+
+// =========================================================================================
+// isLocked reports whether a marble is held at the given time. An expired lock does not count.
+// =========================================================================================
+func isLocked(m *marble, now int64) bool {
+	return m.Lock != nil && (m.Lock.ExpiresAt == 0 || now < m.Lock.ExpiresAt)
+}
+
+// =========================================================================================
+// checkNotLocked returns an error when the marble is held. The transaction timestamp is
+// only needed, and read, when the marble carries a lock.
+// =========================================================================================
+func checkNotLocked(stub shim.ChaincodeStubInterface, m *marble) error {
+	if m.Lock == nil {
+		return nil
+	}
+	now, err := getTxTimestampSeconds(stub)
+	if err != nil {
+		return err
+	}
+	if isLocked(m, now) {
+		return fmt.Errorf("Marble %s is locked by %s", m.Name, m.Lock.Holder)
+	}
+	return nil
+}
@@ -0,0 +1,489 @@
+/*
+Licensed to the Apache Software Foundation (ASF) under one
+or more contributor license agreements.  See the NOTICE file
+distributed with this work for additional information
+regarding copyright ownership.  The ASF licenses this file
+to you under the Apache License, Version 2.0 (the
+"License"); you may not use this file except in compliance
+with the License.  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing,
+software distributed under the License is distributed on an
+"AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations
+under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// testStub wraps the MockStub so that a test can choose the function arguments, the
+// client identity and the transaction time. Each invoke runs in a new transaction, one
+// second after the previous one unless the clock is moved forward with wait.
+type testStub struct {
+	*shim.MockStub
+	args    []string
+	creator []byte
+	now     int64
+	txCount int
+}
+
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	return stub.args[0], stub.args[1:]
+}
+
+func (stub *testStub) GetCreator() ([]byte, error) {
+	return stub.creator, nil
+}
+
+func (stub *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: stub.now}, nil
+}
+
+func newTestStub() *testStub {
+	stub := &testStub{MockStub: shim.NewMockStub("marbles", new(SimpleChaincode)), now: 1500000000}
+	return stub.as("Org1MSP", "tom")
+}
+
+// init runs Init with the admin MSP IDs as arguments
+func (stub *testStub) init(t *testing.T, args ...string) {
+	stub.args = append([]string{"init"}, args...)
+	stub.txCount++
+	txID := strconv.Itoa(stub.txCount)
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+	res := new(SimpleChaincode).Init(stub)
+	if res.Status != shim.OK {
+		fmt.Println("Init", args, "failed", res.Message)
+		t.FailNow()
+	}
+}
+
+// invoke runs a transaction against the wrapped stub
+func (stub *testStub) invoke(args ...string) pb.Response {
+	stub.args = args
+	stub.txCount++
+	stub.now++
+	txID := strconv.Itoa(stub.txCount)
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+	return new(SimpleChaincode).Invoke(stub)
+}
+
+// as makes the following invokes run as the client name of the organization mspID,
+// using a self-signed certificate
+func (stub *testStub) as(mspID string, name string) *testStub {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	certAsBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	stub.creator, err = proto.Marshal(&msp.SerializedIdentity{Mspid: mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certAsBytes})})
+	if err != nil {
+		panic(err)
+	}
+	return stub
+}
+
+// wait moves the transaction time forward
+func (stub *testStub) wait(seconds int64) {
+	stub.now += seconds
+}
+
+func checkInvoke(t *testing.T, stub *testStub, args ...string) pb.Response {
+	res := stub.invoke(args...)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", res.Message)
+		t.FailNow()
+	}
+	return res
+}
+
+func checkInvokeFailed(t *testing.T, stub *testStub, args ...string) pb.Response {
+	res := stub.invoke(args...)
+	if res.Status == shim.OK {
+		fmt.Println("Invoke", args, "succeeded but failure was expected")
+		t.FailNow()
+	}
+	return res
+}
+
+func checkMarble(t *testing.T, stub *testStub, name string, expected marble) {
+	res := checkInvoke(t, stub, "readMarble", name)
+	expectedAsBytes, err := json.Marshal(expected)
+	if err != nil {
+		panic(err)
+	}
+	if string(res.Payload) != string(expectedAsBytes) {
+		fmt.Println("Marble", name, "was", string(res.Payload), "and not", string(expectedAsBytes), "as expected")
+		t.FailNow()
+	}
+}
+
+func checkStats(t *testing.T, stub *testStub, expected string, args ...string) {
+	res := checkInvoke(t, stub, args...)
+	if string(res.Payload) != expected {
+		fmt.Println(args, "returned", string(res.Payload), "and not", expected, "as expected")
+		t.FailNow()
+	}
+}
+
+// indexOf returns the index name of a composite key, empty for a simple key
+func indexOf(stub *testStub, key string) string {
+	if !strings.HasPrefix(key, "\x00") {
+		return ""
+	}
+	indexName, _, err := stub.SplitCompositeKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return indexName
+}
+
+// countKeys returns the number of keys of an index
+func countKeys(stub *testStub, indexName string) int {
+	count := 0
+	for key := range stub.State {
+		if indexOf(stub, key) == indexName {
+			count++
+		}
+	}
+	return count
+}
+
+func TestMarbles_StatsQueries(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t, "Org1MSP")
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "initMarble", "marble2", "red", "50", "tom")
+	checkInvoke(t, stub, "initMarble", "marble3", "blue", "70", "jerry")
+
+	checkStats(t, stub, `[{"owner":"jerry","count":1,"totalSize":70},{"owner":"tom","count":2,"totalSize":85}]`, "getMarbleStatsByOwner")
+	checkStats(t, stub, `[{"color":"blue","count":2,"totalSize":105}]`, "getMarbleStatsByColor", "blue")
+	checkStats(t, stub, `[{"color":"blue","owner":"tom","count":1,"totalSize":35}]`, "getMarbleStatsByColorAndOwner", "blue", "tom")
+}
+
+func TestMarbles_ReindexBackfillsMarblesCreatedBeforeUpgrade(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t, "Org1MSP")
+	for i, color := range []string{"blue", "red", "blue", "green", "blue"} {
+		checkInvoke(t, stub, "initMarble", fmt.Sprintf("marble%d", i+1), color, "10", "tom")
+	}
+	checkInvoke(t, stub, "delete", "marble4")
+
+	// a ledger written before the statistics queries existed has no color~owner~name entries
+	stub.MockTransactionStart("upgrade")
+	for key := range stub.State {
+		if index := indexOf(stub, key); index == colorOwnerIndex || index == configIndex {
+			stub.DelState(key)
+		}
+	}
+	stub.MockTransactionEnd("upgrade")
+	stub.init(t)
+	checkInvokeFailed(t, stub, "getMarbleStatsByColor")
+
+	// marbles created after the upgrade are indexed, but the statistics stay refused
+	checkInvoke(t, stub, "initMarble", "marble6", "red", "10", "jerry")
+	checkInvokeFailed(t, stub, "getMarbleStatsByOwner")
+
+	checkStats(t, stub, `{"indexed":2,"nextKey":"marble3"}`, "reindexMarbles", "", "2")
+	checkInvokeFailed(t, stub, "getMarbleStatsByColor")
+	checkStats(t, stub, `{"indexed":2,"nextKey":"marble6"}`, "reindexMarbles", `{"startKey":"marble3","batchSize":2}`)
+	checkStats(t, stub, `{"indexed":1,"nextKey":""}`, "reindexMarbles", "marble6", "2")
+	checkStats(t, stub, `[{"color":"blue","count":3,"totalSize":30},{"color":"red","count":2,"totalSize":20}]`, "getMarbleStatsByColor")
+	if countKeys(stub, colorOwnerIndex) != 5 {
+		fmt.Println(countKeys(stub, colorOwnerIndex), "index entries were written instead of 5")
+		t.FailNow()
+	}
+
+	// running it again changes nothing
+	checkStats(t, stub, `{"indexed":5,"nextKey":""}`, "reindexMarbles")
+	checkInvokeFailed(t, stub, "reindexMarbles", "", "-1")
+}
+
+func TestMarbles_InitOnEmptyLedgerNeedsNoReindex(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t)
+	checkStats(t, stub, `[]`, "getMarbleStatsByColor")
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkStats(t, stub, `[{"color":"blue","count":1,"totalSize":35}]`, "getMarbleStatsByColor")
+
+	// upgrading again keeps the index complete
+	stub.init(t)
+	checkStats(t, stub, `[{"color":"blue","count":1,"totalSize":35}]`, "getMarbleStatsByColor")
+}
+
+func TestMarbles_DeleteArchivesMarble(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t, "Org1MSP")
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "initMarble", "marble2", "blue", "50", "tom")
+
+	checkInvoke(t, stub, "delete", "marble1", "created by mistake")
+	checkInvokeFailed(t, stub, "readMarble", "marble1")
+	checkInvokeFailed(t, stub, "delete", "marble1")
+	checkStats(t, stub, `[{"color":"blue","count":1,"totalSize":50}]`, "getMarbleStatsByColor")
+	res := checkInvoke(t, stub, "getMarblesByRange", "marble1", "marble3")
+	if strings.Contains(string(res.Payload), `"marble1"`) {
+		fmt.Println("getMarblesByRange returned the archived marble", string(res.Payload))
+		t.FailNow()
+	}
+
+	// the marble stays in state, with the record of who archived it and why
+	archived := marble{}
+	err := json.Unmarshal(stub.State["marble1"], &archived)
+	if err != nil || archived.Archived == nil || *archived.Archived != (archiveRecord{Reason: "created by mistake", DeletedBy: "tom", DeletedByMSP: "Org1MSP", ArchivedAt: stub.now - 4}) {
+		fmt.Println("Marble was not archived as expected:", string(stub.State["marble1"]))
+		t.FailNow()
+	}
+	if countKeys(stub, "color~name") != 1 || countKeys(stub, tombstoneIndex) != 1 {
+		fmt.Println("Archiving did not move the marble from the indexes to the tombstones")
+		t.FailNow()
+	}
+}
+
+func TestMarbles_RestoreMarbleByArchiverOrAdmin(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t, "AdminMSP")
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvokeFailed(t, stub, "restoreMarble", "marble1")
+	checkInvoke(t, stub, "delete", "marble1")
+
+	stub.as("Org2MSP", "tom")
+	checkInvokeFailed(t, stub, "restoreMarble", "marble1")
+	stub.as("Org1MSP", "jerry")
+	checkInvokeFailed(t, stub, "restoreMarble", "marble1")
+	stub.as("Org1MSP", "tom")
+	checkInvoke(t, stub, "restoreMarble", "marble1")
+	checkMarble(t, stub, "marble1", marble{ObjectType: "marble", Name: "marble1", Color: "blue", Size: 35, Owner: "tom"})
+	checkStats(t, stub, `[{"color":"blue","count":1,"totalSize":35}]`, "getMarbleStatsByColor")
+	if countKeys(stub, tombstoneIndex) != 0 {
+		fmt.Println("Restoring the marble left its tombstone")
+		t.FailNow()
+	}
+
+	// an admin may restore the marbles archived by anybody
+	stub.as("Org2MSP", "jerry")
+	checkInvoke(t, stub, "delete", "marble1")
+	stub.as("AdminMSP", "admin")
+	checkInvoke(t, stub, "restoreMarble", `{"name":"marble1"}`)
+	checkMarble(t, stub, "marble1", marble{ObjectType: "marble", Name: "marble1", Color: "blue", Size: 35, Owner: "tom"})
+}
+
+func TestMarbles_RestoreMarbleWithinRetentionWindow(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t, "Org1MSP")
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "initMarble", "marble2", "blue", "35", "tom")
+	checkInvoke(t, stub, "delete", "marble1")
+	checkInvoke(t, stub, "delete", "marble2")
+
+	// marble2 is restored on the last second of its window, marble1 just after its window
+	stub.wait(archiveRetention - 1)
+	checkInvoke(t, stub, "restoreMarble", "marble2")
+	checkInvokeFailed(t, stub, "restoreMarble", "marble1")
+	checkInvokeFailed(t, stub, "readMarble", "marble1")
+}
+
+func TestMarbles_PurgeArchived(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t, "Org1MSP")
+	for _, name := range []string{"marble1", "marble2", "marble3", "marble4"} {
+		checkInvoke(t, stub, "initMarble", name, "blue", "35", "tom")
+	}
+	checkInvoke(t, stub, "delete", "marble1")
+	checkInvoke(t, stub, "delete", "marble2")
+	stub.wait(archiveRetention)
+	checkInvoke(t, stub, "delete", "marble3")
+
+	stub.as("Org2MSP", "tom")
+	checkInvokeFailed(t, stub, "purgeArchived")
+	stub.as("Org1MSP", "admin")
+	checkInvokeFailed(t, stub, "purgeArchived", "marble4")
+	checkInvokeFailed(t, stub, "purgeArchived", "marble5")
+
+	// only the marbles past their retention window are purged
+	checkStats(t, stub, "Purged 2 archived marbles", "purgeArchived")
+	if stub.State["marble1"] != nil || stub.State["marble2"] != nil || stub.State["marble3"] == nil {
+		fmt.Println("purgeArchived did not purge the expired marbles only")
+		t.FailNow()
+	}
+	checkStats(t, stub, "Purged 1 archived marbles", "purgeArchived", "marble3")
+	if stub.State["marble3"] != nil || countKeys(stub, tombstoneIndex) != 0 {
+		fmt.Println("purgeArchived left marble3 or its tombstone")
+		t.FailNow()
+	}
+	checkMarble(t, stub, "marble4", marble{ObjectType: "marble", Name: "marble4", Color: "blue", Size: 35, Owner: "tom"})
+}
+
+func TestMarbles_LockMarbleByOwnerOrAdmin(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t, "AdminMSP")
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+
+	stub.as("Org2MSP", "jerry")
+	checkInvokeFailed(t, stub, "lockMarble", "marble1", "loan-42")
+	stub.as("Org1MSP", "Tom")
+	checkInvoke(t, stub, "lockMarble", "marble1", "loan-42", "0")
+	checkMarble(t, stub, "marble1", marble{ObjectType: "marble", Name: "marble1", Color: "blue", Size: 35, Owner: "tom",
+		Lock: &marbleLock{Holder: "loan-42", LockedBy: "Tom", LockedMSP: "Org1MSP", LockedAt: stub.now}})
+	checkInvokeFailed(t, stub, "lockMarble", "marble1", "loan-43")
+
+	// only the client that locked the marble or an admin may unlock it
+	stub.as("Org2MSP", "jerry")
+	checkInvokeFailed(t, stub, "unlockMarble", "marble1")
+	stub.as("AdminMSP", "admin")
+	checkInvoke(t, stub, "unlockMarble", "marble1")
+	checkInvokeFailed(t, stub, "unlockMarble", "marble1")
+	checkInvoke(t, stub, "lockMarble", `{"name":"marble1","holder":"loan-44","duration":60}`)
+	stub.as("Org1MSP", "tom")
+	checkInvokeFailed(t, stub, "unlockMarble", "marble1")
+	checkInvokeFailed(t, stub, "lockMarble", "marble1", "loan-45", "-1")
+	checkInvokeFailed(t, stub, "lockMarble", "marble2", "loan-45")
+}
+
+func TestMarbles_LockedMarbleCannotMove(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t, "AdminMSP")
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "initMarble", "marble2", "blue", "50", "tom")
+	checkInvoke(t, stub, "lockMarble", "marble1", "loan-42")
+	before := fmt.Sprint(stub.State)
+
+	checkInvokeFailed(t, stub, "transferMarble", "marble1", "jerry")
+	checkInvokeFailed(t, stub, "transferMarblesBasedOnColor", "blue", "jerry")
+	checkInvokeFailed(t, stub, "delete", "marble1")
+	if fmt.Sprint(stub.State) != before {
+		fmt.Println("A refused transaction changed the ledger")
+		t.FailNow()
+	}
+
+	checkInvoke(t, stub, "unlockMarble", "marble1")
+	checkInvoke(t, stub, "transferMarblesBasedOnColor", "blue", "jerry")
+	checkMarble(t, stub, "marble1", marble{ObjectType: "marble", Name: "marble1", Color: "blue", Size: 35, Owner: "jerry"})
+}
+
+func TestMarbles_LockExpires(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t, "AdminMSP")
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+	checkInvoke(t, stub, "lockMarble", "marble1", "loan-42", "60")
+
+	stub.wait(58)
+	checkInvokeFailed(t, stub, "transferMarble", "marble1", "jerry")
+
+	// once expired, the lock no longer holds the marble and anybody may clear it
+	checkInvoke(t, stub, "transferMarble", "marble1", "jerry")
+	checkMarble(t, stub, "marble1", marble{ObjectType: "marble", Name: "marble1", Color: "blue", Size: 35, Owner: "jerry"})
+	stub.as("Org1MSP", "jerry")
+	checkInvoke(t, stub, "lockMarble", "marble1", "loan-43", "10")
+	stub.wait(10)
+	stub.as("Org2MSP", "bob")
+	checkInvoke(t, stub, "unlockMarble", "marble1")
+	checkMarble(t, stub, "marble1", marble{ObjectType: "marble", Name: "marble1", Color: "blue", Size: 35, Owner: "jerry"})
+}
+
+// checkResults checks the statuses of an initMarbles response, one "name status" per entry
+func checkResults(t *testing.T, payload []byte, expected ...string) {
+	var results []marbleResult
+	err := json.Unmarshal(payload, &results)
+	if err != nil {
+		fmt.Println("Could not decode results", string(payload), err)
+		t.FailNow()
+	}
+	got := []string{}
+	for _, result := range results {
+		got = append(got, result.Name+" "+result.Status)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		fmt.Println("Results were", string(payload), "and not", expected, "as expected")
+		t.FailNow()
+	}
+}
+
+func TestMarbles_InitMarblesReportsEachEntry(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t, "Org1MSP")
+	checkInvoke(t, stub, "initMarble", "marble1", "blue", "35", "tom")
+
+	// sizes given as strings are accepted as by initMarble, an existing or a duplicate name fails alone
+	res := checkInvoke(t, stub, "initMarbles", `[{"name":"marble2","color":"Red","size":"50","owner":"Jerry"},
+		{"name":"marble1","color":"blue","size":35,"owner":"tom"},
+		{"name":"marble3","color":"green","size":10,"owner":"tom"},
+		{"name":"marble3","color":"green","size":20,"owner":"tom"}]`)
+	checkResults(t, res.Payload, "marble2 created", "marble1 failed", "marble3 created", "marble3 failed")
+	checkMarble(t, stub, "marble2", marble{ObjectType: "marble", Name: "marble2", Color: "red", Size: 50, Owner: "jerry"})
+	checkMarble(t, stub, "marble3", marble{ObjectType: "marble", Name: "marble3", Color: "green", Size: 10, Owner: "tom"})
+}
+
+func TestMarbles_InitMarblesInvalidEntryFailsAlone(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t, "Org1MSP")
+
+	res := checkInvoke(t, stub, "initMarbles", `[{"name":"marble1","color":"blue","size":"big","owner":"tom"},
+		{"name":"marble2","color":"blue","size":35,"owner":"tom","weight":3},
+		{"name":"marble3","color":"","size":35,"owner":"tom"},
+		"marble4",
+		{"name":"marble5","color":"blue","size":35,"owner":"tom"}]`)
+	checkResults(t, res.Payload, "marble1 failed", "marble2 failed", "marble3 failed", " failed", "marble5 created")
+	var results []marbleResult
+	json.Unmarshal(res.Payload, &results)
+	for i, message := range []string{"size must be a numeric string", "Unknown argument weight", "color must be a non-empty string", "Marble must be a JSON object"} {
+		if !strings.Contains(results[i].Error, message) {
+			fmt.Println("Error of entry", i, "was", results[i].Error, "and not", message)
+			t.FailNow()
+		}
+	}
+	checkInvokeFailed(t, stub, "readMarble", "marble1")
+	checkInvoke(t, stub, "readMarble", "marble5")
+}
+
+func TestMarbles_InitMarblesAllOrNothingWritesNothing(t *testing.T) {
+	stub := newTestStub()
+	stub.init(t, "Org1MSP")
+	keys := len(stub.State)
+
+	res := checkInvokeFailed(t, stub, "initMarbles", `{"marbles":[{"name":"marble1","color":"blue","size":35,"owner":"tom"},
+		{"name":"marble1","color":"red","size":50,"owner":"tom"}],"allOrNothing":true}`)
+	if !strings.Contains(res.Message, `"name":"marble1","status":"rolledBack"`) || !strings.Contains(res.Message, "Duplicate marble in batch: marble1") {
+		fmt.Println("Error was", res.Message)
+		t.FailNow()
+	}
+	if len(stub.State) != keys {
+		fmt.Println("A failed all-or-nothing batch wrote", len(stub.State)-keys, "keys")
+		t.FailNow()
+	}
+
+	res = checkInvoke(t, stub, "initMarbles", `[{"name":"marble1","color":"blue","size":35,"owner":"tom"}]`, "true")
+	checkResults(t, res.Payload, "marble1 created")
+}
@@ -0,0 +1,150 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Command cli queries, creates and transfers fabcar cars, as the user and on the network
+// set in a connection profile.
+//
+// Run it from the fabcar directory once the network is started:
+//
+//	go run ./cli query-all
+//	go run ./cli -output json query 1HGCM82633A004352
+//	go run ./cli create 1G1RA6E44BU000011 Chevrolet Volt red Nick
+//	go run ./cli transfer 1G1RA6E44BU000011 Barry
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/hyperledger/fabric-samples/fabcar/client"
+)
+
+// carGateway runs chaincode functions, the client gateway or a stand-in in tests
+type carGateway interface {
+	Query(function string, args ...string) ([]byte, error)
+	Invoke(function string, args ...string) (string, error)
+}
+
+const usage = `usage: cli [-profile file] [-output table|json] <command> [arguments]
+
+commands:
+  query <vin>
+  query-all [-page-size n] [-bookmark b] [-sort vin|make|model|owner|year|mileage] [-order asc|desc]
+  create <vin> <make> <model> <colour> <owner> [<year> <mileage> <plate>] [<ownerMSP>]
+  transfer <vin> <buyer> [<buyerMSP>]
+  accept <vin>
+`
+
+func main() {
+	profilePath := flag.String("profile", "connection.yaml", "connection profile")
+	output := flag.String("output", "table", "output format, table or json")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || (*output != "table" && *output != "json") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	profile, err := client.LoadProfile(*profilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gateway, err := client.Connect(profile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer gateway.Close()
+
+	err = run(gateway, *output, flag.Args(), os.Stdout)
+	if err != nil {
+		gateway.Close()
+		log.Fatal(err)
+	}
+}
+
+// run runs the command of args and writes its result to out in the given format
+func run(gateway carGateway, output string, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("Missing command")
+	}
+	command, args := args[0], args[1:]
+
+	switch command {
+	case "query":
+		if len(args) != 1 {
+			return errors.New("Usage: query <vin>")
+		}
+		carAsBytes, err := gateway.Query("queryCar", args[0])
+		if err != nil {
+			return err
+		}
+		return printCar(out, output, carAsBytes)
+
+	case "query-all":
+		flags := flag.NewFlagSet("query-all", flag.ContinueOnError)
+		pageSize := flags.Int("page-size", 0, "number of cars per page, all cars when 0")
+		bookmark := flags.String("bookmark", "", "bookmark of the page, returned with the previous page")
+		sortBy := flags.String("sort", "vin", "field to sort the cars by")
+		order := flags.String("order", "asc", "sort order, asc or desc")
+		err := flags.Parse(args)
+		if err != nil {
+			return err
+		} else if flags.NArg() != 0 {
+			return errors.New("Usage: query-all [flags]")
+		} else if *pageSize < 0 {
+			return errors.New("Page size must not be negative")
+		}
+		pageArg := ""
+		if *pageSize > 0 {
+			pageArg = strconv.Itoa(*pageSize)
+		}
+		pageAsBytes, err := gateway.Query("queryAllCars", pageArg, *bookmark, *sortBy, *order)
+		if err != nil {
+			return err
+		}
+		return printCars(out, output, pageAsBytes)
+
+	case "create":
+		if len(args) != 5 && len(args) != 6 && len(args) != 8 && len(args) != 9 {
+			return errors.New("Usage: create <vin> <make> <model> <colour> <owner> [<year> <mileage> <plate>] [<ownerMSP>]")
+		}
+		txID, err := gateway.Invoke("createCar", args...)
+		if err != nil {
+			return err
+		}
+		return printTx(out, output, txID)
+
+	case "transfer":
+		if len(args) != 2 && len(args) != 3 {
+			return errors.New("Usage: transfer <vin> <buyer> [<buyerMSP>]")
+		}
+		txID, err := gateway.Invoke("initiateTransfer", args...)
+		if err != nil {
+			return err
+		}
+		return printTx(out, output, txID)
+
+	case "accept":
+		if len(args) != 1 {
+			return errors.New("Usage: accept <vin>")
+		}
+		txID, err := gateway.Invoke("acceptTransfer", args[0])
+		if err != nil {
+			return err
+		}
+		return printTx(out, output, txID)
+	}
+
+	return fmt.Errorf("Unknown command %s", command)
+}
@@ -0,0 +1,385 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-samples/fabcar/client"
+	"github.com/hyperledger/fabric/protos/common"
+	ab "github.com/hyperledger/fabric/protos/orderer"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// fakeNetwork stands in for the peer and orderer: proposals run a minimal fabcar
+// chaincode against its cars, and the writes of a transaction apply once the orderer
+// receives it
+type fakeNetwork struct {
+	cars      map[string]car
+	offers    map[string]string
+	pending   map[string]func()
+	functions []string
+}
+
+func newFakeNetwork(cars ...car) *fakeNetwork {
+	network := &fakeNetwork{cars: map[string]car{}, offers: map[string]string{}, pending: map[string]func(){}}
+	for _, c := range cars {
+		network.cars[c.VIN] = c
+	}
+	return network
+}
+
+func (network *fakeNetwork) ProcessProposal(ctx context.Context, signed *pb.SignedProposal, opts ...grpc.CallOption) (*pb.ProposalResponse, error) {
+	if len(signed.Signature) == 0 {
+		return nil, errors.New("Proposal is not signed")
+	}
+	proposal := &pb.Proposal{}
+	header := &common.Header{}
+	channelHeader := &common.ChannelHeader{}
+	payload := &pb.ChaincodeProposalPayload{}
+	spec := &pb.ChaincodeInvocationSpec{}
+	err := proto.Unmarshal(signed.ProposalBytes, proposal)
+	if err == nil {
+		err = proto.Unmarshal(proposal.Header, header)
+	}
+	if err == nil {
+		err = proto.Unmarshal(header.ChannelHeader, channelHeader)
+	}
+	if err == nil {
+		err = proto.Unmarshal(proposal.Payload, payload)
+	}
+	if err == nil {
+		err = proto.Unmarshal(payload.Input, spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if channelHeader.ChannelId != "mychannel" || spec.ChaincodeSpec.ChaincodeId.Name != "fabcar" {
+		return nil, fmt.Errorf("Unexpected chaincode %s on %s", spec.ChaincodeSpec.ChaincodeId.Name, channelHeader.ChannelId)
+	}
+
+	args := []string{}
+	for _, arg := range spec.ChaincodeSpec.Input.Args {
+		args = append(args, string(arg))
+	}
+	network.functions = append(network.functions, args[0])
+	result, write, err := network.chaincode(args[0], args[1:])
+	if err != nil {
+		return &pb.ProposalResponse{Response: &pb.Response{Status: 500, Message: err.Error()}}, nil
+	}
+	if write != nil {
+		network.pending[channelHeader.TxId] = write
+	}
+	return &pb.ProposalResponse{
+		Response:    &pb.Response{Status: 200, Payload: result},
+		Payload:     []byte("results"),
+		Endorsement: &pb.Endorsement{Endorser: []byte("peer0.org1.example.com"), Signature: []byte("endorsement")},
+	}, nil
+}
+
+// chaincode runs a fabcar function, returning its result and the writes to commit
+func (network *fakeNetwork) chaincode(function string, args []string) ([]byte, func(), error) {
+	switch function {
+	case "queryCar":
+		c, ok := network.cars[args[0]]
+		if !ok {
+			return nil, nil, errors.New("Car " + args[0] + " does not exist")
+		}
+		carAsBytes, err := json.Marshal(c)
+		return carAsBytes, nil, err
+
+	case "queryAllCars":
+		vins := []string{}
+		for vin := range network.cars {
+			if vin > args[1] {
+				vins = append(vins, vin)
+			}
+		}
+		sort.Strings(vins)
+		pageSize, _ := strconv.Atoi(args[0])
+		bookmark := ""
+		if pageSize > 0 && len(vins) > pageSize {
+			vins = vins[:pageSize]
+			bookmark = vins[pageSize-1]
+		}
+		records := []carRecord{}
+		for _, vin := range vins {
+			records = append(records, carRecord{Key: vin, Record: network.cars[vin]})
+		}
+		if pageSize == 0 {
+			recordsAsBytes, err := json.Marshal(records)
+			return recordsAsBytes, nil, err
+		}
+		pageAsBytes, err := json.Marshal(carPage{Records: records, Fetched: len(records), Bookmark: bookmark})
+		return pageAsBytes, nil, err
+
+	case "createCar":
+		if _, ok := network.cars[args[0]]; ok {
+			return nil, nil, errors.New("Car " + args[0] + " already exists")
+		}
+		c := car{VIN: args[0], Make: args[1], Model: args[2], Colour: args[3], Owner: args[4], Status: "active"}
+		if len(args) == 8 {
+			c.Year, _ = strconv.Atoi(args[5])
+			c.Mileage, _ = strconv.Atoi(args[6])
+			c.Plate = args[7]
+		}
+		return nil, func() { network.cars[c.VIN] = c }, nil
+
+	case "initiateTransfer":
+		if _, ok := network.cars[args[0]]; !ok {
+			return nil, nil, errors.New("Car " + args[0] + " does not exist")
+		}
+		return nil, func() { network.offers[args[0]] = args[1] }, nil
+
+	case "acceptTransfer":
+		buyer, ok := network.offers[args[0]]
+		if !ok {
+			return nil, nil, errors.New("No transfer is pending for car " + args[0])
+		}
+		return nil, func() {
+			c := network.cars[args[0]]
+			c.Owner = buyer
+			network.cars[args[0]] = c
+			delete(network.offers, args[0])
+		}, nil
+	}
+	return nil, nil, errors.New("Invalid Smart Contract function name.")
+}
+
+func (network *fakeNetwork) Broadcast(ctx context.Context, opts ...grpc.CallOption) (ab.AtomicBroadcast_BroadcastClient, error) {
+	return &fakeBroadcast{network: network}, nil
+}
+
+func (network *fakeNetwork) Deliver(ctx context.Context, opts ...grpc.CallOption) (ab.AtomicBroadcast_DeliverClient, error) {
+	return nil, errors.New("Deliver is not supported")
+}
+
+// fakeBroadcast commits the writes of the transactions sent to the orderer
+type fakeBroadcast struct {
+	grpc.ClientStream
+	network *fakeNetwork
+	status  common.Status
+}
+
+func (stream *fakeBroadcast) Send(envelope *common.Envelope) error {
+	payload := &common.Payload{}
+	err := proto.Unmarshal(envelope.Payload, payload)
+	if err != nil {
+		return err
+	}
+	channelHeader := &common.ChannelHeader{}
+	err = proto.Unmarshal(payload.Header.ChannelHeader, channelHeader)
+	if err != nil {
+		return err
+	}
+	write, ok := stream.network.pending[channelHeader.TxId]
+	if !ok || len(envelope.Signature) == 0 {
+		stream.status = common.Status_UNKNOWN
+		return nil
+	}
+	write()
+	delete(stream.network.pending, channelHeader.TxId)
+	stream.status = common.Status_SUCCESS
+	return nil
+}
+
+func (stream *fakeBroadcast) Recv() (*ab.BroadcastResponse, error) {
+	return &ab.BroadcastResponse{Status: stream.status}, nil
+}
+
+func (stream *fakeBroadcast) CloseSend() error {
+	return nil
+}
+
+func testGateway(t *testing.T, network *fakeNetwork) carGateway {
+	id, err := client.LoadIdentity("../creds", "PeerAdmin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.NewGateway(id, "mychannel", "fabcar", time.Second, network, network)
+}
+
+func checkRun(t *testing.T, gateway carGateway, output string, args []string, expected string) {
+	var out bytes.Buffer
+	err := run(gateway, output, args, &out)
+	if err != nil {
+		fmt.Println("Run", args, "failed:", err)
+		t.FailNow()
+	}
+	if out.String() != expected {
+		fmt.Printf("Run %v printed\n%s\nand not\n%s\nas expected\n", args, out.String(), expected)
+		t.FailNow()
+	}
+}
+
+func checkRunFailed(t *testing.T, gateway carGateway, args []string, expected string) {
+	err := run(gateway, "table", args, &bytes.Buffer{})
+	if err == nil {
+		fmt.Println("Run", args, "succeeded")
+		t.FailNow()
+	} else if err.Error() != expected {
+		fmt.Println("Run", args, "failed with", err, "and not", expected)
+		t.FailNow()
+	}
+}
+
+var (
+	tomsCar    = car{VIN: "1HGCM82633A004352", Make: "Toyota", Model: "Prius", Colour: "blue", Owner: "Tom", Year: 2003, Mileage: 120000, Plate: "ABC123", Status: "active"}
+	nicksCar   = car{VIN: "1G1RA6E44BU000011", Make: "Chevrolet", Model: "Volt", Colour: "red", Owner: "Nick", Status: "active"}
+	barrysCar  = car{VIN: "JTDKB20U993000012", Make: "Toyota", Model: "Prius", Colour: "white", Owner: "Barry", Status: "active"}
+	tableTitle = "VIN                MAKE       MODEL  COLOUR  OWNER  YEAR  MILEAGE  PLATE   STATUS\n"
+)
+
+func Test_query(t *testing.T) {
+	gateway := testGateway(t, newFakeNetwork(tomsCar))
+
+	checkRun(t, gateway, "table", []string{"query", tomsCar.VIN},
+		"VIN                MAKE    MODEL  COLOUR  OWNER  YEAR  MILEAGE  PLATE   STATUS\n"+
+			"1HGCM82633A004352  Toyota  Prius  blue    Tom    2003  120000   ABC123  active\n")
+	checkRun(t, gateway, "json", []string{"query", tomsCar.VIN}, `{
+  "vin": "1HGCM82633A004352",
+  "make": "Toyota",
+  "model": "Prius",
+  "colour": "blue",
+  "owner": "Tom",
+  "year": 2003,
+  "mileage": 120000,
+  "plate": "ABC123",
+  "status": "active"
+}
+`)
+	checkRunFailed(t, gateway, []string{"query", "JTDKB20U093000013"}, "queryCar failed: Car JTDKB20U093000013 does not exist")
+	checkRunFailed(t, gateway, []string{"query"}, "Usage: query <vin>")
+}
+
+func Test_query_all(t *testing.T) {
+	network := newFakeNetwork(tomsCar, nicksCar, barrysCar)
+	gateway := testGateway(t, network)
+
+	checkRun(t, gateway, "table", []string{"query-all"}, tableTitle+
+		"1G1RA6E44BU000011  Chevrolet  Volt   red     Nick   -     -        -       active\n"+
+		"1HGCM82633A004352  Toyota     Prius  blue    Tom    2003  120000   ABC123  active\n"+
+		"JTDKB20U993000012  Toyota     Prius  white   Barry  -     -        -       active\n")
+
+	checkRun(t, gateway, "table", []string{"query-all", "-page-size", "2"}, tableTitle+
+		"1G1RA6E44BU000011  Chevrolet  Volt   red     Nick   -     -        -       active\n"+
+		"1HGCM82633A004352  Toyota     Prius  blue    Tom    2003  120000   ABC123  active\n"+
+		"\nNext page: -bookmark 1HGCM82633A004352\n")
+	checkRun(t, gateway, "json", []string{"query-all", "-page-size", "2", "-bookmark", "1HGCM82633A004352"}, `{
+  "records": [
+    {
+      "Key": "JTDKB20U993000012",
+      "Record": {
+        "vin": "JTDKB20U993000012",
+        "make": "Toyota",
+        "model": "Prius",
+        "colour": "white",
+        "owner": "Barry",
+        "year": 0,
+        "mileage": 0,
+        "plate": "",
+        "status": "active"
+      }
+    }
+  ],
+  "fetched": 1,
+  "bookmark": ""
+}
+`)
+
+	checkRunFailed(t, gateway, []string{"query-all", "-page-size", "-1"}, "Page size must not be negative")
+	checkRunFailed(t, gateway, []string{"query-all", "extra"}, "Usage: query-all [flags]")
+}
+
+func Test_create_commits_the_car(t *testing.T) {
+	network := newFakeNetwork(tomsCar)
+	gateway := testGateway(t, network)
+
+	var out bytes.Buffer
+	err := run(gateway, "json", []string{"create", nicksCar.VIN, "Chevrolet", "Volt", "red", "Nick"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tx struct {
+		TxID string `json:"txID"`
+	}
+	err = json.Unmarshal(out.Bytes(), &tx)
+	if err != nil || len(tx.TxID) != 64 {
+		t.Fatalf("Create printed %s", out.String())
+	}
+	if network.cars[nicksCar.VIN] != nicksCar {
+		t.Fatalf("Created car was %v", network.cars[nicksCar.VIN])
+	}
+
+	out.Reset()
+	err = run(gateway, "table", []string{"create", barrysCar.VIN, "Toyota", "Prius", "white", "Barry", "2009", "1000", "XYZ789"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "Transaction ") || !strings.HasSuffix(out.String(), " committed\n") {
+		t.Fatalf("Create printed %s", out.String())
+	}
+	if network.cars[barrysCar.VIN].Year != 2009 || network.cars[barrysCar.VIN].Plate != "XYZ789" {
+		t.Fatalf("Created car was %v", network.cars[barrysCar.VIN])
+	}
+}
+
+func Test_create_failures_are_not_sent_to_the_orderer(t *testing.T) {
+	network := newFakeNetwork(tomsCar)
+	gateway := testGateway(t, network)
+
+	checkRunFailed(t, gateway, []string{"create", tomsCar.VIN, "Honda", "Accord", "black", "Tom"},
+		"createCar failed: Car "+tomsCar.VIN+" already exists")
+	if len(network.pending) != 0 || network.cars[tomsCar.VIN] != tomsCar {
+		t.Fatal("Failed create was committed")
+	}
+	checkRunFailed(t, gateway, []string{"create", nicksCar.VIN, "Chevrolet", "Volt", "red"},
+		"Usage: create <vin> <make> <model> <colour> <owner> [<year> <mileage> <plate>] [<ownerMSP>]")
+}
+
+func Test_transfer_and_accept(t *testing.T) {
+	network := newFakeNetwork(tomsCar)
+	gateway := testGateway(t, network)
+
+	err := run(gateway, "table", []string{"transfer", tomsCar.VIN, "Barry", "Org1MSP"}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network.offers[tomsCar.VIN] != "Barry" || network.cars[tomsCar.VIN].Owner != "Tom" {
+		t.Fatal("Transfer was not initiated")
+	}
+	err = run(gateway, "table", []string{"accept", tomsCar.VIN}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network.cars[tomsCar.VIN].Owner != "Barry" {
+		t.Fatal("Transfer was not accepted")
+	}
+	if fmt.Sprint(network.functions) != "[initiateTransfer acceptTransfer]" {
+		t.Fatalf("Functions run were %v", network.functions)
+	}
+
+	checkRunFailed(t, gateway, []string{"accept", tomsCar.VIN}, "acceptTransfer failed: No transfer is pending for car "+tomsCar.VIN)
+	checkRunFailed(t, gateway, []string{"transfer", tomsCar.VIN}, "Usage: transfer <vin> <buyer> [<buyerMSP>]")
+}
+
+func Test_unknown_command_fails(t *testing.T) {
+	gateway := testGateway(t, newFakeNetwork())
+	checkRunFailed(t, gateway, []string{"delete", tomsCar.VIN}, "Unknown command delete")
+	checkRunFailed(t, gateway, []string{}, "Missing command")
+}
@@ -0,0 +1,123 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// car holds the fields of a fabcar car shown in tables
+type car struct {
+	VIN     string `json:"vin"`
+	Make    string `json:"make"`
+	Model   string `json:"model"`
+	Colour  string `json:"colour"`
+	Owner   string `json:"owner"`
+	Year    int    `json:"year"`
+	Mileage int    `json:"mileage"`
+	Plate   string `json:"plate"`
+	Status  string `json:"status"`
+}
+
+// carRecord is a car of a queryAllCars result
+type carRecord struct {
+	Key    string `json:"Key"`
+	Record car    `json:"Record"`
+}
+
+// carPage is a queryAllCars result when a page size was given
+type carPage struct {
+	Records  []carRecord `json:"records"`
+	Fetched  int         `json:"fetched"`
+	Bookmark string      `json:"bookmark"`
+}
+
+// printCar writes the queryCar result carAsBytes
+func printCar(out io.Writer, output string, carAsBytes []byte) error {
+	if output == "json" {
+		return printJSON(out, carAsBytes)
+	}
+	var c car
+	err := json.Unmarshal(carAsBytes, &c)
+	if err != nil {
+		return fmt.Errorf("Failed to decode car: %s", err.Error())
+	}
+	return printTable(out, []carRecord{{Record: c}})
+}
+
+// printCars writes the queryAllCars result pageAsBytes, either all cars or a page of them
+func printCars(out io.Writer, output string, pageAsBytes []byte) error {
+	if output == "json" {
+		return printJSON(out, pageAsBytes)
+	}
+	var page carPage
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(pageAsBytes), []byte("[")) {
+		err = json.Unmarshal(pageAsBytes, &page.Records)
+	} else {
+		err = json.Unmarshal(pageAsBytes, &page)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to decode cars: %s", err.Error())
+	}
+	err = printTable(out, page.Records)
+	if err != nil {
+		return err
+	}
+	if page.Bookmark != "" {
+		_, err = fmt.Fprintf(out, "\nNext page: -bookmark %s\n", page.Bookmark)
+	}
+	return err
+}
+
+// printTx writes the ID of a committed transaction
+func printTx(out io.Writer, output string, txID string) error {
+	if output == "json" {
+		txAsBytes, err := json.Marshal(map[string]string{"txID": txID})
+		if err != nil {
+			return err
+		}
+		return printJSON(out, txAsBytes)
+	}
+	_, err := fmt.Fprintf(out, "Transaction %s committed\n", txID)
+	return err
+}
+
+// printJSON writes a chaincode result as indented JSON
+func printJSON(out io.Writer, result []byte) error {
+	var buffer bytes.Buffer
+	err := json.Indent(&buffer, result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to decode result: %s", err.Error())
+	}
+	buffer.WriteString("\n")
+	_, err = buffer.WriteTo(out)
+	return err
+}
+
+// printTable writes one row per car, showing "-" for the fields a car does not have
+func printTable(out io.Writer, records []carRecord) error {
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "VIN\tMAKE\tMODEL\tCOLOUR\tOWNER\tYEAR\tMILEAGE\tPLATE\tSTATUS")
+	for _, record := range records {
+		c := record.Record
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", optional(c.VIN), c.Make, c.Model, c.Colour, c.Owner,
+			optional(c.Year), optional(c.Mileage), optional(c.Plate), optional(c.Status))
+	}
+	return writer.Flush()
+}
+
+func optional(value interface{}) string {
+	if value == "" || value == 0 {
+		return "-"
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,71 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/protos/common"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"google.golang.org/grpc"
+)
+
+// BlockReader reads the committed blocks of a channel from a peer, through the qscc
+// system chaincode. Unlike the event hub, it can read blocks committed in the past.
+type BlockReader struct {
+	gateway *Gateway
+}
+
+// ConnectBlockReader connects to the peer at url, such as grpc://localhost:7051, to read
+// the blocks of channel as the given identity
+func ConnectBlockReader(url string, id *Identity, channel string, timeout time.Duration) (*BlockReader, error) {
+	conn, err := dial(url, timeout)
+	if err != nil {
+		return nil, err
+	}
+	gateway := NewGateway(id, channel, "qscc", timeout, pb.NewEndorserClient(conn), nil)
+	gateway.conns = []*grpc.ClientConn{conn}
+	return &BlockReader{gateway: gateway}, nil
+}
+
+// BlockEvents reads block number and returns its chaincode events
+func (reader *BlockReader) BlockEvents(number uint64) ([]ChaincodeEvent, error) {
+	blockAsBytes, err := reader.gateway.Query("GetBlockByNumber", reader.gateway.channel, strconv.FormatUint(number, 10))
+	if err != nil {
+		return nil, err
+	}
+	block := &common.Block{}
+	err = proto.Unmarshal(blockAsBytes, block)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode block %d: %s", number, err.Error())
+	} else if block.Header == nil || block.Header.Number != number {
+		return nil, fmt.Errorf("Peer returned another block than block %d", number)
+	}
+	return ChaincodeEventsFromBlock(block)
+}
+
+// Height returns the number of blocks of the channel
+func (reader *BlockReader) Height() (uint64, error) {
+	infoAsBytes, err := reader.gateway.Query("GetChainInfo", reader.gateway.channel)
+	if err != nil {
+		return 0, err
+	}
+	info := &common.BlockchainInfo{}
+	err = proto.Unmarshal(infoAsBytes, info)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to decode chain info: %s", err.Error())
+	}
+	return info.Height, nil
+}
+
+// Close closes the connection to the peer
+func (reader *BlockReader) Close() error {
+	return reader.gateway.Close()
+}
@@ -0,0 +1,42 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// dial connects to a peer or orderer url, such as grpc://localhost:7051. The sample
+// network runs without TLS, grpcs urls are not supported.
+func dial(url string, timeout time.Duration) (*grpc.ClientConn, error) {
+	address, err := grpcAddress(url)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(timeout))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to %s: %s", url, err.Error())
+	}
+	return conn, nil
+}
+
+// grpcAddress returns the host and port of a grpc:// url
+func grpcAddress(url string) (string, error) {
+	if strings.HasPrefix(url, "grpcs://") {
+		return "", errors.New("TLS connections are not supported: " + url)
+	}
+	address := strings.TrimPrefix(url, "grpc://")
+	if address == "" || strings.Contains(address, "://") || !strings.Contains(address, ":") {
+		return "", errors.New("Invalid url " + url + ", expecting grpc://host:port")
+	}
+	return address, nil
+}
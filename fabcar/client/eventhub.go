@@ -0,0 +1,262 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/protos/common"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric/protos/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// ChaincodeEvent is an event set by a valid transaction of a block
+type ChaincodeEvent struct {
+	BlockNumber uint64
+	TxID        string
+	ChaincodeID string
+	EventName   string
+	Payload     []byte
+}
+
+// EventHub is a block event stream from a peer event service
+type EventHub struct {
+	conn   *grpc.ClientConn
+	stream pb.Events_ChatClient
+	cancel context.CancelFunc
+}
+
+// ConnectEventHub registers for block events with the event service at url, such as
+// grpc://localhost:7053, as the given identity
+func ConnectEventHub(url string, id *Identity, timeout time.Duration) (*EventHub, error) {
+	conn, err := dial(url, timeout)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	hub := &EventHub{conn: conn, cancel: cancel}
+	hub.stream, err = pb.NewEventsClient(conn).Chat(ctx)
+	if err != nil {
+		hub.Close()
+		return nil, fmt.Errorf("Failed to open event stream: %s", err.Error())
+	}
+
+	creator, err := id.Serialize()
+	if err != nil {
+		hub.Close()
+		return nil, err
+	}
+	register := &pb.Event{
+		Event:     &pb.Event_Register{Register: &pb.Register{Events: []*pb.Interest{{EventType: pb.EventType_BLOCK}}}},
+		Creator:   creator,
+		Timestamp: &timestamp.Timestamp{Seconds: time.Now().Unix()},
+	}
+	eventBytes, err := proto.Marshal(register)
+	if err != nil {
+		hub.Close()
+		return nil, err
+	}
+	signature, err := id.Sign(eventBytes)
+	if err != nil {
+		hub.Close()
+		return nil, err
+	}
+	err = hub.stream.Send(&pb.SignedEvent{EventBytes: eventBytes, Signature: signature})
+	if err != nil {
+		hub.Close()
+		return nil, fmt.Errorf("Failed to register for events: %s", err.Error())
+	}
+
+	// the event service acknowledges the registration by sending it back
+	ack, err := hub.stream.Recv()
+	if err != nil {
+		hub.Close()
+		return nil, fmt.Errorf("Failed to register for events: %s", err.Error())
+	} else if _, ok := ack.Event.(*pb.Event_Register); !ok {
+		hub.Close()
+		return nil, fmt.Errorf("Unexpected registration response %v", ack)
+	}
+	return hub, nil
+}
+
+// NextBlock waits for the next block and returns its number and chaincode events
+func (hub *EventHub) NextBlock() (uint64, []ChaincodeEvent, error) {
+	for {
+		event, err := hub.stream.Recv()
+		if err != nil {
+			return 0, nil, err
+		}
+		blockEvent, ok := event.Event.(*pb.Event_Block)
+		if !ok || blockEvent.Block == nil || blockEvent.Block.Header == nil {
+			continue
+		}
+		events, err := ChaincodeEventsFromBlock(blockEvent.Block)
+		return blockEvent.Block.Header.Number, events, err
+	}
+}
+
+// WaitForTx waits for the block holding transaction txID, and returns an error unless
+// the transaction is valid
+func (hub *EventHub) WaitForTx(txID string, timeout time.Duration) error {
+	type result struct {
+		code pb.TxValidationCode
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		for {
+			event, err := hub.stream.Recv()
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			blockEvent, ok := event.Event.(*pb.Event_Block)
+			if !ok || blockEvent.Block == nil {
+				continue
+			}
+			code, found, err := TxValidationCode(blockEvent.Block, txID)
+			if err != nil || found {
+				done <- result{code: code, err: err}
+				return
+			}
+		}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		} else if r.code != pb.TxValidationCode_VALID {
+			return fmt.Errorf("Transaction %s is invalid: %s", txID, r.code)
+		}
+		return nil
+	case <-time.After(timeout):
+		// closing the hub ends the receiving goroutine
+		return fmt.Errorf("Transaction %s was not committed within %s", txID, timeout)
+	}
+}
+
+// Close stops the event stream and closes the connection
+func (hub *EventHub) Close() error {
+	hub.cancel()
+	return hub.conn.Close()
+}
+
+// TxValidationCode returns the validation code of transaction txID, and whether the
+// block holds it
+func TxValidationCode(block *common.Block, txID string) (pb.TxValidationCode, bool, error) {
+	filter := transactionsFilter(block)
+	for i, data := range block.Data.Data {
+		channelHeader, _, err := unmarshalTransaction(data)
+		if err != nil {
+			return 0, false, fmt.Errorf("Failed to decode transaction %d of block %d: %s", i, block.Header.Number, err.Error())
+		}
+		if channelHeader.TxId != txID {
+			continue
+		}
+		if i >= len(filter) {
+			return 0, false, fmt.Errorf("Transaction %s of block %d was not validated", txID, block.Header.Number)
+		}
+		return pb.TxValidationCode(filter[i]), true, nil
+	}
+	return 0, false, nil
+}
+
+// ChaincodeEventsFromBlock returns the chaincode events of the valid endorser
+// transactions of a block
+func ChaincodeEventsFromBlock(block *common.Block) ([]ChaincodeEvent, error) {
+	filter := transactionsFilter(block)
+	events := []ChaincodeEvent{}
+	for i, data := range block.Data.Data {
+		// transactions without a validation flag were not validated, skip them too
+		if i >= len(filter) || filter[i] != uint8(pb.TxValidationCode_VALID) {
+			continue
+		}
+		channelHeader, payload, err := unmarshalTransaction(data)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode transaction %d of block %d: %s", i, block.Header.Number, err.Error())
+		}
+		if common.HeaderType(channelHeader.Type) != common.HeaderType_ENDORSER_TRANSACTION {
+			continue
+		}
+		tx, err := utils.GetTransaction(payload.Data)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode transaction %s: %s", channelHeader.TxId, err.Error())
+		}
+		for _, action := range tx.Actions {
+			event, err := chaincodeEventFromAction(action)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to decode transaction %s: %s", channelHeader.TxId, err.Error())
+			} else if event == nil || event.EventName == "" {
+				continue
+			}
+			events = append(events, ChaincodeEvent{BlockNumber: block.Header.Number, TxID: channelHeader.TxId,
+				ChaincodeID: event.ChaincodeId, EventName: event.EventName, Payload: event.Payload})
+		}
+	}
+	return events, nil
+}
+
+// chaincodeEventFromAction returns the event set by the chaincode of a transaction
+// action, or nil if there is none
+func chaincodeEventFromAction(action *pb.TransactionAction) (*pb.ChaincodeEvent, error) {
+	actionPayload, err := utils.GetChaincodeActionPayload(action.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if actionPayload.Action == nil {
+		return nil, nil
+	}
+	responsePayload, err := utils.GetProposalResponsePayload(actionPayload.Action.ProposalResponsePayload)
+	if err != nil {
+		return nil, err
+	}
+	chaincodeAction, err := utils.GetChaincodeAction(responsePayload.Extension)
+	if err != nil {
+		return nil, err
+	}
+	if len(chaincodeAction.Events) == 0 {
+		return nil, nil
+	}
+	return utils.GetChaincodeEvents(chaincodeAction.Events)
+}
+
+// transactionsFilter returns the validation codes of the transactions of a block, set by
+// the committing peer
+func transactionsFilter(block *common.Block) []byte {
+	if block.Metadata == nil || len(block.Metadata.Metadata) <= int(common.BlockMetadataIndex_TRANSACTIONS_FILTER) {
+		return nil
+	}
+	return block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER]
+}
+
+// unmarshalTransaction decodes the envelope of a block transaction, and returns its
+// channel header and payload
+func unmarshalTransaction(data []byte) (*common.ChannelHeader, *common.Payload, error) {
+	envelope, err := utils.GetEnvelopeFromBlock(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := utils.GetPayload(envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	if payload.Header == nil {
+		return nil, nil, errors.New("Transaction has no header")
+	}
+	channelHeader, err := utils.UnmarshalChannelHeader(payload.Header.ChannelHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return channelHeader, payload, nil
+}
@@ -0,0 +1,226 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/protos/common"
+	ab "github.com/hyperledger/fabric/protos/orderer"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric/protos/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Gateway runs the functions of a chaincode: queries are endorsed by the peer, and
+// invokes are then sent to the orderer and waited for until committed
+type Gateway struct {
+	id        *Identity
+	channel   string
+	chaincode string
+	timeout   time.Duration
+	endorser  pb.EndorserClient
+	orderer   ab.AtomicBroadcastClient
+	// events connects to the peer event hub to wait for commits, none when nil
+	events func() (*EventHub, error)
+	conns  []*grpc.ClientConn
+}
+
+// Connect connects to the peer and orderer of a profile, as the profile user
+func Connect(profile *Profile) (*Gateway, error) {
+	id, err := LoadIdentity(profile.Wallet, profile.User)
+	if err != nil {
+		return nil, err
+	}
+	peerConn, err := dial(profile.Peer, profile.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	ordererConn, err := dial(profile.Orderer, profile.Timeout)
+	if err != nil {
+		peerConn.Close()
+		return nil, err
+	}
+
+	gateway := NewGateway(id, profile.Channel, profile.Chaincode, profile.Timeout,
+		pb.NewEndorserClient(peerConn), ab.NewAtomicBroadcastClient(ordererConn))
+	gateway.conns = []*grpc.ClientConn{peerConn, ordererConn}
+	gateway.events = func() (*EventHub, error) {
+		return ConnectEventHub(profile.Events, id, profile.Timeout)
+	}
+	return gateway, nil
+}
+
+// NewGateway returns a gateway using the given endorser and orderer clients, which do
+// not need to be remote: tests use in-process ones. Invokes do not wait for commits.
+func NewGateway(id *Identity, channel string, chaincode string, timeout time.Duration,
+	endorser pb.EndorserClient, orderer ab.AtomicBroadcastClient) *Gateway {
+	return &Gateway{id: id, channel: channel, chaincode: chaincode, timeout: timeout,
+		endorser: endorser, orderer: orderer}
+}
+
+// Close closes the connections of the gateway
+func (gateway *Gateway) Close() error {
+	for _, conn := range gateway.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// Query runs a chaincode function on the peer without updating the ledger, and returns
+// its payload
+func (gateway *Gateway) Query(function string, args ...string) ([]byte, error) {
+	_, _, response, err := gateway.endorse(function, args)
+	if err != nil {
+		return nil, err
+	}
+	return response.Response.Payload, nil
+}
+
+// Invoke runs a chaincode function and commits its result to the ledger, and returns the
+// transaction ID
+func (gateway *Gateway) Invoke(function string, args ...string) (string, error) {
+	proposal, txID, response, err := gateway.endorse(function, args)
+	if err != nil {
+		return "", err
+	}
+	envelope, err := gateway.transaction(proposal, response)
+	if err != nil {
+		return "", err
+	}
+
+	// the event hub only sends blocks committed after registering, so it must be
+	// connected before the transaction is sent
+	var hub *EventHub
+	if gateway.events != nil {
+		hub, err = gateway.events()
+		if err != nil {
+			return "", err
+		}
+		defer hub.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gateway.timeout)
+	defer cancel()
+	stream, err := gateway.orderer.Broadcast(ctx)
+	if err != nil {
+		return "", fmt.Errorf("Failed to connect to orderer: %s", err.Error())
+	}
+	defer stream.CloseSend()
+	err = stream.Send(envelope)
+	if err != nil {
+		return "", fmt.Errorf("Failed to send transaction %s: %s", txID, err.Error())
+	}
+	broadcastResponse, err := stream.Recv()
+	if err != nil {
+		return "", fmt.Errorf("Failed to send transaction %s: %s", txID, err.Error())
+	} else if broadcastResponse.Status != common.Status_SUCCESS {
+		return "", fmt.Errorf("Orderer rejected transaction %s: %s", txID, broadcastResponse.Status)
+	}
+
+	if hub == nil {
+		return txID, nil
+	}
+	return txID, hub.WaitForTx(txID, gateway.timeout)
+}
+
+// endorse sends a signed proposal for function to the peer, and checks the chaincode
+// succeeded. It returns the proposal, its transaction ID and the peer response.
+func (gateway *Gateway) endorse(function string, args []string) (*pb.Proposal, string, *pb.ProposalResponse, error) {
+	input := [][]byte{[]byte(function)}
+	for _, arg := range args {
+		input = append(input, []byte(arg))
+	}
+	spec := &pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{
+		Type:        pb.ChaincodeSpec_GOLANG,
+		ChaincodeId: &pb.ChaincodeID{Name: gateway.chaincode},
+		Input:       &pb.ChaincodeInput{Args: input},
+	}}
+
+	creator, err := gateway.id.Serialize()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	proposal, txID, err := utils.CreateChaincodeProposal(common.HeaderType_ENDORSER_TRANSACTION, gateway.channel, spec, creator)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("Failed to create proposal: %s", err.Error())
+	}
+	proposalBytes, err := proto.Marshal(proposal)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	signature, err := gateway.id.Sign(proposalBytes)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gateway.timeout)
+	defer cancel()
+	response, err := gateway.endorser.ProcessProposal(ctx, &pb.SignedProposal{ProposalBytes: proposalBytes, Signature: signature})
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("Failed to send proposal: %s", err.Error())
+	}
+	if response.Response == nil {
+		return nil, "", nil, errors.New("Peer returned no response")
+	} else if response.Response.Status != 200 {
+		return nil, "", nil, fmt.Errorf("%s failed: %s", function, response.Response.Message)
+	}
+	return proposal, txID, response, nil
+}
+
+// transaction assembles and signs the transaction envelope of an endorsed proposal
+func (gateway *Gateway) transaction(proposal *pb.Proposal, response *pb.ProposalResponse) (*common.Envelope, error) {
+	if response.Endorsement == nil {
+		return nil, errors.New("Proposal was not endorsed")
+	}
+	header := &common.Header{}
+	err := proto.Unmarshal(proposal.Header, header)
+	if err != nil {
+		return nil, err
+	}
+	// the transient map of the proposal must not reach the ledger
+	proposalPayload := &pb.ChaincodeProposalPayload{}
+	err = proto.Unmarshal(proposal.Payload, proposalPayload)
+	if err != nil {
+		return nil, err
+	}
+	proposalPayload.TransientMap = nil
+	proposalPayloadBytes, err := proto.Marshal(proposalPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	actionPayloadBytes, err := proto.Marshal(&pb.ChaincodeActionPayload{
+		ChaincodeProposalPayload: proposalPayloadBytes,
+		Action: &pb.ChaincodeEndorsedAction{
+			ProposalResponsePayload: response.Payload,
+			Endorsements:            []*pb.Endorsement{response.Endorsement},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	txBytes, err := proto.Marshal(&pb.Transaction{Actions: []*pb.TransactionAction{
+		{Header: header.SignatureHeader, Payload: actionPayloadBytes},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	payloadBytes, err := proto.Marshal(&common.Payload{Header: header, Data: txBytes})
+	if err != nil {
+		return nil, err
+	}
+	signature, err := gateway.id.Sign(payloadBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &common.Envelope{Payload: payloadBytes, Signature: signature}, nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package client holds what the Go fabcar applications share to talk to the network:
+// the user identity read from the wallet written by the Node.js SDK, and the peer and
+// orderer connections.
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// Identity is an enrolled user, able to sign proposals, transactions and event
+// registrations
+type Identity struct {
+	Name        string
+	MSPID       string
+	Certificate []byte // PEM encoded
+	key         *ecdsa.PrivateKey
+}
+
+// walletUser is the user file the Node.js SDK key value store writes, e.g. creds/PeerAdmin
+type walletUser struct {
+	Name       string `json:"name"`
+	MSPID      string `json:"mspid"`
+	Enrollment struct {
+		SigningIdentity string `json:"signingIdentity"`
+		Identity        struct {
+			Certificate string `json:"certificate"`
+		} `json:"identity"`
+	} `json:"enrollment"`
+}
+
+// LoadIdentity reads the user userID from a wallet directory such as fabcar/creds.
+// The private key is read from the <signingIdentity>-priv file next to the user file.
+func LoadIdentity(walletPath string, userID string) (*Identity, error) {
+	userAsBytes, err := ioutil.ReadFile(filepath.Join(walletPath, userID))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read user %s: %s", userID, err.Error())
+	}
+	var user walletUser
+	err = json.Unmarshal(userAsBytes, &user)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode user %s: %s", userID, err.Error())
+	}
+	if user.MSPID == "" || user.Enrollment.SigningIdentity == "" || user.Enrollment.Identity.Certificate == "" {
+		return nil, fmt.Errorf("User %s is not enrolled", userID)
+	}
+
+	certificate := []byte(user.Enrollment.Identity.Certificate)
+	block, _ := pem.Decode(certificate)
+	if block == nil {
+		return nil, fmt.Errorf("Failed to decode certificate of user %s", userID)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse certificate of user %s: %s", userID, err.Error())
+	}
+
+	keyAsBytes, err := ioutil.ReadFile(filepath.Join(walletPath, user.Enrollment.SigningIdentity+"-priv"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read private key of user %s: %s", userID, err.Error())
+	}
+	block, _ = pem.Decode(keyAsBytes)
+	if block == nil {
+		return nil, fmt.Errorf("Failed to decode private key of user %s", userID)
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse private key of user %s: %s", userID, err.Error())
+	}
+	key, ok := parsedKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key of user %s is not an ECDSA key", userID)
+	}
+	certKey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || certKey.X.Cmp(key.X) != 0 || certKey.Y.Cmp(key.Y) != 0 {
+		return nil, fmt.Errorf("Private key of user %s does not match its certificate", userID)
+	}
+
+	return &Identity{Name: user.Name, MSPID: user.MSPID, Certificate: certificate, key: key}, nil
+}
+
+// Serialize returns the identity as the creator of a message, a serialized msp.SerializedIdentity
+func (id *Identity) Serialize() ([]byte, error) {
+	return proto.Marshal(&msp.SerializedIdentity{Mspid: id.MSPID, IdBytes: id.Certificate})
+}
+
+// Sign signs the SHA-256 digest of message. The signature is made low-S, as peers and
+// orderers reject the other one of the two valid ECDSA signatures.
+func (id *Identity) Sign(message []byte) ([]byte, error) {
+	digest := sha256.Sum256(message)
+	r, s, err := ecdsa.Sign(rand.Reader, id.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	halfOrder := new(big.Int).Rsh(id.key.Params().N, 1)
+	if s.Cmp(halfOrder) > 0 {
+		s.Sub(id.key.Params().N, s)
+	}
+	return asn1.Marshal(ecdsaSignature{R: r, S: s})
+}
+
+// ecdsaSignature is the ASN.1 structure of an ECDSA signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
@@ -0,0 +1,89 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+func Test_LoadIdentity_reads_the_sample_wallet(t *testing.T) {
+	id, err := LoadIdentity("../creds", "PeerAdmin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Name != "PeerAdmin" || id.MSPID != "Org1MSP" {
+		t.Fatalf("Identity was %s of %s", id.Name, id.MSPID)
+	}
+
+	creator, err := id.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serializedID := &msp.SerializedIdentity{}
+	err = proto.Unmarshal(creator, serializedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serializedID.Mspid != "Org1MSP" || string(serializedID.IdBytes) != string(id.Certificate) {
+		t.Fatalf("Serialized identity was %v", serializedID)
+	}
+}
+
+func Test_LoadIdentity_missing_user_fails(t *testing.T) {
+	_, err := LoadIdentity("../creds", "Nobody")
+	if err == nil {
+		t.Fatal("Loading a missing user succeeded")
+	}
+}
+
+func Test_Sign_makes_low_S_signatures(t *testing.T) {
+	id, err := LoadIdentity("../creds", "PeerAdmin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := []byte("fabcar")
+	digest := sha256.Sum256(message)
+	halfOrder := new(big.Int).Rsh(id.key.Params().N, 1)
+
+	// low-S is only needed about half of the time, sign enough to hit it
+	for i := 0; i < 20; i++ {
+		signature, err := id.Sign(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sig ecdsaSignature
+		_, err = asn1.Unmarshal(signature, &sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig.S.Cmp(halfOrder) > 0 {
+			t.Fatal("Signature is not low-S")
+		}
+		if !ecdsa.Verify(&id.key.PublicKey, digest[:], sig.R, sig.S) {
+			t.Fatal("Signature does not verify")
+		}
+	}
+}
+
+func Test_grpcAddress(t *testing.T) {
+	address, err := grpcAddress("grpc://localhost:7053")
+	if err != nil || address != "localhost:7053" {
+		t.Fatalf("Address was %s, %v", address, err)
+	}
+	for _, url := range []string{"grpcs://localhost:7053", "http://localhost:7053", "grpc://localhost", ""} {
+		if _, err := grpcAddress(url); err == nil {
+			t.Fatalf("Url %s was accepted", url)
+		}
+	}
+}
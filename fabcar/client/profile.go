@@ -0,0 +1,64 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Profile holds the connection settings of the Go applications, read from a YAML file
+// such as fabcar/connection.yaml. Unset settings default to those of invoke.js.
+type Profile struct {
+	Wallet    string        `yaml:"wallet"` // relative to the profile file
+	User      string        `yaml:"user"`
+	Channel   string        `yaml:"channel"`
+	Chaincode string        `yaml:"chaincode"`
+	Peer      string        `yaml:"peer"`
+	Events    string        `yaml:"events"`
+	Orderer   string        `yaml:"orderer"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// DefaultProfile returns the settings of invoke.js and query.js
+func DefaultProfile() *Profile {
+	return &Profile{
+		Wallet:    "creds",
+		User:      "PeerAdmin",
+		Channel:   "mychannel",
+		Chaincode: "fabcar",
+		Peer:      "grpc://localhost:7051",
+		Events:    "grpc://localhost:7053",
+		Orderer:   "grpc://localhost:7050",
+		Timeout:   30 * time.Second,
+	}
+}
+
+// LoadProfile reads a profile file. A relative wallet path is resolved against the
+// directory of the file.
+func LoadProfile(path string) (*Profile, error) {
+	profileAsBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read profile: %s", err.Error())
+	}
+	profile := DefaultProfile()
+	err = yaml.Unmarshal(profileAsBytes, profile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode profile %s: %s", path, err.Error())
+	}
+	if profile.Timeout <= 0 {
+		return nil, fmt.Errorf("Invalid timeout %s in profile %s", profile.Timeout, path)
+	}
+	if !filepath.IsAbs(profile.Wallet) {
+		profile.Wallet = filepath.Join(filepath.Dir(path), profile.Wallet)
+	}
+	return profile, nil
+}
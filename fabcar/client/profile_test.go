@@ -0,0 +1,71 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeProfile(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "connection.yaml")
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func Test_LoadProfile_reads_the_sample_profile(t *testing.T) {
+	profile, err := LoadProfile("../connection.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DefaultProfile()
+	expected.Wallet = filepath.Join("..", "creds")
+	if *profile != *expected {
+		t.Fatalf("Profile was %v and not %v", profile, expected)
+	}
+	_, err = LoadIdentity(profile.Wallet, profile.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_LoadProfile_defaults_unset_settings(t *testing.T) {
+	path, cleanup := writeProfile(t, "wallet: /var/fabcar/creds\npeer: grpc://peer0:7051\ntimeout: 5s\n")
+	defer cleanup()
+
+	profile, err := LoadProfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Wallet != "/var/fabcar/creds" || profile.Peer != "grpc://peer0:7051" || profile.Timeout != 5*time.Second {
+		t.Fatalf("Profile was %v", profile)
+	}
+	if profile.User != "PeerAdmin" || profile.Orderer != "grpc://localhost:7050" {
+		t.Fatalf("Profile defaults were %v", profile)
+	}
+}
+
+func Test_LoadProfile_invalid_timeout_fails(t *testing.T) {
+	path, cleanup := writeProfile(t, "timeout: 0s\n")
+	defer cleanup()
+
+	_, err := LoadProfile(path)
+	if err == nil {
+		t.Fatal("Loading a profile without timeout succeeded")
+	}
+}
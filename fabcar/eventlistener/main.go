@@ -0,0 +1,154 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Command eventlistener keeps a JSON-lines projection of the fabcar cars up to date
+// from the CarCreated, CarTransferred, CarScrapped and CarDeleted chaincode events.
+// It resumes from the block after the last one it applied, reading the blocks it missed
+// from the peer before the new ones, and builds the projection from the first block of
+// the channel when it starts without one.
+//
+// Run it from the fabcar directory once the network is started, as PeerAdmin from creds:
+//
+//	go run ./eventlistener -out cars.jsonl
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"time"
+
+	"github.com/hyperledger/fabric-samples/fabcar/client"
+)
+
+// eventSource is a stream of blocks, the peer event hub or a stand-in in tests
+type eventSource interface {
+	NextBlock() (uint64, []client.ChaincodeEvent, error)
+}
+
+// blockReader reads the committed blocks of the channel, through the qscc system
+// chaincode or a stand-in in tests
+type blockReader interface {
+	Height() (uint64, error)
+	BlockEvents(number uint64) ([]client.ChaincodeEvent, error)
+}
+
+// catchUp is an event source which first reads the committed blocks from nextBlock on,
+// then passes on the blocks of the live source it has not read yet. The live source must
+// be connected before catchUp reads the height of the channel, so that no block is lost
+// in between.
+type catchUp struct {
+	live      eventSource
+	reader    blockReader
+	nextBlock uint64
+	height    uint64
+}
+
+func newCatchUp(live eventSource, reader blockReader, nextBlock uint64) (*catchUp, error) {
+	height, err := reader.Height()
+	if err != nil {
+		return nil, err
+	}
+	return &catchUp{live: live, reader: reader, nextBlock: nextBlock, height: height}, nil
+}
+
+func (source *catchUp) NextBlock() (uint64, []client.ChaincodeEvent, error) {
+	if source.nextBlock < source.height {
+		number := source.nextBlock
+		events, err := source.reader.BlockEvents(number)
+		if err != nil {
+			return 0, nil, err
+		}
+		source.nextBlock++
+		return number, events, nil
+	}
+	for {
+		number, events, err := source.live.NextBlock()
+		if err != nil || number >= source.nextBlock {
+			source.nextBlock = number + 1
+			return number, events, err
+		}
+	}
+}
+
+func main() {
+	walletPath := flag.String("wallet", "creds", "directory of the user credentials")
+	userID := flag.String("user", "PeerAdmin", "user to register for events as")
+	eventURL := flag.String("events", "grpc://localhost:7053", "peer event service url")
+	peerURL := flag.String("peer", "grpc://localhost:7051", "peer url, to read the blocks missed")
+	channel := flag.String("channel", "mychannel", "channel of the chaincode")
+	chaincodeID := flag.String("chaincode", "fabcar", "chaincode whose events are projected")
+	out := flag.String("out", "cars.jsonl", "JSON-lines projection file")
+	flag.Parse()
+
+	id, err := client.LoadIdentity(*walletPath, *userID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	projection, err := LoadProjection(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hub, err := client.ConnectEventHub(*eventURL, id, 10*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer hub.Close()
+	reader, err := client.ConnectBlockReader(*peerURL, id, *channel, 10*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer reader.Close()
+	source, err := newCatchUp(hub, reader, projection.NextBlock())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Listening to %s events from %s from block %d, projecting to %s", *chaincodeID, *eventURL, projection.NextBlock(), *out)
+
+	err = run(source, *chaincodeID, projection)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run applies the events of chaincodeID to the projection, saving it after each block
+// that changed it and the checkpoint after the others, until the source ends
+func run(source eventSource, chaincodeID string, projection *Projection) error {
+	for {
+		blockNumber, events, err := source.NextBlock()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		changed := false
+		for _, event := range events {
+			if event.ChaincodeID != chaincodeID {
+				continue
+			}
+			applied, err := projection.Apply(event)
+			if err != nil {
+				// a bad payload must not stop the projection, the next events still apply
+				log.Printf("Skipping event: %s", err.Error())
+				continue
+			}
+			if applied {
+				log.Printf("Block %d: %s in transaction %s", blockNumber, event.EventName, event.TxID)
+			}
+			changed = changed || applied
+		}
+		projection.Advance(blockNumber)
+		if changed {
+			err = projection.Save()
+		} else {
+			err = projection.SaveCheckpoint()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
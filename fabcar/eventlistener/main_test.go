@@ -0,0 +1,256 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hyperledger/fabric-samples/fabcar/client"
+)
+
+// fakePeer stands in for the peer event hub, sending the queued blocks then io.EOF
+type fakePeer struct {
+	blocks [][]client.ChaincodeEvent
+	number uint64
+}
+
+func (peer *fakePeer) NextBlock() (uint64, []client.ChaincodeEvent, error) {
+	if len(peer.blocks) == 0 {
+		return 0, nil, io.EOF
+	}
+	peer.number++
+	events := peer.blocks[0]
+	peer.blocks = peer.blocks[1:]
+	for i := range events {
+		events[i].BlockNumber = peer.number
+	}
+	return peer.number, events, nil
+}
+
+// testEvent builds a fabcar event about the given cars, each car being a JSON object
+func testEvent(name string, txID string, cars ...string) client.ChaincodeEvent {
+	events := []carEvent{}
+	for _, car := range cars {
+		var decoded struct {
+			VIN string `json:"vin"`
+		}
+		json.Unmarshal([]byte(car), &decoded)
+		events = append(events, carEvent{VIN: decoded.VIN, Car: json.RawMessage(car), TxID: txID, Timestamp: 1500000000})
+	}
+	payload, _ := json.Marshal(events)
+	return client.ChaincodeEvent{TxID: txID, ChaincodeID: "fabcar", EventName: name, Payload: payload}
+}
+
+func tempProjection(t *testing.T) (*Projection, func()) {
+	dir, err := ioutil.TempDir("", "eventlistener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	projection, err := LoadProjection(filepath.Join(dir, "cars.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return projection, func() { os.RemoveAll(dir) }
+}
+
+func checkRows(t *testing.T, projection *Projection, expected ...string) {
+	got := []string{}
+	for _, row := range projection.Rows() {
+		got = append(got, fmt.Sprintf("%s %s %s", row.VIN, row.Event, row.Car))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		fmt.Println("Rows were", got, "and not", expected, "as expected")
+		t.FailNow()
+	}
+}
+
+const (
+	testCar1 = `{"vin":"1HGCM82633A004352","owner":"Tom","status":"active"}`
+	testCar2 = `{"vin":"1G1RA6E44BU000011","owner":"Nick","status":"active"}`
+)
+
+func Test_run_projects_lifecycle_events(t *testing.T) {
+	projection, cleanup := tempProjection(t)
+	defer cleanup()
+
+	peer := &fakePeer{blocks: [][]client.ChaincodeEvent{
+		{testEvent(eventCarCreated, "tx1", testCar1, testCar2)},
+		{testEvent(eventCarTransferred, "tx2", `{"vin":"1HGCM82633A004352","owner":"Barry","status":"active"}`),
+			testEvent("TransferInitiated", "tx3", testCar2)},
+		{},
+		{testEvent(eventCarScrapped, "tx4", `{"vin":"1HGCM82633A004352","owner":"Barry","status":"scrapped"}`)},
+		{testEvent(eventCarDeleted, "tx5", testCar2)},
+	}}
+	err := run(peer, "fabcar", projection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRows(t, projection, `1HGCM82633A004352 CarScrapped {"vin":"1HGCM82633A004352","owner":"Barry","status":"scrapped"}`)
+
+	// the saved projection is read back the same
+	saved, err := LoadProjection(projection.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRows(t, saved, `1HGCM82633A004352 CarScrapped {"vin":"1HGCM82633A004352","owner":"Barry","status":"scrapped"}`)
+	if row := saved.Rows()[0]; row.BlockNumber != 4 || row.TxID != "tx4" {
+		fmt.Println("Saved row was", row)
+		t.FailNow()
+	}
+}
+
+func Test_run_ignores_other_chaincodes_and_bad_payloads(t *testing.T) {
+	projection, cleanup := tempProjection(t)
+	defer cleanup()
+
+	other := testEvent(eventCarCreated, "tx1", testCar1)
+	other.ChaincodeID = "marbles"
+	bad := testEvent(eventCarCreated, "tx2")
+	bad.Payload = []byte("not json")
+	peer := &fakePeer{blocks: [][]client.ChaincodeEvent{{other, bad, testEvent(eventCarCreated, "tx3", testCar2)}}}
+
+	err := run(peer, "fabcar", projection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRows(t, projection, `1G1RA6E44BU000011 CarCreated `+testCar2)
+}
+
+func Test_Apply_skips_events_older_than_the_projection(t *testing.T) {
+	projection, cleanup := tempProjection(t)
+	defer cleanup()
+
+	transferred := testEvent(eventCarTransferred, "tx2", `{"vin":"1HGCM82633A004352","owner":"Barry"}`)
+	transferred.BlockNumber = 5
+	created := testEvent(eventCarCreated, "tx1", testCar1)
+	created.BlockNumber = 3
+
+	for _, event := range []client.ChaincodeEvent{transferred, created} {
+		if _, err := projection.Apply(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRows(t, projection, `1HGCM82633A004352 CarTransferred {"vin":"1HGCM82633A004352","owner":"Barry"}`)
+}
+
+func Test_Apply_keeps_deleted_cars_deleted(t *testing.T) {
+	projection, cleanup := tempProjection(t)
+	defer cleanup()
+
+	created := testEvent(eventCarCreated, "tx1", testCar1)
+	created.BlockNumber = 3
+	deleted := testEvent(eventCarDeleted, "tx2", testCar1)
+	deleted.BlockNumber = 5
+	for _, event := range []client.ChaincodeEvent{created, deleted, created} {
+		if _, err := projection.Apply(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRows(t, projection)
+
+	// the tombstone is saved, a replay after a restart does not bring the car back either
+	err := projection.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := LoadProjection(projection.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := saved.Apply(created); err != nil || changed {
+		fmt.Println("Replayed CarCreated changed the projection", err)
+		t.FailNow()
+	}
+	checkRows(t, saved)
+
+	// a car created again later is back
+	recreated := testEvent(eventCarCreated, "tx3", testCar1)
+	recreated.BlockNumber = 6
+	if _, err := saved.Apply(recreated); err != nil {
+		t.Fatal(err)
+	}
+	checkRows(t, saved, `1HGCM82633A004352 CarCreated `+testCar1)
+}
+
+func Test_run_saves_the_checkpoint(t *testing.T) {
+	projection, cleanup := tempProjection(t)
+	defer cleanup()
+
+	peer := &fakePeer{blocks: [][]client.ChaincodeEvent{{testEvent(eventCarCreated, "tx1", testCar1)}, {}}}
+	err := run(peer, "fabcar", projection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := LoadProjection(projection.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.NextBlock() != 3 {
+		fmt.Println("Saved projection resumes from block", saved.NextBlock(), "and not 3")
+		t.FailNow()
+	}
+}
+
+// fakeReader stands in for the qscc system chaincode, its blocks being numbered from 0
+type fakeReader struct {
+	blocks [][]client.ChaincodeEvent
+	read   []uint64
+}
+
+func (reader *fakeReader) Height() (uint64, error) {
+	return uint64(len(reader.blocks)), nil
+}
+
+func (reader *fakeReader) BlockEvents(number uint64) ([]client.ChaincodeEvent, error) {
+	reader.read = append(reader.read, number)
+	events := reader.blocks[number]
+	for i := range events {
+		events[i].BlockNumber = number
+	}
+	return events, nil
+}
+
+func Test_catchUp_reads_the_missed_blocks_first(t *testing.T) {
+	projection, cleanup := tempProjection(t)
+	defer cleanup()
+	projection.Advance(1)
+
+	// the blocks committed while the listener was down, then the live ones, the first of which was read already
+	reader := &fakeReader{blocks: [][]client.ChaincodeEvent{
+		{}, {testEvent(eventCarCreated, "tx1", testCar1)},
+		{testEvent(eventCarDeleted, "tx2", testCar1)},
+		{testEvent(eventCarCreated, "tx3", testCar2)},
+	}}
+	peer := &fakePeer{number: 2, blocks: [][]client.ChaincodeEvent{
+		{testEvent(eventCarCreated, "tx3", testCar2)},
+		{testEvent(eventCarTransferred, "tx4", `{"vin":"1G1RA6E44BU000011","owner":"Barry","status":"active"}`)},
+	}}
+	source, err := newCatchUp(peer, reader, projection.NextBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run(source, "fabcar", projection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(reader.read) != fmt.Sprint([]uint64{2, 3}) {
+		fmt.Println("Blocks read were", reader.read)
+		t.FailNow()
+	}
+	checkRows(t, projection, `1G1RA6E44BU000011 CarTransferred {"vin":"1G1RA6E44BU000011","owner":"Barry","status":"active"}`)
+	if projection.NextBlock() != 5 {
+		fmt.Println("Projection resumes from block", projection.NextBlock(), "and not 5")
+		t.FailNow()
+	}
+}
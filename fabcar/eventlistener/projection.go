@@ -0,0 +1,223 @@
+/*
+Copyright IBM Corp All Rights Reserved
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/hyperledger/fabric-samples/fabcar/client"
+)
+
+// Car lifecycle events of the fabcar chaincode
+const (
+	eventCarCreated     = "CarCreated"
+	eventCarTransferred = "CarTransferred"
+	eventCarScrapped    = "CarScrapped"
+	eventCarDeleted     = "CarDeleted"
+)
+
+// carEvent is an entry of the JSON array the car lifecycle events carry. The car is kept
+// as the chaincode encoded it.
+type carEvent struct {
+	VIN              string          `json:"vin"`
+	Car              json.RawMessage `json:"car"`
+	PreviousOwner    string          `json:"previousOwner,omitempty"`
+	PreviousOwnerMSP string          `json:"previousOwnerMSP,omitempty"`
+	TxID             string          `json:"txID"`
+	Timestamp        int64           `json:"timestamp"`
+}
+
+// CarRow is a line of the projection: the last known state of a car and the event that
+// set it. A deleted car is kept as a tombstone, without its state, so that an older event
+// about it applied again does not bring it back.
+type CarRow struct {
+	VIN         string          `json:"vin"`
+	Car         json.RawMessage `json:"car,omitempty"`
+	Deleted     bool            `json:"deleted,omitempty"`
+	Event       string          `json:"event"`
+	BlockNumber uint64          `json:"blockNumber"`
+	TxID        string          `json:"txID"`
+	Timestamp   int64           `json:"timestamp"`
+}
+
+// Projection is the current state of the cars, built from the lifecycle events and saved
+// as a JSON-lines file, one car per line sorted by VIN. The number of the next block to
+// apply is saved next to it, in a checkpoint file, for the listener to resume from.
+type Projection struct {
+	path      string
+	rows      map[string]*CarRow
+	nextBlock uint64
+}
+
+// checkpoint is the content of the checkpoint file
+type checkpoint struct {
+	NextBlock uint64 `json:"nextBlock"`
+}
+
+// LoadProjection reads the projection saved at path, an empty one if there is no file yet
+func LoadProjection(path string) (*Projection, error) {
+	projection := &Projection{path: path, rows: make(map[string]*CarRow)}
+	checkpointAsBytes, err := ioutil.ReadFile(projection.checkpointPath())
+	if err == nil {
+		saved := checkpoint{}
+		err = json.Unmarshal(checkpointAsBytes, &saved)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode %s: %s", projection.checkpointPath(), err.Error())
+		}
+		projection.nextBlock = saved.NextBlock
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return projection, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		row := &CarRow{}
+		err = json.Unmarshal(scanner.Bytes(), row)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode line %d of %s: %s", line, path, err.Error())
+		}
+		projection.rows[row.VIN] = row
+	}
+	return projection, scanner.Err()
+}
+
+// Apply updates the projection with a chaincode event, and tells whether it changed.
+// Events other than the lifecycle ones are ignored, and so are events from a block older
+// than the last one applied to a car, deletions included, so that applying a block again
+// does no harm.
+func (projection *Projection) Apply(event client.ChaincodeEvent) (bool, error) {
+	switch event.EventName {
+	case eventCarCreated, eventCarTransferred, eventCarScrapped, eventCarDeleted:
+	default:
+		return false, nil
+	}
+
+	var carEvents []carEvent
+	err := json.Unmarshal(event.Payload, &carEvents)
+	if err != nil {
+		return false, fmt.Errorf("Failed to decode %s event of transaction %s: %s", event.EventName, event.TxID, err.Error())
+	}
+
+	changed := false
+	for _, carEvent := range carEvents {
+		row, exists := projection.rows[carEvent.VIN]
+		if exists && row.BlockNumber > event.BlockNumber {
+			continue
+		}
+		if event.EventName == eventCarDeleted {
+			projection.rows[carEvent.VIN] = &CarRow{VIN: carEvent.VIN, Deleted: true, Event: event.EventName,
+				BlockNumber: event.BlockNumber, TxID: event.TxID, Timestamp: carEvent.Timestamp}
+			changed = true
+			continue
+		}
+		projection.rows[carEvent.VIN] = &CarRow{VIN: carEvent.VIN, Car: carEvent.Car, Event: event.EventName,
+			BlockNumber: event.BlockNumber, TxID: event.TxID, Timestamp: carEvent.Timestamp}
+		changed = true
+	}
+	return changed, nil
+}
+
+// NextBlock returns the number of the first block not applied to the projection yet
+func (projection *Projection) NextBlock() uint64 {
+	return projection.nextBlock
+}
+
+// Advance records that block blockNumber was applied to the projection
+func (projection *Projection) Advance(blockNumber uint64) {
+	if blockNumber >= projection.nextBlock {
+		projection.nextBlock = blockNumber + 1
+	}
+}
+
+// Rows returns the cars of the projection, sorted by VIN, without the deleted ones
+func (projection *Projection) Rows() []CarRow {
+	rows := []CarRow{}
+	for _, row := range projection.allRows() {
+		if !row.Deleted {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// allRows returns the rows of the projection, tombstones included, sorted by VIN
+func (projection *Projection) allRows() []CarRow {
+	vins := make([]string, 0, len(projection.rows))
+	for vin := range projection.rows {
+		vins = append(vins, vin)
+	}
+	sort.Strings(vins)
+
+	rows := make([]CarRow, len(vins))
+	for i, vin := range vins {
+		rows[i] = *projection.rows[vin]
+	}
+	return rows
+}
+
+// Save writes the projection to its file, then the checkpoint. Each file is replaced at
+// once, readers never see it half written. The checkpoint is written last, so that it
+// never gets ahead of the cars, and applying again the blocks after it does no harm.
+func (projection *Projection) Save() error {
+	var buffer bytes.Buffer
+	for _, row := range projection.allRows() {
+		rowAsBytes, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		buffer.Write(rowAsBytes)
+		buffer.WriteString("\n")
+	}
+
+	err := replaceFile(projection.path, buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	return projection.SaveCheckpoint()
+}
+
+// SaveCheckpoint only writes the checkpoint, for the blocks which did not change the cars
+func (projection *Projection) SaveCheckpoint() error {
+	checkpointAsBytes, err := json.Marshal(checkpoint{NextBlock: projection.nextBlock})
+	if err != nil {
+		return err
+	}
+	return replaceFile(projection.checkpointPath(), checkpointAsBytes)
+}
+
+// checkpointPath returns the path of the checkpoint file, next to the projection
+func (projection *Projection) checkpointPath() string {
+	return projection.path + ".checkpoint"
+}
+
+// replaceFile writes a file to a temporary file, then renames it over the file
+func replaceFile(path string, content []byte) error {
+	tmpPath := path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
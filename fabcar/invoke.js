@@ -48,14 +48,28 @@ Promise.resolve().then(() => {
 }).then(() => {
     tx_id = client.newTransactionID();
     console.log("Assigning transaction_id: ", tx_id._transaction_id);
-    // createCar - requires 5 args, ex: args: ['CAR11', 'Honda', 'Accord', 'Black', 'Tom'],
-    // changeCarOwner - requires 2 args , ex: args: ['CAR10', 'Barry'],
+    // createCar - requires 5 args, ex: args: ['1HGCM82633A004352', 'Honda', 'Accord', 'Black', 'Tom'],
+    //   or 8 args with year, mileage and plate, ex: args: ['1HGCM82633A004352', 'Honda', 'Accord', 'Black', 'Tom', '2003', '154000', 'AB-123-CD'],
+    //   followed by the owner MSP, the MSP of the client by default, ex: args: ['1HGCM82633A004352', 'Honda', 'Accord', 'Black', 'Tom', 'Org1MSP'],
+    // initiateTransfer - requires 2 or 3 args, run by the owner, ex: args: ['1G1RA6E44BU000011', 'Barry', 'Org1MSP'],
+    // acceptTransfer - requires 1 arg, run by the buyer, ex: args: ['1G1RA6E44BU000011'],
+    // cancelTransfer - requires 1 arg, run by the seller or the buyer, ex: args: ['1G1RA6E44BU000011'],
+    // deleteCar - requires 1 arg, run by the owner, ex: args: ['1G1RA6E44BU000011'],
+    // authorizeGarage, revokeGarage - require 1 arg, run by an admin, ex: args: ['Org2MSP'],
+    // addServiceRecord - requires 5 args, run by a garage, ex: args: ['1G1RA6E44BU000011', '2017-06-01', '150000', 'Oil change', '<sha256 of the invoice>'],
+    // authorizeInsurer, revokeInsurer - require 1 arg, run by an admin, ex: args: ['Org2MSP'],
+    // issuePolicy - requires 4 args, run by an insurer, ex: args: ['1G1RA6E44BU000011', '2017-01-01', '2017-12-31', '45000'],
+    // fileClaim - requires 5 args, run by the policy holder, ex: args: ['1G1RA6E44BU000011', '<policy ID>', '2017-06-01', 'Rear bumper dented', '<sha256>,<sha256>'],
+    // updateClaimStatus - requires 4 or 5 args, run by the insurer or the claimant, ex: args: ['1G1RA6E44BU000011', '<policy ID>', '<claim ID>', 'approved', 'Repair quote accepted'],
+    // setCarStatus - requires 2 args, run by the owner or an admin, ex: args: ['1G1RA6E44BU000011', 'stolen'],
+    // assignOwnerMSP - requires 2 args, run by an admin for a car without owner MSP, ex: args: ['1G1RA6E44BU000011', 'Org1MSP'],
+    // migrateCar - requires 2 or 5 args, run by the owner or an admin, ex: args: ['CAR10', '1G1RA6E44BU000011'],
     // send proposal to endorser
     var request = {
         targets: targets,
         chaincodeId: options.chaincode_id,
         fcn: 'createCar',
-        args: ['CAR10', 'Chevy', 'Volt', 'Red', 'Nick'],
+        args: ['1G1RA6E44BU000011', 'Chevy', 'Volt', 'Red', 'Nick'],
         chainId: options.channel_id,
         txId: tx_id
     };
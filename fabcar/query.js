@@ -43,8 +43,12 @@ Promise.resolve().then(() => {
     var transaction_id = client.newTransactionID();
     console.log("Assigning transaction_id: ", transaction_id._transaction_id);
 
-    // queryCar - requires 1 argument, ex: args: ['CAR4'],
+    // queryCar - requires 1 argument, the VIN, ex: args: ['5YJSA1E24HF000005'],
+    // queryTransfer, queryOwnershipHistory, queryServiceHistory, queryPolicies, queryClaims - require 1 argument, the VIN, ex: args: ['5YJSA1E24HF000005'],
+    // queryCarsByOwner, queryCarsByMake - require 1 argument, and optionally a page size and bookmark, ex: args: ['Tomoko', '5'],
+    // queryCarsByMakeModel - requires 2 arguments, and optionally a page size and bookmark, ex: args: ['Toyota', 'Prius'],
     // queryAllCars - requires no arguments , ex: args: [''],
+    // or a page size, bookmark, sort field and order, ex: args: ['5', '', 'year', 'desc'],
     const request = {
         chaincodeId: options.chaincode_id,
         txId: transaction_id,
@@ -0,0 +1,291 @@
+/*
+ * The audit trail of the variables. Pruning and compaction delete deltas from the world state, so before
+ * deleting anything they write an audit record summarizing the deltas: how many there were, the first and
+ * the last of them, in merge order, and the total they were folded into. The transactions which produced a
+ * balance can then be found in the blocks of the channel, even after compaction. The live deltas and the
+ * audit records of a variable are listed, a page at a time, by the deltas and audits queries.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The composite index of the audit records, by position of the transaction which wrote them
+const auditIndexName = "audit~varName~position~txID"
+
+// The number of rows per page of the deltas and audits queries when none is given
+const defaultPageSize = 100
+
+/**
+ * The summary of the deltas of a variable deleted by a transaction
+ */
+type auditRecord struct {
+	Operation     string `json:"operation"` // the function which deleted the deltas
+	TxID          string `json:"txID"`
+	Position      string `json:"position"`
+	Count         int    `json:"count"`
+	Void          int    `json:"void,omitempty"` // the number of void deltas among them, see deltaOperations
+	FirstTxID     string `json:"firstTxID"`
+	FirstPosition string `json:"firstPosition"`
+	LastTxID      string `json:"lastTxID"`
+	LastPosition  string `json:"lastPosition"`
+	Total         string `json:"total"` // the value the deltas were folded into, of the new base row or of the checkpoint
+}
+
+/**
+ * A live delta, as listed by the deltas query
+ */
+type deltaRecord struct {
+	Position string `json:"position"`
+	Op       string `json:"op"`
+	Value    string `json:"value"`
+	TxID     string `json:"txID"`
+}
+
+/**
+ * Lists the live deltas of a variable, in the order they merge in, a page at a time. The deltas folded
+ * into the checkpoint of the variable are summarized by its audit records. The args array contains the
+ * following arguments:
+ *	- args[0] -> The name of the variable
+ *	- args[1] -> Optional, the number of deltas per page, 100 if not given
+ *	- args[2] -> Optional, the bookmark returned with the previous page, to get the next one
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the deltas invocation
+ *
+ * @return A response structure holding the checkpoint, the deltas of the page and the bookmark of the
+ * next page, empty on the last page, as JSON, or an error message
+ */
+func (s *SmartContract) deltas(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	name, pageSize, bookmark, err := parsePageArgs(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, cp, err := getCheckpoint(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	records := []deltaRecord{}
+	bookmark, err = readPage(APIstub, []string{legacyIndexName, deltaIndexName}, name, pageSize, bookmark, func(key string, value []byte) error {
+		d, err := splitDeltaKey(APIstub, key)
+		if err != nil {
+			return err
+		}
+		records = append(records, deltaRecord{Position: d.position, Op: d.op, Value: d.value, TxID: d.txID})
+		return nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	page := struct {
+		Checkpoint *checkpoint   `json:"checkpoint"`
+		Records    []deltaRecord `json:"records"`
+		Fetched    int           `json:"fetched"`
+		Bookmark   string        `json:"bookmark"`
+	}{cp, records, len(records), bookmark}
+	pageBytes, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(pageBytes)
+}
+
+/**
+ * Lists the audit records of a variable, oldest first, a page at a time. The records of a deleted
+ * variable are kept. The args array contains the following arguments:
+ *	- args[0] -> The name of the variable
+ *	- args[1] -> Optional, the number of records per page, 100 if not given
+ *	- args[2] -> Optional, the bookmark returned with the previous page, to get the next one
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the audits invocation
+ *
+ * @return A response structure holding the records of the page and the bookmark of the next page,
+ * empty on the last page, as JSON, or an error message
+ */
+func (s *SmartContract) audits(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	name, pageSize, bookmark, err := parsePageArgs(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	records := []auditRecord{}
+	bookmark, err = readPage(APIstub, []string{auditIndexName}, name, pageSize, bookmark, func(key string, value []byte) error {
+		record := auditRecord{}
+		err := json.Unmarshal(value, &record)
+		if err != nil {
+			return fmt.Errorf("The audit record %s of %s is corrupted: %s", key, name, err.Error())
+		}
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	page := struct {
+		Records  []auditRecord `json:"records"`
+		Fetched  int           `json:"fetched"`
+		Bookmark string        `json:"bookmark"`
+	}{records, len(records), bookmark}
+	pageBytes, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(pageBytes)
+}
+
+/**
+ * Writes the audit record of the deltas of a variable about to be deleted, nothing if there are none
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param operation The function deleting the deltas
+ * @param deltas The deltas, in the order they merge in
+ * @param void The number of void deltas among them
+ * @param total The value the deltas are folded into
+ *
+ * @return An error if the record could not be written
+ */
+func putAudit(APIstub shim.ChaincodeStubInterface, name string, operation string, deltas []delta, void int, total decimal) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	position, err := txPosition(APIstub)
+	if err != nil {
+		return err
+	}
+
+	first, last := deltas[0], deltas[len(deltas)-1]
+	record := auditRecord{
+		Operation:     operation,
+		TxID:          APIstub.GetTxID(),
+		Position:      position,
+		Count:         len(deltas),
+		Void:          void,
+		FirstTxID:     first.txID,
+		FirstPosition: first.position,
+		LastTxID:      last.txID,
+		LastPosition:  last.position,
+		Total:         total.String(),
+	}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	auditKey, err := APIstub.CreateCompositeKey(auditIndexName, []string{name, position, record.TxID})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	err = APIstub.PutState(auditKey, recordBytes)
+	if err != nil {
+		return fmt.Errorf("Could not put the audit record of %s in the ledger: %s", name, err.Error())
+	}
+	return nil
+}
+
+/**
+ * Parses the arguments of a paged query, the name of a variable then the optional page size and
+ * bookmark
+ */
+func parsePageArgs(args []string) (string, int, string, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return "", 0, "", fmt.Errorf("Incorrect number of arguments, expecting 1 to 3")
+	}
+	pageSize := defaultPageSize
+	if len(args) > 1 && args[1] != "" {
+		var err error
+		pageSize, err = strconv.Atoi(args[1])
+		if err != nil || pageSize <= 0 {
+			return "", 0, "", fmt.Errorf("Page size %s is invalid, expecting a positive number", args[1])
+		}
+	}
+	bookmark := ""
+	if len(args) > 2 {
+		bookmark = args[2]
+	}
+	return args[0], pageSize, bookmark, nil
+}
+
+/**
+ * Reads a page of the rows of a variable from composite indexes, the indexes being read one after the
+ * other. The keys of an index are iterated in order, so the page starts after skipping the keys before the
+ * bookmark.
+ *
+ * @param APIstub The chaincode shim
+ * @param indexNames The names of the indexes, in the order they are read
+ * @param name The name of the variable
+ * @param pageSize The number of rows of the page
+ * @param bookmark The key of the first row of the page, empty for the first page
+ * @param visit Called with each row of the page
+ *
+ * @return The bookmark of the next page, empty on the last page, or an error if the bookmark is
+ * invalid or a row could not be read or visited
+ */
+func readPage(APIstub shim.ChaincodeStubInterface, indexNames []string, name string, pageSize int, bookmark string, visit func(key string, value []byte) error) (string, error) {
+	// The index holding the bookmark, the ones before it were read by the previous pages
+	first := 0
+	if bookmark != "" {
+		first = -1
+		for i, indexName := range indexNames {
+			prefix, err := APIstub.CreateCompositeKey(indexName, []string{name})
+			if err != nil {
+				return "", fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+			}
+			if strings.HasPrefix(bookmark, prefix) {
+				first = i
+				break
+			}
+		}
+		if first < 0 {
+			return "", fmt.Errorf("Bookmark %q is invalid", bookmark)
+		}
+	}
+
+	fetched := 0
+	for _, indexName := range indexNames[first:] {
+		resultsIterator, err := APIstub.GetStateByPartialCompositeKey(indexName, []string{name})
+		if err != nil {
+			return "", fmt.Errorf("Could not read the rows of %s from %s: %s", name, indexName, err.Error())
+		}
+		for resultsIterator.HasNext() {
+			responseRange, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return "", fmt.Errorf("Could not read the next row: %s", err.Error())
+			}
+			if responseRange.Key < bookmark {
+				continue
+			}
+			// the page is full, the next one starts with this row
+			if fetched == pageSize {
+				resultsIterator.Close()
+				return responseRange.Key, nil
+			}
+			err = visit(responseRange.Key, responseRange.Value)
+			if err != nil {
+				resultsIterator.Close()
+				return "", err
+			}
+			fetched++
+		}
+		resultsIterator.Close()
+	}
+	return "", nil
+}
@@ -0,0 +1,159 @@
+/*
+ * Tests of the deltas and audits queries.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+type testDeltasPage struct {
+	Checkpoint *checkpoint   `json:"checkpoint"`
+	Records    []deltaRecord `json:"records"`
+	Fetched    int           `json:"fetched"`
+	Bookmark   string        `json:"bookmark"`
+}
+
+type testAuditsPage struct {
+	Records  []auditRecord `json:"records"`
+	Fetched  int           `json:"fetched"`
+	Bookmark string        `json:"bookmark"`
+}
+
+// queryPage invokes a paged query and decodes its page, which must be empty as the records of a page are
+// decoded over the ones already there
+func queryPage(t *testing.T, stub *testStub, page interface{}, args ...string) {
+	res := checkInvoke(t, stub, args...)
+	err := json.Unmarshal(res.Payload, page)
+	if err != nil {
+		fmt.Println("The page of", args, "could not be decoded", err)
+		t.FailNow()
+	}
+}
+
+func TestDeltas_ListsTheLiveDeltasAPageAtATime(t *testing.T) {
+	stub := newTestStub()
+	// the deltas are written by the transactions 2 to 6
+	updateTestVariable(t, stub, "pool", 5)
+	updateTestVariable(t, stub, "pool2", 2)
+	putLegacyDelta(t, stub, "pool", "+", "3")
+
+	expected := []deltaRecord{{Position: basePosition, Op: "+", Value: "3", TxID: "legacy3"}}
+	for n := int64(2); n <= 6; n++ {
+		expected = append(expected, deltaRecord{Position: testPosition(n), Op: "+", Value: "1.00", TxID: fmt.Sprint("tx", n)})
+	}
+
+	records := []deltaRecord{}
+	bookmark := ""
+	for pages := 1; ; pages++ {
+		page := testDeltasPage{}
+		queryPage(t, stub, &page, "deltas", "pool", "2", bookmark)
+		if page.Checkpoint != nil || page.Fetched != len(page.Records) || page.Fetched > 2 {
+			fmt.Println("Page", pages, "of the deltas of pool was", page)
+			t.FailNow()
+		}
+		records = append(records, page.Records...)
+		bookmark = page.Bookmark
+		if bookmark == "" {
+			break
+		} else if pages == 3 {
+			fmt.Println("The deltas of pool have more than 3 pages")
+			t.FailNow()
+		}
+	}
+	if fmt.Sprint(records) != fmt.Sprint(expected) {
+		fmt.Println("The deltas of pool were", records, "and not", expected, "as expected")
+		t.FailNow()
+	}
+
+	// the default page size holds them all
+	page := testDeltasPage{}
+	queryPage(t, stub, &page, "deltas", "pool")
+	if page.Fetched != 6 || page.Bookmark != "" {
+		fmt.Println("The deltas of pool were", page)
+		t.FailNow()
+	}
+}
+
+func TestDeltas_ReportsTheCheckpoint(t *testing.T) {
+	stub := newTestStub()
+	updateTestVariable(t, stub, "pool", 3)
+	checkInvoke(t, stub, "compact", "pool", "0")
+	checkInvoke(t, stub, "update", "pool", "2", "*")
+
+	page := testDeltasPage{}
+	queryPage(t, stub, &page, "deltas", "pool")
+	if page.Checkpoint == nil || page.Checkpoint.Value != "3.00" || page.Fetched != 1 || page.Records[0].Op != "*" || page.Records[0].Value != "2" {
+		fmt.Println("The deltas of pool were", page)
+		t.FailNow()
+	}
+}
+
+func TestDeltas_ChecksTheArguments(t *testing.T) {
+	stub := newTestStub()
+	updateTestVariable(t, stub, "pool", 3)
+	updateTestVariable(t, stub, "pool2", 3)
+
+	checkInvokeFailed(t, stub, "deltas")
+	checkInvokeFailed(t, stub, "deltas", "pool", "0")
+	checkInvokeFailed(t, stub, "deltas", "pool", "ten")
+	checkInvokeFailed(t, stub, "deltas", "pool", "1", "", "extra")
+	checkInvokeFailed(t, stub, "deltas", "pool", "1", "garbage")
+
+	// the bookmark of another variable
+	page := testDeltasPage{}
+	queryPage(t, stub, &page, "deltas", "pool2", "1")
+	checkInvokeFailed(t, stub, "deltas", "pool", "1", page.Bookmark)
+	checkInvokeFailed(t, stub, "audits", "pool2", "1", page.Bookmark)
+	bookmark := page.Bookmark
+	page = testDeltasPage{}
+	queryPage(t, stub, &page, "deltas", "pool2", "", bookmark)
+	if page.Fetched != 2 || page.Records[0].TxID != "tx7" {
+		fmt.Println("The deltas of pool2 after the bookmark were", page)
+		t.FailNow()
+	}
+}
+
+func TestAudits_ListsTheAuditRecordsAPageAtATime(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "stock", "test variable", "", "0", "", "")
+	checkInvoke(t, stub, "update", "stock", "5", "+")
+	checkInvoke(t, stub, "update", "stock", "10", "-")
+	checkInvoke(t, stub, "compact", "stock", "0")
+	checkInvoke(t, stub, "update", "stock", "1", "-")
+	checkInvoke(t, stub, "compact", "stock", "0")
+	checkInvoke(t, stub, "update", "stock", "1", "+")
+	checkInvoke(t, stub, "delete", "stock")
+
+	expected := []auditRecord{
+		{Operation: "compact", TxID: "tx4", Position: testPosition(4), Count: 2, Void: 1, FirstTxID: "tx2", FirstPosition: testPosition(2), LastTxID: "tx3", LastPosition: testPosition(3), Total: "5.00"},
+		{Operation: "compact", TxID: "tx6", Position: testPosition(6), Count: 1, FirstTxID: "tx5", FirstPosition: testPosition(5), LastTxID: "tx5", LastPosition: testPosition(5), Total: "4.00"},
+	}
+
+	// the records of a deleted variable are kept
+	page := testAuditsPage{}
+	queryPage(t, stub, &page, "audits", "stock", "1")
+	if page.Fetched != 1 || page.Bookmark == "" || fmt.Sprint(page.Records[0]) != fmt.Sprint(expected[0]) {
+		fmt.Println("The first page of the audits of stock was", page)
+		t.FailNow()
+	}
+	bookmark := page.Bookmark
+	page = testAuditsPage{}
+	queryPage(t, stub, &page, "audits", "stock", "1", bookmark)
+	if page.Fetched != 1 || page.Bookmark != "" || fmt.Sprint(page.Records[0]) != fmt.Sprint(expected[1]) {
+		fmt.Println("The second page of the audits of stock was", page)
+		t.FailNow()
+	}
+
+	page = testAuditsPage{}
+	queryPage(t, stub, &page, "audits", "unknown")
+	if page.Fetched != 0 || page.Records == nil {
+		fmt.Println("The audits of an unknown variable were", page)
+		t.FailNow()
+	}
+	checkInvokeFailed(t, stub, "audits", "stock", "-1")
+	checkInvokeFailed(t, stub, "audits", "stock", "1", "garbage")
+}
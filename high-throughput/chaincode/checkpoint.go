@@ -0,0 +1,281 @@
+/*
+ * Checkpoints keep get from scanning every delta a variable ever received. A checkpoint row holds the
+ * value of a variable as of a position, and compaction advances it by folding in the deltas positioned
+ * before a cutoff and deleting them. The cutoff lags the compaction transaction by a grace period, so
+ * compaction only reads a range of rows which no update in flight can write to: updates and compaction
+ * never conflict and there is no need for a maintenance window.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The composite index of the checkpoints
+const checkpointIndexName = "checkpoint~varName"
+
+// The default age, in seconds, of the deltas compaction folds into the checkpoint
+const defaultCompactionGrace = 300
+
+/**
+ * The value of a variable as of a position, the deltas positioned before it being folded into the value
+ * and deleted. Deltas committed late, after the compaction of their position, merge after the checkpoint.
+ */
+type checkpoint struct {
+	Value    string `json:"value"`
+	Position string `json:"position"`
+	Folded   int    `json:"folded"`         // the number of deltas folded into the value since the first compaction
+	Void     int    `json:"void,omitempty"` // the number of void deltas among them
+	TxID     string `json:"txID"`           // the last compaction
+}
+
+/**
+ * Advances the checkpoint of a variable, folding in the deltas older than a grace period and deleting
+ * them. The deltas of the grace period, which may still be in flight, are neither read nor deleted. The
+ * args array contains the following arguments:
+ *	- args[0] -> The name of the variable to compact
+ *	- args[1] -> Optional, the grace period in seconds, 300 if not given
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the compact invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) compact(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check there are a correct number of arguments
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 1 or 2")
+	}
+
+	name := args[0]
+	grace := defaultCompactionGrace
+	if len(args) == 2 {
+		var convErr error
+		grace, convErr = strconv.Atoi(args[1])
+		if convErr != nil || grace < 0 {
+			return shim.Error(fmt.Sprintf("Grace period %s is invalid, expecting a number of seconds", args[1]))
+		}
+	}
+
+	// Compute the cutoff from the transaction timestamp, which is the same on every endorser
+	txTimestamp, err := APIstub.GetTxTimestamp()
+	if err != nil || txTimestamp == nil {
+		return shim.Error("The transaction timestamp is not available")
+	}
+	cutoff := formatPosition(time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).Add(-time.Duration(grace) * time.Second))
+
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.checkMaintainer(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkNoPrune(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Fold the deltas into the checkpoint and delete them
+	current, next, folded, err := foldDeltas(APIstub, name, config, cutoff, 0, "compact")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if current == nil && len(folded) == 0 {
+		return shim.Error(fmt.Sprintf("No delta of %s is older than %d seconds", name, grace))
+	}
+	if len(folded) == 0 {
+		return shim.Success([]byte(fmt.Sprintf("Nothing to compact, the checkpoint of %s is at %s", name, current.Position)))
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Compacted %s up to %s, value is %s, %d deltas folded", name, next.Position, next.Value, len(folded))))
+}
+
+/**
+ * Folds the oldest deltas of a variable positioned before a cutoff into its checkpoint, deleting them.
+ * Each call leaves the variable consistent, the checkpoint and the remaining deltas adding up to the
+ * same value as before, and writes the audit record of the deltas folded.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param config The configuration of the variable
+ * @param cutoff The position the deltas to fold must be before
+ * @param limit The maximum number of deltas to fold, 0 for all of them
+ * @param operation The function folding the deltas, for the audit record
+ *
+ * @return The checkpoint before and after the fold, nil if there is none, the deltas folded, or an
+ * error if the fold failed. The checkpoint is only written if deltas were folded.
+ */
+func foldDeltas(APIstub shim.ChaincodeStubInterface, name string, config *varConfig, cutoff string, limit int, operation string) (*checkpoint, *checkpoint, []delta, error) {
+	value, current, err := getCheckpoint(APIstub, name, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	deltas, err := getDeltasBefore(APIstub, name, cutoff, limit)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(deltas) == 0 {
+		return current, current, deltas, nil
+	}
+
+	value, void, err := mergeDeltas(value, deltas, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = putAudit(APIstub, name, operation, deltas, void, value)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, d := range deltas {
+		err = APIstub.DelState(d.key)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Could not delete delta row: %s", err.Error())
+		}
+	}
+
+	// The checkpoint is as of the cutoff once every delta before it is folded, as of the last delta
+	// folded otherwise. Late deltas may be older than the checkpoint, which never moves back.
+	next := &checkpoint{Value: value.String(), Position: deltas[len(deltas)-1].position, Folded: len(deltas), Void: void, TxID: APIstub.GetTxID()}
+	if limit == 0 || len(deltas) < limit {
+		next.Position = cutoff
+	}
+	if current != nil {
+		next.Folded += current.Folded
+		next.Void += current.Void
+		if current.Position > next.Position {
+			next.Position = current.Position
+		}
+	}
+	err = putCheckpoint(APIstub, name, next)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return current, next, deltas, nil
+}
+
+/**
+ * Retrieves the checkpoint of a variable
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param config The configuration of the variable
+ *
+ * @return The value of the checkpoint, zero if there is none, the checkpoint, nil if there is none, or
+ * an error if it could not be read
+ */
+func getCheckpoint(APIstub shim.ChaincodeStubInterface, name string, config *varConfig) (decimal, *checkpoint, error) {
+	checkpointKey, err := APIstub.CreateCompositeKey(checkpointIndexName, []string{name})
+	if err != nil {
+		return decimal{}, nil, fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	checkpointBytes, err := APIstub.GetState(checkpointKey)
+	if err != nil {
+		return decimal{}, nil, fmt.Errorf("Could not retrieve the checkpoint of %s: %s", name, err.Error())
+	} else if checkpointBytes == nil {
+		return zeroDecimal(config.Scale), nil, nil
+	}
+
+	cp := &checkpoint{}
+	err = json.Unmarshal(checkpointBytes, cp)
+	if err != nil {
+		return decimal{}, nil, fmt.Errorf("The checkpoint of %s is corrupted: %s", name, err.Error())
+	}
+	value, err := parseDecimal(cp.Value, config.Scale)
+	if err != nil {
+		return decimal{}, nil, fmt.Errorf("The checkpoint of %s is corrupted: %s", name, err.Error())
+	}
+	return value, cp, nil
+}
+
+/**
+ * Stores the checkpoint of a variable
+ */
+func putCheckpoint(APIstub shim.ChaincodeStubInterface, name string, cp *checkpoint) error {
+	checkpointKey, err := APIstub.CreateCompositeKey(checkpointIndexName, []string{name})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	checkpointBytes, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	err = APIstub.PutState(checkpointKey, checkpointBytes)
+	if err != nil {
+		return fmt.Errorf("Could not put the checkpoint of %s in the ledger: %s", name, err.Error())
+	}
+	return nil
+}
+
+/**
+ * Deletes the checkpoint of a variable, if any
+ */
+func delCheckpoint(APIstub shim.ChaincodeStubInterface, name string) error {
+	checkpointKey, err := APIstub.CreateCompositeKey(checkpointIndexName, []string{name})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	err = APIstub.DelState(checkpointKey)
+	if err != nil {
+		return fmt.Errorf("Could not delete the checkpoint of %s: %s", name, err.Error())
+	}
+	return nil
+}
+
+/**
+ * Retrieves the delta rows of a variable positioned before a cutoff, in the order they merge in. The
+ * peer can not read a range of composite keys other than by partial key, so the rows are read by the
+ * name of the variable and the scan stops at the first row positioned at or after the cutoff: the rows
+ * written after it are not part of the read set of the transaction.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param cutoff The position the rows must be before
+ * @param limit The maximum number of rows to read, 0 for all of them
+ *
+ * @return The deltas, or an error if they could not be read
+ */
+func getDeltasBefore(APIstub shim.ChaincodeStubInterface, name string, cutoff string, limit int) ([]delta, error) {
+	// the rows of the previous key layout have no position, they are all before the cutoff
+	deltas := []delta{}
+	legacyResultsIterator, err := APIstub.GetStateByPartialCompositeKey(legacyIndexName, []string{name})
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve delta rows for %s: %s", name, err.Error())
+	}
+	deltas, err = appendDeltas(APIstub, deltas, legacyResultsIterator, limit)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(deltas) == limit {
+		return deltas, nil
+	}
+
+	deltaResultsIterator, err := APIstub.GetStateByPartialCompositeKey(deltaIndexName, []string{name})
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve delta rows for %s: %s", name, err.Error())
+	}
+	defer deltaResultsIterator.Close()
+	for deltaResultsIterator.HasNext() && (limit == 0 || len(deltas) < limit) {
+		responseRange, err := deltaResultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Could not retrieve next delta row: %s", err.Error())
+		}
+		d, err := splitDeltaKey(APIstub, responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		if d.position >= cutoff {
+			break
+		}
+		deltas = append(deltas, d)
+	}
+	return deltas, nil
+}
@@ -0,0 +1,138 @@
+/*
+ * Tests of the checkpoints and of compaction.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// checkCheckpoint checks the checkpoint of a variable, as of a position and with a number of deltas folded
+func checkCheckpoint(t *testing.T, stub *testStub, name string, value string, position string, folded int, void int) {
+	_, cp, err := getCheckpoint(stub, name, &varConfig{Scale: defaultScale})
+	if err != nil || cp == nil {
+		fmt.Println("The checkpoint of", name, "could not be read", err)
+		t.FailNow()
+	}
+	if cp.Value != value || cp.Position != position || cp.Folded != folded || cp.Void != void {
+		fmt.Println("The checkpoint of", name, "was", *cp, "and not", value, position, folded, void, "as expected")
+		t.FailNow()
+	}
+}
+
+// testPosition returns the position of the deltas of the nth transaction of a testStub
+func testPosition(n int64) string {
+	return fmt.Sprintf("%010d.%09d", 1500000000+n, 0)
+}
+
+func TestCompact_FoldsTheDeltasOlderThanTheGracePeriod(t *testing.T) {
+	stub := newTestStub()
+	// the deltas are written by the transactions 2 to 11
+	updateTestVariable(t, stub, "pool", 10)
+
+	// the cutoff of the 12th transaction is 7, the deltas 2 to 6 are folded
+	checkInvoke(t, stub, "compact", "pool", "5")
+	if countKeys(stub, deltaIndexName) != 5 {
+		fmt.Println("Compaction left", countKeys(stub, deltaIndexName), "delta rows instead of 5")
+		t.FailNow()
+	}
+	checkCheckpoint(t, stub, "pool", "5.00", testPosition(7), 5, 0)
+	checkValue(t, stub, "pool", "10.00")
+
+	checkInvoke(t, stub, "compact", "pool", "5")
+	checkCheckpoint(t, stub, "pool", "7.00", testPosition(9), 7, 0)
+	checkValue(t, stub, "pool", "10.00")
+
+	// nothing is older than the grace period
+	res := checkInvoke(t, stub, "compact", "pool")
+	if string(res.Payload) != "Nothing to compact, the checkpoint of pool is at "+testPosition(9) {
+		fmt.Println("Compaction returned", string(res.Payload))
+		t.FailNow()
+	}
+	checkInvoke(t, stub, "compact", "pool", "0")
+	checkCheckpoint(t, stub, "pool", "10.00", testPosition(17), 10, 0)
+	if countKeys(stub, deltaIndexName) != 0 {
+		fmt.Println("Compaction left", countKeys(stub, deltaIndexName), "delta rows")
+		t.FailNow()
+	}
+	checkValue(t, stub, "pool", "10.00")
+}
+
+func TestCompact_FoldsTheDeltasCommittedLate(t *testing.T) {
+	stub := newTestStub()
+	updateTestVariable(t, stub, "pool", 5)
+	checkInvoke(t, stub, "compact", "pool", "0")
+	checkCheckpoint(t, stub, "pool", "5.00", testPosition(7), 5, 0)
+
+	// a delta positioned before the checkpoint merges after it
+	stub.MockTransactionStart("late")
+	_, err := putDelta(stub.MockStub, delta{name: "pool", position: testPosition(3), op: "*", value: "2", txID: "late"})
+	stub.MockTransactionEnd("late")
+	if err != nil {
+		fmt.Println("The late delta could not be written", err)
+		t.FailNow()
+	}
+	checkValue(t, stub, "pool", "10.00")
+
+	// the cutoff of the 9th transaction is 4, the checkpoint never moves back
+	checkInvoke(t, stub, "compact", "pool", "5")
+	checkCheckpoint(t, stub, "pool", "10.00", testPosition(7), 6, 0)
+	checkValue(t, stub, "pool", "10.00")
+}
+
+func TestCompact_CountsTheVoidDeltas(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "stock", "test variable", "", "0", "", "")
+	checkInvoke(t, stub, "update", "stock", "5", "+")
+	checkInvoke(t, stub, "update", "stock", "10", "-")
+	checkInvoke(t, stub, "update", "stock", "1", "-")
+
+	checkInvoke(t, stub, "compact", "stock", "0")
+	checkCheckpoint(t, stub, "stock", "4.00", testPosition(5), 3, 1)
+	checkInvoke(t, stub, "update", "stock", "10", "-")
+	res := checkInvoke(t, stub, "get", "stock", "detail")
+	if string(res.Payload) != `{"value":"4.00","void":1,"foldedVoid":1}` {
+		fmt.Println("Detail of stock was", string(res.Payload))
+		t.FailNow()
+	}
+
+	checkInvoke(t, stub, "compact", "stock", "0")
+	checkCheckpoint(t, stub, "stock", "4.00", testPosition(8), 4, 2)
+}
+
+func TestCompact_LeavesTheLedgerUnchangedOnFailure(t *testing.T) {
+	stub := newTestStub()
+	updateTestVariable(t, stub, "pool", 5)
+	before := stub.snapshot()
+
+	// the audit record, each deletion, then the checkpoint
+	for _, failAfter := range []int{0, 1, 3, 6} {
+		stub.failAfter = failAfter
+		checkInvokeFailed(t, stub, "compact", "pool", "0")
+		checkState(t, stub, before)
+	}
+
+	stub.failAfter = -1
+	checkInvoke(t, stub, "compact", "pool", "0")
+	checkValue(t, stub, "pool", "5.00")
+}
+
+func TestCompact_ChecksTheArguments(t *testing.T) {
+	stub := newTestStub()
+	updateTestVariable(t, stub, "pool", 1)
+
+	checkInvokeFailed(t, stub, "compact")
+	checkInvokeFailed(t, stub, "compact", "pool", "-1")
+	checkInvokeFailed(t, stub, "compact", "pool", "ten")
+	checkInvokeFailed(t, stub, "compact", "pool", "0", "extra")
+	checkInvokeFailed(t, stub, "compact", "unknown", "0")
+	// the delta is younger than the default grace period
+	checkInvokeFailed(t, stub, "compact", "pool")
+
+	// a prune run in progress can be rolled back, compaction would break it
+	updateTestVariable(t, stub, "pool2", 3)
+	checkInvoke(t, stub, "prune", "pool2", "1")
+	checkInvokeFailed(t, stub, "compact", "pool2", "0")
+}
@@ -0,0 +1,171 @@
+/*
+ * Exact fixed-point arithmetic for the variable values. Deltas used to be summed as float64, which
+ * drifts over millions of monetary deltas and makes the aggregate depend on the order the rows are
+ * read in. A decimal holds an unscaled integer and a scale, the number of digits after the point,
+ * so sums are exact and the same on every endorser.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// The largest scale a variable can be given
+const maxScale = 18
+
+/**
+ * A fixed-point decimal number, worth unscaled * 10^-scale
+ */
+type decimal struct {
+	unscaled *big.Int
+	scale    int
+}
+
+/**
+ * Parses a decimal number such as 12, -0.5 or +3.25, with at most scale digits after the point.
+ * Exponents, hexadecimal and special values are rejected.
+ *
+ * @param str The string to parse
+ * @param scale The number of digits after the point of the result
+ *
+ * @return The decimal, or an error if str is not a number or has more digits than the scale allows
+ */
+func parseDecimal(str string, scale int) (decimal, error) {
+	digits := str
+	negative := false
+	if strings.HasPrefix(digits, "-") || strings.HasPrefix(digits, "+") {
+		negative = digits[0] == '-'
+		digits = digits[1:]
+	}
+
+	intPart, fracPart := digits, ""
+	if point := strings.IndexByte(digits, '.'); point >= 0 {
+		intPart, fracPart = digits[:point], digits[point+1:]
+	}
+	if (intPart == "" && fracPart == "") || !isDigits(intPart) || !isDigits(fracPart) {
+		return decimal{}, fmt.Errorf("%s is not a decimal number", str)
+	}
+
+	// trailing zeros do not carry precision, 1.50 fits a scale of 1
+	fracPart = strings.TrimRight(fracPart, "0")
+	if len(fracPart) > scale {
+		return decimal{}, fmt.Errorf("%s has more than %d digits after the decimal point", str, scale)
+	}
+
+	unscaled, _ := new(big.Int).SetString(intPart+fracPart+strings.Repeat("0", scale-len(fracPart)), 10)
+	if negative {
+		unscaled.Neg(unscaled)
+	}
+	return decimal{unscaled: unscaled, scale: scale}, nil
+}
+
+/**
+ * Tells whether str only holds the digits 0 to 9, the empty string included
+ */
+func isDigits(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if str[i] < '0' || str[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * Returns zero at the given scale
+ */
+func zeroDecimal(scale int) decimal {
+	return decimal{unscaled: new(big.Int), scale: scale}
+}
+
+/**
+ * Returns d at the smallest scale which holds it exactly, 1.50 becoming 1.5
+ */
+func (d decimal) compact() decimal {
+	unscaled, scale := new(big.Int).Set(d.unscaled), d.scale
+	ten, digit := big.NewInt(10), new(big.Int)
+	for scale > 0 {
+		quotient, remainder := new(big.Int).QuoRem(unscaled, ten, digit)
+		if remainder.Sign() != 0 {
+			break
+		}
+		unscaled, scale = quotient, scale-1
+	}
+	return decimal{unscaled: unscaled, scale: scale}
+}
+
+/**
+ * Returns d + other, both of the same scale
+ */
+func (d decimal) add(other decimal) decimal {
+	return decimal{unscaled: new(big.Int).Add(d.unscaled, other.unscaled), scale: d.scale}
+}
+
+/**
+ * Returns d - other, both of the same scale
+ */
+func (d decimal) sub(other decimal) decimal {
+	return decimal{unscaled: new(big.Int).Sub(d.unscaled, other.unscaled), scale: d.scale}
+}
+
+/**
+ * Returns d * other rounded to the scale of d, halves being rounded to the even neighbour so that
+ * rounding errors do not accumulate in one direction
+ */
+func (d decimal) mul(other decimal) decimal {
+	product := new(big.Int).Mul(d.unscaled, other.unscaled)
+
+	// the product has the scale of d plus the scale of other, drop the digits of other
+	divisor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(other.scale)), nil)
+	quotient, remainder := new(big.Int).QuoRem(product, divisor, new(big.Int))
+	twiceRemainder := new(big.Int).Abs(remainder)
+	twiceRemainder.Lsh(twiceRemainder, 1)
+	if cmp := twiceRemainder.Cmp(divisor); cmp > 0 || (cmp == 0 && quotient.Bit(0) == 1) {
+		quotient.Add(quotient, big.NewInt(int64(product.Sign())))
+	}
+	return decimal{unscaled: quotient, scale: d.scale}
+}
+
+/**
+ * Returns -d
+ */
+func (d decimal) neg() decimal {
+	return decimal{unscaled: new(big.Int).Neg(d.unscaled), scale: d.scale}
+}
+
+/**
+ * Returns -1, 0 or +1 as d is negative, zero or positive
+ */
+func (d decimal) sign() int {
+	return d.unscaled.Sign()
+}
+
+/**
+ * Compares d and other, both of the same scale, returning -1, 0 or +1 as d is lower than, equal
+ * to or greater than other
+ */
+func (d decimal) cmp(other decimal) int {
+	return d.unscaled.Cmp(other.unscaled)
+}
+
+/**
+ * Formats the decimal with exactly scale digits after the point, e.g. 12.50 for a scale of 2
+ */
+func (d decimal) String() string {
+	digits := new(big.Int).Abs(d.unscaled).String()
+	if len(digits) <= d.scale {
+		digits = strings.Repeat("0", d.scale-len(digits)+1) + digits
+	}
+
+	sign := ""
+	if d.unscaled.Sign() < 0 {
+		sign = "-"
+	}
+	if d.scale == 0 {
+		return sign + digits
+	}
+	return sign + digits[:len(digits)-d.scale] + "." + digits[len(digits)-d.scale:]
+}
@@ -0,0 +1,225 @@
+/*
+ * Tests of the fixed-point decimals and of the scale of the variables.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDecimal_ParseAndFormat(t *testing.T) {
+	tests := []struct {
+		str      string
+		scale    int
+		expected string // the formatted decimal, empty when parsing must fail
+	}{
+		{"12", 2, "12.00"},
+		{"-0.5", 2, "-0.50"},
+		{"+3.25", 2, "3.25"},
+		{".5", 1, "0.5"},
+		{"5.", 1, "5.0"},
+		{"1.50", 1, "1.5"},
+		{"0.001", 3, "0.001"},
+		{"-0", 2, "0.00"},
+		{"7", 0, "7"},
+		{"123456789012345678901234567890.123456789012345678", maxScale, "123456789012345678901234567890.123456789012345678"},
+		{"1.001", 2, ""},
+		{"0.5", 0, ""},
+		{"", 2, ""},
+		{".", 2, ""},
+		{"-", 2, ""},
+		{"1e3", 2, ""},
+		{"0x10", 2, ""},
+		{"NaN", 2, ""},
+		{"Inf", 2, ""},
+		{"1,5", 2, ""},
+		{"--1", 2, ""},
+		{" 1", 2, ""},
+		{"1.2.3", 2, ""},
+	}
+
+	for _, test := range tests {
+		d, err := parseDecimal(test.str, test.scale)
+		if test.expected == "" {
+			if err == nil {
+				fmt.Printf("%q was parsed at scale %d as %s but is invalid\n", test.str, test.scale, d)
+				t.FailNow()
+			}
+			continue
+		}
+		if err != nil || d.String() != test.expected {
+			fmt.Printf("%q was parsed at scale %d as %s and not %s as expected: %v\n", test.str, test.scale, d, test.expected, err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestDecimal_Arithmetic(t *testing.T) {
+	a, _ := parseDecimal("10.25", 2)
+	b, _ := parseDecimal("0.75", 2)
+
+	for _, test := range []struct {
+		got      decimal
+		expected string
+	}{
+		{a.add(b), "11.00"},
+		{a.sub(b), "9.50"},
+		{b.sub(a), "-9.50"},
+		{a.neg(), "-10.25"},
+		{zeroDecimal(3), "0.000"},
+	} {
+		if test.got.String() != test.expected {
+			fmt.Println("Result was", test.got, "and not", test.expected, "as expected")
+			t.FailNow()
+		}
+	}
+	if a.cmp(b) != 1 || b.cmp(a) != -1 || a.cmp(a) != 0 || a.neg().sign() != -1 || zeroDecimal(2).sign() != 0 {
+		fmt.Println("Comparisons of", a, "and", b, "are wrong")
+		t.FailNow()
+	}
+}
+
+func TestDecimal_MulRoundsHalfToEven(t *testing.T) {
+	tests := []struct {
+		value    string
+		factor   string
+		expected string
+	}{
+		{"10.00", "1.5", "15.00"},
+		{"1.00", "0.125", "0.12"},
+		{"1.00", "0.135", "0.14"},
+		{"1.00", "0.1251", "0.13"},
+		{"-1.00", "0.125", "-0.12"},
+		{"-1.00", "0.135", "-0.14"},
+		{"0.01", "0.5", "0.00"},
+		{"0.03", "0.5", "0.02"},
+		{"3.00", "-2", "-6.00"},
+	}
+
+	for _, test := range tests {
+		value, _ := parseDecimal(test.value, 2)
+		factor, err := parseDecimal(test.factor, maxScale)
+		if err != nil {
+			fmt.Println("Factor", test.factor, "is invalid", err)
+			t.FailNow()
+		}
+		got := value.mul(factor.compact())
+		if got.String() != test.expected {
+			fmt.Println(test.value, "*", test.factor, "was", got, "and not", test.expected, "as expected")
+			t.FailNow()
+		}
+	}
+}
+
+func TestDecimal_Compact(t *testing.T) {
+	for str, expected := range map[string]string{"1.500": "1.5", "2.000": "2", "0.000": "0", "-0.120": "-0.12", "0.001": "0.001"} {
+		d, _ := parseDecimal(str, 3)
+		if d.compact().String() != expected {
+			fmt.Println(str, "was compacted to", d.compact(), "and not", expected, "as expected")
+			t.FailNow()
+		}
+	}
+}
+
+func TestSetScale_KeepsTheDeltasExact(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "pool")
+	checkInvoke(t, stub, "update", "pool", "0.1", "+")
+	checkInvoke(t, stub, "update", "pool", "0.2", "+")
+	checkValue(t, stub, "pool", "0.30")
+	checkInvokeFailed(t, stub, "update", "pool", "0.001", "+")
+
+	checkInvoke(t, stub, "setscale", "pool", "4")
+	checkInvoke(t, stub, "update", "pool", "0.0001", "+")
+	checkValue(t, stub, "pool", "0.3001")
+
+	// the deltas written at a scale must stay exact
+	checkInvokeFailed(t, stub, "setscale", "pool", "3")
+	checkInvoke(t, stub, "setscale", "pool", "4")
+	checkValue(t, stub, "pool", "0.3001")
+}
+
+func TestSetScale_ChecksTheArguments(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "pool")
+
+	checkInvokeFailed(t, stub, "setscale", "pool")
+	checkInvokeFailed(t, stub, "setscale", "pool", "-1")
+	checkInvokeFailed(t, stub, "setscale", "pool", fmt.Sprint(maxScale+1))
+	checkInvokeFailed(t, stub, "setscale", "pool", "two")
+	checkInvokeFailed(t, stub, "setscale", "pool", "4", "extra")
+
+	stub.mspID = "Org2MSP"
+	checkInvokeFailed(t, stub, "setscale", "pool", "4")
+	stub.mspID = "Org1MSP"
+	checkInvoke(t, stub, "setscale", "pool", fmt.Sprint(maxScale))
+}
+
+func TestParseLegacyValue_ReadsTheFloatsOfEarlierVersions(t *testing.T) {
+	tests := []struct {
+		str      string
+		expected string // the value at a scale of 2, empty when parsing must fail
+	}{
+		{"12.5", "12.50"},
+		{"1e3", "1000.00"},
+		{"1.5E-1", "0.15"},
+		{"0x1p4", "16.00"},
+		{"0.125", "0.12"},
+		{"0.135", "0.14"},
+		{"-2.5e0", "-2.50"},
+		{"123456789012345678.25", "123456789012345678.25"},
+		{"abc", ""},
+		{"1/2", ""},
+	}
+
+	config := &varConfig{Scale: 2}
+	for _, test := range tests {
+		d, err := parseLegacyValue(test.str, config)
+		if test.expected == "" {
+			if err == nil {
+				fmt.Printf("%q was parsed as %s but is invalid\n", test.str, d)
+				t.FailNow()
+			}
+			continue
+		}
+		if err != nil || d.String() != test.expected {
+			fmt.Printf("%q was parsed as %s and not %s as expected: %v\n", test.str, d, test.expected, err)
+			t.FailNow()
+		}
+	}
+	for _, str := range []string{"Inf", "-Inf", "NaN"} {
+		if _, err := parseLegacyValue(str, config); err != errNotFinite {
+			fmt.Printf("%q was not reported as not finite: %v\n", str, err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestGet_MigratesTheLegacyDeltasOfEarlierVersions(t *testing.T) {
+	stub := newTestStub()
+	putLegacyDelta(t, stub, "old", "+", "1e3")
+	putLegacyDelta(t, stub, "old", "-", "0.125")
+	putLegacyDelta(t, stub, "old", "+", "Inf")
+	checkInit(t, stub, "init", "Org1MSP")
+	checkInvoke(t, stub, "createvariable", "old", "test variable", "", "", "", "")
+
+	checkValue(t, stub, "old", "999.88")
+	res := checkInvoke(t, stub, "get", "old", "detail")
+	if string(res.Payload) != `{"value":"999.88","void":1,"foldedVoid":0}` {
+		fmt.Println("Detail of old was", string(res.Payload))
+		t.FailNow()
+	}
+
+	// the legacy rows can be folded, and are gone once pruned
+	checkInvoke(t, stub, "compact", "old", "0")
+	checkValue(t, stub, "old", "999.88")
+	putLegacyDelta(t, stub, "old", "+", "2E1")
+	checkInvoke(t, stub, "prunefast", "old")
+	checkValue(t, stub, "old", "1019.88")
+	if countKeys(stub, legacyIndexName) != 0 {
+		fmt.Println("Pruning left", countKeys(stub, legacyIndexName), "legacy rows")
+		t.FailNow()
+	}
+}
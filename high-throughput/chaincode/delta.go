@@ -0,0 +1,308 @@
+/*
+ * Storage and merge rules of the deltas. Each delta is a row whose composite key holds the variable
+ * name, the position of the delta, the operation, the value and the transaction ID. The position is
+ * the transaction timestamp, so the rows of a variable are read in the order their transactions were
+ * created in and operations which do not commute, such as a multiplication after an addition, always
+ * merge the same way.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// The composite index of the deltas
+const deltaIndexName = "varName~position~op~value~txID"
+
+// The composite index of the deltas written before positions were introduced, they only hold
+// additions and subtractions and apply before any positioned delta
+const legacyIndexName = "varName~op~value~txID"
+
+// The error of a legacy delta holding a value no decimal can hold, NaN or an infinity
+var errNotFinite = errors.New("the value is not a finite number")
+
+// The position of the legacy rows, which apply first
+const basePosition = "0000000000.000000000"
+
+/**
+ * The operations a delta can hold, and how each one merges into the value of the variable:
+ *	- "+" and "-" add and subtract the delta
+ *	- "*" multiplies by the delta, rounding to the scale of the variable, halves to even
+ *	- "min" and "max" cap the value to at most and at least the delta
+ *	- "=" sets the value to the delta, discarding the effect of the deltas positioned before it
+ * When the variable has a floor, an operation which would take the value below it, or further below
+ * it, is void and the value is left unchanged, the floor being the one in force at the position of the
+ * delta, see floorAt. The same goes for a ceiling and the values above it. A
+ * legacy delta holding NaN or an infinity is void too, see parseLegacyValue.
+ */
+var deltaOperations = map[string]bool{"+": true, "-": true, "*": true, "min": true, "max": true, "=": true}
+
+// The operation of the decrements which drew on a quota, see drawQuota. They subtract as "-" does but are
+// never void: the quota already guaranteed the floor when the decrement was accepted, and a delta merging
+// before the increment which funded the quota, its client clock being behind, must still count. Clients
+// can not write it, update uses "-".
+const drawOp = "draw"
+
+/**
+ * A delta row of a variable
+ */
+type delta struct {
+	key      string
+	name     string
+	position string
+	op       string
+	value    string
+	txID     string
+	legacy   bool // read from the legacy index, see parseLegacyValue
+}
+
+/**
+ * Formats the position of a delta written by the current transaction, its timestamp
+ *
+ * @param APIstub The chaincode shim
+ *
+ * @return The position, which sorts as the timestamps do, or an error if the timestamp is unknown
+ */
+func txPosition(APIstub shim.ChaincodeStubInterface) (string, error) {
+	txTimestamp, err := APIstub.GetTxTimestamp()
+	if err != nil {
+		return "", fmt.Errorf("Could not retrieve the transaction timestamp: %s", err.Error())
+	} else if txTimestamp == nil {
+		return "", fmt.Errorf("The transaction timestamp is not available")
+	}
+	return formatPosition(time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos))), nil
+}
+
+/**
+ * Formats the position of an instant, the seconds and nanoseconds since the epoch padded so that
+ * positions sort as the instants do
+ */
+func formatPosition(t time.Time) string {
+	return fmt.Sprintf("%010d.%09d", t.Unix(), t.Nanosecond())
+}
+
+/**
+ * Writes a delta row for a variable
+ *
+ * @param APIstub The chaincode shim
+ * @param d The delta, its key is ignored
+ *
+ * @return The key of the row, or an error if it could not be written
+ */
+func putDelta(APIstub shim.ChaincodeStubInterface, d delta) (string, error) {
+	key, err := APIstub.CreateCompositeKey(deltaIndexName, []string{d.name, d.position, d.op, d.value, d.txID})
+	if err != nil {
+		return "", fmt.Errorf("Could not create a composite key for %s: %s", d.name, err.Error())
+	}
+	err = APIstub.PutState(key, []byte{0x00})
+	if err != nil {
+		return "", fmt.Errorf("Could not put operation for %s in the ledger: %s", d.name, err.Error())
+	}
+	return key, nil
+}
+
+/**
+ * Retrieves the delta rows of a variable in the order they merge in: the rows written before positions
+ * were introduced first, then the others by position.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The deltas, or an error if they could not be read
+ */
+func getDeltas(APIstub shim.ChaincodeStubInterface, name string) ([]delta, error) {
+	deltas := []delta{}
+	for _, indexName := range []string{legacyIndexName, deltaIndexName} {
+		deltaResultsIterator, err := APIstub.GetStateByPartialCompositeKey(indexName, []string{name})
+		if err != nil {
+			return nil, fmt.Errorf("Could not retrieve delta rows for %s: %s", name, err.Error())
+		}
+		deltas, err = appendDeltas(APIstub, deltas, deltaResultsIterator, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deltas, nil
+}
+
+/**
+ * Appends the delta rows of an iterator to a slice of deltas, closing the iterator. No more rows are
+ * appended once the slice holds limit deltas, unless limit is 0.
+ */
+func appendDeltas(APIstub shim.ChaincodeStubInterface, deltas []delta, deltaResultsIterator shim.StateQueryIteratorInterface, limit int) ([]delta, error) {
+	defer deltaResultsIterator.Close()
+	for deltaResultsIterator.HasNext() && (limit == 0 || len(deltas) < limit) {
+		responseRange, err := deltaResultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Could not retrieve next delta row: %s", err.Error())
+		}
+		d, err := splitDeltaKey(APIstub, responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		deltas = append(deltas, d)
+	}
+	return deltas, nil
+}
+
+/**
+ * Splits the key of a delta row, of either index, into its parts
+ */
+func splitDeltaKey(APIstub shim.ChaincodeStubInterface, key string) (delta, error) {
+	indexName, keyParts, err := APIstub.SplitCompositeKey(key)
+	if err != nil {
+		return delta{}, err
+	}
+	if indexName == legacyIndexName && len(keyParts) == 4 {
+		return delta{key: key, name: keyParts[0], position: basePosition, op: keyParts[1], value: keyParts[2], txID: keyParts[3], legacy: true}, nil
+	} else if indexName == deltaIndexName && len(keyParts) == 5 {
+		return delta{key: key, name: keyParts[0], position: keyParts[1], op: keyParts[2], value: keyParts[3], txID: keyParts[4]}, nil
+	}
+	return delta{}, fmt.Errorf("Delta row %q is malformed", key)
+}
+
+/**
+ * Parses the value of a delta, at the scale of the variable except for factors, which can have up to
+ * maxScale digits after the point
+ *
+ * @param op The operation of the delta
+ * @param valueStr The value of the delta
+ * @param config The configuration of the variable
+ *
+ * @return The value, or an error if the operation is unknown or the value invalid for it
+ */
+func parseDeltaValue(op string, valueStr string, config *varConfig) (decimal, error) {
+	if !deltaOperations[op] && op != drawOp {
+		return decimal{}, fmt.Errorf("Operator %s is unrecognized", op)
+	}
+	if op == "*" {
+		factor, err := parseDecimal(valueStr, maxScale)
+		if err != nil {
+			return decimal{}, err
+		}
+		return factor.compact(), nil
+	}
+	return parseDecimal(valueStr, config.Scale)
+}
+
+/**
+ * Parses the value of a legacy delta. Earlier versions of this chaincode accepted any value strconv.ParseFloat
+ * does, such as 1e3, 0x10 or 0.125 for a scale of 2, so a value which is not a decimal at the scale of the
+ * variable is read as a float, its shortest representation being rounded to the scale, halves to even.
+ *
+ * @param valueStr The value of the delta
+ * @param config The configuration of the variable
+ *
+ * @return The value, or errNotFinite for NaN and the infinities, or an error if it is not a number
+ */
+func parseLegacyValue(valueStr string, config *varConfig) (decimal, error) {
+	value, err := parseDecimal(valueStr, config.Scale)
+	if err == nil {
+		return value, nil
+	}
+	f, convErr := strconv.ParseFloat(valueStr, 64)
+	if convErr != nil {
+		return decimal{}, err
+	} else if math.IsNaN(f) || math.IsInf(f, 0) {
+		return decimal{}, errNotFinite
+	}
+
+	shortest := strconv.FormatFloat(f, 'f', -1, 64)
+	scale := 0
+	if point := strings.IndexByte(shortest, '.'); point >= 0 {
+		scale = len(shortest) - point - 1
+	}
+	exact, err := parseDecimal(shortest, scale)
+	if err != nil {
+		return decimal{}, err
+	}
+	one, _ := parseDecimal("1", config.Scale)
+	return one.mul(exact), nil
+}
+
+/**
+ * Merges deltas into a value, following the rules of deltaOperations
+ *
+ * @param value The value before the deltas
+ * @param deltas The deltas, in the order they merge in
+ * @param config The configuration of the variable, its scale and bounds
+ *
+ * @return The value after the deltas and the number of void deltas, or an error if a delta is invalid
+ */
+func mergeDeltas(value decimal, deltas []delta, config *varConfig) (decimal, int, error) {
+	currentFloor, err := config.floor()
+	if err != nil {
+		return decimal{}, 0, err
+	}
+	ceiling, err := config.ceiling()
+	if err != nil {
+		return decimal{}, 0, err
+	}
+
+	void := 0
+	for _, d := range deltas {
+		var operand decimal
+		if d.legacy && (d.op == "+" || d.op == "-") {
+			operand, err = parseLegacyValue(d.value, config)
+		} else {
+			operand, err = parseDeltaValue(d.op, d.value, config)
+		}
+		if err == errNotFinite {
+			// no value can hold it, the legacy delta never counts
+			void++
+			continue
+		} else if err != nil {
+			return decimal{}, 0, fmt.Errorf("Delta %s of %s is invalid: %s", d.txID, d.name, err.Error())
+		}
+
+		next := value
+		switch d.op {
+		case "+":
+			next = value.add(operand)
+		case "-", drawOp:
+			next = value.sub(operand)
+		case "*":
+			next = value.mul(operand)
+		case "min":
+			if operand.cmp(value) < 0 {
+				next = operand
+			}
+		case "max":
+			if operand.cmp(value) > 0 {
+				next = operand
+			}
+		case "=":
+			next = operand
+		}
+
+		if d.op == drawOp {
+			value = next
+			continue
+		}
+		floor := currentFloor
+		if d.position < config.FloorPosition {
+			floor, err = config.floorAt(d.position)
+			if err != nil {
+				return decimal{}, 0, err
+			}
+		}
+		if floor != nil && next.cmp(*floor) < 0 && next.cmp(value) < 0 {
+			void++
+			continue
+		}
+		if ceiling != nil && next.cmp(*ceiling) > 0 && next.cmp(value) > 0 {
+			void++
+			continue
+		}
+		value = next
+	}
+	return value, void, nil
+}
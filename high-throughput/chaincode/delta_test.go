@@ -0,0 +1,202 @@
+/*
+ * Tests of the merge rules of the deltas, and fuzz tests of their composite keys, whose parts may hold
+ * the separator characters of composite keys, U+0000 and U+10FFFF.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// isKeyAttribute tells whether a string can be part of a composite key
+func isKeyAttribute(str string) bool {
+	return utf8.ValidString(str) && !strings.ContainsRune(str, 0) && !strings.ContainsRune(str, utf8.MaxRune)
+}
+
+// addKeySeeds adds seeds holding the separator characters, alone, at either end and in the middle
+func addKeySeeds(f *testing.F) {
+	f.Add("pool", "pool2")
+	f.Add("pool\x00", "pool")
+	f.Add("pool", "pool\x00+")
+	f.Add("\x00pool", "pool")
+	f.Add("po\U0010FFFFol", "po")
+	f.Add("pool\U0010FFFF", "pool")
+	f.Add("\xff", "pool")
+	f.Add("pool~", "pool~position")
+	f.Add("a", "a\U0010FFFE")
+}
+
+func FuzzPutDelta_RoundTripsTheKeyParts(f *testing.F) {
+	for _, seed := range []string{"", "+", "1.00", "tx\x00", "\U0010FFFF", "\xc3"} {
+		f.Add("pool", seed)
+		f.Add(seed, "pool")
+	}
+	f.Fuzz(func(t *testing.T, name string, part string) {
+		stub := newTestStub()
+		d := delta{name: name, position: "1500000000.000000000", op: part, value: part, txID: part}
+		stub.MockTransactionStart("fuzz")
+		key, err := putDelta(stub.MockStub, d)
+		stub.MockTransactionEnd("fuzz")
+
+		valid := isKeyAttribute(name) && isKeyAttribute(part)
+		if err != nil {
+			if valid {
+				fmt.Printf("Delta %q %q was rejected: %s\n", name, part, err)
+				t.FailNow()
+			}
+			return
+		} else if !valid {
+			fmt.Printf("Delta %q %q was accepted but is not a valid key\n", name, part)
+			t.FailNow()
+		}
+
+		got, err := splitDeltaKey(stub, key)
+		d.key = key
+		if err != nil || got != d {
+			fmt.Printf("Key %q was split into %v and not %v as expected: %v\n", key, got, d, err)
+			t.FailNow()
+		}
+		deltas, err := getDeltas(stub, name)
+		if err != nil || len(deltas) != 1 || deltas[0] != d {
+			fmt.Printf("Deltas of %q were %v and not %v as expected: %v\n", name, deltas, d, err)
+			t.FailNow()
+		}
+	})
+}
+
+func FuzzUpdate_KeepsVariablesApart(f *testing.F) {
+	addKeySeeds(f)
+	f.Fuzz(func(t *testing.T, name string, other string) {
+		if name == other {
+			return
+		}
+		stub := newTestStub()
+		for i, n := range []string{name, other} {
+			if stub.invoke("createvariable", n, "", "", "", "", "").Status != OK {
+				if n != "" && isKeyAttribute(n) {
+					fmt.Printf("Variable %q could not be created\n", n)
+					t.FailNow()
+				}
+				continue
+			}
+			checkInvoke(t, stub, "update", n, fmt.Sprint(i+1), "+")
+			checkInvoke(t, stub, "update", n, "10", "+")
+		}
+
+		// the rows of a variable are never read as rows of the other
+		for i, n := range []string{name, other} {
+			if n == "" || !isKeyAttribute(n) {
+				checkInvokeFailed(t, stub, "get", n)
+				continue
+			}
+			checkValue(t, stub, n, fmt.Sprintf("%d.00", i+11))
+			checkInvoke(t, stub, "compact", n, "0")
+			checkValue(t, stub, n, fmt.Sprintf("%d.00", i+11))
+		}
+		for i, n := range []string{name, other} {
+			if n != "" && isKeyAttribute(n) {
+				checkInvoke(t, stub, "prunefast", n)
+				checkValue(t, stub, n, fmt.Sprintf("%d.00", i+11))
+			}
+		}
+	})
+}
+
+func TestMergeDeltas_Rules(t *testing.T) {
+	tests := []struct {
+		name     string
+		floor    string
+		ceiling  string
+		start    string
+		deltas   [][2]string // the operation and value of each delta
+		expected string
+		void     int
+	}{
+		{"add and subtract", "", "", "10", [][2]string{{"+", "5"}, {"-", "2.5"}}, "12.50", 0},
+		{"multiply", "", "", "10", [][2]string{{"*", "1.5"}, {"*", "0.333"}}, "5.00", 0},
+		{"multiply rounds half to even", "", "", "0.25", [][2]string{{"*", "0.5"}}, "0.12", 0},
+		{"multiply by a negative factor", "", "", "3", [][2]string{{"*", "-2"}}, "-6.00", 0},
+		{"min caps", "", "", "10", [][2]string{{"min", "7"}, {"min", "8"}}, "7.00", 0},
+		{"max raises", "", "", "10", [][2]string{{"max", "12"}, {"max", "11"}}, "12.00", 0},
+		{"set discards the earlier deltas", "", "", "10", [][2]string{{"+", "5"}, {"=", "3"}, {"+", "1"}}, "4.00", 0},
+		{"order matters", "", "", "10", [][2]string{{"*", "2"}, {"+", "1"}}, "21.00", 0},
+
+		{"subtract below the floor is void", "0", "", "10", [][2]string{{"-", "15"}, {"-", "10"}}, "0.00", 1},
+		{"add below the floor is void", "0", "", "0", [][2]string{{"+", "-1"}}, "0.00", 1},
+		{"multiply below the floor is void", "0", "", "10", [][2]string{{"*", "-1"}}, "10.00", 1},
+		{"min below the floor is void", "5", "", "10", [][2]string{{"min", "4"}, {"min", "5"}}, "5.00", 1},
+		{"set below the floor is void", "5", "", "10", [][2]string{{"=", "4"}}, "10.00", 1},
+		{"moving towards the floor is not void", "0", "", "-10", [][2]string{{"+", "5"}, {"-", "1"}}, "-5.00", 1},
+		{"add above the ceiling is void", "", "100", "90", [][2]string{{"+", "20"}, {"+", "10"}}, "100.00", 1},
+		{"multiply above the ceiling is void", "", "100", "60", [][2]string{{"*", "2"}, {"*", "0.5"}}, "30.00", 1},
+		{"max above the ceiling is void", "", "100", "60", [][2]string{{"max", "101"}, {"max", "100"}}, "100.00", 1},
+		{"set above the ceiling is void", "", "100", "60", [][2]string{{"=", "150"}, {"=", "99"}}, "99.00", 1},
+		{"both bounds", "0", "100", "50", [][2]string{{"-", "60"}, {"+", "60"}, {"*", "2"}, {"=", "0"}}, "0.00", 2},
+		{"a draw on a quota is never void", "0", "", "10", [][2]string{{drawOp, "30"}, {"+", "40"}, {"-", "30"}}, "20.00", 1},
+	}
+
+	for _, test := range tests {
+		config := &varConfig{Scale: 2, Floor: test.floor, Ceiling: test.ceiling}
+		start, err := parseDecimal(test.start, config.Scale)
+		if err != nil {
+			fmt.Println(test.name, ": start", test.start, "is invalid", err)
+			t.FailNow()
+		}
+		deltas := []delta{}
+		for i, d := range test.deltas {
+			deltas = append(deltas, delta{name: "pool", position: fmt.Sprintf("%020d", i), op: d[0], value: d[1], txID: fmt.Sprint(i)})
+		}
+
+		value, void, err := mergeDeltas(start, deltas, config)
+		if err != nil || value.String() != test.expected || void != test.void {
+			fmt.Println(test.name, ": merged into", value, "with", void, "void deltas and not", test.expected, "with", test.void, "as expected", err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestMergeDeltas_RejectsInvalidDeltas(t *testing.T) {
+	config := &varConfig{Scale: 2}
+	for _, d := range [][2]string{{"/", "2"}, {"+", "0.001"}, {"min", "abc"}, {"*", "1e2"}} {
+		_, _, err := mergeDeltas(zeroDecimal(2), []delta{{name: "pool", op: d[0], value: d[1]}}, config)
+		if err == nil {
+			fmt.Println("Delta", d, "was merged but is invalid")
+			t.FailNow()
+		}
+	}
+
+	// a corrupted bound fails the merge rather than being ignored
+	_, _, err := mergeDeltas(zeroDecimal(2), nil, &varConfig{Scale: 2, Floor: "0.001"})
+	if err == nil {
+		fmt.Println("A corrupted floor was ignored")
+		t.FailNow()
+	}
+}
+
+func TestGet_ReportsTheVoidDeltas(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "stock", "test variable", "", "0", "", "")
+	checkInvoke(t, stub, "update", "stock", "10", "+")
+	checkInvoke(t, stub, "update", "stock", "15", "-")
+	checkInvoke(t, stub, "update", "stock", "4", "-")
+	checkInvoke(t, stub, "update", "stock", "20", "=")
+	checkInvoke(t, stub, "update", "stock", "-1", "=")
+
+	checkValue(t, stub, "stock", "20.00")
+	res := checkInvoke(t, stub, "get", "stock", "detail")
+	if string(res.Payload) != `{"value":"20.00","void":2,"foldedVoid":0}` {
+		fmt.Println("Detail of stock was", string(res.Payload))
+		t.FailNow()
+	}
+	res = checkInvoke(t, stub, "get", "stock", "")
+	if string(res.Payload) != "20.00" {
+		fmt.Println("Value of stock was", string(res.Payload))
+		t.FailNow()
+	}
+	checkInvokeFailed(t, stub, "get", "stock", "void")
+	checkInvokeFailed(t, stub, "get", "stock", "detail", "extra")
+}
@@ -22,6 +22,7 @@ package main
  * 2 specific Hyperledger Fabric specific libraries for Smart Contracts
  */
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 
@@ -29,7 +30,7 @@ import (
 	sc "github.com/hyperledger/fabric/protos/peer"
 )
 
-//SmartContract is the data structure which represents this contract and on which  various contract lifecycle functions are attached
+// SmartContract is the data structure which represents this contract and on which  various contract lifecycle functions are attached
 type SmartContract struct {
 }
 
@@ -39,33 +40,116 @@ const (
 	ERROR = 500
 )
 
-// Init is called when the smart contract is instantiated
+// The number of digits allowed after the decimal point of a variable whose scale was not set
+const defaultScale = 2
+
+/**
+ * The configuration of a variable, stored as JSON under its config~varName key. Variables which were
+ * never configured have the default scale and no bounds, and variables which were never created with
+ * createVariable have no owner and can not be updated.
+ */
+type varConfig struct {
+	Scale         int           `json:"scale"`
+	Floor         string        `json:"floor,omitempty"`         // a decimal at the scale, deltas taking the value below it are void
+	FloorPosition string        `json:"floorPosition,omitempty"` // the position setFloor set the floor at, it bounds the deltas from there on
+	EarlierFloors []floorChange `json:"earlierFloors,omitempty"` // the floors before it, which bound the deltas positioned before it
+	Ceiling       string        `json:"ceiling,omitempty"`       // a decimal at the scale, deltas taking the value above it are void
+	Owner         string        `json:"owner,omitempty"`         // the MSP ID of the organization which created the variable
+	Description   string        `json:"description,omitempty"`
+	Unit          string        `json:"unit,omitempty"`
+	Writers       []string      `json:"writers,omitempty"`     // the MSP IDs allowed to update the variable besides the owner
+	Partitioned   bool          `json:"partitioned,omitempty"` // decrements draw on the quota of their organization, see quota.go
+}
+
+/**
+ * A floor a variable had from a position on, see floorAt
+ */
+type floorChange struct {
+	Position string `json:"position"`
+	Floor    string `json:"floor,omitempty"` // empty if the variable had no floor
+}
+
+// Init is called when the smart contract is instantiated or upgraded, its arguments are the MSP IDs of
+// the admins, see checkAdmin. The admins are kept when none are given.
 func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
+	_, args := APIstub.GetFunctionAndParameters()
+	if len(args) > 0 {
+		err := setAdminMSPs(APIstub, args)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 	return shim.Success(nil)
 }
 
 // Invoke routes invocations to the appropriate function in chaincode
 // Current supported invocations are:
-//	- update, adds a delta to an aggregate variable in the ledger, all variables are assumed to start at 0
-//	- get, retrieves the aggregate value of a variable in the ledger
-//	- pruneFast, deletes all rows associated with the variable and replaces them with a single row containing the aggregate value
-//	- pruneSafe, same as pruneFast except it pre-computed the value and backs it up before performing any destructive operations
-//	- delete, removes all rows associated with the variable
+//   - createvariable, registers a variable with its owner, description, unit, bounds and writers, all variables start at 0,
+//     or registers a variable updated before variables had to be created, admins only
+//   - listvariables, lists the registered variables
+//   - update, adds a delta to an aggregate variable in the ledger
+//   - get, retrieves the aggregate value of a variable in the ledger, and optionally the number of void deltas
+//   - updatemany, adds deltas to several variables in one transaction, all of them or none
+//   - getmany, retrieves the aggregate values of several variables
+//   - pruneFast, deletes all rows associated with the variable and replaces them with a checkpoint holding the aggregate value
+//   - pruneSafe, same as pruneFast except it pre-computes the value before reading the rows to delete
+//   - prune, starts or resumes a batched prune of the variable, folding its rows into its checkpoint a batch per transaction
+//   - prunerollback, rolls back a batched prune which is not committed yet, a batch per transaction
+//   - delete, removes all rows associated with the variable
+//   - setscale, sets the number of digits allowed after the decimal point of a variable
+//   - setfloor, sets the value below which the deltas of a variable are void
+//   - setpartitioned, turns the per-organization quotas guaranteeing the floor of a variable on or off
+//   - allocatequota, allocates quota of a variable to an organization, or takes it back
+//   - transferquota, transfers quota of a variable to another organization
+//   - getquota, retrieves the quotas of a variable
+//   - deltas, lists the live deltas of a variable, a page at a time
+//   - audits, lists the audit records of the deltas deleted by pruning and compaction, a page at a time
+//   - compact, folds the deltas of a variable older than a grace period into its checkpoint
 func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response {
 	// Retrieve the requested Smart Contract function and arguments
 	function, args := APIstub.GetFunctionAndParameters()
 
 	// Route to the appropriate handler function to interact with the ledger appropriately
-	if function == "update" {
+	if function == "createvariable" {
+		return s.createVariable(APIstub, args)
+	} else if function == "listvariables" {
+		return s.listVariables(APIstub, args)
+	} else if function == "update" {
 		return s.update(APIstub, args)
 	} else if function == "get" {
 		return s.get(APIstub, args)
+	} else if function == "updatemany" {
+		return s.updateMany(APIstub, args)
+	} else if function == "getmany" {
+		return s.getMany(APIstub, args)
 	} else if function == "prunefast" {
 		return s.pruneFast(APIstub, args)
 	} else if function == "prunesafe" {
 		return s.pruneSafe(APIstub, args)
+	} else if function == "prune" {
+		return s.prune(APIstub, args)
+	} else if function == "prunerollback" {
+		return s.pruneRollback(APIstub, args)
 	} else if function == "delete" {
 		return s.delete(APIstub, args)
+	} else if function == "setscale" {
+		return s.setScale(APIstub, args)
+	} else if function == "setfloor" {
+		return s.setFloor(APIstub, args)
+	} else if function == "setpartitioned" {
+		return s.setPartitioned(APIstub, args)
+	} else if function == "allocatequota" {
+		return s.allocateQuota(APIstub, args)
+	} else if function == "transferquota" {
+		return s.transferQuota(APIstub, args)
+	} else if function == "getquota" {
+		return s.getQuota(APIstub, args)
+	} else if function == "deltas" {
+		return s.deltas(APIstub, args)
+	} else if function == "audits" {
+		return s.audits(APIstub, args)
+	} else if function == "compact" {
+		return s.compact(APIstub, args)
 	} else if function == "putstandard" {
 		return s.putStandard(APIstub, args)
 	} else if function == "getstandard" {
@@ -76,12 +160,13 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 }
 
 /**
- * Updates the ledger to include a new delta for a particular variable. If this is the first time
- * this variable is being added to the ledger, then its initial value is assumed to be 0. The arguments
- * to give in the args array are as follows:
+ * Updates the ledger to include a new delta for a particular variable. The variable must have been
+ * created with createVariable and the client must belong to its owner or to one of its writers. When
+ * the quota partitions of the variable are on, only "+" and "-" are allowed and a decrement draws on
+ * the quota of the organization of the client. The arguments to give in the args array are as follows:
  *	- args[0] -> name of the variable
- *	- args[1] -> new delta (float)
- *	- args[2] -> operation (currently supported are addition "+" and subtraction "-")
+ *	- args[1] -> new delta (decimal, with at most as many digits after the point as the variable's scale)
+ *	- args[2] -> operation (one of "+", "-", "*", "min", "max" and "=", see deltaOperations)
  *
  * @param APIstub The chaincode shim
  * @param args The arguments array for the update invocation
@@ -97,40 +182,100 @@ func (s *SmartContract) update(APIstub shim.ChaincodeStubInterface, args []strin
 	// Extract the args
 	name := args[0]
 	op := args[2]
-	_, err := strconv.ParseFloat(args[1], 64)
+
+	value, _, err := addDelta(APIstub, name, args[1], op)
 	if err != nil {
-		return shim.Error("Provided value was not a number")
+		return shim.Error(err.Error())
 	}
 
+	return shim.Success([]byte(fmt.Sprintf("Successfully added %s%s to %s", op, value, name)))
+}
+
+/**
+ * Checks a delta of a variable and writes its row. The variable must have been created and the client
+ * must be allowed to update it. A decrement of a variable whose quota partitions are on draws on the
+ * quota of the organization of the client, and is written as a drawOp row which is never void.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param valueStr The value of the delta
+ * @param op The operation of the delta
+ *
+ * @return The value of the delta and the configuration of the variable, or an error if the delta is
+ * invalid or could not be written
+ */
+func addDelta(APIstub shim.ChaincodeStubInterface, name string, valueStr string, op string) (decimal, *varConfig, error) {
 	// Make sure a valid operator is provided
-	if op != "+" && op != "-" {
-		return shim.Error(fmt.Sprintf("Operator %s is unrecognized", op))
+	if !deltaOperations[op] {
+		return decimal{}, nil, fmt.Errorf("Operator %s is unrecognized", op)
 	}
 
-	// Retrieve info needed for the update procedure
-	txid := APIstub.GetTxID()
-	compositeIndexName := "varName~op~value~txID"
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return decimal{}, nil, err
+	}
+	err = config.checkWriter(APIstub, name)
+	if err != nil {
+		return decimal{}, nil, err
+	}
+	value, err := parseDeltaValue(op, valueStr, config)
+	if err != nil {
+		return decimal{}, nil, fmt.Errorf("Provided value was not valid for %s: %s", name, err.Error())
+	}
 
-	// Create the composite key that will allow us to query for all deltas on a particular variable
-	compositeKey, compositeErr := APIstub.CreateCompositeKey(compositeIndexName, []string{name, op, args[1], txid})
-	if compositeErr != nil {
-		return shim.Error(fmt.Sprintf("Could not create a composite key for %s: %s", name, compositeErr.Error()))
+	// Decrements of a partitioned variable only read the quota of the organization of the client
+	rowOp, rowValue := op, value
+	if config.Partitioned {
+		decrement := value
+		if op == "+" {
+			decrement = value.neg()
+		} else if op != "-" {
+			return decimal{}, nil, fmt.Errorf("Operator %s is not allowed while the quota partitions of %s are on", op, name)
+		}
+		if decrement.sign() > 0 {
+			mspID, err := getCreatorMSP(APIstub)
+			if err != nil {
+				return decimal{}, nil, err
+			}
+			_, err = drawQuota(APIstub, name, mspID, decrement, config)
+			if err != nil {
+				return decimal{}, nil, err
+			}
+			// The row of a decrement backed by a quota is never void, see drawOp
+			rowOp, rowValue = drawOp, decrement
+		}
+	}
+
+	// Retrieve info needed for the update procedure
+	position, err := txPosition(APIstub)
+	if err != nil {
+		return decimal{}, nil, err
 	}
 
-	// Save the composite key index
-	compositePutErr := APIstub.PutState(compositeKey, []byte{0x00})
-	if compositePutErr != nil {
-		return shim.Error(fmt.Sprintf("Could not put operation for %s in the ledger: %s", name, compositePutErr.Error()))
+	// Save the delta row, the value being written in its canonical form so that the same amount
+	// always has the same key
+	_, err = putDelta(APIstub, delta{name: name, position: position, op: rowOp, value: rowValue.String(), txID: APIstub.GetTxID()})
+	if err != nil {
+		return decimal{}, nil, err
 	}
+	return value, config, nil
+}
 
-	return shim.Success([]byte(fmt.Sprintf("Successfully added %s%s to %s", op, args[1], name)))
+/**
+ * The value of a variable and its void deltas, as returned by get when asked for the detail
+ */
+type valueDetail struct {
+	Value      string `json:"value"`
+	Void       int    `json:"void"`       // the void deltas not folded into the checkpoint yet
+	FoldedVoid int    `json:"foldedVoid"` // the void deltas folded into the checkpoint, see its audit records
 }
 
 /**
- * Retrieves the aggregate value of a variable in the ledger. Gets all delta rows for the variable
- * and computes the final value from all deltas. The args array for the invocation must contain the
- * following argument:
+ * Retrieves the aggregate value of a variable in the ledger. Gets the checkpoint and the delta rows
+ * not yet folded into it, and computes the final value from them. The args array for the invocation must contain the
+ * following arguments:
  *	- args[0] -> The name of the variable to get the value of
+ *	- args[1] -> Optional, "detail" to get the value and the number of void deltas as JSON, see valueDetail
  *
  * @param APIstub The chaincode shim
  * @param args The arguments array for the get invocation
@@ -139,68 +284,54 @@ func (s *SmartContract) update(APIstub shim.ChaincodeStubInterface, args []strin
  */
 func (s *SmartContract) get(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 	// Check we have a valid number of args
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments, expecting 1")
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 1 or 2")
+	}
+	detail := len(args) == 2 && args[1] != ""
+	if detail && args[1] != "detail" {
+		return shim.Error(fmt.Sprintf("Invalid flag %s, expecting detail", args[1]))
 	}
 
 	name := args[0]
-	// Get all deltas for the variable
-	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{name})
-	if deltaErr != nil {
-		return shim.Error(fmt.Sprintf("Could not retrieve value for %s: %s", name, deltaErr.Error()))
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Merge the checkpoint and the deltas for the variable
+	finalVal, void, found, err := getValue(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	defer deltaResultsIterator.Close()
 
 	// Check the variable existed
-	if !deltaResultsIterator.HasNext() {
+	if !found {
 		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
 	}
-
-	// Iterate through result set and compute final value
-	var finalVal float64
-	var i int
-	for i = 0; deltaResultsIterator.HasNext(); i++ {
-		// Get the next row
-		responseRange, nextErr := deltaResultsIterator.Next()
-		if nextErr != nil {
-			return shim.Error(nextErr.Error())
-		}
-
-		// Split the composite key into its component parts
-		_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
-		if splitKeyErr != nil {
-			return shim.Error(splitKeyErr.Error())
-		}
-
-		// Retrieve the delta value and operation
-		operation := keyParts[1]
-		valueStr := keyParts[2]
-
-		// Convert the value string and perform the operation
-		value, convErr := strconv.ParseFloat(valueStr, 64)
-		if convErr != nil {
-			return shim.Error(convErr.Error())
-		}
-
-		switch operation {
-		case "+":
-			finalVal += value
-		case "-":
-			finalVal -= value
-		default:
-			return shim.Error(fmt.Sprintf("Unrecognized operation %s", operation))
-		}
+	if !detail {
+		return shim.Success([]byte(finalVal.String()))
 	}
 
-	return shim.Success([]byte(strconv.FormatFloat(finalVal, 'f', -1, 64)))
+	result := valueDetail{Value: finalVal.String(), Void: void}
+	_, cp, err := getCheckpoint(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if cp != nil {
+		result.FoldedVoid = cp.Void
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultBytes)
 }
 
 /**
- * Prunes a variable by deleting all of its delta rows while computing the final value. Once all rows
- * have been processed and deleted, a single new row is added which defines a delta containing the final
- * computed value of the variable. This function is NOT safe as any failures or errors during pruning
- * will result in an undefined final value for the variable and loss of data. Use pruneSafe if data
- * integrity is important. The args array contains the following argument:
+ * Prunes a variable by computing its final value in a single pass over its delta rows, writing it to the
+ * checkpoint of the variable, then deleting the delta rows. A transaction commits
+ * all of its writes or none of them, so a failure never loses data, but all the rows are deleted in a
+ * single transaction: use prune to prune variables with many rows in batches. The args array contains
+ * the following argument:
  *	- args[0] -> The name of the variable to prune
  *
  * @param APIstub The chaincode shim
@@ -217,75 +348,52 @@ func (s *SmartContract) pruneFast(APIstub shim.ChaincodeStubInterface, args []st
 	// Retrieve the name of the variable to prune
 	name := args[0]
 
-	// Get all delta rows for the variable
-	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{name})
-	if deltaErr != nil {
-		return shim.Error(fmt.Sprintf("Could not retrieve value for %s: %s", name, deltaErr.Error()))
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.checkMaintainer(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkNoPrune(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Get the checkpoint and all delta rows for the variable
+	finalVal, cp, err := getCheckpoint(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	deltas, err := getDeltas(APIstub, name)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not retrieve value for %s: %s", name, err.Error()))
 	}
-	defer deltaResultsIterator.Close()
 
 	// Check the variable existed
-	if !deltaResultsIterator.HasNext() {
+	if cp == nil && len(deltas) == 0 {
 		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
 	}
 
-	// Iterate through result set computing final value while iterating and deleting each key
-	var finalVal float64
-	var i int
-	for i = 0; deltaResultsIterator.HasNext(); i++ {
-		// Get the next row
-		responseRange, nextErr := deltaResultsIterator.Next()
-		if nextErr != nil {
-			return shim.Error(nextErr.Error())
-		}
-
-		// Split the key into its composite parts
-		_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
-		if splitKeyErr != nil {
-			return shim.Error(splitKeyErr.Error())
-		}
-
-		// Retrieve the operation and value
-		operation := keyParts[1]
-		valueStr := keyParts[2]
-
-		// Convert the value to a float
-		value, convErr := strconv.ParseFloat(valueStr, 64)
-		if convErr != nil {
-			return shim.Error(convErr.Error())
-		}
-
-		// Delete the row from the ledger
-		deltaRowDelErr := APIstub.DelState(responseRange.Key)
-		if deltaRowDelErr != nil {
-			return shim.Error(fmt.Sprintf("Could not delete delta row: %s", deltaRowDelErr.Error()))
-		}
-
-		// Add the value of the deleted row to the final aggregate
-		switch operation {
-		case "+":
-			finalVal += value
-		case "-":
-			finalVal -= value
-		default:
-			return shim.Error(fmt.Sprintf("Unrecognized operation %s", operation))
-		}
+	// Compute the final value, then write it before deleting anything
+	finalVal, void, err := mergeDeltas(finalVal, deltas, config)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-
-	// Update the ledger with the final value and return
-	updateResp := s.update(APIstub, []string{name, strconv.FormatFloat(finalVal, 'f', -1, 64), "+"})
-	if updateResp.Status == OK {
-		return shim.Success([]byte(fmt.Sprintf("Successfully pruned variable %s, final value is %f, %d rows pruned", args[0], finalVal, i)))
+	err = replaceDeltas(APIstub, name, finalVal, cp, deltas, void, "prunefast")
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to prune variable %s: %s", name, err.Error()))
 	}
 
-	return shim.Error(fmt.Sprintf("Failed to prune variable: all rows deleted but could not update value to %f, variable no longer exists in ledger", finalVal))
+	return shim.Success([]byte(fmt.Sprintf("Successfully pruned variable %s, final value is %s, %d rows pruned", name, finalVal, len(deltas))))
 }
 
 /**
- * This function performs the same function as pruneFast except it provides data backups in case the
- * prune fails. The final aggregate value is computed before any deletion occurs and is backed up
- * to a new row. This back-up row is deleted only after the new aggregate delta has been successfully
- * written to the ledger. The args array contains the following argument:
+ * This function performs the same function as pruneFast except the final aggregate value is computed,
+ * through get, before the rows are even read for deletion, so that a variable whose value can not be
+ * computed is left untouched. It also removes the backup row which earlier versions of this chaincode
+ * wrote while pruning. The args array contains the following argument:
  *	args[0] -> The name of the variable to prune
  *
  * @param APIstub The chaincode shim
@@ -301,59 +409,103 @@ func (s *SmartContract) pruneSafe(APIstub shim.ChaincodeStubInterface, args []st
 
 	// Get the var name
 	name := args[0]
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.checkMaintainer(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkNoPrune(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// Get the var's value and process it
-	getResp := s.get(APIstub, args)
+	getResp := s.get(APIstub, []string{name, "detail"})
 	if getResp.Status == ERROR {
 		return shim.Error(fmt.Sprintf("Could not retrieve the value of %s before pruning, pruning aborted: %s", name, getResp.Message))
 	}
-
-	valueStr := string(getResp.Payload)
-	val, convErr := strconv.ParseFloat(valueStr, 64)
-	if convErr != nil {
-		return shim.Error(fmt.Sprintf("Could not convert the value of %s to a number before pruning, pruning aborted: %s", name, convErr.Error()))
+	result := valueDetail{}
+	err = json.Unmarshal(getResp.Payload, &result)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-
-	// Store the var's value temporarily
-	backupPutErr := APIstub.PutState(fmt.Sprintf("%s_PRUNE_BACKUP", name), []byte(valueStr))
-	if backupPutErr != nil {
-		return shim.Error(fmt.Sprintf("Could not backup the value of %s before pruning, pruning aborted: %s", name, backupPutErr.Error()))
+	finalVal, err := parseDecimal(result.Value, config.Scale)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	// Get all deltas for the variable
-	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{name})
+	// Get the checkpoint and all deltas for the variable
+	_, cp, err := getCheckpoint(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	deltas, deltaErr := getDeltas(APIstub, name)
 	if deltaErr != nil {
 		return shim.Error(fmt.Sprintf("Could not retrieve value for %s: %s", name, deltaErr.Error()))
 	}
-	defer deltaResultsIterator.Close()
-
-	// Delete each row
-	var i int
-	for i = 0; deltaResultsIterator.HasNext(); i++ {
-		responseRange, nextErr := deltaResultsIterator.Next()
-		if nextErr != nil {
-			return shim.Error(fmt.Sprintf("Could not retrieve next row for pruning: %s", nextErr.Error()))
-		}
 
-		deltaRowDelErr := APIstub.DelState(responseRange.Key)
-		if deltaRowDelErr != nil {
-			return shim.Error(fmt.Sprintf("Could not delete delta row: %s", deltaRowDelErr.Error()))
-		}
+	// Replace them with the final value
+	err = replaceDeltas(APIstub, name, finalVal, cp, deltas, result.Void, "prunesafe")
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Failed to prune variable %s: %s", name, err.Error()))
 	}
 
-	// Insert new row for the final value
-	updateResp := s.update(APIstub, []string{name, valueStr, "+"})
-	if updateResp.Status == ERROR {
-		return shim.Error(fmt.Sprintf("Could not insert the final value of the variable after pruning, variable backup is stored in %s_PRUNE_BACKUP: %s", name, updateResp.Message))
+	// Remove the backup of earlier versions, if any
+	err = APIstub.DelState(fmt.Sprintf("%s_PRUNE_BACKUP", name))
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not delete backup value %s_PRUNE_BACKUP: %s", name, err.Error()))
 	}
 
-	// Delete the backup value
-	delErr := APIstub.DelState(fmt.Sprintf("%s_PRUNE_BACKUP", name))
-	if delErr != nil {
-		return shim.Error(fmt.Sprintf("Could not delete backup value %s_PRUNE_BACKUP, this does not affect the ledger but should be removed manually", name))
-	}
+	return shim.Success([]byte(fmt.Sprintf("Successfully pruned variable %s, final value is %s, %d rows pruned", name, finalVal, len(deltas))))
+}
 
-	return shim.Success([]byte(fmt.Sprintf("Successfully pruned variable %s, final value is %f, %d rows pruned", name, val, i)))
+/**
+ * Replaces the checkpoint and the delta rows of a variable with a checkpoint holding its value, as of the
+ * position of the current transaction, the audit record of the deltas and the checkpoint being written
+ * first. The value is stored as is: a checkpoint is never checked against the bounds of the variable, so a
+ * value below its floor is kept rather than being voided by the next merge.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param value The value of the variable
+ * @param current The checkpoint of the variable, nil if there is none
+ * @param deltas The delta rows to delete
+ * @param void The number of void deltas among them
+ * @param operation The function replacing the rows, for the audit record
+ *
+ * @return An error if the rows could not be replaced
+ */
+func replaceDeltas(APIstub shim.ChaincodeStubInterface, name string, value decimal, current *checkpoint, deltas []delta, void int, operation string) error {
+	err := putAudit(APIstub, name, operation, deltas, void, value)
+	if err != nil {
+		return err
+	}
+	position, err := txPosition(APIstub)
+	if err != nil {
+		return err
+	}
+	next := &checkpoint{Value: value.String(), Position: position, Folded: len(deltas), Void: void, TxID: APIstub.GetTxID()}
+	if current != nil {
+		next.Folded += current.Folded
+		next.Void += current.Void
+		if current.Position > next.Position {
+			next.Position = current.Position
+		}
+	}
+	err = putCheckpoint(APIstub, name, next)
+	if err != nil {
+		return err
+	}
+	for _, d := range deltas {
+		err = APIstub.DelState(d.key)
+		if err != nil {
+			return fmt.Errorf("Could not delete delta row: %s", err.Error())
+		}
+	}
+	return nil
 }
 
 /**
@@ -375,62 +527,344 @@ func (s *SmartContract) delete(APIstub shim.ChaincodeStubInterface, args []strin
 	// Retrieve the variable name
 	name := args[0]
 
-	// Delete all delta rows
-	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{name})
+	// Check the client may delete the variable before reading its rows
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.checkOwner(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkNoPrune(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Delete all delta rows, ensuring the variable exists
+	deltas, deltaErr := getDeltas(APIstub, name)
 	if deltaErr != nil {
 		return shim.Error(fmt.Sprintf("Could not retrieve delta rows for %s: %s", name, deltaErr.Error()))
 	}
-	defer deltaResultsIterator.Close()
-
-	// Ensure the variable exists
-	if !deltaResultsIterator.HasNext() {
+	_, cp, err := getCheckpoint(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if config.Owner == "" && cp == nil && len(deltas) == 0 {
 		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
 	}
-
-	// Iterate through result set and delete all indices
-	var i int
-	for i = 0; deltaResultsIterator.HasNext(); i++ {
-		responseRange, nextErr := deltaResultsIterator.Next()
-		if nextErr != nil {
-			return shim.Error(fmt.Sprintf("Could not retrieve next delta row: %s", nextErr.Error()))
+	err = delCheckpoint(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	partitions, err := getPartitions(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for mspID := range partitions {
+		err = delPartition(APIstub, name, mspID)
+		if err != nil {
+			return shim.Error(err.Error())
 		}
+	}
 
-		deltaRowDelErr := APIstub.DelState(responseRange.Key)
+	// Iterate through the deltas and delete all rows
+	var i int
+	for i = 0; i < len(deltas); i++ {
+		deltaRowDelErr := APIstub.DelState(deltas[i].key)
 		if deltaRowDelErr != nil {
 			return shim.Error(fmt.Sprintf("Could not delete delta row: %s", deltaRowDelErr.Error()))
 		}
 	}
 
+	// The configuration goes with the variable, a new variable by the same name starts with the defaults
+	configKey, err := APIstub.CreateCompositeKey("config~varName", []string{name})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not create a composite key for %s: %s", name, err.Error()))
+	}
+	err = APIstub.DelState(configKey)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not delete the configuration of %s: %s", name, err.Error()))
+	}
+
 	return shim.Success([]byte(fmt.Sprintf("Deleted %s, %d rows removed", name, i)))
 }
 
 /**
- * Converts a float64 to a byte array
+ * Sets the scale of a variable, the number of digits allowed after the decimal point of its deltas.
+ * Variables whose scale was never set have a scale of 2. The scale can only be increased, so that
+ * the deltas already in the ledger stay exact. The args array contains the following arguments:
+ *	- args[0] -> The name of the variable
+ *	- args[1] -> The new scale, from 0 to 18
  *
- * @param f The float64 to convert
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the setscale invocation
  *
- * @return The byte array representation
+ * @return A response structure indicating success or failure with a message
  */
-func f2barr(f float64) []byte {
-	str := strconv.FormatFloat(f, 'f', -1, 64)
+func (s *SmartContract) setScale(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check there are a correct number of arguments
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+
+	name := args[0]
+	scale, convErr := strconv.Atoi(args[1])
+	if convErr != nil || scale < 0 || scale > maxScale {
+		return shim.Error(fmt.Sprintf("Scale %s is invalid, expecting a number from 0 to %d", args[1], maxScale))
+	}
 
-	return []byte(str)
+	// Amounts recorded at the current scale must still be representable
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.checkOwner(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if scale < config.Scale {
+		return shim.Error(fmt.Sprintf("The scale of %s can only be increased, it is %d", name, config.Scale))
+	}
+
+	config.Scale = scale
+	err = putVarConfig(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Scale of %s set to %d", name, scale)))
 }
 
-// The main function is only relevant in unit test mode. Only included here for completeness.
-func main() {
+/**
+ * Sets the floor of a variable, making it a bounded counter: a delta which would take its value below
+ * the floor is void when the deltas are merged. The floor only bounds the deltas positioned after the
+ * transaction setting it, the earlier ones keeping the floor they had, so the value of the variable does
+ * not depend on whether they were folded into its checkpoint already. The args array contains the
+ * following arguments:
+ *	- args[0] -> The name of the variable
+ *	- args[1] -> The floor, a decimal at the scale of the variable, or an empty string to remove it
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the setfloor invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) setFloor(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check there are a correct number of arguments
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+
+	name := args[0]
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.checkOwner(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if config.Partitioned {
+		return shim.Error(fmt.Sprintf("The floor of %s can not be changed while its quota partitions are on", name))
+	}
+
+	// The floor being replaced still bounds the deltas positioned before the new one, see floorAt
+	position, err := txPosition(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, cp, err := getCheckpoint(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if config.Floor != "" || config.FloorPosition != "" {
+		config.EarlierFloors = append(config.EarlierFloors, floorChange{Position: config.FloorPosition, Floor: config.Floor})
+	}
+	config.FloorPosition = position
+	if cp != nil {
+		// The floors replaced before the checkpoint bound no delta left, the deltas committed late merging
+		// after the checkpoint as if they were positioned at it
+		for len(config.EarlierFloors) > 0 && nextFloorPosition(config, 0) <= cp.Position {
+			config.EarlierFloors = config.EarlierFloors[1:]
+		}
+	}
+
+	config.Floor = ""
+	if args[1] != "" {
+		floor, err := parseDecimal(args[1], config.Scale)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Floor %s is invalid for %s: %s", args[1], name, err.Error()))
+		}
+		if ceiling, err := config.ceiling(); err != nil {
+			return shim.Error(err.Error())
+		} else if ceiling != nil && floor.cmp(*ceiling) > 0 {
+			return shim.Error(fmt.Sprintf("Floor %s is above the ceiling %s of %s", floor, ceiling, name))
+		}
+		config.Floor = floor.String()
+	}
 
-	// Create a new Smart Contract
-	err := shim.Start(new(SmartContract))
+	err = putVarConfig(APIstub, name, config)
 	if err != nil {
-		fmt.Printf("Error creating new Smart Contract: %s", err)
+		return shim.Error(err.Error())
 	}
+
+	if config.Floor == "" {
+		return shim.Success([]byte(fmt.Sprintf("Floor of %s removed", name)))
+	}
+	return shim.Success([]byte(fmt.Sprintf("Floor of %s set to %s", name, config.Floor)))
+}
+
+/**
+ * Computes the value of a variable, merging the deltas not folded into its checkpoint yet
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param config The configuration of the variable
+ *
+ * @return The value, zero if the variable has neither a checkpoint nor deltas, the number of void deltas
+ * merged, whether the variable has a checkpoint or deltas, or an error if the value could not be computed
+ */
+func getValue(APIstub shim.ChaincodeStubInterface, name string, config *varConfig) (decimal, int, bool, error) {
+	value, cp, err := getCheckpoint(APIstub, name, config)
+	if err != nil {
+		return decimal{}, 0, false, err
+	}
+	deltas, err := getDeltas(APIstub, name)
+	if err != nil {
+		return decimal{}, 0, false, fmt.Errorf("Could not retrieve value for %s: %s", name, err.Error())
+	}
+	value, void, err := mergeDeltas(value, deltas, config)
+	if err != nil {
+		return decimal{}, 0, false, err
+	}
+	return value, void, cp != nil || len(deltas) > 0, nil
+}
+
+/**
+ * Retrieves the configuration of a variable, the defaults if it was never configured
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The configuration, or an error if it could not be read
+ */
+func getVarConfig(APIstub shim.ChaincodeStubInterface, name string) (*varConfig, error) {
+	configKey, err := APIstub.CreateCompositeKey("config~varName", []string{name})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	configBytes, err := APIstub.GetState(configKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve the configuration of %s: %s", name, err.Error())
+	} else if configBytes == nil {
+		return &varConfig{Scale: defaultScale}, nil
+	}
+
+	config := &varConfig{}
+	err = json.Unmarshal(configBytes, config)
+	if err != nil {
+		return nil, fmt.Errorf("The configuration of %s is corrupted: %s", name, err.Error())
+	}
+	return config, nil
+}
+
+/**
+ * Stores the configuration of a variable
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param config The configuration
+ *
+ * @return An error if it could not be written
+ */
+func putVarConfig(APIstub shim.ChaincodeStubInterface, name string, config *varConfig) error {
+	configKey, err := APIstub.CreateCompositeKey("config~varName", []string{name})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	err = APIstub.PutState(configKey, configBytes)
+	if err != nil {
+		return fmt.Errorf("Could not put the configuration of %s in the ledger: %s", name, err.Error())
+	}
+	return nil
+}
+
+/**
+ * Parses the floor of a variable
+ *
+ * @return The floor, nil if the variable has none, or an error if it is corrupted
+ */
+func (config *varConfig) floor() (*decimal, error) {
+	return config.bound("floor", config.Floor)
+}
+
+/**
+ * Parses the floor bounding the deltas of a variable positioned at a position: the floor set by setFloor
+ * bounds the deltas positioned from the transaction which set it on, and the floors it replaced the deltas
+ * positioned before it. The deltas positioned before the first floor was set have none, unless it was set
+ * when the variable was created.
+ *
+ * @return The floor, nil if there is none, or an error if it is corrupted
+ */
+func (config *varConfig) floorAt(position string) (*decimal, error) {
+	if position >= config.FloorPosition {
+		return config.floor()
+	}
+	for i := len(config.EarlierFloors) - 1; i >= 0; i-- {
+		if position >= config.EarlierFloors[i].Position {
+			return config.bound("floor", config.EarlierFloors[i].Floor)
+		}
+	}
+	return nil, nil
+}
+
+/**
+ * Returns the position the floor following the ith earlier floor of a variable was set at
+ */
+func nextFloorPosition(config *varConfig, i int) string {
+	if i+1 < len(config.EarlierFloors) {
+		return config.EarlierFloors[i+1].Position
+	}
+	return config.FloorPosition
+}
+
+/**
+ * Parses the ceiling of a variable
+ *
+ * @return The ceiling, nil if the variable has none, or an error if it is corrupted
+ */
+func (config *varConfig) ceiling() (*decimal, error) {
+	return config.bound("ceiling", config.Ceiling)
+}
+
+/**
+ * Parses a bound of a variable, kind naming it in errors
+ */
+func (config *varConfig) bound(kind string, boundStr string) (*decimal, error) {
+	if boundStr == "" {
+		return nil, nil
+	}
+	bound, err := parseDecimal(boundStr, config.Scale)
+	if err != nil {
+		return nil, fmt.Errorf("The %s %s is corrupted: %s", kind, boundStr, err.Error())
+	}
+	return &bound, nil
 }
 
 /**
  * All functions below this are for testing traditional editing of a single row
  */
 func (s *SmartContract) putStandard(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check there are a correct number of arguments
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+
 	name := args[0]
 	valStr := args[1]
 
@@ -448,6 +882,11 @@ func (s *SmartContract) putStandard(APIstub shim.ChaincodeStubInterface, args []
 }
 
 func (s *SmartContract) getStandard(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check there are a correct number of arguments
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+
 	name := args[0]
 
 	val, getErr := APIstub.GetState(name)
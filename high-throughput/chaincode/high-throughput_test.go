@@ -0,0 +1,425 @@
+/*
+ * Tests of update, get, delete and the traditional single row functions, and the stub the tests of the
+ * chaincode run on.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// testStub wraps the MockStub the way a peer runs a transaction: its writes are buffered and only
+// applied if it succeeds, and it does not read them back. A test can choose the function arguments and
+// the organization of the client, and make the writes fail. Each invoke runs in a new transaction, one
+// second after the previous one unless the clock of the client is behind.
+type testStub struct {
+	*shim.MockStub
+	args       []string
+	mspID      string
+	txCount    int64
+	writes     []testWrite
+	failAfter  int // the number of writes of a transaction which succeed before the next ones fail, -1 for none
+	writeCount int
+	clockSkew  int64 // the seconds the clock of the client is behind, taken off the transaction timestamps
+}
+
+// testWrite is a write buffered by the testStub, a deletion if deleted is set
+type testWrite struct {
+	key     string
+	value   []byte
+	deleted bool
+}
+
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	return stub.args[0], stub.args[1:]
+}
+
+func (stub *testStub) PutState(key string, value []byte) error {
+	if stub.failAfter >= 0 && stub.writeCount >= stub.failAfter {
+		return errors.New("injected write failure")
+	}
+	stub.writeCount++
+	stub.writes = append(stub.writes, testWrite{key: key, value: value})
+	return nil
+}
+
+func (stub *testStub) DelState(key string) error {
+	if stub.failAfter >= 0 && stub.writeCount >= stub.failAfter {
+		return errors.New("injected delete failure")
+	}
+	stub.writeCount++
+	stub.writes = append(stub.writes, testWrite{key: key, deleted: true})
+	return nil
+}
+
+func (stub *testStub) GetCreator() ([]byte, error) {
+	return proto.Marshal(&msp.SerializedIdentity{Mspid: stub.mspID})
+}
+
+func (stub *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: 1500000000 + stub.txCount - stub.clockSkew}, nil
+}
+
+func newTestStub() *testStub {
+	return &testStub{MockStub: shim.NewMockStub("high-throughput", new(SmartContract)), mspID: "Org1MSP", failAfter: -1}
+}
+
+// invoke runs a transaction against the wrapped stub, and commits its writes if it succeeds
+func (stub *testStub) invoke(args ...string) sc.Response {
+	return stub.run(new(SmartContract).Invoke, args)
+}
+
+// init runs Init against the wrapped stub, as an instantiation or an upgrade does
+func (stub *testStub) init(args ...string) sc.Response {
+	return stub.run(new(SmartContract).Init, args)
+}
+
+// run runs a transaction calling a function of the chaincode, and commits its writes if it succeeds
+func (stub *testStub) run(function func(shim.ChaincodeStubInterface) sc.Response, args []string) sc.Response {
+	stub.args = args
+	stub.txCount++
+	stub.writes = nil
+	stub.writeCount = 0
+	txID := "tx" + strconv.FormatInt(stub.txCount, 10)
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+
+	res := function(stub)
+	if res.Status == shim.OK {
+		for _, write := range stub.writes {
+			if write.deleted {
+				stub.MockStub.DelState(write.key)
+			} else {
+				stub.MockStub.PutState(write.key, write.value)
+			}
+		}
+	}
+	return res
+}
+
+// snapshot returns a copy of the committed state
+func (stub *testStub) snapshot() map[string]string {
+	state := map[string]string{}
+	for key, value := range stub.State {
+		state[key] = string(value)
+	}
+	return state
+}
+
+// countKeys returns the number of keys of an object type
+func countKeys(stub *testStub, objectType string) int {
+	count := 0
+	for key := range stub.State {
+		if gotType, _, err := stub.SplitCompositeKey(key); err == nil && gotType == objectType {
+			count++
+		}
+	}
+	return count
+}
+
+func checkInvoke(t *testing.T, stub *testStub, args ...string) sc.Response {
+	res := stub.invoke(args...)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", res.Message)
+		t.FailNow()
+	}
+	return res
+}
+
+func checkInvokeFailed(t *testing.T, stub *testStub, args ...string) sc.Response {
+	res := stub.invoke(args...)
+	if res.Status == shim.OK {
+		fmt.Println("Invoke", args, "succeeded but failure was expected")
+		t.FailNow()
+	}
+	return res
+}
+
+func checkValue(t *testing.T, stub *testStub, name string, expected string) {
+	res := checkInvoke(t, stub, "get", name)
+	if string(res.Payload) != expected {
+		fmt.Println("Value of", name, "was", string(res.Payload), "and not", expected, "as expected")
+		t.FailNow()
+	}
+}
+
+func checkState(t *testing.T, stub *testStub, expected map[string]string) {
+	state := stub.snapshot()
+	for key, value := range expected {
+		if gotValue, ok := state[key]; !ok || gotValue != value {
+			fmt.Printf("State %q was %q and not %q as expected\n", key, gotValue, value)
+			t.FailNow()
+		}
+	}
+	for key := range state {
+		if _, ok := expected[key]; !ok {
+			fmt.Printf("State %q exists but was not expected to\n", key)
+			t.FailNow()
+		}
+	}
+}
+
+// createTestVariable creates a variable owned by Org1MSP with no bounds
+func createTestVariable(t *testing.T, stub *testStub, name string) {
+	checkInvoke(t, stub, "createvariable", name, "test variable", "", "", "", "")
+}
+
+func TestUpdate_AggregatesManyDeltas(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "pool")
+
+	expected := 0
+	for i := 1; i <= 300; i++ {
+		if i%10 == 0 {
+			checkInvoke(t, stub, "update", "pool", "2.50", "-")
+			expected -= 250
+		} else {
+			checkInvoke(t, stub, "update", "pool", "1.25", "+")
+			expected += 125
+		}
+	}
+
+	if countKeys(stub, deltaIndexName) != 300 {
+		fmt.Println(countKeys(stub, deltaIndexName), "delta rows were written instead of 300")
+		t.FailNow()
+	}
+	checkValue(t, stub, "pool", fmt.Sprintf("%d.%02d", expected/100, expected%100))
+}
+
+func TestUpdate_MergesOperationsInOrder(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "temp")
+
+	checkInvoke(t, stub, "update", "temp", "10", "+")
+	checkInvoke(t, stub, "update", "temp", "1.5", "*")
+	checkInvoke(t, stub, "update", "temp", "20", "max")
+	checkInvoke(t, stub, "update", "temp", "18", "min")
+	checkValue(t, stub, "temp", "18.00")
+
+	checkInvoke(t, stub, "update", "temp", "5", "=")
+	checkInvoke(t, stub, "update", "temp", "1", "+")
+	checkValue(t, stub, "temp", "6.00")
+}
+
+func TestUpdate_RejectsUnknownOperators(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "pool")
+
+	for _, op := range []string{"", "/", "x", "++", "plus", "MIN", " +"} {
+		checkInvokeFailed(t, stub, "update", "pool", "1", op)
+	}
+	if countKeys(stub, deltaIndexName) != 0 {
+		fmt.Println("Rejected updates wrote delta rows")
+		t.FailNow()
+	}
+	checkInvokeFailed(t, stub, "get", "pool")
+}
+
+func TestUpdate_RejectsInvalidValues(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "pool")
+
+	for _, value := range []string{"", "abc", "1e3", "0x10", "NaN", "1.001", "1,5", "--1"} {
+		checkInvokeFailed(t, stub, "update", "pool", value, "+")
+	}
+	if countKeys(stub, deltaIndexName) != 0 {
+		fmt.Println("Rejected updates wrote delta rows")
+		t.FailNow()
+	}
+}
+
+func TestUpdate_ChecksTheArguments(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "pool")
+
+	checkInvokeFailed(t, stub, "update")
+	checkInvokeFailed(t, stub, "update", "pool")
+	checkInvokeFailed(t, stub, "update", "pool", "1")
+	checkInvokeFailed(t, stub, "update", "pool", "1", "+", "extra")
+	checkInvokeFailed(t, stub, "update", "unknown", "1", "+")
+}
+
+func TestUpdate_IsRefusedToOtherOrganizations(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "pool", "test variable", "", "", "", "Org2MSP")
+
+	stub.mspID = "Org3MSP"
+	checkInvokeFailed(t, stub, "update", "pool", "1", "+")
+	stub.mspID = "Org2MSP"
+	checkInvoke(t, stub, "update", "pool", "1", "+")
+	checkValue(t, stub, "pool", "1.00")
+}
+
+func TestSetFloor_BoundsOnlyTheDeltasAfterIt(t *testing.T) {
+	for _, compacted := range []bool{false, true} {
+		stub := newTestStub()
+		createTestVariable(t, stub, "stock")
+		checkInvoke(t, stub, "update", "stock", "100", "+")
+		checkInvoke(t, stub, "update", "stock", "150", "-")
+		if compacted {
+			checkInvoke(t, stub, "compact", "stock", "0")
+		}
+
+		// the value is the same whether the deltas were folded into the checkpoint or not
+		checkInvoke(t, stub, "setfloor", "stock", "0")
+		checkValue(t, stub, "stock", "-50.00")
+		checkInvoke(t, stub, "update", "stock", "1", "-")
+		checkValue(t, stub, "stock", "-50.00")
+		checkInvoke(t, stub, "update", "stock", "100", "+")
+		checkInvoke(t, stub, "update", "stock", "60", "-")
+		checkValue(t, stub, "stock", "50.00")
+	}
+
+	// a delta which only took the value below the floor after a later increment is not voided either
+	stub := newTestStub()
+	createTestVariable(t, stub, "stock")
+	checkInvoke(t, stub, "update", "stock", "100", "+")
+	checkInvoke(t, stub, "update", "stock", "150", "-")
+	checkInvoke(t, stub, "update", "stock", "100", "+")
+	checkInvoke(t, stub, "setfloor", "stock", "0")
+	checkValue(t, stub, "stock", "50.00")
+}
+
+func TestSetFloor_KeepsTheFloorsItReplacesForTheDeltasBeforeIt(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "stock", "test variable", "", "0", "", "")
+	checkInvoke(t, stub, "update", "stock", "10", "-")
+	checkInvoke(t, stub, "setfloor", "stock", "-100")
+	checkInvoke(t, stub, "update", "stock", "50", "-")
+	checkInvoke(t, stub, "setfloor", "stock", "")
+	checkInvoke(t, stub, "update", "stock", "100", "-")
+	checkInvoke(t, stub, "setfloor", "stock", "0")
+	checkValue(t, stub, "stock", "-150.00")
+
+	// the floors replaced before the checkpoint are forgotten
+	checkInvoke(t, stub, "compact", "stock", "0")
+	checkInvoke(t, stub, "setfloor", "stock", "-200")
+	checkValue(t, stub, "stock", "-150.00")
+	checkVariables(t, stub, []variableInfo{{"stock", varConfig{Scale: 2, Floor: "-200.00", FloorPosition: testPosition(10),
+		EarlierFloors: []floorChange{{testPosition(7), "0.00"}}, Owner: "Org1MSP", Description: "test variable"}}})
+	checkInvoke(t, stub, "update", "stock", "100", "-")
+	checkValue(t, stub, "stock", "-150.00")
+}
+
+func TestGet_FailsForUnknownVariables(t *testing.T) {
+	stub := newTestStub()
+	checkInvokeFailed(t, stub, "get", "unknown")
+	checkInvokeFailed(t, stub, "get")
+	checkInvokeFailed(t, stub, "get", "unknown", "extra")
+}
+
+func TestGet_KeepsVariablesApart(t *testing.T) {
+	stub := newTestStub()
+	for _, name := range []string{"a", "ab", "a b", "a~b"} {
+		createTestVariable(t, stub, name)
+	}
+	checkInvoke(t, stub, "update", "a", "1", "+")
+	checkInvoke(t, stub, "update", "ab", "2", "+")
+	checkInvoke(t, stub, "update", "a b", "3", "+")
+	checkInvoke(t, stub, "update", "a~b", "4", "+")
+
+	checkValue(t, stub, "a", "1.00")
+	checkValue(t, stub, "ab", "2.00")
+	checkValue(t, stub, "a b", "3.00")
+	checkValue(t, stub, "a~b", "4.00")
+}
+
+func TestDelete_RemovesTheVariable(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "pool")
+	createTestVariable(t, stub, "other")
+	for i := 0; i < 5; i++ {
+		checkInvoke(t, stub, "update", "pool", "1", "+")
+	}
+	checkInvoke(t, stub, "update", "other", "7", "+")
+	checkInvoke(t, stub, "compact", "pool", "2")
+	checkInvoke(t, stub, "update", "pool", "1", "+")
+
+	checkInvoke(t, stub, "delete", "pool")
+	checkInvokeFailed(t, stub, "get", "pool")
+	checkInvokeFailed(t, stub, "update", "pool", "1", "+")
+	if countKeys(stub, deltaIndexName) != 1 || countKeys(stub, checkpointIndexName) != 0 || countKeys(stub, "config~varName") != 1 {
+		fmt.Println("Delete left rows of pool or removed rows of other")
+		t.FailNow()
+	}
+	checkValue(t, stub, "other", "7.00")
+
+	// a variable created again by the same name starts from scratch
+	createTestVariable(t, stub, "pool")
+	checkInvoke(t, stub, "update", "pool", "2", "+")
+	checkValue(t, stub, "pool", "2.00")
+}
+
+func TestDelete_FailsForUnknownVariables(t *testing.T) {
+	stub := newTestStub()
+	checkInvokeFailed(t, stub, "delete", "unknown")
+	checkInvokeFailed(t, stub, "delete")
+	checkInvokeFailed(t, stub, "delete", "unknown", "extra")
+}
+
+func TestDelete_IsRefusedToOtherOrganizations(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "pool", "test variable", "", "", "", "Org2MSP")
+	checkInvoke(t, stub, "update", "pool", "1", "+")
+
+	stub.mspID = "Org2MSP"
+	checkInvokeFailed(t, stub, "delete", "pool")
+	stub.mspID = "Org1MSP"
+	checkValue(t, stub, "pool", "1.00")
+}
+
+func TestDelete_LeavesTheLedgerUnchangedOnFailure(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "pool")
+	for i := 0; i < 5; i++ {
+		checkInvoke(t, stub, "update", "pool", "1", "+")
+	}
+	before := stub.snapshot()
+
+	stub.failAfter = 3
+	checkInvokeFailed(t, stub, "delete", "pool")
+	checkState(t, stub, before)
+	stub.failAfter = -1
+	checkValue(t, stub, "pool", "5.00")
+	checkInvoke(t, stub, "delete", "pool")
+}
+
+func TestPutStandardAndGetStandard(t *testing.T) {
+	stub := newTestStub()
+	res := checkInvoke(t, stub, "getstandard", "row")
+	if len(res.Payload) != 0 {
+		fmt.Println("Row was", string(res.Payload), "before being put")
+		t.FailNow()
+	}
+
+	checkInvoke(t, stub, "putstandard", "row", "1")
+	checkInvoke(t, stub, "putstandard", "row", "2")
+	res = checkInvoke(t, stub, "getstandard", "row")
+	if string(res.Payload) != "2" {
+		fmt.Println("Row was", string(res.Payload), "and not 2 as expected")
+		t.FailNow()
+	}
+}
+
+func TestPutStandardAndGetStandard_CheckTheArguments(t *testing.T) {
+	stub := newTestStub()
+	checkInvokeFailed(t, stub, "putstandard")
+	checkInvokeFailed(t, stub, "putstandard", "row")
+	checkInvokeFailed(t, stub, "putstandard", "row", "1", "extra")
+	checkInvokeFailed(t, stub, "getstandard")
+	checkInvokeFailed(t, stub, "getstandard", "row", "extra")
+	if len(stub.State) != 0 {
+		fmt.Println("Rejected putstandard wrote rows")
+		t.FailNow()
+	}
+}
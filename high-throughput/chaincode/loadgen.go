@@ -0,0 +1,245 @@
+//go:build loadgen
+// +build loadgen
+
+/*
+ * A load generator for the chaincode, replacing the many-updates.sh scripts. It submits update and
+ * putstandard transactions on one variable from concurrent clients, at a given rate for a given duration,
+ * then reports the throughput, the latency percentiles and the rate of MVCC read conflicts of each pattern:
+ * the deltas written by update never conflict, the single row rewritten by putstandard mostly does.
+ * The transactions are either submitted to a network, through the peer CLI, or to an in-process ledger
+ * built on shim.MockStub which cuts blocks and validates them the way a peer does. The load generator
+ * replaces the main function of the chaincode when built with the loadgen tag:
+ *
+ *	go run -tags loadgen . -mode mock -pattern both -concurrency 50 -duration 30s
+ *	go run -tags loadgen . -mode network -rate 200
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/**
+ * Where the transactions are submitted, the in-process ledger or a network
+ */
+type target interface {
+	// Submits a transaction and waits for its block, returning its validation code, or an error if
+	// it could not be endorsed or committed
+	invoke(function string, args ...string) (sc.TxValidationCode, error)
+	// Runs a chaincode function without submitting a transaction, returning its payload
+	query(function string, args ...string) ([]byte, error)
+	close() error
+}
+
+/**
+ * The settings of a run, shared by the patterns
+ */
+type loadConfig struct {
+	concurrency int
+	rate        float64 // transactions per second over all the clients, 0 for no limit
+	duration    time.Duration
+	variable    string
+	value       string
+}
+
+func main() {
+	mode := flag.String("mode", "mock", "where to submit the transactions, mock for an in-process ledger or network")
+	pattern := flag.String("pattern", "both", "the transactions to submit, update, putstandard or both one after the other")
+	concurrency := flag.Int("concurrency", 10, "the number of concurrent clients")
+	rate := flag.Float64("rate", 0, "the transactions per second submitted by all the clients, 0 for as many as they can")
+	duration := flag.Duration("duration", 10*time.Second, "how long each pattern submits transactions for")
+	variable := flag.String("variable", "loadgen", "the variable to update, created if it does not exist")
+	value := flag.String("value", "1", "the value each update adds to the variable")
+	mspID := flag.String("msp", "Org1MSP", "mock mode: the MSP ID of the client")
+	blockSize := flag.Int("block-size", 10, "mock mode: the maximum number of transactions of a block")
+	blockTimeout := flag.Duration("block-timeout", 2*time.Second, "mock mode: how long a block waits for more transactions")
+	orderer := flag.String("orderer", "orderer.example.com:7050", "network mode: the address of the orderer")
+	caFile := flag.String("cafile", "/opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ordererOrganizations/example.com/orderers/orderer.example.com/msp/tlscacerts/tlsca.example.com-cert.pem", "network mode: the TLS CA certificate of the orderer")
+	channel := flag.String("channel", envOr("CHANNEL_NAME", "mychannel"), "network mode: the name of the channel")
+	chaincode := flag.String("chaincode", envOr("CC_NAME", "bigdatacc"), "network mode: the name of the chaincode")
+	flag.Parse()
+
+	patterns := []string{*pattern}
+	if *pattern == "both" {
+		patterns = []string{"update", "putstandard"}
+	} else if *pattern != "update" && *pattern != "putstandard" {
+		log.Fatalf("Pattern %s is unrecognized, expecting update, putstandard or both", *pattern)
+	}
+	if *concurrency <= 0 || *rate < 0 || *duration <= 0 {
+		log.Fatal("The concurrency and the duration must be positive, the rate can not be negative")
+	}
+	if _, err := strconv.ParseFloat(*value, 64); err != nil {
+		log.Fatalf("Value %s is not a number", *value)
+	}
+	config := loadConfig{concurrency: *concurrency, rate: *rate, duration: *duration, variable: *variable, value: *value}
+
+	var t target
+	var err error
+	switch *mode {
+	case "mock":
+		if *blockSize <= 0 || *blockTimeout <= 0 {
+			log.Fatal("The block size and the block timeout must be positive")
+		}
+		t, err = newMockLedger(*mspID, *blockSize, *blockTimeout)
+	case "network":
+		t, err = connectNetwork(*orderer, *caFile, *channel, *chaincode)
+	default:
+		log.Fatalf("Mode %s is unrecognized, expecting mock or network", *mode)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer t.close()
+
+	if contains(patterns, "update") {
+		_, err = t.invoke("createvariable", config.variable, "Created by the load generator", "", "", "", "")
+		if err != nil && !strings.Contains(err.Error(), "already exists") {
+			t.close()
+			log.Fatal(err)
+		}
+	}
+
+	results := []*patternStats{}
+	for _, p := range patterns {
+		fmt.Printf("Submitting %s transactions for %s with %d clients\n", p, config.duration, config.concurrency)
+		stats, err := runPattern(t, p, config)
+		if err != nil {
+			t.close()
+			log.Fatal(err)
+		}
+		results = append(results, stats)
+	}
+	fmt.Println()
+	printReport(os.Stdout, results)
+}
+
+/**
+ * Submits the transactions of a pattern from concurrent clients until the duration of the run is over,
+ * and reads the value of the variable before and after
+ *
+ * @param t Where to submit the transactions
+ * @param pattern update or putstandard
+ * @param config The settings of the run
+ *
+ * @return The statistics of the pattern, or an error if the value of the variable could not be read
+ */
+func runPattern(t target, pattern string, config loadConfig) (*patternStats, error) {
+	getFunction := "get"
+	if pattern == "putstandard" {
+		getFunction = "getstandard"
+	}
+	// a variable without deltas has no value yet
+	initial, err := t.query(getFunction, config.variable)
+	if err != nil && !strings.Contains(err.Error(), "No variable by the name") {
+		return nil, err
+	}
+
+	stats := newPatternStats(pattern)
+	stats.initial = string(initial)
+
+	// the clients take a token before each transaction, the tokens being handed out at the rate of the run
+	var tokens <-chan time.Time
+	if config.rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / config.rate))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	var sequence int64
+	deadline := time.Now().Add(config.duration)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < config.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if tokens != nil {
+					select {
+					case <-tokens:
+					case <-time.After(deadline.Sub(time.Now())):
+						return
+					}
+				}
+
+				// putstandard writes the sequence number of the transaction, as many-updates-traditional.sh did
+				args := []string{config.variable, config.value, "+"}
+				if pattern == "putstandard" {
+					args = []string{config.variable, strconv.FormatInt(atomic.AddInt64(&sequence, 1), 10)}
+				}
+				submitted := time.Now()
+				code, err := t.invoke(pattern, args...)
+				stats.record(time.Since(submitted), code, err)
+			}
+		}()
+	}
+	wg.Wait()
+	stats.elapsed = time.Since(start)
+
+	final, err := t.query(getFunction, config.variable)
+	if err != nil {
+		return nil, err
+	}
+	stats.final = string(final)
+	if pattern == "update" {
+		stats.expected = expectedValue(stats.initial, config.value, stats.committed)
+	}
+	return stats, nil
+}
+
+/**
+ * Computes the value a variable should have once the committed updates were added to it
+ *
+ * @param initial The value before the run, empty if the variable had none
+ * @param value The value added by each update
+ * @param committed The number of committed updates
+ *
+ * @return The expected value, or nil if the values are not numbers
+ */
+func expectedValue(initial string, value string, committed int) *big.Rat {
+	total := new(big.Rat)
+	if initial != "" {
+		if _, ok := total.SetString(initial); !ok {
+			return nil
+		}
+	}
+	delta, ok := new(big.Rat).SetString(value)
+	if !ok {
+		return nil
+	}
+	return total.Add(total, delta.Mul(delta, new(big.Rat).SetInt64(int64(committed))))
+}
+
+/**
+ * Tells whether a list of strings holds a given string
+ */
+func contains(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Returns the value of an environment variable, or a default value if it is not set
+ */
+func envOr(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,365 @@
+//go:build loadgen
+// +build loadgen
+
+/*
+ * The in-process ledger of the load generator. The committed state is held by a shim.MockStub, which on its
+ * own runs one invocation after the other and so never conflicts. The ledger adds what a peer does around
+ * it: the chaincode is simulated against the committed state, recording the versions of the keys it reads
+ * and buffering its writes, the simulated transactions are cut into blocks, and each transaction of a block
+ * is validated, its reads checked against the state left by the transactions before it, then committed or
+ * marked with an MVCC or phantom read conflict.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/**
+ * The ledger, its committed state and the transactions waiting for the next block
+ */
+type mockLedger struct {
+	// simulations hold the read lock, blocks are cut and committed under the write lock
+	mutex        sync.RWMutex
+	contract     *SmartContract
+	state        *shim.MockStub
+	versions     map[string]uint64 // the sequence number of the transaction which last wrote each key
+	sequence     uint64
+	pending      []*mockTx
+	generation   int // incremented by each block, so that the timer of a block already cut does nothing
+	creator      []byte
+	blockSize    int
+	blockTimeout time.Duration
+}
+
+/**
+ * A simulated transaction, its read set and its write set
+ */
+type mockTx struct {
+	txID   string
+	reads  map[string]uint64
+	ranges []*rangeRead
+	writes map[string]*mockWrite
+	done   chan sc.TxValidationCode
+}
+
+/**
+ * A range read by a transaction, the keys it returned and whether it was read to the end
+ */
+type rangeRead struct {
+	startKey  string
+	endKey    string
+	keys      []string
+	versions  []uint64
+	exhausted bool
+}
+
+/**
+ * A key written or deleted by a transaction
+ */
+type mockWrite struct {
+	value   []byte
+	deleted bool
+}
+
+/**
+ * Creates an empty ledger
+ *
+ * @param mspID The MSP ID of the client submitting the transactions
+ * @param blockSize The maximum number of transactions of a block
+ * @param blockTimeout How long a block waits for more transactions before it is cut
+ *
+ * @return The ledger, or an error if the identity of the client could not be encoded
+ */
+func newMockLedger(mspID string, blockSize int, blockTimeout time.Duration) (*mockLedger, error) {
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID})
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode the identity of %s: %s", mspID, err.Error())
+	}
+	contract := new(SmartContract)
+	return &mockLedger{
+		contract:     contract,
+		state:        shim.NewMockStub("loadgen", contract),
+		versions:     map[string]uint64{},
+		creator:      creator,
+		blockSize:    blockSize,
+		blockTimeout: blockTimeout,
+	}, nil
+}
+
+/**
+ * Simulates a transaction then waits for it to be validated in a block
+ */
+func (ledger *mockLedger) invoke(function string, args ...string) (sc.TxValidationCode, error) {
+	tx := &mockTx{reads: map[string]uint64{}, writes: map[string]*mockWrite{}, done: make(chan sc.TxValidationCode, 1)}
+	_, err := ledger.simulate(tx, function, args)
+	if err != nil {
+		return 0, err
+	}
+
+	ledger.mutex.Lock()
+	ledger.pending = append(ledger.pending, tx)
+	if len(ledger.pending) >= ledger.blockSize {
+		ledger.cutBlock()
+	} else if len(ledger.pending) == 1 {
+		generation := ledger.generation
+		time.AfterFunc(ledger.blockTimeout, func() {
+			ledger.mutex.Lock()
+			defer ledger.mutex.Unlock()
+			if ledger.generation == generation {
+				ledger.cutBlock()
+			}
+		})
+	}
+	ledger.mutex.Unlock()
+
+	return <-tx.done, nil
+}
+
+/**
+ * Simulates a transaction and returns its payload, discarding its writes
+ */
+func (ledger *mockLedger) query(function string, args ...string) ([]byte, error) {
+	tx := &mockTx{reads: map[string]uint64{}, writes: map[string]*mockWrite{}}
+	return ledger.simulate(tx, function, args)
+}
+
+/**
+ * Cuts the transactions left into a last block
+ */
+func (ledger *mockLedger) close() error {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	if len(ledger.pending) > 0 {
+		ledger.cutBlock()
+	}
+	return nil
+}
+
+/**
+ * Runs the chaincode against the committed state, filling the read and write sets of a transaction
+ *
+ * @return The payload of the chaincode, or an error if it failed, as the endorsement would
+ */
+func (ledger *mockLedger) simulate(tx *mockTx, function string, args []string) ([]byte, error) {
+	ledger.mutex.Lock()
+	ledger.sequence++
+	tx.txID = fmt.Sprintf("loadgen%010d", ledger.sequence)
+	ledger.mutex.Unlock()
+
+	input := [][]byte{[]byte(function)}
+	for _, arg := range args {
+		input = append(input, []byte(arg))
+	}
+	now := time.Now()
+	stub := &txStub{
+		MockStub:  ledger.state,
+		ledger:    ledger,
+		tx:        tx,
+		args:      input,
+		timestamp: &timestamp.Timestamp{Seconds: now.Unix(), Nanos: int32(now.Nanosecond())},
+	}
+
+	ledger.mutex.RLock()
+	response := ledger.contract.Invoke(stub)
+	ledger.mutex.RUnlock()
+	if response.Status != shim.OK {
+		return nil, fmt.Errorf("%s failed: %s", function, response.Message)
+	}
+	return response.Payload, nil
+}
+
+/**
+ * Validates the pending transactions in order and commits the valid ones, the caller holding the write lock
+ */
+func (ledger *mockLedger) cutBlock() {
+	block := ledger.pending
+	ledger.pending = nil
+	ledger.generation++
+
+	for _, tx := range block {
+		code := ledger.validate(tx)
+		if code == sc.TxValidationCode_VALID {
+			ledger.commit(tx)
+		}
+		tx.done <- code
+	}
+}
+
+/**
+ * Checks the keys and the ranges read by a transaction were not changed since it was simulated, by a
+ * transaction of an earlier block or by a valid one before it in its block
+ */
+func (ledger *mockLedger) validate(tx *mockTx) sc.TxValidationCode {
+	for key, version := range tx.reads {
+		if ledger.versions[key] != version {
+			return sc.TxValidationCode_MVCC_READ_CONFLICT
+		}
+	}
+
+	for _, read := range tx.ranges {
+		// a range which was not read to the end is only checked up to its last key
+		iterator := shim.NewMockStateRangeQueryIterator(ledger.state, read.startKey, read.endKey)
+		i := 0
+		for iterator.HasNext() && (read.exhausted || i < len(read.keys)) {
+			kv, err := iterator.Next()
+			if err != nil || i == len(read.keys) || kv.Key != read.keys[i] || ledger.versions[kv.Key] != read.versions[i] {
+				return sc.TxValidationCode_PHANTOM_READ_CONFLICT
+			}
+			i++
+		}
+		if i != len(read.keys) {
+			return sc.TxValidationCode_PHANTOM_READ_CONFLICT
+		}
+	}
+	return sc.TxValidationCode_VALID
+}
+
+/**
+ * Applies the writes of a valid transaction to the committed state
+ */
+func (ledger *mockLedger) commit(tx *mockTx) {
+	ledger.sequence++
+	ledger.state.MockTransactionStart(tx.txID)
+	for key, write := range tx.writes {
+		if write.deleted {
+			ledger.state.DelState(key)
+			delete(ledger.versions, key)
+		} else {
+			ledger.state.PutState(key, write.value)
+			ledger.versions[key] = ledger.sequence
+		}
+	}
+	ledger.state.MockTransactionEnd(tx.txID)
+}
+
+/**
+ * The stub given to the chaincode during a simulation. Reads go to the committed state of the ledger and
+ * are recorded, writes are buffered in the transaction. As on a peer, a transaction does not read its own
+ * writes.
+ */
+type txStub struct {
+	*shim.MockStub
+	ledger    *mockLedger
+	tx        *mockTx
+	args      [][]byte
+	timestamp *timestamp.Timestamp
+}
+
+func (stub *txStub) GetArgs() [][]byte {
+	return stub.args
+}
+
+func (stub *txStub) GetStringArgs() []string {
+	strargs := make([]string, 0, len(stub.args))
+	for _, barg := range stub.args {
+		strargs = append(strargs, string(barg))
+	}
+	return strargs
+}
+
+func (stub *txStub) GetFunctionAndParameters() (string, []string) {
+	allargs := stub.GetStringArgs()
+	if len(allargs) == 0 {
+		return "", []string{}
+	}
+	return allargs[0], allargs[1:]
+}
+
+func (stub *txStub) GetTxID() string {
+	return stub.tx.txID
+}
+
+func (stub *txStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return stub.timestamp, nil
+}
+
+func (stub *txStub) GetCreator() ([]byte, error) {
+	return stub.ledger.creator, nil
+}
+
+func (stub *txStub) GetState(key string) ([]byte, error) {
+	stub.tx.reads[key] = stub.ledger.versions[key]
+	return stub.MockStub.GetState(key)
+}
+
+func (stub *txStub) PutState(key string, value []byte) error {
+	if key == "" {
+		return fmt.Errorf("The key of a state can not be empty")
+	}
+	stub.tx.writes[key] = &mockWrite{value: value}
+	return nil
+}
+
+func (stub *txStub) DelState(key string) error {
+	stub.tx.writes[key] = &mockWrite{deleted: true}
+	return nil
+}
+
+func (stub *txStub) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	iterator, err := stub.MockStub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	return stub.recordRange(startKey, endKey, iterator), nil
+}
+
+func (stub *txStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	iterator, err := stub.MockStub.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	// the range the mock stub iterates over, the keys starting with the partial key
+	partialCompositeKey, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		iterator.Close()
+		return nil, err
+	}
+	return stub.recordRange(partialCompositeKey, partialCompositeKey+string(utf8.MaxRune), iterator), nil
+}
+
+/**
+ * Records a range read by the transaction, wrapping the iterator over it
+ */
+func (stub *txStub) recordRange(startKey, endKey string, iterator shim.StateQueryIteratorInterface) shim.StateQueryIteratorInterface {
+	read := &rangeRead{startKey: startKey, endKey: endKey}
+	stub.tx.ranges = append(stub.tx.ranges, read)
+	return &recordingIterator{StateQueryIteratorInterface: iterator, ledger: stub.ledger, read: read}
+}
+
+/**
+ * An iterator over a range of the committed state, recording the keys it returns in the range read
+ */
+type recordingIterator struct {
+	shim.StateQueryIteratorInterface
+	ledger *mockLedger
+	read   *rangeRead
+}
+
+func (iterator *recordingIterator) HasNext() bool {
+	hasNext := iterator.StateQueryIteratorInterface.HasNext()
+	if !hasNext {
+		iterator.read.exhausted = true
+	}
+	return hasNext
+}
+
+func (iterator *recordingIterator) Next() (*queryresult.KV, error) {
+	kv, err := iterator.StateQueryIteratorInterface.Next()
+	if err == nil {
+		iterator.read.keys = append(iterator.read.keys, kv.Key)
+		iterator.read.versions = append(iterator.read.versions, iterator.ledger.versions[kv.Key])
+	}
+	return kv, err
+}
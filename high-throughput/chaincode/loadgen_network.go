@@ -0,0 +1,120 @@
+//go:build loadgen
+// +build loadgen
+
+/*
+ * The network target of the load generator. Each transaction is submitted by a peer CLI process, which
+ * waits for the block of the transaction with --waitForEvent and reports the validation code of an invalid
+ * one in its error. The flag was added to the peer CLI in Fabric 1.2, unlike the scripts of this sample
+ * the load generator needs a CLI at least that recent.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The error of the peer CLI when a transaction was committed but marked invalid
+var invalidTxPattern = regexp.MustCompile(`transaction invalidated with status \(([A-Z_]+)\)`)
+
+/**
+ * A network, reached through the peer CLI, its environment selecting the peer and the identity of the client
+ */
+type network struct {
+	orderer   string
+	caFile    string
+	channel   string
+	chaincode string
+}
+
+/**
+ * Checks the peer CLI can be run and is recent enough to wait for the block of a transaction
+ *
+ * @param orderer The address of the orderer
+ * @param caFile The TLS CA certificate of the orderer, used when CORE_PEER_TLS_ENABLED is true
+ * @param channel The name of the channel
+ * @param chaincode The name of the chaincode
+ *
+ * @return The network, or an error if the peer CLI was not found or can not wait for a transaction
+ */
+func connectNetwork(orderer string, caFile string, channel string, chaincode string) (*network, error) {
+	_, err := exec.LookPath("peer")
+	if err != nil {
+		return nil, fmt.Errorf("The network mode runs the peer CLI, which was not found: %s", err.Error())
+	}
+	usage, err := exec.Command("peer", "chaincode", "invoke", "--help").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("Could not run the peer CLI: %s: %s", err.Error(), strings.TrimSpace(string(usage)))
+	}
+	if !bytes.Contains(usage, []byte("--waitForEvent")) {
+		return nil, fmt.Errorf("The peer CLI has no --waitForEvent flag, the network mode needs the peer CLI of Fabric 1.2 or later")
+	}
+	return &network{orderer: orderer, caFile: caFile, channel: channel, chaincode: chaincode}, nil
+}
+
+/**
+ * Submits a transaction and waits for its block, a transaction committed as invalid being reported by its
+ * validation code rather than as an error
+ */
+func (n *network) invoke(function string, args ...string) (sc.TxValidationCode, error) {
+	tls := os.Getenv("CORE_PEER_TLS_ENABLED")
+	if tls == "" {
+		tls = "false"
+	}
+	_, err := n.peer("invoke", function, args, "-o", n.orderer, "--tls", tls, "--cafile", n.caFile, "--waitForEvent")
+	if err != nil {
+		if match := invalidTxPattern.FindStringSubmatch(err.Error()); match != nil {
+			if code, ok := sc.TxValidationCode_value[match[1]]; ok {
+				return sc.TxValidationCode(code), nil
+			}
+		}
+		return 0, err
+	}
+	return sc.TxValidationCode_VALID, nil
+}
+
+func (n *network) query(function string, args ...string) ([]byte, error) {
+	payload, err := n.peer("query", function, args)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(payload, "\n"), nil
+}
+
+func (n *network) close() error {
+	return nil
+}
+
+/**
+ * Runs a peer chaincode command
+ *
+ * @param command invoke or query
+ * @param function The chaincode function
+ * @param args The arguments of the function
+ * @param flags The flags of the command besides the channel, the chaincode and its arguments
+ *
+ * @return The standard output of the command, or an error holding its error output if it failed
+ */
+func (n *network) peer(command string, function string, args []string, flags ...string) ([]byte, error) {
+	input, err := json.Marshal(map[string][]string{"Args": append([]string{function}, args...)})
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("peer", append([]string{"chaincode", command, "-C", n.channel, "-n", n.chaincode, "-c", string(input)}, flags...)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %s: %s", command, function, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,146 @@
+//go:build loadgen
+// +build loadgen
+
+/*
+ * The statistics of the load generator: the outcome and the latency of each transaction, summarized in a
+ * report per pattern.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/**
+ * The outcome of the transactions of a pattern, recorded by all its clients
+ */
+type patternStats struct {
+	mutex     sync.Mutex
+	pattern   string
+	committed int // valid transactions
+	conflicts int // transactions invalidated by an MVCC or phantom read conflict
+	invalid   int // transactions invalidated for any other reason
+	errors    int // transactions which could not be endorsed or committed
+	latencies []time.Duration
+	elapsed   time.Duration
+	initial   string   // the value of the variable before the run
+	final     string   // the value of the variable after the run
+	expected  *big.Rat // the value the variable should have after the run, nil if unknown
+}
+
+func newPatternStats(pattern string) *patternStats {
+	return &patternStats{pattern: pattern}
+}
+
+/**
+ * Records the outcome of a transaction
+ *
+ * @param latency The time from the submission of the transaction to its commit
+ * @param code The validation code of the transaction
+ * @param err The error if the transaction could not be endorsed or committed
+ */
+func (stats *patternStats) record(latency time.Duration, code sc.TxValidationCode, err error) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	if err != nil {
+		stats.errors++
+		return
+	}
+	stats.latencies = append(stats.latencies, latency)
+	switch code {
+	case sc.TxValidationCode_VALID:
+		stats.committed++
+	case sc.TxValidationCode_MVCC_READ_CONFLICT, sc.TxValidationCode_PHANTOM_READ_CONFLICT:
+		stats.conflicts++
+	default:
+		stats.invalid++
+	}
+}
+
+/**
+ * Returns the number of transactions which reached a block, valid or not
+ */
+func (stats *patternStats) ordered() int {
+	return stats.committed + stats.conflicts + stats.invalid
+}
+
+/**
+ * Returns the latency below which a given percentage of the ordered transactions were committed
+ */
+func (stats *patternStats) percentile(percent float64) time.Duration {
+	if len(stats.latencies) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, stats.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := int(percent/100*float64(len(sorted))+0.5) - 1
+	if index < 0 {
+		index = 0
+	} else if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
+
+/**
+ * Writes the report of a run, a table of the statistics of each pattern followed by the values of the
+ * variable
+ *
+ * @param out Where to write the report
+ * @param results The statistics of the patterns, in the order they ran
+ */
+func printReport(out io.Writer, results []*patternStats) {
+	writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "PATTERN\tSUBMITTED\tCOMMITTED\tCONFLICTS\tCONFLICT RATE\tINVALID\tERRORS\tTX/S\tP50\tP90\tP99\tMAX\t")
+	for _, stats := range results {
+		conflictRate := 0.0
+		if stats.ordered() > 0 {
+			conflictRate = 100 * float64(stats.conflicts) / float64(stats.ordered())
+		}
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%d\t%.1f%%\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t\n", stats.pattern,
+			stats.ordered()+stats.errors, stats.committed, stats.conflicts, conflictRate, stats.invalid, stats.errors,
+			float64(stats.committed)/stats.elapsed.Seconds(), round(stats.percentile(50)), round(stats.percentile(90)),
+			round(stats.percentile(99)), round(stats.percentile(100)))
+	}
+	writer.Flush()
+
+	fmt.Fprintln(out)
+	for _, stats := range results {
+		initial := stats.initial
+		if initial == "" {
+			initial = "none"
+		}
+		fmt.Fprintf(out, "%s: value %s before the run, %s after", stats.pattern, initial, stats.final)
+		if stats.expected != nil {
+			final, ok := new(big.Rat).SetString(stats.final)
+			if ok && final.Cmp(stats.expected) == 0 {
+				fmt.Fprintf(out, ", as expected")
+			} else {
+				expected := strings.TrimRight(stats.expected.FloatString(maxScale), "0")
+				fmt.Fprintf(out, ", expected %s", strings.TrimSuffix(expected, "."))
+			}
+		}
+		fmt.Fprintln(out)
+	}
+}
+
+/**
+ * Rounds a latency for display, to the millisecond above a second and to the microsecond below
+ */
+func round(latency time.Duration) time.Duration {
+	if latency >= time.Second {
+		return latency - latency%time.Millisecond
+	}
+	return latency - latency%time.Microsecond
+}
@@ -0,0 +1,59 @@
+//go:build loadgen
+// +build loadgen
+
+/*
+ * A smoke test of the load generator, running both patterns for a moment on the in-process ledger.
+ * Run it with go test -tags loadgen.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestLoadgen_RunsBothPatternsOnTheMockLedger(t *testing.T) {
+	ledger, err := newMockLedger("Org1MSP", 5, 20*time.Millisecond)
+	if err != nil {
+		fmt.Println("The ledger could not be created", err)
+		t.FailNow()
+	}
+	defer ledger.close()
+	config := loadConfig{concurrency: 4, duration: 300 * time.Millisecond, variable: "loadgen", value: "1"}
+
+	_, err = ledger.invoke("createvariable", config.variable, "Created by the load generator", "", "", "", "")
+	if err != nil {
+		fmt.Println("The variable could not be created", err)
+		t.FailNow()
+	}
+
+	// the updates never conflict and add up
+	stats, err := runPattern(ledger, "update", config)
+	if err != nil {
+		fmt.Println("The update pattern failed", err)
+		t.FailNow()
+	}
+	if stats.committed == 0 || stats.conflicts != 0 || stats.invalid != 0 || stats.errors != 0 {
+		fmt.Println("The updates were", stats.committed, "committed,", stats.conflicts, "conflicts,", stats.invalid, "invalid,", stats.errors, "errors")
+		t.FailNow()
+	}
+	final, ok := new(big.Rat).SetString(stats.final)
+	if !ok || stats.expected == nil || final.Cmp(stats.expected) != 0 {
+		fmt.Println("The value after the updates was", stats.final, "and not", stats.expected, "as expected")
+		t.FailNow()
+	}
+
+	// the transactions of a block rewriting the same row conflict
+	stats, err = runPattern(ledger, "putstandard", config)
+	if err != nil {
+		fmt.Println("The putstandard pattern failed", err)
+		t.FailNow()
+	}
+	if stats.committed == 0 || stats.conflicts == 0 || stats.errors != 0 {
+		fmt.Println("The putstandard transactions were", stats.committed, "committed,", stats.conflicts, "conflicts,", stats.errors, "errors")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !loadgen
+// +build !loadgen
+
+/*
+ * The entry point of the chaincode. It is left out of builds with the loadgen tag, which replace it with
+ * the load generator of loadgen.go.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// The main function is only relevant in unit test mode. Only included here for completeness.
+func main() {
+
+	// Create a new Smart Contract
+	err := shim.Start(new(SmartContract))
+	if err != nil {
+		fmt.Printf("Error creating new Smart Contract: %s", err)
+	}
+}
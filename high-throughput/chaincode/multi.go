@@ -0,0 +1,151 @@
+/*
+ * Updates and reads of several variables in one transaction. A transfer between two pools, debiting one
+ * and crediting the other, is a single updateMany transaction, committed whole or not at all. Each delta
+ * is a row of its own, keyed by the transaction like the deltas of update, so updateMany transactions do
+ * not conflict with each other or with updates. Deltas are only checked against the bounds of their
+ * variable when they are merged, so a transfer whose debit could be void, which would leave the credit
+ * alone, is rejected: a variable with a floor can only be debited by a transfer while its quota partitions
+ * are on, the debit drawing on a quota and being written as a drawOp delta, which is never void.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/**
+ * The value of a variable, as listed by getMany
+ */
+type variableValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+/**
+ * Adds deltas to several variables in one transaction, all of them or none. Each variable can only be
+ * updated once per transaction. When more than one variable is updated, the deltas which could be void
+ * because of the bounds of their variable are rejected, see checkNotVoid. The args array holds a triple
+ * of arguments per delta, as the arguments of update:
+ *	- args[3*i] -> The name of the variable
+ *	- args[3*i+1] -> The value of the delta
+ *	- args[3*i+2] -> The operation of the delta, see deltaOperations
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the updateMany invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) updateMany(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check there are a correct number of arguments
+	if len(args) == 0 || len(args)%3 != 0 {
+		return shim.Error("Incorrect number of arguments, expecting a name, a value and an operation per variable")
+	}
+
+	updated := map[string]bool{}
+	added := []string{}
+	for i := 0; i < len(args); i += 3 {
+		name, op := args[i], args[i+2]
+		// a second delta of a variable would have the same position, the order they merge in would be lost
+		if updated[name] {
+			return shim.Error(fmt.Sprintf("Variable %s is updated more than once", name))
+		}
+		updated[name] = true
+
+		value, config, err := addDelta(APIstub, name, args[i+1], op)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(args) > 3 {
+			err = checkNotVoid(name, op, value, config)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		added = append(added, fmt.Sprintf("%s%s to %s", op, value, name))
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Successfully added %s", strings.Join(added, ", "))))
+}
+
+/**
+ * Retrieves the aggregate values of several variables. The args array holds the names of the variables.
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the getMany invocation
+ *
+ * @return A response structure holding a JSON array of the names and values of the variables, in the
+ * order of the arguments, or an error message if one of the variables does not exist
+ */
+func (s *SmartContract) getMany(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) == 0 {
+		return shim.Error("Incorrect number of arguments, expecting at least 1")
+	}
+
+	values := []variableValue{}
+	for _, name := range args {
+		config, err := getVarConfig(APIstub, name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		value, _, found, err := getValue(APIstub, name, config)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if !found {
+			return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
+		}
+		values = append(values, variableValue{Name: name, Value: value.String()})
+	}
+
+	valuesBytes, err := json.Marshal(values)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(valuesBytes)
+}
+
+/**
+ * Checks a delta of a transfer can not be void, which would apply the other deltas of the transfer alone.
+ * A decrement is void below the floor of its variable unless the quota partitions of the variable are on,
+ * an increment above its ceiling, and the other operations can be void under either bound.
+ *
+ * @param name The name of the variable
+ * @param op The operation of the delta
+ * @param value The value of the delta
+ * @param config The configuration of the variable
+ *
+ * @return An error if the delta could be void
+ */
+func checkNotVoid(name string, op string, value decimal, config *varConfig) error {
+	floor, err := config.floor()
+	if err != nil {
+		return err
+	}
+	ceiling, err := config.ceiling()
+	if err != nil {
+		return err
+	}
+	if floor == nil && ceiling == nil {
+		return nil
+	}
+
+	if op != "+" && op != "-" {
+		return fmt.Errorf("Operator %s can not be used on %s with other variables, the delta could be void because of its bounds", op, name)
+	}
+	increment := value
+	if op == "-" {
+		increment = value.neg()
+	}
+	if increment.sign() < 0 && floor != nil && !config.Partitioned {
+		return fmt.Errorf("%s can not be decremented with other variables unless its quota partitions are on, the delta could be void because of its floor", name)
+	}
+	if increment.sign() > 0 && ceiling != nil {
+		return fmt.Errorf("%s can not be incremented with other variables, the delta could be void because of its ceiling", name)
+	}
+	return nil
+}
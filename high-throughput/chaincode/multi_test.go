@@ -0,0 +1,147 @@
+/*
+ * Tests of updateMany and getMany.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func checkValues(t *testing.T, stub *testStub, expected []variableValue, names ...string) {
+	res := checkInvoke(t, stub, append([]string{"getmany"}, names...)...)
+	values := []variableValue{}
+	err := json.Unmarshal(res.Payload, &values)
+	if err != nil {
+		fmt.Println("Could not decode the values of", names, err)
+		t.FailNow()
+	}
+	if fmt.Sprint(values) != fmt.Sprint(expected) {
+		fmt.Println("Values of", names, "were", values, "and not", expected, "as expected")
+		t.FailNow()
+	}
+}
+
+func TestUpdateMany_TransfersBetweenVariables(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "pool1")
+	createTestVariable(t, stub, "pool2")
+	checkInvoke(t, stub, "update", "pool1", "100", "+")
+
+	checkInvoke(t, stub, "updatemany", "pool1", "30", "-", "pool2", "30", "+")
+	checkInvoke(t, stub, "updatemany", "pool1", "5.5", "-", "pool2", "5.5", "+")
+	checkValues(t, stub, []variableValue{{"pool2", "35.50"}, {"pool1", "64.50"}}, "pool2", "pool1")
+
+	// each delta is a row of its own, as with update
+	if countKeys(stub, deltaIndexName) != 5 {
+		fmt.Println(countKeys(stub, deltaIndexName), "delta rows were written instead of 5")
+		t.FailNow()
+	}
+}
+
+func TestUpdateMany_AppliesAllDeltasOrNone(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "pool1")
+	checkInvoke(t, stub, "createvariable", "pool2", "test variable", "", "", "", "")
+	checkInvoke(t, stub, "update", "pool1", "100", "+")
+	stub.mspID = "Org2MSP"
+	checkInvoke(t, stub, "createvariable", "pool3", "test variable", "", "", "", "")
+	stub.mspID = "Org1MSP"
+	before := stub.snapshot()
+
+	checkInvokeFailed(t, stub, "updatemany", "pool1", "30", "-", "unknown", "30", "+")
+	checkInvokeFailed(t, stub, "updatemany", "pool1", "30", "-", "pool2", "30", "/")
+	checkInvokeFailed(t, stub, "updatemany", "pool1", "30", "-", "pool2", "0.001", "+")
+	checkInvokeFailed(t, stub, "updatemany", "pool1", "30", "-", "pool3", "30", "+")
+	stub.failAfter = 1
+	checkInvokeFailed(t, stub, "updatemany", "pool1", "30", "-", "pool2", "30", "+")
+	stub.failAfter = -1
+	checkState(t, stub, before)
+	checkValue(t, stub, "pool1", "100.00")
+}
+
+func TestUpdateMany_ChecksTheArguments(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "pool1")
+	createTestVariable(t, stub, "pool2")
+
+	checkInvokeFailed(t, stub, "updatemany")
+	checkInvokeFailed(t, stub, "updatemany", "pool1", "1")
+	checkInvokeFailed(t, stub, "updatemany", "pool1", "1", "+", "pool2")
+	checkInvokeFailed(t, stub, "updatemany", "pool1", "1", "+", "pool1", "1", "-")
+	if countKeys(stub, deltaIndexName) != 0 {
+		fmt.Println("Rejected updates wrote delta rows")
+		t.FailNow()
+	}
+
+	// a single delta is an update
+	checkInvoke(t, stub, "updatemany", "pool1", "2", "*")
+	checkInvoke(t, stub, "updatemany", "pool1", "1", "+")
+	checkValue(t, stub, "pool1", "1.00")
+}
+
+func TestUpdateMany_RejectsDeltasWhichCouldBeVoid(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "floored", "test variable", "", "0", "", "")
+	checkInvoke(t, stub, "createvariable", "capped", "test variable", "", "", "1000", "")
+	createTestVariable(t, stub, "free")
+	checkInvoke(t, stub, "update", "floored", "100", "+")
+	checkInvoke(t, stub, "update", "capped", "100", "+")
+
+	checkInvokeFailed(t, stub, "updatemany", "floored", "30", "-", "free", "30", "+")
+	checkInvokeFailed(t, stub, "updatemany", "floored", "-30", "+", "free", "30", "+")
+	checkInvokeFailed(t, stub, "updatemany", "free", "30", "-", "capped", "30", "+")
+	checkInvokeFailed(t, stub, "updatemany", "free", "2", "*", "capped", "2", "*")
+
+	// the deltas moving away from the bounds can not be void
+	checkInvoke(t, stub, "updatemany", "free", "30", "-", "floored", "30", "+")
+	checkInvoke(t, stub, "updatemany", "capped", "30", "-", "free", "30", "+")
+	checkValues(t, stub, []variableValue{{"floored", "130.00"}, {"capped", "70.00"}, {"free", "0.00"}}, "floored", "capped", "free")
+}
+
+func TestUpdateMany_DebitsPartitionedVariablesFromTheirQuota(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "floored", "test variable", "", "0", "", "")
+	createTestVariable(t, stub, "free")
+	checkInvoke(t, stub, "update", "floored", "100", "+")
+	checkInvoke(t, stub, "setpartitioned", "floored", "true")
+	checkInvoke(t, stub, "allocatequota", "floored", "Org1MSP", "50")
+
+	checkInvoke(t, stub, "updatemany", "floored", "30", "-", "free", "30", "+")
+	before := stub.snapshot()
+	checkInvokeFailed(t, stub, "updatemany", "floored", "30", "-", "free", "30", "+")
+	checkState(t, stub, before)
+	checkValues(t, stub, []variableValue{{"floored", "70.00"}, {"free", "30.00"}}, "floored", "free")
+}
+
+func TestUpdateMany_DebitsFromAQuotaWhateverTheClockOfTheClient(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "pool1", "test variable", "", "0", "", "")
+	createTestVariable(t, stub, "pool2")
+	checkInvoke(t, stub, "setpartitioned", "pool1", "true")
+	checkInvoke(t, stub, "update", "pool1", "30", "+")
+	checkInvoke(t, stub, "allocatequota", "pool1", "Org1MSP", "30")
+
+	// the clock of the client is behind, the debit merges before the credit of pool1 funding the quota
+	stub.clockSkew = 3
+	checkInvoke(t, stub, "updatemany", "pool1", "30", "-", "pool2", "30", "+")
+	stub.clockSkew = 0
+	checkValues(t, stub, []variableValue{{"pool1", "0.00"}, {"pool2", "30.00"}}, "pool1", "pool2")
+	res := checkInvoke(t, stub, "get", "pool1", "detail")
+	if string(res.Payload) != `{"value":"0.00","void":0,"foldedVoid":0}` {
+		fmt.Println("Detail of pool1 was", string(res.Payload))
+		t.FailNow()
+	}
+}
+
+func TestGetMany_FailsForUnknownVariables(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "pool1")
+	checkInvoke(t, stub, "update", "pool1", "1", "+")
+
+	checkInvokeFailed(t, stub, "getmany")
+	checkInvokeFailed(t, stub, "getmany", "pool1", "unknown")
+	checkValues(t, stub, []variableValue{{"pool1", "1.00"}, {"pool1", "1.00"}}, "pool1", "pool1")
+}
@@ -0,0 +1,427 @@
+/*
+ * Batched pruning, for variables with more deltas than a single transaction can delete. A prune run folds
+ * the deltas of a variable into its checkpoint a batch at a time, each transaction leaving the variable
+ * consistent. The run is recorded in a cursor row, holding the cutoff the run started with and its
+ * progress, and the keys of the deltas of each batch are journaled with the checkpoint they were folded
+ * into, so that a run can be rolled back batch by batch until all deltas are folded. Once they are, the
+ * run is committed and its journal is removed, a batch of journal rows at a time.
+ *
+ * The same invocation resumes the run until it is finished, so it can be re-submitted as often as
+ * needed, from a cron job for instance, and the cutoff of the run is in its first transaction: the
+ * deltas written while it is in progress are neither read nor deleted and never conflict with it.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The composite index of the cursors of the prune runs
+const pruneIndexName = "prune~varName"
+
+// The composite index of the journal of the prune runs
+const pruneBatchIndexName = "pruneBatch~varName~batch"
+
+// The default number of deltas folded, restored or cleaned up per transaction
+const defaultPruneBatchSize = 100
+
+/**
+ * The progress of a prune run
+ */
+type pruneCursor struct {
+	Cutoff    string `json:"cutoff"`    // the position of the first transaction of the run
+	BatchSize int    `json:"batchSize"` // the batch size of the last transaction of the run
+	Batches   int    `json:"batches"`   // the number of batches in the journal
+	Folded    int    `json:"folded"`    // the number of deltas folded by the run
+	Committed bool   `json:"committed"` // whether all deltas are folded, the run can no longer be rolled back
+	TxID      string `json:"txID"`      // the first transaction of the run
+}
+
+/**
+ * A batch of a prune run, the keys of the deltas folded and the checkpoint they were folded into
+ */
+type pruneBatch struct {
+	Before *checkpoint `json:"before"`
+	Keys   []string    `json:"keys"`
+}
+
+/**
+ * Starts or resumes the prune run of a variable. Each invocation folds a batch of deltas into the
+ * checkpoint of the variable or, once they are all folded, removes a batch of journal rows; the run is
+ * finished when the response says so. The args array contains the following arguments:
+ *	- args[0] -> The name of the variable to prune
+ *	- args[1] -> Optional, the number of rows to process, 100 if not given
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the prune invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) prune(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	name, batchSize, errResp := pruneArgs(args)
+	if errResp != nil {
+		return *errResp
+	}
+
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.checkMaintainer(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	cursor, err := getPruneCursor(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Start a run, all the deltas before this transaction are pruned
+	if cursor == nil {
+		position, err := txPosition(APIstub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		cursor = &pruneCursor{Cutoff: position, TxID: APIstub.GetTxID()}
+	}
+	if batchSize == 0 {
+		batchSize = cursor.BatchSize
+	}
+	if batchSize == 0 {
+		batchSize = defaultPruneBatchSize
+	}
+	cursor.BatchSize = batchSize
+
+	// Remove a batch of journal rows once the run is committed
+	if cursor.Committed {
+		removed := 0
+		for ; removed < batchSize && cursor.Batches > 0; removed++ {
+			cursor.Batches--
+			err = delPruneBatch(APIstub, name, cursor.Batches)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		if cursor.Batches > 0 {
+			err = putPruneCursor(APIstub, name, cursor)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			return shim.Success([]byte(fmt.Sprintf("Pruning %s, %d journal rows removed, %d left, resubmit to continue", name, removed, cursor.Batches)))
+		}
+		err = delPruneCursor(APIstub, name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success([]byte(fmt.Sprintf("Pruned %s, %d deltas folded in run %s", name, cursor.Folded, cursor.TxID)))
+	}
+
+	// Fold a batch of deltas, journaling their keys
+	before, after, folded, err := foldDeltas(APIstub, name, config, cursor.Cutoff, batchSize, "prune")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if before == nil && len(folded) == 0 && cursor.Batches == 0 {
+		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
+	}
+	if len(folded) > 0 {
+		batch := &pruneBatch{Before: before}
+		for _, d := range folded {
+			batch.Keys = append(batch.Keys, d.key)
+		}
+		err = putPruneBatch(APIstub, name, cursor.Batches, batch)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		cursor.Batches++
+		cursor.Folded += len(folded)
+	}
+
+	if len(folded) == batchSize {
+		err = putPruneCursor(APIstub, name, cursor)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success([]byte(fmt.Sprintf("Pruning %s, %d deltas folded, value is %s as of %s, resubmit to continue", name, len(folded), after.Value, after.Position)))
+	}
+
+	// Every delta before the cutoff is folded
+	if cursor.Batches == 0 {
+		err = delPruneCursor(APIstub, name)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success([]byte(fmt.Sprintf("Pruned %s, nothing to fold, value is %s as of %s", name, after.Value, after.Position)))
+	}
+	cursor.Committed = true
+	err = putPruneCursor(APIstub, name, cursor)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(fmt.Sprintf("Pruning %s, all %d deltas folded and committed, value is %s, resubmit to remove the journal", name, cursor.Folded, after.Value)))
+}
+
+/**
+ * Rolls back the prune run of a variable, restoring the deltas of a batch and the checkpoint they were
+ * folded into per invocation, most recent batch first. The run is rolled back when the response says
+ * so. A committed run can not be rolled back. The args array contains the following arguments:
+ *	- args[0] -> The name of the variable whose prune run to roll back
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the prunerollback invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) pruneRollback(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+
+	name := args[0]
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.checkMaintainer(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	cursor, err := getPruneCursor(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if cursor == nil {
+		return shim.Error(fmt.Sprintf("No prune of %s is in progress", name))
+	} else if cursor.Committed {
+		return shim.Error(fmt.Sprintf("The prune of %s is committed and can not be rolled back, resubmit prune to finish it", name))
+	}
+
+	// Restore the last batch, deltas and checkpoint together so that the variable stays consistent
+	if cursor.Batches > 0 {
+		cursor.Batches--
+		batch, err := getPruneBatch(APIstub, name, cursor.Batches)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		// the audit trail records the deltas restored next to the record of their fold
+		total := zeroDecimal(config.Scale)
+		if batch.Before != nil {
+			total, err = parseDecimal(batch.Before.Value, config.Scale)
+			if err != nil {
+				return shim.Error(fmt.Sprintf("Batch %d of the prune of %s is corrupted: %s", cursor.Batches, name, err.Error()))
+			}
+		}
+		restored := []delta{}
+		for _, key := range batch.Keys {
+			d, err := splitDeltaKey(APIstub, key)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			restored = append(restored, d)
+		}
+		err = putAudit(APIstub, name, "prunerollback", restored, 0, total)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		for _, key := range batch.Keys {
+			err = APIstub.PutState(key, []byte{0x00})
+			if err != nil {
+				return shim.Error(fmt.Sprintf("Could not restore delta row: %s", err.Error()))
+			}
+		}
+		if batch.Before == nil {
+			err = delCheckpoint(APIstub, name)
+		} else {
+			err = putCheckpoint(APIstub, name, batch.Before)
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = delPruneBatch(APIstub, name, cursor.Batches)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		cursor.Folded -= len(batch.Keys)
+	}
+
+	if cursor.Batches > 0 {
+		err = putPruneCursor(APIstub, name, cursor)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success([]byte(fmt.Sprintf("Rolling back the prune of %s, %d batches left, resubmit to continue", name, cursor.Batches)))
+	}
+	err = delPruneCursor(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(fmt.Sprintf("Rolled back the prune of %s", name)))
+}
+
+/**
+ * Parses the arguments of a prune invocation
+ *
+ * @return The name of the variable, the batch size, 0 if not given, or an error response
+ */
+func pruneArgs(args []string) (string, int, *sc.Response) {
+	if len(args) != 1 && len(args) != 2 {
+		resp := shim.Error("Incorrect number of arguments, expecting 1 or 2")
+		return "", 0, &resp
+	}
+	if len(args) == 1 {
+		return args[0], 0, nil
+	}
+	batchSize, err := strconv.Atoi(args[1])
+	if err != nil || batchSize < 1 {
+		resp := shim.Error(fmt.Sprintf("Batch size %s is invalid, expecting a positive number", args[1]))
+		return "", 0, &resp
+	}
+	return args[0], batchSize, nil
+}
+
+/**
+ * Checks no prune run of a variable is in progress, the operations which rewrite the checkpoint or the
+ * deltas of a variable would make it impossible to roll back
+ */
+func checkNoPrune(APIstub shim.ChaincodeStubInterface, name string) error {
+	cursor, err := getPruneCursor(APIstub, name)
+	if err != nil {
+		return err
+	} else if cursor != nil {
+		return fmt.Errorf("The prune of %s started by %s is in progress, finish it or roll it back first", name, cursor.TxID)
+	}
+	return nil
+}
+
+/**
+ * Retrieves the cursor of the prune run of a variable
+ *
+ * @return The cursor, nil if no run is in progress, or an error if it could not be read
+ */
+func getPruneCursor(APIstub shim.ChaincodeStubInterface, name string) (*pruneCursor, error) {
+	cursorKey, err := APIstub.CreateCompositeKey(pruneIndexName, []string{name})
+	if err != nil {
+		return nil, fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	cursorBytes, err := APIstub.GetState(cursorKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve the prune cursor of %s: %s", name, err.Error())
+	} else if cursorBytes == nil {
+		return nil, nil
+	}
+
+	cursor := &pruneCursor{}
+	err = json.Unmarshal(cursorBytes, cursor)
+	if err != nil {
+		return nil, fmt.Errorf("The prune cursor of %s is corrupted: %s", name, err.Error())
+	}
+	return cursor, nil
+}
+
+/**
+ * Stores the cursor of the prune run of a variable
+ */
+func putPruneCursor(APIstub shim.ChaincodeStubInterface, name string, cursor *pruneCursor) error {
+	cursorKey, err := APIstub.CreateCompositeKey(pruneIndexName, []string{name})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	cursorBytes, err := json.Marshal(cursor)
+	if err != nil {
+		return err
+	}
+	err = APIstub.PutState(cursorKey, cursorBytes)
+	if err != nil {
+		return fmt.Errorf("Could not put the prune cursor of %s in the ledger: %s", name, err.Error())
+	}
+	return nil
+}
+
+/**
+ * Deletes the cursor of the prune run of a variable
+ */
+func delPruneCursor(APIstub shim.ChaincodeStubInterface, name string) error {
+	cursorKey, err := APIstub.CreateCompositeKey(pruneIndexName, []string{name})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	err = APIstub.DelState(cursorKey)
+	if err != nil {
+		return fmt.Errorf("Could not delete the prune cursor of %s: %s", name, err.Error())
+	}
+	return nil
+}
+
+/**
+ * Creates the key of a batch of the prune run of a variable, the batches sort by number
+ */
+func pruneBatchKey(APIstub shim.ChaincodeStubInterface, name string, number int) (string, error) {
+	batchKey, err := APIstub.CreateCompositeKey(pruneBatchIndexName, []string{name, fmt.Sprintf("%010d", number)})
+	if err != nil {
+		return "", fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	return batchKey, nil
+}
+
+/**
+ * Retrieves a batch of the prune run of a variable
+ */
+func getPruneBatch(APIstub shim.ChaincodeStubInterface, name string, number int) (*pruneBatch, error) {
+	batchKey, err := pruneBatchKey(APIstub, name, number)
+	if err != nil {
+		return nil, err
+	}
+	batchBytes, err := APIstub.GetState(batchKey)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve batch %d of the prune of %s: %s", number, name, err.Error())
+	} else if batchBytes == nil {
+		return nil, fmt.Errorf("Batch %d of the prune of %s is missing", number, name)
+	}
+
+	batch := &pruneBatch{}
+	err = json.Unmarshal(batchBytes, batch)
+	if err != nil {
+		return nil, fmt.Errorf("Batch %d of the prune of %s is corrupted: %s", number, name, err.Error())
+	}
+	return batch, nil
+}
+
+/**
+ * Stores a batch of the prune run of a variable
+ */
+func putPruneBatch(APIstub shim.ChaincodeStubInterface, name string, number int, batch *pruneBatch) error {
+	batchKey, err := pruneBatchKey(APIstub, name, number)
+	if err != nil {
+		return err
+	}
+	batchBytes, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	err = APIstub.PutState(batchKey, batchBytes)
+	if err != nil {
+		return fmt.Errorf("Could not put batch %d of the prune of %s in the ledger: %s", number, name, err.Error())
+	}
+	return nil
+}
+
+/**
+ * Deletes a batch of the prune run of a variable
+ */
+func delPruneBatch(APIstub shim.ChaincodeStubInterface, name string, number int) error {
+	batchKey, err := pruneBatchKey(APIstub, name, number)
+	if err != nil {
+		return err
+	}
+	err = APIstub.DelState(batchKey)
+	if err != nil {
+		return fmt.Errorf("Could not delete batch %d of the prune of %s: %s", number, name, err.Error())
+	}
+	return nil
+}
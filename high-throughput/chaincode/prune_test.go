@@ -0,0 +1,356 @@
+/*
+ * Tests of pruneFast, pruneSafe and the batched prune, with writes failing partway through.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// updateTestVariable creates a variable and adds count deltas of +1 to it
+func updateTestVariable(t *testing.T, stub *testStub, name string, count int) {
+	createTestVariable(t, stub, name)
+	for i := 0; i < count; i++ {
+		checkInvoke(t, stub, "update", name, "1", "+")
+	}
+}
+
+// checkAudits checks the audit records of a variable have the given operations and counts, reading them
+// from the state rather than with the audits query
+func checkAudits(t *testing.T, stub *testStub, name string, operations []string, counts []int) {
+	resultsIterator, err := stub.MockStub.GetStateByPartialCompositeKey(auditIndexName, []string{name})
+	if err != nil {
+		fmt.Println("Could not read the audit records of", name, err)
+		t.FailNow()
+	}
+	defer resultsIterator.Close()
+	records := []auditRecord{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			fmt.Println("Could not read the audit records of", name, err)
+			t.FailNow()
+		}
+		record := auditRecord{}
+		err = json.Unmarshal(responseRange.Value, &record)
+		if err != nil {
+			fmt.Println("Could not decode the audit records of", name, err)
+			t.FailNow()
+		}
+		records = append(records, record)
+	}
+	if len(records) != len(operations) {
+		fmt.Println(name, "has", len(records), "audit records and not", len(operations), "as expected")
+		t.FailNow()
+	}
+	for i, record := range records {
+		if record.Operation != operations[i] || record.Count != counts[i] {
+			fmt.Println("Audit record", i, "of", name, "is", record.Operation, record.Count, "and not", operations[i], counts[i], "as expected")
+			t.FailNow()
+		}
+	}
+}
+
+func TestPruneFastAndPruneSafe_ReplaceTheDeltasWithTheirValue(t *testing.T) {
+	for _, function := range []string{"prunefast", "prunesafe"} {
+		stub := newTestStub()
+		updateTestVariable(t, stub, "pool", 20)
+		checkInvoke(t, stub, "update", "pool", "2", "*")
+
+		checkInvoke(t, stub, function, "pool")
+		if countKeys(stub, deltaIndexName) != 0 {
+			fmt.Println(function, "left", countKeys(stub, deltaIndexName), "delta rows")
+			t.FailNow()
+		}
+		checkCheckpoint(t, stub, "pool", "40.00", testPosition(23), 21, 0)
+		checkValue(t, stub, "pool", "40.00")
+		checkAudits(t, stub, "pool", []string{function}, []int{21})
+
+		// the deltas after the prune merge after the value it wrote
+		checkInvoke(t, stub, "update", "pool", "1", "+")
+		checkInvoke(t, stub, function, "pool")
+		checkValue(t, stub, "pool", "41.00")
+		checkAudits(t, stub, "pool", []string{function, function}, []int{21, 1})
+	}
+}
+
+func TestPruneFastAndPruneSafe_FoldTheCheckpoint(t *testing.T) {
+	for _, function := range []string{"prunefast", "prunesafe"} {
+		stub := newTestStub()
+		updateTestVariable(t, stub, "pool", 10)
+		checkInvoke(t, stub, "compact", "pool", "5")
+		checkInvoke(t, stub, "update", "pool", "1", "+")
+
+		checkInvoke(t, stub, function, "pool")
+		if countKeys(stub, deltaIndexName) != 0 {
+			fmt.Println(function, "left", countKeys(stub, deltaIndexName), "delta rows")
+			t.FailNow()
+		}
+		checkCheckpoint(t, stub, "pool", "11.00", testPosition(14), 11, 0)
+		checkValue(t, stub, "pool", "11.00")
+	}
+}
+
+func TestPruneFastAndPruneSafe_KeepAValueBelowTheFloor(t *testing.T) {
+	for _, function := range []string{"prunefast", "prunesafe"} {
+		stub := newTestStub()
+		createTestVariable(t, stub, "stock")
+		checkInvoke(t, stub, "update", "stock", "50", "-")
+		checkInvoke(t, stub, "compact", "stock", "0")
+		checkInvoke(t, stub, "setfloor", "stock", "0")
+
+		// the value is below the floor, pruning again must not void it
+		checkValue(t, stub, "stock", "-50.00")
+		checkInvoke(t, stub, function, "stock")
+		checkValue(t, stub, "stock", "-50.00")
+		checkInvoke(t, stub, function, "stock")
+		checkValue(t, stub, "stock", "-50.00")
+		checkInvoke(t, stub, "update", "stock", "1", "-")
+		checkInvoke(t, stub, "update", "stock", "100", "+")
+		checkValue(t, stub, "stock", "50.00")
+	}
+}
+
+func TestPruneFastAndPruneSafe_LeaveTheLedgerUnchangedOnFailure(t *testing.T) {
+	for _, function := range []string{"prunefast", "prunesafe"} {
+		stub := newTestStub()
+		updateTestVariable(t, stub, "pool", 20)
+		before := stub.snapshot()
+
+		// the audit record, the checkpoint, then each deletion
+		for _, failAfter := range []int{0, 1, 2, 10, 21} {
+			stub.failAfter = failAfter
+			checkInvokeFailed(t, stub, function, "pool")
+			checkState(t, stub, before)
+		}
+
+		stub.failAfter = -1
+		checkValue(t, stub, "pool", "20.00")
+		checkInvoke(t, stub, function, "pool")
+		checkValue(t, stub, "pool", "20.00")
+	}
+}
+
+func TestPruneFastAndPruneSafe_FailForUnknownVariables(t *testing.T) {
+	for _, function := range []string{"prunefast", "prunesafe"} {
+		stub := newTestStub()
+		checkInvokeFailed(t, stub, function, "unknown")
+		checkInvokeFailed(t, stub, function)
+		checkInvokeFailed(t, stub, function, "unknown", "extra")
+	}
+}
+
+func TestPruneAndCompact_AreRefusedToOtherOrganizations(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "pool", "test variable", "", "", "", "Org2MSP")
+	for i := 0; i < 3; i++ {
+		checkInvoke(t, stub, "update", "pool", "1", "+")
+	}
+	before := stub.snapshot()
+
+	stub.mspID = "Org3MSP"
+	for _, args := range [][]string{{"compact", "pool", "0"}, {"prunefast", "pool"}, {"prunesafe", "pool"}, {"prune", "pool", "1"}} {
+		checkInvokeFailed(t, stub, args...)
+	}
+	checkState(t, stub, before)
+
+	// a writer can roll back the run of the owner
+	stub.mspID = "Org1MSP"
+	checkInvoke(t, stub, "prune", "pool", "1")
+	stub.mspID = "Org3MSP"
+	checkInvokeFailed(t, stub, "prunerollback", "pool")
+	stub.mspID = "Org2MSP"
+	checkInvoke(t, stub, "prunerollback", "pool")
+	checkInvoke(t, stub, "prunefast", "pool")
+	checkValue(t, stub, "pool", "3.00")
+
+	// the variables which were never created need an admin
+	putLegacyDelta(t, stub, "legacy", "+", "5")
+	checkInit(t, stub, "init", "AdminMSP")
+	stub.mspID = "Org1MSP"
+	checkInvokeFailed(t, stub, "prunesafe", "legacy")
+	stub.mspID = "AdminMSP"
+	checkInvoke(t, stub, "prunesafe", "legacy")
+	checkValue(t, stub, "legacy", "5.00")
+}
+
+func TestPruneSafe_RemovesTheBackupOfEarlierVersions(t *testing.T) {
+	stub := newTestStub()
+	updateTestVariable(t, stub, "pool", 3)
+	stub.MockTransactionStart("legacy")
+	stub.MockStub.PutState("pool_PRUNE_BACKUP", []byte("2"))
+	stub.MockTransactionEnd("legacy")
+
+	checkInvoke(t, stub, "prunesafe", "pool")
+	if stub.State["pool_PRUNE_BACKUP"] != nil {
+		fmt.Println("pruneSafe left the backup row")
+		t.FailNow()
+	}
+	checkValue(t, stub, "pool", "3.00")
+}
+
+func TestPrune_FoldsTheDeltasInBatches(t *testing.T) {
+	stub := newTestStub()
+	updateTestVariable(t, stub, "pool", 25)
+
+	checkInvoke(t, stub, "prune", "pool", "10")
+	checkValue(t, stub, "pool", "25.00")
+	// the deltas written during the run are not pruned
+	checkInvoke(t, stub, "update", "pool", "1", "+")
+	checkInvokeFailed(t, stub, "prunefast", "pool")
+	checkInvokeFailed(t, stub, "delete", "pool")
+	checkInvoke(t, stub, "prune", "pool")
+	checkInvoke(t, stub, "prune", "pool")
+	checkValue(t, stub, "pool", "26.00")
+
+	// the run is committed, the journal is removed
+	checkInvokeFailed(t, stub, "prunerollback", "pool")
+	checkInvoke(t, stub, "prune", "pool", "2")
+	checkInvoke(t, stub, "prune", "pool", "2")
+	if countKeys(stub, pruneIndexName) != 0 || countKeys(stub, pruneBatchIndexName) != 0 {
+		fmt.Println("The prune run left its cursor or journal")
+		t.FailNow()
+	}
+	if countKeys(stub, deltaIndexName) != 1 {
+		fmt.Println("The prune run left", countKeys(stub, deltaIndexName), "delta rows instead of 1")
+		t.FailNow()
+	}
+	checkValue(t, stub, "pool", "26.00")
+	checkAudits(t, stub, "pool", []string{"prune", "prune", "prune"}, []int{10, 10, 5})
+}
+
+func TestPrune_ResumesAfterAFailedBatch(t *testing.T) {
+	stub := newTestStub()
+	updateTestVariable(t, stub, "pool", 25)
+	checkInvoke(t, stub, "prune", "pool", "10")
+	before := stub.snapshot()
+
+	// the audit record, the deletions, the checkpoint, the journal row then the cursor
+	for _, failAfter := range []int{0, 1, 5, 11, 12, 13} {
+		stub.failAfter = failAfter
+		checkInvokeFailed(t, stub, "prune", "pool")
+		checkState(t, stub, before)
+	}
+
+	stub.failAfter = -1
+	checkInvoke(t, stub, "prune", "pool")
+	checkInvoke(t, stub, "prune", "pool")
+	checkInvoke(t, stub, "prune", "pool")
+	if countKeys(stub, pruneIndexName) != 0 || countKeys(stub, deltaIndexName) != 0 {
+		fmt.Println("The prune run was not finished")
+		t.FailNow()
+	}
+	checkValue(t, stub, "pool", "25.00")
+}
+
+func TestPruneRollback_RestoresTheDeltas(t *testing.T) {
+	stub := newTestStub()
+	updateTestVariable(t, stub, "pool", 25)
+	checkInvoke(t, stub, "compact", "pool", "20")
+	original := stub.snapshot()
+
+	checkInvoke(t, stub, "prune", "pool", "8")
+	checkInvoke(t, stub, "prune", "pool")
+	checkValue(t, stub, "pool", "25.00")
+	pruned := stub.snapshot()
+
+	// the audit record, the restored deltas, the checkpoint, the journal row then the cursor
+	for _, failAfter := range []int{0, 4, 9, 10, 11} {
+		stub.failAfter = failAfter
+		checkInvokeFailed(t, stub, "prunerollback", "pool")
+		checkState(t, stub, pruned)
+	}
+
+	stub.failAfter = -1
+	checkInvoke(t, stub, "prunerollback", "pool")
+	checkInvoke(t, stub, "prunerollback", "pool")
+	checkInvokeFailed(t, stub, "prunerollback", "pool")
+	checkValue(t, stub, "pool", "25.00")
+
+	// everything is back, but the audit records
+	for key := range stub.State {
+		if objectType, _, err := stub.SplitCompositeKey(key); err == nil && objectType == auditIndexName {
+			original[key] = string(stub.State[key])
+		}
+	}
+	checkState(t, stub, original)
+	checkAudits(t, stub, "pool", []string{"compact", "prune", "prune", "prunerollback", "prunerollback"}, []int{5, 8, 8, 8, 8})
+}
+
+func TestPrune_ChecksTheArguments(t *testing.T) {
+	stub := newTestStub()
+	updateTestVariable(t, stub, "pool", 1)
+
+	checkInvokeFailed(t, stub, "prune")
+	checkInvokeFailed(t, stub, "prune", "pool", "0")
+	checkInvokeFailed(t, stub, "prune", "pool", "ten")
+	checkInvokeFailed(t, stub, "prune", "pool", "10", "extra")
+	checkInvokeFailed(t, stub, "prune", "unknown")
+	checkInvokeFailed(t, stub, "prunerollback", "pool")
+}
+
+func TestPrune_RemovesTheJournalInBatches(t *testing.T) {
+	stub := newTestStub()
+	updateTestVariable(t, stub, "pool", 25)
+
+	for i := 1; i <= 5; i++ {
+		checkInvoke(t, stub, "prune", "pool", "5")
+		if countKeys(stub, pruneBatchIndexName) != i {
+			fmt.Println("The journal has", countKeys(stub, pruneBatchIndexName), "batches and not", i, "as expected")
+			t.FailNow()
+		}
+	}
+
+	// the other operations rewriting the deltas are refused until the run is finished
+	for _, args := range [][]string{{"prunefast", "pool"}, {"prunesafe", "pool"}, {"compact", "pool", "0"}, {"delete", "pool"}} {
+		checkInvokeFailed(t, stub, args...)
+	}
+	checkInvoke(t, stub, "update", "pool", "1", "+")
+
+	res := checkInvoke(t, stub, "prune", "pool")
+	if string(res.Payload) != "Pruning pool, all 25 deltas folded and committed, value is 25.00, resubmit to remove the journal" {
+		fmt.Println("Prune returned", string(res.Payload))
+		t.FailNow()
+	}
+	checkInvokeFailed(t, stub, "prunerollback", "pool")
+
+	// the batch size of the invocation is the number of journal rows removed
+	for _, left := range []int{3, 1} {
+		checkInvoke(t, stub, "prune", "pool", "2")
+		if countKeys(stub, pruneBatchIndexName) != left {
+			fmt.Println("The journal has", countKeys(stub, pruneBatchIndexName), "batches and not", left, "as expected")
+			t.FailNow()
+		}
+	}
+	res = checkInvoke(t, stub, "prune", "pool", "2")
+	if string(res.Payload) != "Pruned pool, 25 deltas folded in run tx27" {
+		fmt.Println("Prune returned", string(res.Payload))
+		t.FailNow()
+	}
+	if countKeys(stub, pruneIndexName) != 0 || countKeys(stub, pruneBatchIndexName) != 0 {
+		fmt.Println("The prune run left its cursor or journal")
+		t.FailNow()
+	}
+	checkValue(t, stub, "pool", "26.00")
+	checkInvoke(t, stub, "prunefast", "pool")
+	checkValue(t, stub, "pool", "26.00")
+}
+
+func TestPrune_WithNothingToFoldFinishesAtOnce(t *testing.T) {
+	stub := newTestStub()
+	updateTestVariable(t, stub, "pool", 3)
+	checkInvoke(t, stub, "compact", "pool", "0")
+
+	res := checkInvoke(t, stub, "prune", "pool")
+	if string(res.Payload) != "Pruned pool, nothing to fold, value is 3.00 as of "+testPosition(5) {
+		fmt.Println("Prune returned", string(res.Payload))
+		t.FailNow()
+	}
+	if countKeys(stub, pruneIndexName) != 0 {
+		fmt.Println("The prune run left its cursor")
+		t.FailNow()
+	}
+}
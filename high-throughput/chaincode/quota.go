@@ -0,0 +1,426 @@
+/*
+ * Quota partitions guarantee the floor of a variable without giving up conflict-free updates. The amount
+ * a variable may still decrease by, its value minus its floor, is split into per-organization quotas,
+ * each stored in its own row. A decrement draws on the quota of the organization of the client, reading
+ * and writing that row only: decrements from the same organization are serialized, those of different
+ * organizations never conflict, and the quotas never add up to more than the value above the floor.
+ * Increments need no quota, they grow the unallocated amount, which the owner of the variable allocates
+ * to the organizations, and organizations can transfer quota between themselves to rebalance it.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The composite index of the quota partitions
+const quotaIndexName = "quota~varName~mspID"
+
+/**
+ * The quotas of a variable, as returned by getquota
+ */
+type quotaInfo struct {
+	Value       string            `json:"value"`
+	Floor       string            `json:"floor"`
+	Unallocated string            `json:"unallocated"`
+	Partitions  map[string]string `json:"partitions"`
+}
+
+/**
+ * Turns quota partitions on or off for a variable. The variable must have a floor and be at or above it
+ * to turn them on, all the quotas being empty, and turning them off removes the quotas. While they are
+ * on, the deltas of the variable can only be "+" and "-" and its floor can not be changed. The args
+ * array contains the following arguments:
+ *	- args[0] -> The name of the variable
+ *	- args[1] -> "true" to turn quota partitions on, "false" to turn them off
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the setpartitioned invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) setPartitioned(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check there are a correct number of arguments
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+
+	name := args[0]
+	partitioned, convErr := strconv.ParseBool(args[1])
+	if convErr != nil {
+		return shim.Error(fmt.Sprintf("%s is invalid, expecting true or false", args[1]))
+	}
+
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if config.Owner == "" {
+		return shim.Error(fmt.Sprintf("No variable by the name %s exists, create it with createvariable first", name))
+	}
+	err = config.checkOwner(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if partitioned == config.Partitioned {
+		return shim.Success([]byte(fmt.Sprintf("Quota partitions of %s already %s", name, onOff(partitioned))))
+	}
+
+	if partitioned {
+		// The guarantee only holds from a value at or above the floor
+		floor, err := config.floor()
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if floor == nil {
+			return shim.Error(fmt.Sprintf("%s has no floor, set one before turning quota partitions on", name))
+		}
+		value, _, _, err := getValue(APIstub, name, config)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if value.cmp(*floor) < 0 {
+			return shim.Error(fmt.Sprintf("The value %s of %s is below its floor %s", value, name, floor))
+		}
+	}
+
+	// Stale quotas would break the guarantee when the partitions are turned on again
+	partitions, err := getPartitions(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for mspID := range partitions {
+		err = delPartition(APIstub, name, mspID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	config.Partitioned = partitioned
+	err = putVarConfig(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Quota partitions of %s turned %s", name, onOff(partitioned))))
+}
+
+/**
+ * Allocates quota of a variable to an organization, or takes it back with a negative amount. Only the
+ * owner of the variable can allocate quota, and only the unallocated amount, the value of the variable
+ * above its floor which is not allocated yet. The value of the variable is read, so an allocation
+ * conflicts with the updates in flight and should be retried if it fails. The args array contains the
+ * following arguments:
+ *	- args[0] -> The name of the variable
+ *	- args[1] -> The MSP ID of the organization, the owner or a writer of the variable
+ *	- args[2] -> The amount, a decimal at the scale of the variable
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the allocatequota invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) allocateQuota(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check there are a correct number of arguments
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments, expecting 3")
+	}
+
+	name := args[0]
+	mspID := args[1]
+	config, err := getPartitionedConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.checkOwner(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !config.isWriter(mspID) {
+		return shim.Error(fmt.Sprintf("%s is not allowed to update %s", mspID, name))
+	}
+	amount, err := parseDecimal(args[2], config.Scale)
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Amount %s is invalid for %s: %s", args[2], name, err.Error()))
+	}
+
+	info, err := getQuotaInfo(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	unallocated, err := parseDecimal(info.Unallocated, config.Scale)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if amount.cmp(unallocated) > 0 {
+		return shim.Error(fmt.Sprintf("Only %s of %s is unallocated, can not allocate %s", unallocated, name, amount))
+	}
+
+	quota, err := getPartition(APIstub, name, mspID, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	quota = quota.add(amount)
+	if quota.sign() < 0 {
+		return shim.Error(fmt.Sprintf("The quota of %s for %s is only %s, can not take back %s", name, mspID, quota.sub(amount), amount.neg()))
+	}
+	err = putPartition(APIstub, name, mspID, quota)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Quota of %s for %s is now %s, %s unallocated", name, mspID, quota, unallocated.sub(amount))))
+}
+
+/**
+ * Transfers quota of a variable from the organization of the client to another one. Only the two
+ * quotas are read, so a transfer does not conflict with the decrements of other organizations. The
+ * args array contains the following arguments:
+ *	- args[0] -> The name of the variable
+ *	- args[1] -> The MSP ID of the organization receiving the quota, the owner or a writer of the variable
+ *	- args[2] -> The amount, a positive decimal at the scale of the variable
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the transferquota invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) transferQuota(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check there are a correct number of arguments
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments, expecting 3")
+	}
+
+	name := args[0]
+	toMSP := args[1]
+	config, err := getPartitionedConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = config.checkWriter(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !config.isWriter(toMSP) {
+		return shim.Error(fmt.Sprintf("%s is not allowed to update %s", toMSP, name))
+	}
+	amount, err := parseDecimal(args[2], config.Scale)
+	if err != nil || amount.sign() <= 0 {
+		return shim.Error(fmt.Sprintf("Amount %s is invalid for %s, expecting a positive decimal at scale %d", args[2], name, config.Scale))
+	}
+
+	fromMSP, err := getCreatorMSP(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if fromMSP == toMSP {
+		return shim.Error(fmt.Sprintf("Can not transfer quota of %s from %s to itself", name, fromMSP))
+	}
+	fromQuota, err := drawQuota(APIstub, name, fromMSP, amount, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	toQuota, err := getPartition(APIstub, name, toMSP, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	toQuota = toQuota.add(amount)
+	err = putPartition(APIstub, name, toMSP, toQuota)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Transferred %s of %s quota from %s, now %s, to %s, now %s", amount, name, fromMSP, fromQuota, toMSP, toQuota)))
+}
+
+/**
+ * Retrieves the quotas of a variable, with its value, its floor and the amount not allocated yet. The
+ * args array contains the following argument:
+ *	- args[0] -> The name of the variable
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the getquota invocation
+ *
+ * @return A response structure holding the quotas as JSON, or an error message
+ */
+func (s *SmartContract) getQuota(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+
+	name := args[0]
+	config, err := getPartitionedConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	info, err := getQuotaInfo(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(infoBytes)
+}
+
+/**
+ * Draws an amount from the quota of an organization for a variable, the quota must cover it
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param mspID The MSP ID of the organization
+ * @param amount The amount to draw
+ * @param config The configuration of the variable
+ *
+ * @return The quota left, or an error if it does not cover the amount or could not be updated
+ */
+func drawQuota(APIstub shim.ChaincodeStubInterface, name string, mspID string, amount decimal, config *varConfig) (decimal, error) {
+	quota, err := getPartition(APIstub, name, mspID, config)
+	if err != nil {
+		return decimal{}, err
+	}
+	if quota.cmp(amount) < 0 {
+		return decimal{}, fmt.Errorf("The quota of %s for %s is %s, it does not cover %s", name, mspID, quota, amount)
+	}
+	quota = quota.sub(amount)
+	err = putPartition(APIstub, name, mspID, quota)
+	if err != nil {
+		return decimal{}, err
+	}
+	return quota, nil
+}
+
+/**
+ * Retrieves the configuration of a variable whose quota partitions are on
+ */
+func getPartitionedConfig(APIstub shim.ChaincodeStubInterface, name string) (*varConfig, error) {
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return nil, err
+	}
+	if !config.Partitioned {
+		return nil, fmt.Errorf("Quota partitions of %s are off, turn them on with setpartitioned first", name)
+	}
+	return config, nil
+}
+
+/**
+ * Computes the quotas of a variable and the amount not allocated yet
+ */
+func getQuotaInfo(APIstub shim.ChaincodeStubInterface, name string, config *varConfig) (*quotaInfo, error) {
+	value, _, _, err := getValue(APIstub, name, config)
+	if err != nil {
+		return nil, err
+	}
+	floor, err := config.floor()
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := getPartitions(APIstub, name, config)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &quotaInfo{Value: value.String(), Floor: floor.String(), Partitions: map[string]string{}}
+	unallocated := value.sub(*floor)
+	for mspID, quota := range partitions {
+		info.Partitions[mspID] = quota.String()
+		unallocated = unallocated.sub(quota)
+	}
+	info.Unallocated = unallocated.String()
+	return info, nil
+}
+
+/**
+ * Retrieves the quota of an organization for a variable, zero if none was allocated
+ */
+func getPartition(APIstub shim.ChaincodeStubInterface, name string, mspID string, config *varConfig) (decimal, error) {
+	partitionKey, err := APIstub.CreateCompositeKey(quotaIndexName, []string{name, mspID})
+	if err != nil {
+		return decimal{}, fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	quotaBytes, err := APIstub.GetState(partitionKey)
+	if err != nil {
+		return decimal{}, fmt.Errorf("Could not retrieve the quota of %s for %s: %s", name, mspID, err.Error())
+	} else if quotaBytes == nil {
+		return zeroDecimal(config.Scale), nil
+	}
+	quota, err := parseDecimal(string(quotaBytes), config.Scale)
+	if err != nil {
+		return decimal{}, fmt.Errorf("The quota of %s for %s is corrupted: %s", name, mspID, err.Error())
+	}
+	return quota, nil
+}
+
+/**
+ * Retrieves the quotas of all the organizations for a variable, by MSP ID
+ */
+func getPartitions(APIstub shim.ChaincodeStubInterface, name string, config *varConfig) (map[string]decimal, error) {
+	partitionResultsIterator, err := APIstub.GetStateByPartialCompositeKey(quotaIndexName, []string{name})
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve the quotas of %s: %s", name, err.Error())
+	}
+	defer partitionResultsIterator.Close()
+
+	partitions := map[string]decimal{}
+	for partitionResultsIterator.HasNext() {
+		responseRange, err := partitionResultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("Could not retrieve next quota: %s", err.Error())
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Could not split composite key %s: %s", responseRange.Key, err.Error())
+		}
+		quota, err := parseDecimal(string(responseRange.Value), config.Scale)
+		if err != nil {
+			return nil, fmt.Errorf("The quota of %s for %s is corrupted: %s", name, keyParts[1], err.Error())
+		}
+		partitions[keyParts[1]] = quota
+	}
+	return partitions, nil
+}
+
+/**
+ * Stores the quota of an organization for a variable
+ */
+func putPartition(APIstub shim.ChaincodeStubInterface, name string, mspID string, quota decimal) error {
+	partitionKey, err := APIstub.CreateCompositeKey(quotaIndexName, []string{name, mspID})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	err = APIstub.PutState(partitionKey, []byte(quota.String()))
+	if err != nil {
+		return fmt.Errorf("Could not put the quota of %s for %s in the ledger: %s", name, mspID, err.Error())
+	}
+	return nil
+}
+
+/**
+ * Deletes the quota of an organization for a variable
+ */
+func delPartition(APIstub shim.ChaincodeStubInterface, name string, mspID string) error {
+	partitionKey, err := APIstub.CreateCompositeKey(quotaIndexName, []string{name, mspID})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, err.Error())
+	}
+	err = APIstub.DelState(partitionKey)
+	if err != nil {
+		return fmt.Errorf("Could not delete the quota of %s for %s: %s", name, mspID, err.Error())
+	}
+	return nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,181 @@
+/*
+ * Tests of the quota partitions.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newQuotaTestStub returns a stub holding the stock variable of Org1MSP, with a floor of 0, a value of
+// 100, Org2MSP as writer and its quota partitions on
+func newQuotaTestStub(t *testing.T) *testStub {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "stock", "test variable", "", "0", "", "Org2MSP")
+	checkInvoke(t, stub, "update", "stock", "100", "+")
+	checkInvoke(t, stub, "setpartitioned", "stock", "true")
+	return stub
+}
+
+func checkQuota(t *testing.T, stub *testStub, name string, expected string) {
+	res := checkInvoke(t, stub, "getquota", name)
+	if string(res.Payload) != expected {
+		fmt.Println("Quotas of", name, "were", string(res.Payload), "and not", expected, "as expected")
+		t.FailNow()
+	}
+}
+
+func TestSetPartitioned_NeedsAFloorAndTheOwner(t *testing.T) {
+	stub := newTestStub()
+	createTestVariable(t, stub, "free")
+	checkInvokeFailed(t, stub, "setpartitioned", "free", "true")
+	checkInvoke(t, stub, "createvariable", "stock", "test variable", "", "0", "", "Org2MSP")
+
+	stub.mspID = "Org2MSP"
+	checkInvokeFailed(t, stub, "setpartitioned", "stock", "true")
+	stub.mspID = "Org1MSP"
+	checkInvokeFailed(t, stub, "setpartitioned", "stock", "yes")
+	checkInvokeFailed(t, stub, "setpartitioned", "stock")
+	checkInvokeFailed(t, stub, "setpartitioned", "unknown", "true")
+	checkInvokeFailed(t, stub, "getquota", "stock")
+
+	checkInvoke(t, stub, "setpartitioned", "stock", "true")
+	checkInvoke(t, stub, "setpartitioned", "stock", "true")
+	checkQuota(t, stub, "stock", `{"value":"0.00","floor":"0.00","unallocated":"0.00","partitions":{}}`)
+}
+
+func TestSetPartitioned_RestrictsTheOperations(t *testing.T) {
+	stub := newQuotaTestStub(t)
+
+	for _, op := range []string{"*", "min", "max", "="} {
+		checkInvokeFailed(t, stub, "update", "stock", "1", op)
+	}
+	checkInvokeFailed(t, stub, "setfloor", "stock", "10")
+
+	// turning the partitions off removes the quotas
+	checkInvoke(t, stub, "allocatequota", "stock", "Org2MSP", "10")
+	checkInvoke(t, stub, "setpartitioned", "stock", "false")
+	if countKeys(stub, quotaIndexName) != 0 {
+		fmt.Println("The quotas were left when the partitions were turned off")
+		t.FailNow()
+	}
+	checkInvoke(t, stub, "update", "stock", "2", "*")
+	checkInvoke(t, stub, "setfloor", "stock", "10")
+	checkInvoke(t, stub, "setpartitioned", "stock", "true")
+	checkQuota(t, stub, "stock", `{"value":"200.00","floor":"10.00","unallocated":"190.00","partitions":{}}`)
+}
+
+func TestAllocateQuota_AllocatesTheUnallocatedAmount(t *testing.T) {
+	stub := newQuotaTestStub(t)
+
+	checkInvoke(t, stub, "allocatequota", "stock", "Org1MSP", "30")
+	checkInvoke(t, stub, "allocatequota", "stock", "Org2MSP", "50")
+	checkQuota(t, stub, "stock", `{"value":"100.00","floor":"0.00","unallocated":"20.00","partitions":{"Org1MSP":"30.00","Org2MSP":"50.00"}}`)
+	checkInvokeFailed(t, stub, "allocatequota", "stock", "Org2MSP", "20.01")
+
+	// a negative amount takes quota back
+	checkInvoke(t, stub, "allocatequota", "stock", "Org2MSP", "-10")
+	checkInvokeFailed(t, stub, "allocatequota", "stock", "Org2MSP", "-40.01")
+	checkQuota(t, stub, "stock", `{"value":"100.00","floor":"0.00","unallocated":"30.00","partitions":{"Org1MSP":"30.00","Org2MSP":"40.00"}}`)
+
+	// increments grow the unallocated amount
+	checkInvoke(t, stub, "update", "stock", "5", "+")
+	checkQuota(t, stub, "stock", `{"value":"105.00","floor":"0.00","unallocated":"35.00","partitions":{"Org1MSP":"30.00","Org2MSP":"40.00"}}`)
+}
+
+func TestAllocateQuota_ChecksTheArguments(t *testing.T) {
+	stub := newQuotaTestStub(t)
+
+	checkInvokeFailed(t, stub, "allocatequota", "stock", "Org2MSP")
+	checkInvokeFailed(t, stub, "allocatequota", "stock", "Org2MSP", "ten")
+	checkInvokeFailed(t, stub, "allocatequota", "stock", "Org2MSP", "0.001")
+	checkInvokeFailed(t, stub, "allocatequota", "stock", "Org3MSP", "10")
+	checkInvokeFailed(t, stub, "allocatequota", "unknown", "Org2MSP", "10")
+	stub.mspID = "Org2MSP"
+	checkInvokeFailed(t, stub, "allocatequota", "stock", "Org2MSP", "10")
+	checkQuota(t, stub, "stock", `{"value":"100.00","floor":"0.00","unallocated":"100.00","partitions":{}}`)
+}
+
+func TestUpdate_DecrementsDrawOnTheQuota(t *testing.T) {
+	stub := newQuotaTestStub(t)
+	checkInvoke(t, stub, "allocatequota", "stock", "Org1MSP", "30")
+	checkInvoke(t, stub, "allocatequota", "stock", "Org2MSP", "50")
+
+	checkInvoke(t, stub, "update", "stock", "25", "-")
+	checkInvokeFailed(t, stub, "update", "stock", "5.01", "-")
+	// adding a negative value is a decrement
+	checkInvokeFailed(t, stub, "update", "stock", "-5.01", "+")
+	checkInvoke(t, stub, "update", "stock", "-5", "+")
+
+	stub.mspID = "Org2MSP"
+	checkInvoke(t, stub, "update", "stock", "50", "-")
+	checkInvokeFailed(t, stub, "update", "stock", "0.01", "-")
+	stub.mspID = "Org3MSP"
+	checkInvokeFailed(t, stub, "update", "stock", "1", "+")
+
+	// the floor is guaranteed, no delta is void
+	stub.mspID = "Org1MSP"
+	checkQuota(t, stub, "stock", `{"value":"20.00","floor":"0.00","unallocated":"20.00","partitions":{"Org1MSP":"0.00","Org2MSP":"0.00"}}`)
+	res := checkInvoke(t, stub, "get", "stock", "detail")
+	if string(res.Payload) != `{"value":"20.00","void":0,"foldedVoid":0}` {
+		fmt.Println("Detail of stock was", string(res.Payload))
+		t.FailNow()
+	}
+}
+
+func TestUpdate_DecrementsDrawingOnTheQuotaAreNeverVoid(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "stock", "test variable", "", "0", "", "")
+	checkInvoke(t, stub, "setpartitioned", "stock", "true")
+	checkInvoke(t, stub, "update", "stock", "100", "+")
+	checkInvoke(t, stub, "allocatequota", "stock", "Org1MSP", "100")
+
+	// the clock of the client is behind, the decrement merges before the increment funding the quota
+	stub.clockSkew = 3
+	checkInvoke(t, stub, "update", "stock", "100", "-")
+	stub.clockSkew = 0
+	res := checkInvoke(t, stub, "get", "stock", "detail")
+	if string(res.Payload) != `{"value":"0.00","void":0,"foldedVoid":0}` {
+		fmt.Println("Detail of stock was", string(res.Payload))
+		t.FailNow()
+	}
+	checkQuota(t, stub, "stock", `{"value":"0.00","floor":"0.00","unallocated":"0.00","partitions":{"Org1MSP":"0.00"}}`)
+
+	// nor when they are folded
+	checkInvoke(t, stub, "compact", "stock", "0")
+	checkCheckpoint(t, stub, "stock", "0.00", testPosition(8), 2, 0)
+	checkInvokeFailed(t, stub, "update", "stock", "1", drawOp)
+}
+
+func TestTransferQuota_MovesQuotaBetweenOrganizations(t *testing.T) {
+	stub := newQuotaTestStub(t)
+	checkInvoke(t, stub, "allocatequota", "stock", "Org1MSP", "30")
+
+	checkInvoke(t, stub, "transferquota", "stock", "Org2MSP", "10")
+	checkInvokeFailed(t, stub, "transferquota", "stock", "Org2MSP", "20.01")
+	checkInvokeFailed(t, stub, "transferquota", "stock", "Org1MSP", "1")
+	checkInvokeFailed(t, stub, "transferquota", "stock", "Org3MSP", "1")
+	checkInvokeFailed(t, stub, "transferquota", "stock", "Org2MSP", "0")
+	checkInvokeFailed(t, stub, "transferquota", "stock", "Org2MSP", "-1")
+	checkInvokeFailed(t, stub, "transferquota", "stock", "Org2MSP")
+	stub.mspID = "Org3MSP"
+	checkInvokeFailed(t, stub, "transferquota", "stock", "Org1MSP", "1")
+
+	stub.mspID = "Org2MSP"
+	checkInvoke(t, stub, "transferquota", "stock", "Org1MSP", "4")
+	checkQuota(t, stub, "stock", `{"value":"100.00","floor":"0.00","unallocated":"70.00","partitions":{"Org1MSP":"24.00","Org2MSP":"6.00"}}`)
+}
+
+func TestDelete_RemovesTheQuotas(t *testing.T) {
+	stub := newQuotaTestStub(t)
+	checkInvoke(t, stub, "allocatequota", "stock", "Org1MSP", "30")
+	checkInvoke(t, stub, "allocatequota", "stock", "Org2MSP", "50")
+
+	checkInvoke(t, stub, "delete", "stock")
+	if countKeys(stub, quotaIndexName) != 0 {
+		fmt.Println("Delete left the quotas of stock")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,346 @@
+/*
+ * The registry of the variables. A variable is created explicitly, by a member of the organization which
+ * owns it, with a description, a unit, optional bounds and the organizations allowed to update it, so that
+ * a typo in the name of a variable is an error rather than a new variable. The registration is part of the
+ * configuration of the variable, which update already reads, so updates stay free of read conflicts.
+ * The variables updated before variables had to be created have no owner: only the admins, whose MSP IDs
+ * are given when the chaincode is instantiated, can change them or register them for their owner.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The composite index of the settings of the chaincode, such as the MSP IDs of the admins
+const settingIndexName = "setting~name"
+
+/**
+ * A registered variable, as listed by listVariables
+ */
+type variableInfo struct {
+	Name string `json:"name"`
+	varConfig
+}
+
+/**
+ * Creates a variable, owned by the organization of the client. A variable which already has deltas but
+ * was never created, because it was updated before variables had to be, can only be created by an admin,
+ * who gives the organization owning it. The args array contains the following arguments:
+ *	- args[0] -> The name of the variable
+ *	- args[1] -> A description of the variable
+ *	- args[2] -> The unit of the variable, such as "kWh", can be empty
+ *	- args[3] -> The minimum of the variable, its floor, or an empty string for none
+ *	- args[4] -> The maximum of the variable, its ceiling, or an empty string for none
+ *	- args[5] -> The comma separated MSP IDs allowed to update the variable besides the owner, can be empty
+ *	- args[6] -> Optional, admins only, the MSP ID of the owner if it is not the organization of the client
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the createvariable invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) createVariable(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check there are a correct number of arguments
+	if len(args) != 6 && len(args) != 7 {
+		return shim.Error("Incorrect number of arguments, expecting 6 or 7")
+	}
+
+	name := args[0]
+	if name == "" {
+		return shim.Error("The name of the variable can not be empty")
+	}
+	config, err := getVarConfig(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if config.Owner != "" {
+		return shim.Error(fmt.Sprintf("Variable %s already exists, owned by %s", name, config.Owner))
+	}
+
+	owner, err := getCreatorMSP(APIstub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(args) == 7 && args[6] != "" {
+		err = checkAdmin(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Only an admin can create %s for another organization: %s", name, err.Error()))
+		}
+		owner = args[6]
+	}
+
+	// The deltas of a variable updated before variables had to be created go to the owner with it
+	_, _, found, err := getValue(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if found {
+		err = checkAdmin(APIstub)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Variable %s already has deltas, only an admin can create it: %s", name, err.Error()))
+		}
+	}
+	config.Owner = owner
+	config.Description = args[1]
+	config.Unit = args[2]
+
+	// The bounds are at the scale of the variable, the default one unless it was set beforehand
+	for i, bound := range []*string{&config.Floor, &config.Ceiling} {
+		if args[3+i] == "" {
+			continue
+		}
+		value, err := parseDecimal(args[3+i], config.Scale)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Bound %s is invalid for %s: %s", args[3+i], name, err.Error()))
+		}
+		*bound = value.String()
+	}
+	floor, err := config.floor()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ceiling, err := config.ceiling()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if floor != nil && ceiling != nil && floor.cmp(*ceiling) > 0 {
+		return shim.Error(fmt.Sprintf("The minimum %s of %s is above its maximum %s", floor, name, ceiling))
+	}
+
+	config.Writers = nil
+	for _, writer := range strings.Split(args[5], ",") {
+		writer = strings.TrimSpace(writer)
+		if writer != "" && writer != owner {
+			config.Writers = append(config.Writers, writer)
+		}
+	}
+
+	err = putVarConfig(APIstub, name, config)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Created variable %s owned by %s", name, owner)))
+}
+
+/**
+ * Lists the registered variables, sorted by name, with their configuration. The args array must be
+ * empty.
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the listvariables invocation
+ *
+ * @return A response structure holding a JSON array of the variables, or an error message
+ */
+func (s *SmartContract) listVariables(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments, expecting 0")
+	}
+
+	configResultsIterator, err := APIstub.GetStateByPartialCompositeKey("config~varName", []string{})
+	if err != nil {
+		return shim.Error(fmt.Sprintf("Could not retrieve the variables: %s", err.Error()))
+	}
+	defer configResultsIterator.Close()
+
+	variables := []variableInfo{}
+	for configResultsIterator.HasNext() {
+		responseRange, err := configResultsIterator.Next()
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve next variable: %s", err.Error()))
+		}
+		_, keyParts, err := APIstub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("Could not split composite key %s: %s", responseRange.Key, err.Error()))
+		}
+
+		variable := variableInfo{Name: keyParts[0]}
+		err = json.Unmarshal(responseRange.Value, &variable.varConfig)
+		if err != nil {
+			return shim.Error(fmt.Sprintf("The configuration of %s is corrupted: %s", keyParts[0], err.Error()))
+		}
+		// variables configured with setscale before being created are not registered
+		if variable.Owner != "" {
+			variables = append(variables, variable)
+		}
+	}
+
+	variablesBytes, err := json.Marshal(variables)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(variablesBytes)
+}
+
+/**
+ * Checks the client belongs to the owner of a variable. Variables which were never created have no
+ * owner and can only be changed by an admin.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return An error if the client is not allowed to change the variable
+ */
+func (config *varConfig) checkOwner(APIstub shim.ChaincodeStubInterface, name string) error {
+	if config.Owner == "" {
+		err := checkAdmin(APIstub)
+		if err != nil {
+			return fmt.Errorf("Variable %s was never created, only an admin can change it: %s", name, err.Error())
+		}
+		return nil
+	}
+	mspID, err := getCreatorMSP(APIstub)
+	if err != nil {
+		return err
+	}
+	if mspID != config.Owner {
+		return fmt.Errorf("Client from %s is not allowed to change %s, owned by %s", mspID, name, config.Owner)
+	}
+	return nil
+}
+
+/**
+ * Checks a variable was created and the client belongs to its owner or to one of its writers
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return An error if the client is not allowed to update the variable
+ */
+func (config *varConfig) checkWriter(APIstub shim.ChaincodeStubInterface, name string) error {
+	if config.Owner == "" {
+		return fmt.Errorf("No variable by the name %s exists, create it with createvariable first", name)
+	}
+	mspID, err := getCreatorMSP(APIstub)
+	if err != nil {
+		return err
+	}
+	if !config.isWriter(mspID) {
+		return fmt.Errorf("Client from %s is not allowed to update %s", mspID, name)
+	}
+	return nil
+}
+
+/**
+ * Checks the client may compact or prune a variable: its owner or one of its writers, or an admin for a
+ * variable which was never created. Folding the deltas does not change the value, but it rewrites the
+ * rows of the variable and its audit trail, so it is not open to every organization.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return An error if the client is not allowed to compact or prune the variable
+ */
+func (config *varConfig) checkMaintainer(APIstub shim.ChaincodeStubInterface, name string) error {
+	if config.Owner == "" {
+		return config.checkOwner(APIstub, name)
+	}
+	return config.checkWriter(APIstub, name)
+}
+
+/**
+ * Tells whether an organization is the owner or one of the writers of a variable
+ */
+func (config *varConfig) isWriter(mspID string) bool {
+	if mspID == config.Owner {
+		return true
+	}
+	for _, writer := range config.Writers {
+		if mspID == writer {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Retrieves the MSP ID of the client which submitted the transaction
+ *
+ * @param APIstub The chaincode shim
+ *
+ * @return The MSP ID, or an error if the creator of the transaction could not be decoded
+ */
+func getCreatorMSP(APIstub shim.ChaincodeStubInterface) (string, error) {
+	creator, err := APIstub.GetCreator()
+	if err != nil {
+		return "", fmt.Errorf("Could not retrieve the creator of the transaction: %s", err.Error())
+	}
+
+	serializedID := &msp.SerializedIdentity{}
+	err = proto.Unmarshal(creator, serializedID)
+	if err != nil {
+		return "", fmt.Errorf("Could not decode the creator of the transaction: %s", err.Error())
+	} else if serializedID.Mspid == "" {
+		return "", fmt.Errorf("The creator of the transaction has no MSP ID")
+	}
+	return serializedID.Mspid, nil
+}
+
+/**
+ * Stores the MSP IDs of the organizations whose members are admins of the chaincode
+ *
+ * @param APIstub The chaincode shim
+ * @param mspIDs The MSP IDs
+ *
+ * @return An error if they could not be written
+ */
+func setAdminMSPs(APIstub shim.ChaincodeStubInterface, mspIDs []string) error {
+	adminKey, err := APIstub.CreateCompositeKey(settingIndexName, []string{"adminMSPs"})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for the admins: %s", err.Error())
+	}
+	mspIDsBytes, err := json.Marshal(mspIDs)
+	if err != nil {
+		return err
+	}
+	err = APIstub.PutState(adminKey, mspIDsBytes)
+	if err != nil {
+		return fmt.Errorf("Could not put the admins in the ledger: %s", err.Error())
+	}
+	return nil
+}
+
+/**
+ * Checks the client belongs to one of the admin organizations, given when the chaincode was instantiated
+ *
+ * @param APIstub The chaincode shim
+ *
+ * @return An error if the client is not an admin
+ */
+func checkAdmin(APIstub shim.ChaincodeStubInterface) error {
+	adminKey, err := APIstub.CreateCompositeKey(settingIndexName, []string{"adminMSPs"})
+	if err != nil {
+		return fmt.Errorf("Could not create a composite key for the admins: %s", err.Error())
+	}
+	mspIDsBytes, err := APIstub.GetState(adminKey)
+	if err != nil {
+		return fmt.Errorf("Could not retrieve the admins: %s", err.Error())
+	} else if mspIDsBytes == nil {
+		return fmt.Errorf("No admin is configured, instantiate the chaincode with the MSP IDs of the admins")
+	}
+	adminMSPs := []string{}
+	err = json.Unmarshal(mspIDsBytes, &adminMSPs)
+	if err != nil {
+		return fmt.Errorf("The admins are corrupted: %s", err.Error())
+	}
+
+	mspID, err := getCreatorMSP(APIstub)
+	if err != nil {
+		return err
+	}
+	for _, adminMSP := range adminMSPs {
+		if mspID == adminMSP {
+			return nil
+		}
+	}
+	return fmt.Errorf("Client from %s is not an admin", mspID)
+}
@@ -0,0 +1,149 @@
+/*
+ * Tests of the registry of the variables and of the admins.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// putLegacyDelta writes a delta the way the chaincode did before variables had to be created
+func putLegacyDelta(t *testing.T, stub *testStub, name string, op string, value string) {
+	stub.MockTransactionStart("legacy")
+	defer stub.MockTransactionEnd("legacy")
+	key, err := stub.CreateCompositeKey(legacyIndexName, []string{name, op, value, "legacy" + value})
+	if err == nil {
+		err = stub.MockStub.PutState(key, []byte{0x00})
+	}
+	if err != nil {
+		fmt.Println("The legacy delta of", name, "could not be written", err)
+		t.FailNow()
+	}
+}
+
+func checkInit(t *testing.T, stub *testStub, args ...string) {
+	res := stub.init(args...)
+	if res.Status != OK {
+		fmt.Println("Init", args, "failed", res.Message)
+		t.FailNow()
+	}
+}
+
+func checkVariables(t *testing.T, stub *testStub, expected []variableInfo) {
+	res := checkInvoke(t, stub, "listvariables")
+	variables := []variableInfo{}
+	err := json.Unmarshal(res.Payload, &variables)
+	if err != nil {
+		fmt.Println("Could not decode the variables", err)
+		t.FailNow()
+	}
+	if fmt.Sprint(variables) != fmt.Sprint(expected) {
+		fmt.Println("Variables were", variables, "and not", expected, "as expected")
+		t.FailNow()
+	}
+}
+
+func TestCreateVariable_RegistersTheOwner(t *testing.T) {
+	stub := newTestStub()
+	checkInvoke(t, stub, "createvariable", "energy", "Energy delivered", "kWh", "0", "1000.5", "Org2MSP, Org1MSP,,Org3MSP")
+	stub.mspID = "Org2MSP"
+	checkInvoke(t, stub, "createvariable", "cash", "Cash", "", "", "", "")
+
+	checkVariables(t, stub, []variableInfo{
+		{"cash", varConfig{Scale: 2, Owner: "Org2MSP", Description: "Cash"}},
+		{"energy", varConfig{Scale: 2, Floor: "0.00", Ceiling: "1000.50", Owner: "Org1MSP", Description: "Energy delivered", Unit: "kWh", Writers: []string{"Org2MSP", "Org3MSP"}}},
+	})
+
+	// a variable is created once, whoever asks
+	checkInvokeFailed(t, stub, "createvariable", "energy", "Energy", "kWh", "", "", "")
+	stub.mspID = "Org1MSP"
+	checkInvokeFailed(t, stub, "createvariable", "energy", "Energy", "kWh", "", "", "")
+	checkInvokeFailed(t, stub, "listvariables", "energy")
+}
+
+func TestCreateVariable_ChecksTheArguments(t *testing.T) {
+	stub := newTestStub()
+
+	checkInvokeFailed(t, stub, "createvariable", "pool", "test variable", "", "", "")
+	checkInvokeFailed(t, stub, "createvariable", "pool", "test variable", "", "", "", "", "", "extra")
+	checkInvokeFailed(t, stub, "createvariable", "", "test variable", "", "", "", "")
+	checkInvokeFailed(t, stub, "createvariable", "pool", "test variable", "", "ten", "", "")
+	checkInvokeFailed(t, stub, "createvariable", "pool", "test variable", "", "", "0.001", "")
+	checkInvokeFailed(t, stub, "createvariable", "pool", "test variable", "", "10", "5", "")
+	checkVariables(t, stub, []variableInfo{})
+
+	// the bounds are at the scale of the variable
+	checkInvoke(t, stub, "createvariable", "pool", "test variable", "", "5", "5", "")
+	checkVariables(t, stub, []variableInfo{{"pool", varConfig{Scale: 2, Floor: "5.00", Ceiling: "5.00", Owner: "Org1MSP", Description: "test variable"}}})
+}
+
+func TestCreateVariable_ForAnotherOrganizationNeedsAnAdmin(t *testing.T) {
+	stub := newTestStub()
+	checkInvokeFailed(t, stub, "createvariable", "pool", "test variable", "", "", "", "", "Org2MSP")
+	checkInit(t, stub, "init", "AdminMSP")
+	checkInvokeFailed(t, stub, "createvariable", "pool", "test variable", "", "", "", "", "Org2MSP")
+
+	stub.mspID = "AdminMSP"
+	checkInvoke(t, stub, "createvariable", "pool", "test variable", "", "", "", "", "Org2MSP")
+	checkInvokeFailed(t, stub, "update", "pool", "1", "+")
+	stub.mspID = "Org2MSP"
+	checkInvoke(t, stub, "update", "pool", "1", "+")
+	checkValue(t, stub, "pool", "1.00")
+}
+
+func TestCreateVariable_ClaimingALegacyVariableNeedsAnAdmin(t *testing.T) {
+	stub := newTestStub()
+	putLegacyDelta(t, stub, "legacy", "+", "5")
+	putLegacyDelta(t, stub, "legacy", "-", "2")
+
+	// without admins, the variable can not be claimed
+	checkInvokeFailed(t, stub, "createvariable", "legacy", "test variable", "", "", "", "")
+	checkInit(t, stub, "init", "AdminMSP")
+	checkInvokeFailed(t, stub, "createvariable", "legacy", "test variable", "", "", "", "")
+	stub.mspID = "Org2MSP"
+	checkInvokeFailed(t, stub, "createvariable", "legacy", "test variable", "", "", "", "")
+	checkVariables(t, stub, []variableInfo{})
+
+	stub.mspID = "AdminMSP"
+	checkInvoke(t, stub, "createvariable", "legacy", "test variable", "", "", "", "", "Org2MSP")
+	stub.mspID = "Org2MSP"
+	checkInvoke(t, stub, "update", "legacy", "1", "+")
+	checkValue(t, stub, "legacy", "4.00")
+}
+
+func TestCheckOwner_UnregisteredVariablesNeedAnAdmin(t *testing.T) {
+	stub := newTestStub()
+	putLegacyDelta(t, stub, "legacy", "+", "5")
+
+	for _, mspID := range []string{"Org1MSP", "Org2MSP"} {
+		stub.mspID = mspID
+		checkInvokeFailed(t, stub, "setscale", "legacy", "4")
+		checkInvokeFailed(t, stub, "setfloor", "legacy", "0")
+		checkInvokeFailed(t, stub, "delete", "legacy")
+		checkInvokeFailed(t, stub, "update", "legacy", "1", "+")
+	}
+	checkValue(t, stub, "legacy", "5.00")
+
+	checkInit(t, stub, "init", "AdminMSP", "Org3MSP")
+	stub.mspID = "Org3MSP"
+	checkInvoke(t, stub, "setscale", "legacy", "4")
+	checkValue(t, stub, "legacy", "5.0000")
+	checkInvoke(t, stub, "delete", "legacy")
+	checkInvokeFailed(t, stub, "get", "legacy")
+}
+
+func TestInit_KeepsTheAdminsWhenNoneAreGiven(t *testing.T) {
+	stub := newTestStub()
+	checkInit(t, stub, "init", "AdminMSP")
+	stub.mspID = "AdminMSP"
+	checkInvoke(t, stub, "createvariable", "pool1", "test variable", "", "", "", "", "Org1MSP")
+
+	// an upgrade without arguments keeps the admins, one with arguments replaces them
+	checkInit(t, stub, "init")
+	checkInvoke(t, stub, "createvariable", "pool2", "test variable", "", "", "", "", "Org1MSP")
+	checkInit(t, stub, "init", "Org2MSP")
+	checkInvokeFailed(t, stub, "createvariable", "pool3", "test variable", "", "", "", "", "Org1MSP")
+}
@@ -0,0 +1,6 @@
+ARGS=""
+for ARG in "$@"
+do
+	ARGS=$ARGS',"'$ARG'"'
+done
+peer chaincode invoke -o orderer.example.com:7050  --tls $CORE_PEER_TLS_ENABLED --cafile /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ordererOrganizations/example.com/orderers/orderer.example.com/msp/tlscacerts/tlsca.example.com-cert.pem  -C $CHANNEL_NAME -n $CC_NAME -c '{"Args":["updatemany"'"$ARGS"']}'